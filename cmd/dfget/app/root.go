@@ -18,9 +18,12 @@ import (
 )
 
 var (
-	localLimit string
-	totalLimit string
-	filter     string
+	localLimit      string
+	totalLimit      string
+	maxDownloadRate string
+	filter          string
+
+	backSourceHeaders []string
 )
 
 var cfg = config.NewConfig()
@@ -49,9 +52,17 @@ func runDfget(args []string) error {
 	checkParameters()
 	cfg.ClientLogger.Infof("get cmd params:%q", args)
 
+	if cfg.CheckHealth {
+		return runCheckHealth()
+	}
+
 	config.AssertConfig(cfg)
 	cfg.ClientLogger.Infof("get init config:%v", cfg)
 
+	if cfg.ListURL != "" {
+		return runList()
+	}
+
 	// enter the core process
 	err := core.Start(cfg)
 	util.Printer.Println(resultMsg(cfg, time.Now(), err))
@@ -61,6 +72,48 @@ func runDfget(args []string) error {
 	return nil
 }
 
+// runList downloads the files of the list and prints the result of each
+// file, it fails if any of them fails.
+func runList() error {
+	results, err := core.StartList(cfg)
+	if err != nil {
+		util.Printer.Println(resultMsg(cfg, time.Now(), err))
+		return err
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			util.Printer.Printf("%s: FAIL(%d) %s", r.Item.Output, r.Err.Code, r.Err.Msg)
+			continue
+		}
+		util.Printer.Printf("%s: SUCCESS", r.Item.Output)
+	}
+	util.Printer.Printf("download %d files of list:%s, %d failed, cost:%.3fs",
+		len(results), cfg.ListURL, failed, time.Since(cfg.StartTime).Seconds())
+	if failed > 0 {
+		return errors.Newf(config.CodeListFailed, "%d of %d files failed", failed, len(results))
+	}
+	return nil
+}
+
+// runCheckHealth prints the health of each supernode, it fails if none of
+// them is healthy.
+func runCheckHealth() error {
+	dead, err := core.CheckHealth(cfg)
+	if dead == nil {
+		return err
+	}
+	for _, node := range cfg.Node {
+		if e, ok := dead[node]; ok {
+			util.Printer.Printf("%s: UNHEALTHY %v", node, e)
+			continue
+		}
+		util.Printer.Printf("%s: HEALTHY", node)
+	}
+	return err
+}
+
 func checkParameters() {
 	if len(os.Args) < 2 {
 		fmt.Println("Please use the command 'help' to show the help information.")
@@ -96,12 +149,15 @@ func initProperties() {
 	}
 
 	cfg.Filter = transFilter(filter)
+	cfg.BackSourceHeaders = util.ConvertHeaders(backSourceHeaders)
 
 	var err error
 	cfg.LocalLimit, err = transLimit(localLimit)
 	util.PanicIfError(err, "convert locallimit error")
 	cfg.TotalLimit, err = transLimit(totalLimit)
 	util.PanicIfError(err, "convert totallimit error")
+	cfg.MaxDownloadRate, err = transLimit(maxDownloadRate)
+	util.PanicIfError(err, "convert maxdownloadrate error")
 }
 
 func initLog() {
@@ -129,18 +185,42 @@ func initFlags() {
 		"will download a file from this url")
 	flagSet.StringVarP(&cfg.Output, "output", "o", "",
 		"output path that not only contains the dir part but also name part")
+	flagSet.StringVar(&cfg.RequestRange, "range", "",
+		"the bytes range 'start-end' of the file to download only, the output isn't verified by the md5, eg: --range=0-1023")
+	flagSet.StringSliceVar(&cfg.ExtraTargets, "extraoutput", nil,
+		"additional output paths the downloaded file is linked or copied to")
+	flagSet.StringVar(&cfg.ListURL, "listurl", "",
+		"will download the files of the list from this url into the output directory, each line of the list is a path relative to it optionally followed by the md5")
+	flagSet.StringVar(&cfg.ListPattern, "listpattern", "",
+		"download only the files of the list whose paths match this glob pattern, eg: --listpattern='images/*.tar'")
+	flagSet.IntVar(&cfg.ListParallelism, "listparallelism", 1,
+		"the number of the files of the list downloaded at the same time")
+	flagSet.BoolVar(&cfg.Fsync, "fsync", false,
+		"fsync the output and its directory before exiting successfully, it slows down the large downloads")
+	flagSet.StringVar(&cfg.LinkStrategy, "linkstrategy", config.LinkStrategyAuto,
+		"how the downloaded file is placed at the output, must be 'auto', 'link', 'copy' or 'reflink'")
+	flagSet.StringVar(&cfg.Assembly, "assembly", config.AssemblyAuto,
+		"how the pieces are assembled into the output, must be 'auto', 'random' or 'sequential'")
 
 	// localLimit & totalLimit & timeout
 	flagSet.StringVarP(&localLimit, "locallimit", "s", "",
 		"rate limit about a single download task, its format is 20M/m/K/k")
 	flagSet.StringVarP(&totalLimit, "totallimit", "", "",
 		"rate limit about the whole host, its format is 20M/m/K/k")
+	flagSet.StringVar(&maxDownloadRate, "maxdownloadrate", "",
+		"rate limit about the pieces downloaded from the peers concurrently, its format is 20M/m/K/k")
 	flagSet.IntVarP(&cfg.Timeout, "timeout", "e", 0,
 		"download timeout(second)")
+	flagSet.BoolVar(&cfg.TimeoutBackSource, "timeoutbacksource", false,
+		"download from the source once the download from peers exceeds the timeout instead of failing")
 
 	// md5 & identifier
 	flagSet.StringVarP(&cfg.Md5, "md5", "m", "",
 		"expected file md5")
+	flagSet.StringVar(&cfg.Digest, "digest", "",
+		"expected file digest in the form of 'sha256:<hex>', it's verified instead of the md5")
+	flagSet.Float64Var(&cfg.DiskSpaceHeadroom, "diskspaceheadroom", config.DefaultDiskSpaceHeadroom,
+		"the factor of the file length the free space of the data dir must have before downloading from peers")
 	flagSet.StringVarP(&cfg.Identifier, "identifier", "i", "",
 		"identify download task, it is available merely when md5 param not exist")
 
@@ -158,20 +238,138 @@ func initFlags() {
 
 	flagSet.StringSliceVar(&cfg.Header, "header", nil,
 		"http header, eg: --header='Accept: *' --header='Host: abc'")
+	flagSet.StringVar(&cfg.UserAgent, "useragent", config.DefaultUserAgent,
+		"the User-Agent of the requests to the supernodes, the peers and the origins")
+
+	flagSet.StringSliceVar(&cfg.MetaHeaders, "metaheader", nil,
+		"response headers of the source stored into '<output>.meta', eg: --metaheader=Content-Type")
 
 	flagSet.StringSliceVarP(&cfg.Node, "node", "n", nil,
 		"specify supnernodes")
+	flagSet.StringSliceVar(&cfg.AlternateNodes, "alternatenode", nil,
+		"the supernodes registered to in order when the migration fails to register to the remainder of the nodes")
+	flagSet.BoolVar(&cfg.MigrationHealthCheck, "migrationhealthcheck", false,
+		"skip the supernodes failing the health check when migrating, the supernodes must serve '/_ping'")
+	flagSet.BoolVar(&cfg.CheckHealth, "checkhealth", false,
+		"only check the health of the supernodes and exit, it fails if none of them is healthy")
+
+	flagSet.StringVar(&cfg.PeerInterface, "peerinterface", "",
+		"the ip or the name of the local network interface used by p2p traffic")
+	flagSet.IntVar(&cfg.PeerMaxIdleConnsPerHost, "peermaxidleconns", config.DefaultPeerMaxIdleConnsPerHost,
+		"the idle connections kept alive to each peer for fetching the next pieces")
+	flagSet.BoolVar(&cfg.PeerHTTP2, "peerhttp2", false,
+		"fetch the pieces from the peers by HTTP/2 without TLS, all the peers must serve it with '--servehttp2'")
 
 	flagSet.BoolVar(&cfg.Notbs, "notbs", false,
 		"not back source when p2p fail")
+	flagSet.IntVar(&cfg.RegisterFanout, "registerfanout", 1,
+		"the number of the supernodes registered to concurrently, the first one succeeding is adopted")
+	flagSet.BoolVar(&cfg.BackSourceOnly, "backsourceonly", false,
+		"download from the source without registering to the supernodes")
+	flagSet.BoolVar(&cfg.DryRun, "dryrun", false,
+		"only register to the supernodes and print the piece layout without downloading")
+	flagSet.StringVar(&cfg.HeartbeatFile, "heartbeatfile", "",
+		"the file whose mtime is updated periodically while the download is making progress")
+	flagSet.DurationVar(&cfg.HeartbeatInterval, "heartbeatinterval", config.DefaultHeartbeatInterval,
+		"the interval of updating the heartbeat file")
+	flagSet.StringSliceVar(&cfg.Mirrors, "mirror", nil,
+		"URLs of the same file on the other origins, the fastest one is downloaded from when back source")
+	flagSet.IntVar(&cfg.MaxProbedOrigins, "maxprobedorigins", 0,
+		"the maximum number of the origins probed when back source, 0 means probing all")
+	flagSet.DurationVar(&cfg.OriginProbeTimeout, "originprobetimeout", config.DefaultOriginProbeTimeout,
+		"the timeout of probing an origin")
+	flagSet.StringSliceVar(&backSourceHeaders, "backsourceheader", nil,
+		"http header only sent to the origins when back source, eg: --backsourceheader='Authorization: Bearer xxx'")
+	flagSet.StringVar(&cfg.BackSourceProxy, "backsourceproxy", "",
+		"the http proxy the requests to the origins go through, default: the proxy of the environment")
+	flagSet.BoolVar(&cfg.BackSourceDecompress, "backsourcedecompress", false,
+		"accept the zstd or gzip encoded response of the source and decompress it when back source")
+	flagSet.DurationVar(&cfg.QueuePollTimeout, "queuepolltimeout", config.DefaultQueuePollTimeout,
+		"the timeout of waiting for a piece in the download from peers")
+	flagSet.IntVar(&cfg.MaxQueuePollTimeouts, "maxqueuepolltimeouts", 0,
+		"back source after this number of consecutive queue poll timeouts, 0 means waiting forever")
+	flagSet.DurationVar(&cfg.LimitedRetryDelay, "limitedretrydelay", config.DefaultLimitedRetryDelay,
+		"the delay before pulling the piece tasks again when the supernode limits the pulls")
+	flagSet.DurationVar(&cfg.PieceTimeout, "piecetimeout", 0,
+		"the timeout of downloading a piece from the peer, after which the piece is requested again, 0 means no timeout")
+	flagSet.IntVar(&cfg.PullPieceMaxRetries, "pullpiecemaxretries", 0,
+		"back source after this number of consecutive retries of pulling the piece tasks, 0 means no limit")
+	flagSet.DurationVar(&cfg.PullPieceMaxBackoff, "pullpiecemaxbackoff", 0,
+		"the maximum delay of the exponential backoff between the retries of pulling the piece tasks")
+	flagSet.BoolVar(&cfg.Resume, "resume", false,
+		"resume the download interrupted by a restart from the pieces left in the data dir")
+	flagSet.BoolVar(&cfg.HostDedup, "hostdedup", false,
+		"wait for the other dfget downloading the same task on the host and reuse the file it downloaded")
+	flagSet.StringVar(&cfg.LocalCacheDir, "localcachedir", "",
+		"the dir of a local mirror whose files are named by their digests as '<algorithm>/<hex>', the file of the md5 or the digest is used instead of downloading it")
+	flagSet.StringVar(&cfg.ProgressSocket, "progresssocket", "",
+		"the unix socket the progress is streamed into by the compact binary frames")
+	flagSet.DurationVar(&cfg.MoveRetryTimeout, "moveretrytimeout", 0,
+		"the maximum time of retrying moving the file to the output while it's read-only transiently")
+	flagSet.BoolVar(&cfg.ReportContributions, "reportcontribution", false,
+		"report the bytes each peer served to the supernode after downloading")
+	flagSet.IntVar(&cfg.MaxVerifyRetries, "verifyretries", 0,
+		"the number of times the download is retried from scratch if the md5 doesn't match")
+	flagSet.BoolVar(&cfg.VerifyRetryBlacklist, "verifyretryblacklist", false,
+		"refuse the peers used by the download failing the md5 check when retrying it")
+	flagSet.BoolVar(&cfg.CheckInodes, "checkinodes", false,
+		"fail fast if the filesystems don't have enough free inodes for the download")
+	flagSet.DurationVar(&cfg.LogThrottleInterval, "logthrottle", 0,
+		"the interval the repeated errors of the download are logged at most once, 0 disables it")
+	flagSet.StringVar(&cfg.ManifestFile, "manifest", "",
+		"the file the manifest of the download is written into for reproducing it")
+	flagSet.StringVar(&cfg.SummaryFile, "summary", "",
+		"the file the JSON summary of the download is written into once it finishes, '-' means the stdout")
+	flagSet.StringVar(&cfg.ReplayManifest, "replaymanifest", "",
+		"the manifest of a previous download to be reproduced")
+	flagSet.BoolVar(&cfg.NoMove, "nomove", false,
+		"leave the file downloaded by p2p in the data dir instead of moving it to the output")
+	flagSet.BoolVar(&cfg.DirectWrite, "directwrite", false,
+		"assemble the pieces straight into the target if it's on the same device as the data dir")
+	flagSet.BoolVar(&cfg.WriteAt, "writeat", false,
+		"write each piece at its offset of the preallocated file once it's downloaded instead of writing the pieces one by one")
+	flagSet.BoolVar(&cfg.Seed, "seed", false,
+		"seed the existing output to the other peers instead of downloading it")
+	flagSet.BoolVar(&cfg.CompressServiceFile, "compressservicefile", false,
+		"store the file served to the other peers compressed by zstd after the download succeeds")
+	flagSet.BoolVar(&cfg.KeepIntermediate, "keepintermediate", false,
+		"keep the intermediate files in the data dir after the download from peers succeeds")
+	flagSet.Float64Var(&cfg.PartialRatio, "partialratio", 0,
+		"write the downloaded prefix to the output and exit with PARTIAL(1500) if the download fails"+
+			"\nbut at least this fraction of the file is downloaded, the partial output is NOT md5 checked")
 	flagSet.BoolVar(&cfg.DFDaemon, "dfdaemon", false,
 		"caller is from dfdaemon")
 
+	// debug
+	flagSet.StringSliceVar(&cfg.PinnedPeers, "pinpeer", nil,
+		"the cid of the peer all the pieces are forced to be downloaded from, for debugging only")
+	flagSet.BoolVar(&cfg.PinnedPeersStrict, "pinstrict", false,
+		"fail the ranges that can't be downloaded from the pinned peers, for debugging only")
+	flagSet.BoolVar(&cfg.VerifyLineage, "verifylineage", false,
+		"fail the download assembled from the pieces of unexpected tasks, for debugging only")
+	flagSet.MarkHidden("pinpeer")
+	flagSet.MarkHidden("pinstrict")
+	flagSet.MarkHidden("verifylineage")
+
 	// pass to server
 	rootCmd.PersistentFlags().DurationVar(&cfg.RV.DataExpireTime, "expiretime", config.DataExpireTime,
 		"server will delete cached files if these files doesn't be modification within this duration")
 	rootCmd.PersistentFlags().DurationVar(&cfg.RV.ServerAliveTime, "alivetime", config.ServerAliveTime,
 		"server will stop if there is no uploading task within this duration")
+	rootCmd.PersistentFlags().IntVar(&cfg.RV.MaxServingStreams, "maxstreams", 0,
+		"server will upload at most this number of pieces concurrently, 0 means no limit")
+	rootCmd.PersistentFlags().DurationVar(&cfg.RV.ServingQueueTimeout, "streamqueuetimeout", 0,
+		"server will reject the uploads waiting for a free stream longer than this duration")
+	rootCmd.PersistentFlags().BoolVar(&cfg.RV.ServeHTTP2, "servehttp2", false,
+		"server will also serve HTTP/2 without TLS to the peers fetching pieces with '--peerhttp2'")
+	rootCmd.PersistentFlags().StringVar(&cfg.SupernodeCACert, "supernodecacert", "",
+		"the CA bundle the certificates of the supernodes are verified by, it enables https to the supernodes")
+	rootCmd.PersistentFlags().StringVar(&cfg.SupernodeCert, "supernodecert", "",
+		"the client certificate presented to the supernodes, it enables https to the supernodes")
+	rootCmd.PersistentFlags().StringVar(&cfg.SupernodeKey, "supernodekey", "",
+		"the key of the client certificate presented to the supernodes")
+	rootCmd.PersistentFlags().BoolVar(&cfg.SupernodeInsecureSkipVerify, "supernodeinsecure", false,
+		"request the supernodes by https without verifying their certificates, for testing only")
 
 	// others
 	flagSet.BoolVarP(&cfg.ShowBar, "showbar", "b", false,
@@ -215,13 +413,22 @@ func transFilter(filter string) []string {
 }
 
 func resultMsg(cfg *config.Config, end time.Time, e *errors.DFGetError) string {
+	if e != nil && e.Code == config.CodePartial {
+		return fmt.Sprintf("download PARTIAL(%d) cost:%.3fs length:%d reason:%d path:%s error:%v",
+			e.Code, end.Sub(cfg.StartTime).Seconds(), cfg.RV.FileLength,
+			cfg.BackSourceReason, cfg.RV.ResultPath, e)
+	}
 	if e != nil {
 		return fmt.Sprintf("download FAIL(%d) cost:%.3fs length:%d reason:%d error:%v",
 			e.Code, end.Sub(cfg.StartTime).Seconds(), cfg.RV.FileLength,
 			cfg.BackSourceReason, e)
 	}
-	return fmt.Sprintf("download SUCCESS(0) cost:%.3fs length:%d reason:%d",
+	msg := fmt.Sprintf("download SUCCESS(0) cost:%.3fs length:%d reason:%d",
 		end.Sub(cfg.StartTime).Seconds(), cfg.RV.FileLength, cfg.BackSourceReason)
+	if cfg.NoMove {
+		msg += " path:" + cfg.RV.ResultPath
+	}
+	return msg
 }
 
 // Execute will process dfget.
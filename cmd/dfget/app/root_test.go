@@ -146,6 +146,11 @@ func (suit *dfgetSuit) TestResultMsg() {
 	msg = resultMsg(cfg, end, errors.New(1, "TestFail"))
 	suit.Equal(msg, "download FAIL(1) cost:0.100s length:0 reason:1 error:"+
 		`{"Code":1,"Msg":"TestFail"}`)
+
+	cfg.RV.ResultPath = "/tmp/target"
+	msg = resultMsg(cfg, end, errors.New(config.CodePartial, "TestPartial"))
+	suit.Equal(msg, "download PARTIAL(1500) cost:0.100s length:0 reason:1 path:/tmp/target error:"+
+		`{"Code":1500,"Msg":"TestPartial"}`)
 }
 
 func TestSuite(t *testing.T) {
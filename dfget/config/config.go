@@ -20,12 +20,15 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -144,12 +147,34 @@ type Config struct {
 	// TotalLimit rate limit about the whole host,format: 20M/m/K/k.
 	TotalLimit int `json:"totalLimit,omitempty"`
 
-	// Timeout download timeout(second).
+	// MaxDownloadRate is the maximum rate(bytes/second) of downloading the
+	// pieces from the peers and the local CDN, it's shared by all the pieces
+	// downloading concurrently, format: 20M/m/K/k. 0 means no limit.
+	MaxDownloadRate int `json:"maxDownloadRate,omitempty"`
+
+	// Timeout download timeout(second). The P2PDownloader stops pulling the
+	// piece tasks and the pieces downloading once it expires, and fails or
+	// downloads from the source if TimeoutBackSource is set.
 	Timeout int `json:"timeout,omitempty"`
 
+	// TimeoutBackSource indicates whether to download from the source once
+	// the download from the peers exceeds Timeout instead of failing.
+	TimeoutBackSource bool `json:"timeoutBackSource,omitempty"`
+
 	// Md5 expected file md5.
 	Md5 string `json:"md5,omitempty"`
 
+	// Digest expected file digest in the form of 'sha256:<hex>', the file
+	// is verified by it instead of Md5 if it's set.
+	Digest string `json:"digest,omitempty"`
+
+	// RequestRange is the bytes range 'start-end' of the file to download,
+	// both inclusive. Only the pieces overlapping it are downloaded and the
+	// output only contains the bytes of the range, and it isn't verified by
+	// Md5 or Digest which are of the whole file. default: the whole file.
+	// eg: --range=0-1023.
+	RequestRange string `json:"requestRange,omitempty"`
+
 	// Identifier identify download task, it is available merely when md5 param not exist.
 	Identifier string `json:"identifier,omitempty"`
 
@@ -169,12 +194,97 @@ type Config struct {
 	// eg: --header='Accept: *' --header='Host: abc'.
 	Header []string `json:"header,omitempty"`
 
+	// UserAgent is the User-Agent of the requests to the supernodes, the
+	// peers and the origins, the one set by Header or BackSourceHeaders
+	// overrides it for the origins. default: dfget/<version>.
+	UserAgent string `json:"userAgent,omitempty"`
+
+	// MetaHeaders are the names of the response headers of the source, such as
+	// 'Content-Type', which will be stored into a sidecar file named
+	// '<output>.meta' in json format after downloading successfully.
+	// eg: --metaheader=Content-Type --metaheader=Last-Modified.
+	MetaHeaders []string `json:"metaHeaders,omitempty"`
+
+	// TrustedPeers are the CIDRs or ips of the peers that the pieces can be
+	// downloaded from, the supernodes are always trusted. If it's set, dfget
+	// refuses the untrusted peers and fails once a range is only available
+	// from them, and doesn't download from the source unless TrustOrigin is
+	// set. default: all the peers are trusted.
+	TrustedPeers []string `json:"trustedPeers,omitempty"`
+
+	// TrustOrigin allows downloading from the source when TrustedPeers is set.
+	TrustOrigin bool `json:"trustOrigin,omitempty"`
+
+	// PinnedPeers are the Cids of the peers that all the pieces are forced to
+	// be downloaded from regardless of the peers suggested by the supernode,
+	// it's an advanced option for debugging and reproducing the peer specific
+	// issues. The addresses of the pinned peers are learned from the piece
+	// tasks, so a range is downloaded from the suggested peer if none of the
+	// pinned peers has been dispatched yet, or fails when PinnedPeersStrict is
+	// set. default: not pinned.
+	PinnedPeers []string `json:"pinnedPeers,omitempty"`
+
+	// PinnedPeersStrict fails the ranges that can't be downloaded from the
+	// PinnedPeers instead of falling back to the suggested peers.
+	PinnedPeersStrict bool `json:"pinnedPeersStrict,omitempty"`
+
 	// Node specify supernodes.
 	Node []string `json:"node,omitempty"`
 
+	// AlternateNodes are the supernodes registered to in order when the
+	// migration fails to register to the remainder of the Node, the node
+	// migrated from is skipped.
+	AlternateNodes []string `json:"alternateNodes,omitempty"`
+
+	// PeerInterface specifies the ip address or the name of the local network
+	// interface used by the P2P traffic, it's used for both serving pieces to
+	// other peers and fetching pieces from them, and its ip is advertised to
+	// the supernodes as the ip of the peer and the prefix of the cid. The
+	// traffic between dfget and supernodes is not affected. It must belong
+	// to a local network interface.
+	// default: the local ip connected to the supernode.
+	PeerInterface string `json:"peerInterface,omitempty"`
+
+	// PeerMaxIdleConnsPerHost is the idle connections kept alive to each
+	// peer by the http client shared by the pieces, so that the next pieces
+	// from the peer skip the tcp handshake.
+	// default: 16.
+	PeerMaxIdleConnsPerHost int `json:"peerMaxIdleConnsPerHost,omitempty"`
+
+	// PeerHTTP2 fetches the pieces from the peers by HTTP/2 without TLS,
+	// which multiplexes the concurrent pieces from a peer over one
+	// connection. All the peers must run a peer server started with
+	// RuntimeVariable.ServeHTTP2, the ones serving HTTP/1 only fail the
+	// pieces.
+	PeerHTTP2 bool `json:"peerHTTP2,omitempty"`
+
+	// SupernodeCACert is the CA bundle the certificates of the supernodes are
+	// verified by, the system roots are used if it's empty. The supernodes
+	// are requested by https if it, SupernodeCert or
+	// SupernodeInsecureSkipVerify is set.
+	SupernodeCACert string `json:"supernodeCACert,omitempty"`
+
+	// SupernodeCert and SupernodeKey are the client certificate and its key
+	// presented to the supernodes requiring the mutual tls.
+	SupernodeCert string `json:"supernodeCert,omitempty"`
+	SupernodeKey  string `json:"supernodeKey,omitempty"`
+
+	// SupernodeInsecureSkipVerify requests the supernodes by https without
+	// verifying their certificates, for testing only.
+	SupernodeInsecureSkipVerify bool `json:"supernodeInsecureSkipVerify,omitempty"`
+
 	// Notbs indicates whether to not back source to download when p2p fails.
 	Notbs bool `json:"notbs,omitempty"`
 
+	// BackSourceOnly downloads the file from the source without registering
+	// to the supernodes, for the environments where the supernodes are
+	// unreachable. It's the same as the pattern 'source'.
+	BackSourceOnly bool `json:"backSourceOnly,omitempty"`
+
+	// DryRun only registers to the supernodes and prints the piece layout
+	// assigned, without downloading the file.
+	DryRun bool `json:"dryRun,omitempty"`
+
 	// DFDaemon indicates whether the caller is from dfdaemon
 	DFDaemon bool `json:"dfdaemon,omitempty"`
 
@@ -198,6 +308,509 @@ type Config struct {
 	// TODO: support setupFlags
 	ClientQueueSize int `json:"clientQueueSize,omitempty"`
 
+	// DigestOnWrite computes the md5 of the file while the pieces are being
+	// written instead of re-reading the whole file before moving it to the
+	// target. The pieces written out of order are read back once the pieces
+	// before them are written, and the md5 will be computed after assembly
+	// as before once a piece is rewritten.
+	DigestOnWrite bool `json:"digestOnWrite,omitempty"`
+
+	// LocalCDN is the address of a CDN co-located with dfget, such as
+	// 'http://127.0.0.1:8001', which mirrors the files of the supernode CDN.
+	// The pieces will be downloaded from it firstly and only the missing
+	// pieces will be downloaded from peers. default: disabled.
+	LocalCDN string `json:"localCDN,omitempty"`
+
+	// DeltaBaseFile is the path of a local file, such as the previous version
+	// of the downloading file, whose unchanged pieces will be reused instead
+	// of being downloaded from peers. It costs a full md5 pass over this file
+	// to index its pieces before downloading, and another pass whenever the
+	// piece size changes. default: disabled.
+	DeltaBaseFile string `json:"deltaBaseFile,omitempty"`
+
+	// ReadBackVerify re-reads the target file after moving it and checks its
+	// md5 to detect the corruptions happened in the storage layer, such as a
+	// flaky NFS. It doubles the disk IO of the target file.
+	ReadBackVerify bool `json:"readBackVerify,omitempty"`
+
+	// Fsync fsyncs the target file, the ExtraTargets and their parent
+	// directories before the download succeeds, so that the file and its
+	// directory entry survive a crash of the host right after dfget exits.
+	// It blocks until the page cache of the file is written back, which can
+	// take seconds for a large file on a slow disk, so it's disabled by
+	// default.
+	Fsync bool `json:"fsync,omitempty"`
+
+	// MaxVerifyRetries is the number of times the download from peers is
+	// retried from scratch if the assembled file doesn't match the md5,
+	// which registers to the supernodes again and discards all the pieces
+	// downloaded. default: 0.
+	MaxVerifyRetries int `json:"maxVerifyRetries,omitempty"`
+
+	// VerifyRetryBlacklist refuses the pieces from the peers used by the
+	// attempts failing the md5 check in the retries of MaxVerifyRetries,
+	// except the supernodes.
+	VerifyRetryBlacklist bool `json:"verifyRetryBlacklist,omitempty"`
+
+	// Assembly is the strategy assembling the downloaded pieces into the
+	// output: "random" writes them at their offsets of a temp file which is
+	// moved to the output then, "sequential" streams them in order into the
+	// output directly as required by the FIFOs and the devices, and "auto"
+	// picks "sequential" for such outputs and "random" for the others.
+	// default: auto.
+	Assembly string `json:"assembly,omitempty"`
+
+	// Mirrors are the URLs of the same file on the other origins. The back
+	// source probes at most MaxProbedOrigins of the URL and the Mirrors
+	// within OriginProbeTimeout, downloads from the fastest responder and
+	// falls back to the others by their latencies.
+	Mirrors []string `json:"mirrors,omitempty"`
+
+	// RegisterFanout is the number of the supernodes registered to
+	// concurrently, the first one succeeding is adopted and the others are
+	// kept for the migrations, so that a slow supernode doesn't stall the
+	// startup. default: 1, the supernodes are registered to one by one.
+	RegisterFanout int `json:"registerFanout,omitempty"`
+
+	// MaxProbedOrigins is the maximum number of the origins probed by the
+	// back source, the others are tried after the probed ones in order.
+	// 0 means probing all.
+	MaxProbedOrigins int `json:"maxProbedOrigins,omitempty"`
+
+	// OriginProbeTimeout is the timeout of probing an origin. default: 2s.
+	OriginProbeTimeout time.Duration `json:"originProbeTimeout,omitempty"`
+
+	// BackSourceHeaders are the headers sent to the origins in addition to
+	// Header when downloading from the source, such as the 'Authorization'
+	// of a private registry. They are sent by the back source, the probes of
+	// the origins, the range requests and the HEAD requests of the metadata,
+	// but never to the supernodes or the peers. Their values are redacted
+	// from the logged config.
+	// eg: --backsourceheader='Authorization: Bearer xxx'.
+	BackSourceHeaders map[string]string `json:"backSourceHeaders,omitempty"`
+
+	// BackSourceProxy is the URL of the http proxy which the requests to the
+	// origins are sent through, such as 'http://proxy:3128'. Its user info
+	// is redacted from the logged config. default: the proxy of the
+	// environment.
+	BackSourceProxy string `json:"backSourceProxy,omitempty"`
+
+	// BackSourceDecompress indicates whether to accept the zstd or gzip
+	// encoded response when downloading the whole file from the source,
+	// which is decompressed on the fly and verified by the decompressed
+	// bytes. It's disabled by default since some origins encode the
+	// pre-compressed files which should be stored as-is.
+	BackSourceDecompress bool `json:"backSourceDecompress,omitempty"`
+
+	// MoveRetryTimeout is the maximum time of retrying moving the downloaded
+	// file to the output every MoveRetryInterval while the output is
+	// read-only transiently, such as the ZFS or Btrfs dataset being
+	// snapshotted. The output on a read-only mount fails immediately.
+	// default: disabled.
+	MoveRetryTimeout time.Duration `json:"moveRetryTimeout,omitempty"`
+
+	// ReportContributions reports the bytes each peer served to the download
+	// to the supernode after downloading from peers, best-effort. At most
+	// MaxReportedContributors peers are reported by their cids, the others
+	// are summed up.
+	ReportContributions bool `json:"reportContributions,omitempty"`
+
+	// ExtraTargets are the additional paths the downloaded file is hard
+	// linked or copied to after moving it to the output. They are verified
+	// as the output when ReadBackVerify is set.
+	ExtraTargets []string `json:"extraTargets,omitempty"`
+
+	// ListURL is the url of a list of the files downloaded instead of the
+	// URL, and the Output is the directory they're downloaded into by their
+	// paths in the list. Each line of the list is the path of a file relative
+	// to the ListURL, which the url of the file is resolved by, optionally
+	// followed by its md5. The blank lines and the ones starting with '#' are
+	// ignored. The files are downloaded by core.StartList sharing one
+	// supernode session, and each of them is registered as a task.
+	ListURL string `json:"listURL,omitempty"`
+
+	// ListPattern downloads only the files of the ListURL whose paths match
+	// the glob pattern by path.Match, e.g. "images/*.tar", in which '*'
+	// doesn't match '/'. default: all the files.
+	ListPattern string `json:"listPattern,omitempty"`
+
+	// ListParallelism is the number of the files of the ListURL downloaded
+	// concurrently. default: 1.
+	ListParallelism int `json:"listParallelism,omitempty"`
+
+	// CopyThreshold is the size in bytes below which the downloaded file is
+	// copied instead of hard linked, such as from the data dir to the output
+	// or to the ExtraTargets, so that the small files don't share the inode
+	// with the files served to the peers. 0 means always linking.
+	CopyThreshold int64 `json:"copyThreshold,omitempty"`
+
+	// LinkStrategy is how the downloaded file is placed at the other paths,
+	// such as from the data dir to the output or to the ExtraTargets: "link"
+	// hard links it and fails if linking fails, "copy" copies it, which
+	// suits the filesystems where the hard links are undesirable such as
+	// overlayfs, "reflink" clones it by FICLONE on the filesystems
+	// supporting it and copies it otherwise, and "auto" hard links it and
+	// copies it if linking fails or it's smaller than CopyThreshold.
+	// default: auto.
+	LinkStrategy string `json:"linkStrategy,omitempty"`
+
+	// VerifyConcurrency is the maximum number of the targets verified
+	// concurrently by ReadBackVerify. default: 4.
+	VerifyConcurrency int `json:"verifyConcurrency,omitempty"`
+
+	// ThroughputSampleInterval is the interval of sampling the throughput of
+	// the download from peers, the samples are available by
+	// P2PDownloader.GetThroughputSamples. default: disabled.
+	ThroughputSampleInterval time.Duration `json:"throughputSampleInterval,omitempty"`
+
+	// QueuePollTimeout is the timeout of waiting for a piece result or a
+	// piece task to be requested in the main loop of the download from
+	// peers. default: 2s.
+	QueuePollTimeout time.Duration `json:"queuePollTimeout,omitempty"`
+
+	// MaxQueuePollTimeouts is the number of the consecutive timeouts of
+	// QueuePollTimeout after which the download stalls and falls back to
+	// the source. 0 means waiting forever.
+	MaxQueuePollTimeouts int `json:"maxQueuePollTimeouts,omitempty"`
+
+	// PieceTimeout is the timeout of downloading a piece from the peer, the
+	// piece is marked failed and requested from the supernode again after
+	// it, so that a hung peer doesn't stall the download. default: disabled.
+	PieceTimeout time.Duration `json:"pieceTimeout,omitempty"`
+
+	// PullPieceMaxRetries is the maximum number of the consecutive retries
+	// of pulling the piece tasks while the supernodes ask to wait or fail,
+	// after which the download falls back to the source. 0 means no limit.
+	PullPieceMaxRetries int `json:"pullPieceMaxRetries,omitempty"`
+
+	// PullPieceMaxBackoff enables the exponential backoff between the
+	// retries of pulling the piece tasks: the delay doubles from
+	// config.PullPieceBaseBackoff up to it with jitter. 0 means sleeping
+	// 0.6s~2s randomly.
+	PullPieceMaxBackoff time.Duration `json:"pullPieceMaxBackoff,omitempty"`
+
+	// LimitedRetryDelay is the delay before pulling the piece tasks again
+	// when the supernode limits the pulls by TaskCodeLimited, it's never
+	// back source for the limit. default: 1s.
+	LimitedRetryDelay time.Duration `json:"limitedRetryDelay,omitempty"`
+
+	// WaitFunc returns the delay before the retry of pulling the piece tasks
+	// after the given attempts instead of PullPieceMaxBackoff, e.g. the tests
+	// can wait no time to be deterministic. default: nil.
+	WaitFunc func(attempt int) time.Duration `json:"-"`
+
+	// Resume resumes the download from peers interrupted by a restart of
+	// dfget: the pieces written into the service file are recorded in a
+	// sidecar file next to it, and they are skipped by the next download
+	// of the same url to the same output.
+	Resume bool `json:"resume,omitempty"`
+
+	// HostDedup coordinates the dfget processes downloading the same task on
+	// the host by a lock file of the taskID in the data dir: the later ones
+	// wait for the one holding the lock and reuse the service file it
+	// downloaded instead of downloading the file again. The lock is released
+	// by the system if the holder crashes, and the waiters download the file
+	// by themselves if there's no service file left to reuse.
+	HostDedup bool `json:"hostDedup,omitempty"`
+
+	// LocalCacheDir is the dir of a local mirror whose files are named by
+	// their digests as '<algorithm>/<hex>', eg: md5/<hex> or sha256/<hex>.
+	// The file of the digest expected by Digest or Md5 is verified and
+	// placed at the output by LinkStrategy before registering to the
+	// supernodes, and it's downloaded as usual if it's missing or corrupted.
+	LocalCacheDir string `json:"localCacheDir,omitempty"`
+
+	// HeartbeatFile is the file whose mtime is updated every HeartbeatInterval
+	// while the download is making progress, so the external watchdogs can
+	// distinguish a slow download from a stuck one. It's created if not
+	// exist. default: disabled.
+	HeartbeatFile string `json:"heartbeatFile,omitempty"`
+
+	// HeartbeatInterval is the interval of updating the HeartbeatFile.
+	// default: 10s.
+	HeartbeatInterval time.Duration `json:"heartbeatInterval,omitempty"`
+
+	// VerifyLineage asserts that the downloaded file is assembled from the
+	// pieces of the tasks the download has migrated through since the piece
+	// size changed last time, and they cover the file exactly. The download
+	// fails otherwise. It's a correctness guard of the migration.
+	VerifyLineage bool `json:"verifyLineage,omitempty"`
+
+	// EventBufferSize is the buffer size of the channel returned by
+	// P2PDownloader.Events delivering the events of the download, the events
+	// are dropped if it's full. default: disabled.
+	EventBufferSize int `json:"eventBufferSize,omitempty"`
+
+	// ProgressSocket is the unix socket the progress of the download from
+	// peers is streamed into by the compact binary frames decoded by
+	// downloader.DecodeProgressFrame, for the local UIs rendering the
+	// frequent updates. The frames are coalesced if the consumer is slow.
+	// default: disabled.
+	ProgressSocket string `json:"progressSocket,omitempty"`
+
+	// ProgressFunc is called with the bytes of the file content downloaded
+	// and the length of the file, which is -1 if unknown, every time the
+	// download from peers progresses, and once more after it succeeds. It's
+	// called by the goroutine running P2PDownloader.Run and should return
+	// quickly. default: nil.
+	ProgressFunc func(downloaded, total int64) `json:"-"`
+
+	// OnMigrate is called with the supernode migrated from, the supernode
+	// migrated to and the task id registered to it every time the download
+	// migrates to another supernode, for the monitoring to track the churn of
+	// the supernodes. It should return quickly. default: nil.
+	OnMigrate func(oldNode, newNode, newTaskID string) `json:"-"`
+
+	// OnBackSource is called with the BackSourceReason right before the
+	// P2PDownloader falls back to the source, for the alerting to count the
+	// failures of the P2P download by the reasons, such as
+	// BackSourceReasonSourceError and BackSourceReasonDownloadError. It's
+	// called even if Notbs fails the download instead. It should return
+	// quickly. default: nil.
+	OnBackSource func(reason int) `json:"-"`
+
+	// OnPieceDone is called with the range, the cid of the peer serving it,
+	// the bytes of the file content and the time of fetching it every time a
+	// piece downloaded succeeds, for building the latency histograms and
+	// finding out the slow peers without the verbose logs. The pieces kept
+	// from the previous download aren't reported. It's called by the
+	// goroutine running P2PDownloader.Run and should return quickly.
+	// default: nil.
+	OnPieceDone func(pieceRange, cid string, bytes int64, cost time.Duration) `json:"-"`
+
+	// Metrics counts the pieces requested, succeeded and failed, the
+	// migrations, the back sources and the bytes downloaded from the peers,
+	// for the long-lived process embedding dfget to export them.
+	// default: nil.
+	Metrics *Metrics `json:"-"`
+
+	// OutputWriter receives the content of the file in order instead of the
+	// Output for the process embedding dfget to stream it, e.g. into tar.
+	// The pieces out of order wait in the service file, and the file is
+	// assembled sequentially. The Output still names the download.
+	// default: nil.
+	OutputWriter io.Writer `json:"-"`
+
+	// CheckInodes fails the download before creating any file if the
+	// filesystems it writes to don't have enough free inodes, which would
+	// cause confusing failures later. The filesystems without a fixed number
+	// of inodes, such as btrfs, are skipped. default: false.
+	CheckInodes bool `json:"checkInodes,omitempty"`
+
+	// DiskSpaceHeadroom is the factor of the file length the free space of
+	// the data dir must have before the download from peers starts, or it
+	// fails early with downloader.ErrInsufficientSpace. Set it to 2 if the
+	// data dir also holds the client file copied from the service file,
+	// e.g. NoMove is set or the file is assembled sequentially.
+	// default: 1.
+	DiskSpaceHeadroom float64 `json:"diskSpaceHeadroom,omitempty"`
+
+	// LogThrottleInterval throttles the repeated errors and warnings of the
+	// download from peers: only the first message of a kind is logged within
+	// the interval, and the number of the suppressed ones is logged with the
+	// next. It doesn't take effect in the verbose mode. default: disabled.
+	LogThrottleInterval time.Duration `json:"logThrottleInterval,omitempty"`
+
+	// RecordFile is the file that records the piece tasks pulled from the
+	// supernodes and the piece contents downloaded from the peers, which can
+	// be replayed offline by downloader.Replayer to reproduce a download
+	// deterministically. default: disabled.
+	RecordFile string `json:"recordFile,omitempty"`
+
+	// ManifestFile is the file the manifest of a download from peers is
+	// written into in json format after it succeeds, which captures the url,
+	// the supernodes, the piece size, the source of each piece and the md5
+	// of the file for auditing. The pieces reused from the DeltaBaseFile or
+	// the LocalCDN are recorded as the peers they are dispatched from.
+	// default: disabled.
+	ManifestFile string `json:"manifestFile,omitempty"`
+
+	// SummaryFile is the file the JSON summary of the download is written
+	// into once it finishes, '-' means the stdout. The summary has the
+	// taskID, the node, the bytes from the peers and the source, the
+	// migrations, the elapsed time and the digest of the output.
+	SummaryFile string `json:"summaryFile,omitempty"`
+
+	// ReplayManifest is the manifest written by ManifestFile of a previous
+	// download to be reproduced: its supernodes are registered to first, the
+	// pieces are downloaded from the same peers if they are dispatched with
+	// the same piece size, and the file must match its md5 unless Md5 is set.
+	ReplayManifest string `json:"replayManifest,omitempty"`
+
+	// NoMove leaves the downloaded file in the data dir instead of moving it to
+	// the output when downloading from peers, its path is reported by
+	// RV.ResultPath. The file will be removed by the peer server once it
+	// expires. It doesn't affect downloading from the source.
+	NoMove bool `json:"noMove,omitempty"`
+
+	// KeepIntermediate keeps the client file and the service file in the
+	// data dir after the download from peers succeeds. Otherwise the client
+	// file is removed unless NoMove is set, and the service file is removed
+	// unless the peer server is running: the peer server seeds the service
+	// file to the other peers until it expires, removing it earlier would
+	// move their downloads onto the supernodes. Keeping the files costs the
+	// disk of the data dir until the peer server expires them.
+	KeepIntermediate bool `json:"keepIntermediate,omitempty"`
+
+	// DirectWrite assembles the pieces downloaded from peers straight into
+	// the target file instead of moving the client file into it, if the data
+	// dir and the target are on the same device. The service file is hard
+	// linked to the target for the peer server, so the target mustn't be
+	// modified while it's seeded. It's ignored if the target is assembled
+	// sequentially, a range is requested, NoMove is set or the download is
+	// resumed, and the target holds the partial content during the download.
+	DirectWrite bool `json:"directWrite,omitempty"`
+
+	// WriteAt writes each piece downloaded from peers at its offset of the
+	// service file by the fetch downloading it, instead of queueing it for
+	// the client writer writing the pieces one by one, so the pieces out of
+	// order aren't held in memory until they are written. The service file
+	// is preallocated to the registered file length and truncated to the
+	// end of the written pieces once the download finishes. It's ignored if
+	// the target isn't linked to the service file, such as the target
+	// assembled sequentially, and WriteBufferSize doesn't buffer the pieces
+	// written by it.
+	WriteAt bool `json:"writeAt,omitempty"`
+
+	// Seed seeds the existing Output to the other peers as the file of the
+	// url instead of downloading it, which pre-warms the dedicated seeders:
+	// it's registered to the supernodes and served by the peer server. Md5
+	// or Identifier should be set for registering the task the downloaders
+	// do, and the file is verified by the expected digest if it's known.
+	Seed bool `json:"seed,omitempty"`
+
+	// CompressServiceFile stores the service file in the data dir compressed
+	// by zstd after the download succeeds, and the peer server decompresses
+	// the pieces on the fly when serving them, which trades CPU for disk on
+	// the seed nodes serving the compressible files. The served pieces and so
+	// their digests are the same as the uncompressed ones. It takes
+	// precedence over sharing the service file with the output by
+	// LinkStrategy or DirectWrite: the compressed file replaces the service
+	// file, and the output keeps the uncompressed content on its own.
+	CompressServiceFile bool `json:"compressServiceFile,omitempty"`
+
+	// PartialRatio enables the soft-fail mode for the best-effort caches: if
+	// the download can't be completed but the contiguous prefix downloaded
+	// from peers is at least PartialRatio of the file, the prefix is written
+	// to the output and the download fails with CodePartial. The md5 of the
+	// partial output is never checked, so the consumers expecting complete
+	// files must check the result code and never use the output of a
+	// partial download as the file. 0 means disabled.
+	PartialRatio float64 `json:"partialRatio,omitempty"`
+
+	// MaxBufferedBytes is the maximum bytes of the pieces buffered in memory
+	// by all the concurrent fetches and the writers, the new pieces won't be
+	// started or fetched until the buffered ones are written to disk. It
+	// makes the memory footprint predictable under tight cgroup limits.
+	// 0 means no limit.
+	MaxBufferedBytes int64 `json:"maxBufferedBytes,omitempty"`
+
+	// ClientQueueMemory is the bytes of the downloaded pieces queued for the
+	// client writer, the capacity of the queue is derived from it and the
+	// piece size, and it's changed with the piece size.
+	// default: 24MB, which keeps 6 pieces of 4MB.
+	ClientQueueMemory int64 `json:"clientQueueMemory,omitempty"`
+
+	// WriteBufferSize is the bytes of the downloaded pieces held in memory
+	// before writing them into the service file together, the adjacent ones
+	// are written by one sequential write. It's flushed earlier if the
+	// MaxBufferedBytes is nearly used up, all the pieces are downloaded or no
+	// more pieces are downloaded for a while, and the buffered pieces are
+	// reported succeeded to the supernode only after they're written.
+	// It trades memory for fewer and larger writes on the slow filesystems
+	// such as NFS, but the peers can't download the buffered pieces from it.
+	// 0 means writing every piece once it's downloaded.
+	WriteBufferSize int64 `json:"writeBufferSize,omitempty"`
+
+	// MaxOpenFiles is the maximum number of the file descriptors used by the
+	// peer sockets and the temp files of a download, the new pieces won't be
+	// started until the used ones are closed. The connectivity checks are
+	// skipped so that the pooled connections are reused when it's near the
+	// limit. 0 means a fraction of the soft limit of open files of the
+	// process, and a negative value means no limit.
+	MaxOpenFiles int `json:"maxOpenFiles,omitempty"`
+
+	// MaxConcurrentPieces is the maximum number of the pieces downloaded
+	// from peers concurrently, the piece tasks started beyond it wait for
+	// the running ones to finish. It bounds the load on the NIC and the disk
+	// when pulling huge files. 0 means no limit.
+	MaxConcurrentPieces int `json:"maxConcurrentPieces,omitempty"`
+
+	// PieceCoalesceFactor is the maximum number of the adjacent pieces served
+	// by the same peer that are downloaded by one request, which reduces the
+	// per piece overhead when the supernode sets a tiny piece size. The pieces
+	// are coalesced up to 4MB and still reported to the supernode one by one.
+	// It doesn't work with DeltaBaseFile or LocalCDN. 0 or 1 means disabled.
+	PieceCoalesceFactor int `json:"pieceCoalesceFactor,omitempty"`
+
+	// MaxRangesPerPull is the maximum number of new piece ranges started after
+	// each pull from the supernode, the rest are deferred to the subsequent
+	// pulls to pace the dispatching. The deferred ranges aren't counted as
+	// running pieces, so the pulls continue as the started pieces finish.
+	// 0 means no limit.
+	MaxRangesPerPull int `json:"maxRangesPerPull,omitempty"`
+
+	// MaxRangeFailures is the number of failures of a single range from one
+	// supernode, after which dfget migrates to another supernode instead of
+	// retrying the range from the same one, which may cache a bad piece.
+	// 0 means never.
+	MaxRangeFailures int `json:"maxRangeFailures,omitempty"`
+
+	// MaxRangeRetries is the maximum number of the re-requests of a single
+	// range caused by failures from all the supernodes. Once a range exceeds
+	// it, the range is downloaded from the source if RangeBackSource is set,
+	// otherwise the download fails with CodeRangeExhausted identifying the
+	// range. 0 means no limit.
+	MaxRangeRetries int `json:"maxRangeRetries,omitempty"`
+
+	// RangeBackSource downloads only the ranges exceeding MaxRangeRetries
+	// from the source instead of failing the download, which requires the
+	// source to support range requests.
+	RangeBackSource bool `json:"rangeBackSource,omitempty"`
+
+	// UnknownCodePolicy determines how to handle the response codes of
+	// pulling piece tasks unknown to this dfget, which may be sent by a newer
+	// supernode during rolling upgrades. It must be one of 'migrate',
+	// 'retry' and 'fatal': 'retry' pulls again up to UnknownCodeRetryLimit
+	// times before migrating, and 'fatal' fails the p2p download.
+	// default: migrate.
+	UnknownCodePolicy string `json:"unknownCodePolicy,omitempty"`
+
+	// WarmStandby registers to the next supernode as a standby in the
+	// background while downloading from the current one, so that the task is
+	// warm on it and the migration switches to it instantly instead of
+	// registering after the failure. Another standby is registered after
+	// every migration.
+	WarmStandby bool `json:"warmStandby,omitempty"`
+
+	// MigrationJitter is the upper bound of the random delay before migrating
+	// to another supernode, it staggers the migrations of the downloads when
+	// a supernode fails. 0 means no delay.
+	MigrationJitter time.Duration `json:"migrationJitter,omitempty"`
+
+	// MigrationRateLimit is the maximum number of migrations per second shared
+	// by all the downloads in the current process. 0 means no limit.
+	MigrationRateLimit int `json:"migrationRateLimit,omitempty"`
+
+	// MigrationMaxBackoff enables the exponential backoff between the
+	// consecutive registrations of the migrations, so that the downloads
+	// don't register to the supernodes in a tight loop while they're failing:
+	// the delay doubles from config.MigrationBaseBackoff up to it with jitter
+	// since the second registration. It's reset once the piece tasks are
+	// pulled from the supernode registered. 0 means no backoff.
+	MigrationMaxBackoff time.Duration `json:"migrationMaxBackoff,omitempty"`
+
+	// MigrationHealthCheck checks the health of the remainder nodes and the
+	// alternate nodes before registering to them for the migrations, the
+	// dead ones are skipped without waiting for their registrations to time
+	// out. The supernodes must serve the health endpoint '/_ping'.
+	MigrationHealthCheck bool `json:"migrationHealthCheck,omitempty"`
+
+	// CheckHealth only checks the health of the supernodes of Node and
+	// prints the result of each without downloading, it fails with
+	// CodeUnhealthy if none of them is healthy.
+	CheckHealth bool `json:"checkHealth,omitempty"`
+
 	// Start time.
 	StartTime time.Time `json:"startTime"`
 
@@ -224,12 +837,54 @@ type Config struct {
 	// Client logger.
 	ClientLogger *logrus.Logger `json:"-"`
 
+	// Logger receives the logs of the downloaders instead of the
+	// ClientLogger if it's set, so that the embedders can route them into
+	// their own logging stack, such as zap or zerolog.
+	Logger Logger `json:"-"`
+
 	// Server logger, only created when Pattern equals 'p2p'.
 	ServerLogger *logrus.Logger `json:"-"`
 }
 
+// Logger is the minimal logger the downloaders write to, *logrus.Logger
+// implements it.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Log returns the logger of the downloaders, which is the Logger if it's
+// set or the ClientLogger.
+func (cfg *Config) Log() Logger {
+	if cfg.Logger != nil {
+		return cfg.Logger
+	}
+	return cfg.ClientLogger
+}
+
+// EffectiveUserAgent returns the UserAgent, or the DefaultUserAgent if it's
+// not set.
+func (cfg *Config) EffectiveUserAgent() string {
+	if cfg.UserAgent == "" {
+		return DefaultUserAgent
+	}
+	return cfg.UserAgent
+}
+
 func (cfg *Config) String() string {
-	js, _ := json.Marshal(cfg)
+	c := *cfg
+	if len(cfg.BackSourceHeaders) > 0 {
+		c.BackSourceHeaders = make(map[string]string, len(cfg.BackSourceHeaders))
+		for k := range cfg.BackSourceHeaders {
+			c.BackSourceHeaders[k] = "xxxxx"
+		}
+	}
+	if u, err := url.Parse(cfg.BackSourceProxy); err == nil && u.User != nil {
+		c.BackSourceProxy = u.Redacted()
+	}
+	js, _ := json.Marshal(&c)
 	return string(js)
 }
 
@@ -267,23 +922,94 @@ func AssertConfig(cfg *Config) {
 		}
 	}()
 
-	util.PanicIfError(checkURL(cfg), "invalid url")
-	util.PanicIfError(checkOutput(cfg), "invalid output")
+	if util.IsEmptyStr(cfg.ListURL) {
+		util.PanicIfError(checkURL(cfg), "invalid url")
+		util.PanicIfError(checkOutput(cfg), "invalid output")
+	} else {
+		util.PanicIfError(checkList(cfg), "invalid list")
+	}
+	util.PanicIfError(checkRequestRange(cfg), "invalid range")
+	util.PanicIfError(checkLinkStrategy(cfg), "invalid link strategy")
+	if !util.IsEmptyStr(cfg.Digest) {
+		util.PanicIfError(util.CheckDigest(cfg.Digest), "invalid digest")
+	}
+	if !util.IsEmptyStr(cfg.BackSourceProxy) {
+		_, err := url.Parse(cfg.BackSourceProxy)
+		util.PanicIfError(err, "invalid back source proxy")
+	}
 }
 
+var urlRegexp = regexp.MustCompile(`(https?|HTTPS?)://([\w_]+:[\w_]+@)?([\w-]+\.)+[\w-]+(/[\w- ./?%&=]*)?`)
+
 func checkURL(cfg *Config) error {
 	// shorter than the shortest case 'http://a.b'
 	if len(cfg.URL) < 10 {
 		return fmt.Errorf(cfg.URL)
 	}
-	reg := regexp.MustCompile(`(https?|HTTPS?)://([\w_]+:[\w_]+@)?([\w-]+\.)+[\w-]+(/[\w- ./?%&=]*)?`)
-	if url := reg.FindString(cfg.URL); util.IsEmptyStr(url) {
+	if url := urlRegexp.FindString(cfg.URL); util.IsEmptyStr(url) {
 		return fmt.Errorf(cfg.URL)
 	}
 	return nil
 }
 
+// checkList checks the ListURL and the Output which is the directory the
+// files of the list are downloaded into, it's the current directory if it
+// isn't set.
+func checkList(cfg *Config) error {
+	if !urlRegexp.MatchString(cfg.ListURL) {
+		return fmt.Errorf("list url:%s", cfg.ListURL)
+	}
+	if cfg.ListPattern != "" {
+		if _, err := path.Match(cfg.ListPattern, ""); err != nil {
+			return fmt.Errorf("list pattern:%s error:%v", cfg.ListPattern, err)
+		}
+	}
+	if util.IsEmptyStr(cfg.Output) {
+		cfg.Output = "."
+	}
+	absPath, err := filepath.Abs(cfg.Output)
+	if err != nil {
+		return fmt.Errorf("get absolute path[%s] error: %v", cfg.Output, err)
+	}
+	cfg.Output = absPath
+	if f, err := os.Stat(cfg.Output); err == nil && !f.IsDir() {
+		return fmt.Errorf("path[%s] is file but requires directory path", cfg.Output)
+	}
+	return nil
+}
+
 // This function must be called after checkURL
+func checkLinkStrategy(cfg *Config) error {
+	switch cfg.LinkStrategy {
+	case "", LinkStrategyAuto, LinkStrategyLink, LinkStrategyCopy, LinkStrategyReflink:
+		return nil
+	}
+	return fmt.Errorf("unknown link strategy:%s", cfg.LinkStrategy)
+}
+
+func checkRequestRange(cfg *Config) error {
+	if util.IsEmptyStr(cfg.RequestRange) {
+		return nil
+	}
+	if _, _, ok := ParseRequestRange(cfg.RequestRange); !ok {
+		return fmt.Errorf("range[%s] isn't in the form of 'start-end'", cfg.RequestRange)
+	}
+	return nil
+}
+
+// ParseRequestRange parses the RequestRange 'start-end' into its inclusive
+// bounds.
+func ParseRequestRange(r string) (start int64, end int64, ok bool) {
+	kv := strings.SplitN(r, "-", 2)
+	if len(kv) != 2 {
+		return 0, 0, false
+	}
+	var err1, err2 error
+	start, err1 = strconv.ParseInt(strings.TrimSpace(kv[0]), 10, 64)
+	end, err2 = strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+	return start, end, err1 == nil && err2 == nil && start >= 0 && start <= end
+}
+
 func checkOutput(cfg *Config) error {
 	if util.IsEmptyStr(cfg.Output) {
 		url := strings.TrimRight(cfg.URL, "/")
@@ -326,15 +1052,29 @@ type RuntimeVariable struct {
 	RealTarget    string
 	TargetDir     string
 	TempTarget    string
+	ResultPath    string
 	Cid           string
 	TaskURL       string
 	TaskFileName  string
 	LocalIP       string
+	PeerIP        string
 	PeerPort      int
 	FileLength    int64
+	Assembly      string
 
 	DataExpireTime  time.Duration
 	ServerAliveTime time.Duration
+
+	// MaxServingStreams is the maximum number of the pieces the peer server
+	// uploads concurrently, the requests beyond it wait ServingQueueTimeout
+	// for a free stream and are rejected with 503 and Retry-After then.
+	// 0 means no limit.
+	MaxServingStreams   int
+	ServingQueueTimeout time.Duration
+
+	// ServeHTTP2 makes the peer server serve the peers fetching the pieces
+	// by HTTP/2 without TLS(Config.PeerHTTP2) along with the HTTP/1 ones.
+	ServeHTTP2 bool
 }
 
 func (rv *RuntimeVariable) String() string {
@@ -18,6 +18,8 @@ package config
 
 import (
 	"time"
+
+	"github.com/dragonflyoss/Dragonfly/version"
 )
 
 /* the response code from supernode */
@@ -55,6 +57,84 @@ const (
 	TaskCodeSourceError     = 610
 )
 
+/* the policies of handling the unknown task codes */
+const (
+	UnknownCodeMigrate = "migrate"
+	UnknownCodeRetry   = "retry"
+	UnknownCodeFatal   = "fatal"
+
+	// InodeReserve is the number of the free inodes left for the others
+	// by the Config.CheckInodes.
+	InodeReserve = 16
+
+	// DefaultDiskSpaceHeadroom is the default Config.DiskSpaceHeadroom, the
+	// data dir holds the service file only.
+	DefaultDiskSpaceHeadroom = 1.0
+
+	// DefaultClientQueueMemory is the default Config.ClientQueueMemory,
+	// which keeps DefaultClientQueueSize pieces of 4MB.
+	DefaultClientQueueMemory = DefaultClientQueueSize * 4 * 1024 * 1024
+	// MinClientQueueSize and MaxClientQueueSize bound the capacity of the
+	// client queue derived from the Config.ClientQueueMemory.
+	MinClientQueueSize = 2
+	MaxClientQueueSize = 1024
+
+	// DefaultSchedulerMaxRunning is the ranges in processing allowed for
+	// pulling the next piece tasks by the default piece scheduler.
+	DefaultSchedulerMaxRunning = 2
+
+	// DefaultUserAgent is the default Config.UserAgent.
+	DefaultUserAgent = "dfget/" + version.DFGetVersion
+
+	// DefaultPeerMaxIdleConnsPerHost is the default
+	// Config.PeerMaxIdleConnsPerHost.
+	DefaultPeerMaxIdleConnsPerHost = 16
+
+	// DefaultOriginProbeTimeout is the default timeout of probing an origin
+	// by the Config.Mirrors.
+	DefaultOriginProbeTimeout = 2 * time.Second
+
+	// MoveRetryInterval is the interval of retrying moving the downloaded
+	// file to the output by the Config.MoveRetryTimeout.
+	MoveRetryInterval = 500 * time.Millisecond
+
+	// MaxReportedContributors is the maximum number of the peers reported
+	// by their cids by the Config.ReportContributions.
+	MaxReportedContributors = 64
+
+	// UnknownCodeRetryLimit is the number of times pulling piece tasks again
+	// with the UnknownCodeRetry policy before migrating.
+	UnknownCodeRetryLimit = 3
+)
+
+/* the error code of dfget */
+const (
+	// CodeUntrusted represents that the download can't be completed
+	// without the peers or the source outside the trust domain.
+	CodeUntrusted = 1400
+
+	// CodePartial represents that the download failed but only the
+	// contiguous prefix of the file is written to the output, see
+	// Config.PartialRatio.
+	CodePartial = 1500
+
+	// CodeRangeExhausted represents that a range failed more than
+	// Config.MaxRangeRetries times.
+	CodeRangeExhausted = 1600
+
+	// CodeNoInodes represents that the filesystems don't have enough free
+	// inodes for the download, see Config.CheckInodes.
+	CodeNoInodes = 1700
+
+	// CodeListFailed represents that some of the files of Config.ListURL
+	// failed to download, the others are downloaded.
+	CodeListFailed = 1800
+
+	// CodeUnhealthy represents that none of the supernodes passes the
+	// health check, see Config.CheckHealth.
+	CodeUnhealthy = 1900
+)
+
 /* the reason of backing to source */
 const (
 	BackSourceReasonNone          = 0
@@ -67,6 +147,9 @@ const (
 	BackSourceReasonHostSysError  = 7
 	BackSourceReasonNodeEmpty     = 8
 	BackSourceReasonSourceError   = 10
+	BackSourceReasonQueueTimeout  = 11
+	BackSourceReasonPullRetries   = 12
+	BackSourceReasonTimeout       = 13
 	BackSourceReasonUserSpecified = 100
 	ForceNotBackSourceAddition    = 1000
 )
@@ -78,6 +161,21 @@ const (
 	PatternSource = "source"
 )
 
+/* assembly strategy of the target file */
+const (
+	AssemblyAuto       = "auto"
+	AssemblyRandom     = "random"
+	AssemblySequential = "sequential"
+)
+
+/* strategy of linking the downloaded file to the targets */
+const (
+	LinkStrategyAuto    = "auto"
+	LinkStrategyLink    = "link"
+	LinkStrategyCopy    = "copy"
+	LinkStrategyReflink = "reflink"
+)
+
 /* properties */
 const (
 	DefaultYamlConfigFile  = "/etc/dragonfly.yaml"
@@ -101,11 +199,77 @@ const (
 	PeerHTTPPathPrefix = "/peer/file/"
 	CDNPathPrefix      = "/qtdown/"
 
+	// MetaFileSuffix is appended to the target to name the sidecar file
+	// which stores the captured response headers.
+	MetaFileSuffix = ".meta"
+
 	LocalHTTPPathCheck  = "/check/"
 	LocalHTTPPathClient = "/client/"
 	LocalHTTPPathRate   = "/rate/"
 	LocalHTTPPing       = "/server/ping"
+	LocalHTTPStats      = "/server/stats"
+
+	// ServingRetryAfter is the seconds in the Retry-After header of the
+	// uploads rejected by RuntimeVariable.MaxServingStreams.
+	ServingRetryAfter = 1
 
 	DataExpireTime  = 3 * time.Minute
 	ServerAliveTime = 5 * time.Minute
+
+	DefaultHeartbeatInterval = 10 * time.Second
+	DefaultQueuePollTimeout  = 2 * time.Second
+	DefaultVerifyConcurrency = 4
+
+	// DefaultLimitedRetryDelay is the default delay before pulling the piece
+	// tasks again when the supernode limits the pulls by TaskCodeLimited.
+	DefaultLimitedRetryDelay = time.Second
+
+	// WriteBufferFlushInterval is the time after which the pieces buffered
+	// by Config.WriteBufferSize are flushed if no more pieces are queued for
+	// the writer, so that the last pieces are reported succeeded.
+	WriteBufferFlushInterval = time.Second
+
+	// TimeoutStopGrace is the time the download stopped by Config.Timeout is
+	// waited for to stop the pieces and write the received ones before it's
+	// abandoned.
+	TimeoutStopGrace = 10 * time.Second
+
+	// PullPieceBaseBackoff is the delay before the first retry of pulling
+	// the piece tasks when PullPieceMaxBackoff is set.
+	PullPieceBaseBackoff = 600 * time.Millisecond
+
+	// HostLockPollInterval is the interval of trying to acquire the lock of
+	// the task held by another dfget process on the host when HostDedup is
+	// set.
+	HostLockPollInterval = 200 * time.Millisecond
+
+	// MigrationBaseBackoff is the delay before the second consecutive
+	// registration of the migrations when MigrationMaxBackoff is set.
+	MigrationBaseBackoff = time.Second
+
+	// HealthCheckTimeout is the timeout of checking the health of a
+	// supernode.
+	HealthCheckTimeout = 2 * time.Second
+
+	// ResumeSaveInterval is the minimum interval of recording the written
+	// pieces into the sidecar file of the service file when Resume is set.
+	ResumeSaveInterval = time.Second
+
+	// UntrustedRetryLimit is the number of times a range is offered by the
+	// untrusted peers only, after which the download fails in the strict
+	// trust domain mode.
+	UntrustedRetryLimit = 3
+
+	// MaxCoalescedSize is the maximum bytes of the adjacent pieces downloaded
+	// by one request when coalescing the pieces.
+	MaxCoalescedSize = 4 * 1024 * 1024
+
+	// CompressBlockSize is the bytes of the service file compressed as a
+	// zstd frame independently, which is decompressed as a whole when
+	// serving.
+	CompressBlockSize = 1024 * 1024
+
+	// OpenFilesRatio is the fraction of the soft limit of open files used by
+	// a download when MaxOpenFiles isn't set.
+	OpenFilesRatio = 0.5
 )
@@ -0,0 +1,98 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"sync/atomic"
+)
+
+// The names of the counters of Metrics, they follow the naming of the
+// prometheus counters.
+const (
+	MetricPiecesRequested = "dfget_pieces_requested_total"
+	MetricPiecesSucceeded = "dfget_pieces_succeeded_total"
+	MetricPiecesFailed    = "dfget_pieces_failed_total"
+	MetricMigrations      = "dfget_supernode_migrations_total"
+	MetricBackSources     = "dfget_back_sources_total"
+	MetricBytes           = "dfget_downloaded_bytes_total"
+)
+
+var metricNames = []string{
+	MetricPiecesRequested,
+	MetricPiecesSucceeded,
+	MetricPiecesFailed,
+	MetricMigrations,
+	MetricBackSources,
+	MetricBytes,
+}
+
+var metricHelps = map[string]string{
+	MetricPiecesRequested: "The pieces requested from the peers.",
+	MetricPiecesSucceeded: "The pieces downloaded successfully.",
+	MetricPiecesFailed:    "The pieces failed to download.",
+	MetricMigrations:      "The migrations to another supernode.",
+	MetricBackSources:     "The downloads falling back to the source.",
+	MetricBytes:           "The bytes of the pieces downloaded from the peers.",
+}
+
+// Metrics counts the activities of the downloads, it can be shared by the
+// downloads of a long-lived process which exports the counters, such as by
+// a prometheus.Collector built by the Each. The nil Metrics counts nothing.
+type Metrics struct {
+	counters map[string]*int64
+}
+
+// NewMetrics creates a Metrics whose counters are all zero.
+func NewMetrics() *Metrics {
+	m := &Metrics{counters: make(map[string]*int64, len(metricNames))}
+	for _, name := range metricNames {
+		m.counters[name] = new(int64)
+	}
+	return m
+}
+
+// Add adds n to the counter of the name, the unknown name is ignored.
+func (m *Metrics) Add(name string, n int64) {
+	if m == nil {
+		return
+	}
+	if c, ok := m.counters[name]; ok {
+		atomic.AddInt64(c, n)
+	}
+}
+
+// Get returns the value of the counter of the name.
+func (m *Metrics) Get(name string) int64 {
+	if m == nil {
+		return 0
+	}
+	if c, ok := m.counters[name]; ok {
+		return atomic.LoadInt64(c)
+	}
+	return 0
+}
+
+// Each calls fn with the name, the help and the value of every counter in
+// a fixed order.
+func (m *Metrics) Each(fn func(name, help string, value int64)) {
+	if m == nil {
+		return
+	}
+	for _, name := range metricNames {
+		fn(name, metricHelps[name], m.Get(name))
+	}
+}
@@ -0,0 +1,44 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"github.com/go-check/check"
+)
+
+func (suite *ConfigSuite) TestMetrics(c *check.C) {
+	var m *Metrics
+	m.Add(MetricBytes, 1)
+	c.Assert(m.Get(MetricBytes), check.Equals, int64(0))
+
+	m = NewMetrics()
+	m.Add(MetricBytes, 10)
+	m.Add(MetricBytes, 5)
+	m.Add(MetricMigrations, 1)
+	m.Add("unknown", 1)
+	c.Assert(m.Get(MetricBytes), check.Equals, int64(15))
+	c.Assert(m.Get("unknown"), check.Equals, int64(0))
+
+	values := make(map[string]int64)
+	m.Each(func(name, help string, value int64) {
+		c.Assert(help, check.Not(check.Equals), "")
+		values[name] = value
+	})
+	c.Assert(values, check.HasLen, 6)
+	c.Assert(values[MetricMigrations], check.Equals, int64(1))
+	c.Assert(values[MetricBackSources], check.Equals, int64(0))
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
 	"github.com/dragonflyoss/Dragonfly/dfget/types"
 	"github.com/dragonflyoss/Dragonfly/dfget/util"
 )
@@ -31,6 +32,8 @@ const (
 	peerPullPieceTaskPath = "/peer/task"
 	peerReportPiecePath   = "/peer/piece/suc"
 	peerServiceDownPath   = "/peer/service/down"
+	peerContributionPath  = "/peer/contribution"
+	healthCheckPath       = "/_ping"
 )
 
 // NewSupernodeAPI creates a new instance of SupernodeAPI with default value.
@@ -43,12 +46,34 @@ func NewSupernodeAPI() SupernodeAPI {
 	}
 }
 
+// NewSupernodeAPIFromConfig creates a new instance of SupernodeAPI which
+// communicates with the supernodes by https if the tls of the cfg is set,
+// or by http otherwise. The requests carry the User-Agent of the cfg.
+func NewSupernodeAPIFromConfig(cfg *config.Config) (SupernodeAPI, error) {
+	api := NewSupernodeAPI().(*supernodeAPI)
+	if util.IsEmptyStr(cfg.SupernodeCACert) && util.IsEmptyStr(cfg.SupernodeCert) &&
+		!cfg.SupernodeInsecureSkipVerify {
+		api.HTTPClient = util.NewHTTPClient(nil, cfg.EffectiveUserAgent())
+		return api, nil
+	}
+	tlsConfig, err := util.LoadTLSConfig(cfg.SupernodeCACert, cfg.SupernodeCert,
+		cfg.SupernodeKey, cfg.SupernodeInsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	api.Scheme = "https"
+	api.HTTPClient = util.NewHTTPClient(tlsConfig, cfg.EffectiveUserAgent())
+	return api, nil
+}
+
 // SupernodeAPI defines the communication methods between supernode and dfget.
 type SupernodeAPI interface {
 	Register(ip string, req *types.RegisterRequest) (resp *types.RegisterResponse, e error)
 	PullPieceTask(ip string, req *types.PullPieceTaskRequest) (resp *types.PullPieceTaskResponse, e error)
 	ReportPiece(ip string, req *types.ReportPieceRequest) (resp *types.BaseResponse, e error)
 	ServiceDown(ip string, taskID string, cid string) (resp *types.BaseResponse, e error)
+	ReportContribution(ip string, req *types.ReportContributionRequest) (resp *types.BaseResponse, e error)
+	CheckHealth(ip string) error
 }
 
 type supernodeAPI struct {
@@ -66,8 +91,7 @@ func (api *supernodeAPI) Register(ip string, req *types.RegisterRequest) (
 		code int
 		body []byte
 	)
-	url := fmt.Sprintf("%s://%s:%d%s",
-		api.Scheme, ip, api.ServicePort, peerRegisterPath)
+	url := api.url(ip, peerRegisterPath)
 	if code, body, e = api.HTTPClient.PostJSON(url, req, api.Timeout); e != nil {
 		return nil, e
 	}
@@ -84,8 +108,7 @@ func (api *supernodeAPI) Register(ip string, req *types.RegisterRequest) (
 func (api *supernodeAPI) PullPieceTask(ip string, req *types.PullPieceTaskRequest) (
 	resp *types.PullPieceTaskResponse, e error) {
 
-	url := fmt.Sprintf("%s://%s:%d%s?%s",
-		api.Scheme, ip, api.ServicePort, peerPullPieceTaskPath, util.ParseQuery(req))
+	url := api.url(ip, peerPullPieceTaskPath) + "?" + util.ParseQuery(req)
 
 	resp = new(types.PullPieceTaskResponse)
 	e = api.get(url, resp)
@@ -96,8 +119,7 @@ func (api *supernodeAPI) PullPieceTask(ip string, req *types.PullPieceTaskReques
 func (api *supernodeAPI) ReportPiece(ip string, req *types.ReportPieceRequest) (
 	resp *types.BaseResponse, e error) {
 
-	url := fmt.Sprintf("%s://%s:%d%s?%s",
-		api.Scheme, ip, api.ServicePort, peerReportPiecePath, util.ParseQuery(req))
+	url := api.url(ip, peerReportPiecePath) + "?" + util.ParseQuery(req)
 
 	resp = new(types.BaseResponse)
 	e = api.get(url, resp)
@@ -108,14 +130,54 @@ func (api *supernodeAPI) ReportPiece(ip string, req *types.ReportPieceRequest) (
 func (api *supernodeAPI) ServiceDown(ip string, taskID string, cid string) (
 	resp *types.BaseResponse, e error) {
 
-	url := fmt.Sprintf("%s://%s:%d%s?taskId=%s&cid=%s",
-		api.Scheme, ip, api.ServicePort, peerServiceDownPath, taskID, cid)
+	url := fmt.Sprintf("%s?taskId=%s&cid=%s",
+		api.url(ip, peerServiceDownPath), taskID, cid)
 
 	resp = new(types.BaseResponse)
 	e = api.get(url, resp)
 	return
 }
 
+// ReportContribution reports the bytes served by each peer to supernode.
+func (api *supernodeAPI) ReportContribution(ip string, req *types.ReportContributionRequest) (
+	resp *types.BaseResponse, e error) {
+	var (
+		code int
+		body []byte
+	)
+	url := api.url(ip, peerContributionPath)
+	if code, body, e = api.HTTPClient.PostJSON(url, req, api.Timeout); e != nil {
+		return nil, e
+	}
+	if !util.HTTPStatusOk(code) {
+		return nil, fmt.Errorf("%d:%s", code, body)
+	}
+	resp = new(types.BaseResponse)
+	e = json.Unmarshal(body, resp)
+	return resp, e
+}
+
+// CheckHealth pings the health endpoint of the supernode, it returns nil if
+// the supernode is serving. It's much lighter than the registration, so that
+// the dead supernodes can be found out quickly.
+func (api *supernodeAPI) CheckHealth(ip string) error {
+	code, body, e := api.HTTPClient.Get(api.url(ip, healthCheckPath), config.HealthCheckTimeout)
+	if e != nil {
+		return e
+	}
+	if !util.HTTPStatusOk(code) {
+		return fmt.Errorf("%d:%s", code, body)
+	}
+	return nil
+}
+
+// url returns the url of the path on the supernode ip, which may be an ipv6
+// address and may carry the port overriding the ServicePort.
+func (api *supernodeAPI) url(ip string, path string) string {
+	host, port := util.SplitHostPort(ip, api.ServicePort)
+	return fmt.Sprintf("%s://%s%s", api.Scheme, util.JoinHostPort(host, port), path)
+}
+
 func (api *supernodeAPI) get(url string, resp interface{}) error {
 	var (
 		code int
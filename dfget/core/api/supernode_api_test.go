@@ -19,6 +19,7 @@ package api
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/dragonflyoss/Dragonfly/dfget/config"
 	"github.com/dragonflyoss/Dragonfly/dfget/types"
@@ -76,6 +77,33 @@ func (s *SupernodeAPITestSuite) TestSupernodeAPI_Register(c *check.C) {
 	c.Assert(r.Data.FileLength, check.Equals, res.Data.FileLength)
 }
 
+func (s *SupernodeAPITestSuite) TestSupernodeAPI_IPv6(c *check.C) {
+	var urls []string
+	s.mock.postJSON = func(url string, body interface{}, timeout time.Duration) (int, []byte, error) {
+		urls = append(urls, url)
+		return 200, []byte(`{"Code":200}`), nil
+	}
+	s.mock.get = func(url string, timeout time.Duration) (int, []byte, error) {
+		urls = append(urls, url)
+		return 200, []byte(`{"Code":200}`), nil
+	}
+
+	for _, ip := range []string{"fd00::2", "[fd00::2]", "[fd00::2]:8001", "127.0.0.1:8001"} {
+		s.api.Register(ip, createRegisterRequest())
+		s.api.ServiceDown(ip, "task", "cid")
+	}
+	c.Assert(urls, check.DeepEquals, []string{
+		"http://[fd00::2]:8002" + peerRegisterPath,
+		"http://[fd00::2]:8002" + peerServiceDownPath + "?taskId=task&cid=cid",
+		"http://[fd00::2]:8002" + peerRegisterPath,
+		"http://[fd00::2]:8002" + peerServiceDownPath + "?taskId=task&cid=cid",
+		"http://[fd00::2]:8001" + peerRegisterPath,
+		"http://[fd00::2]:8001" + peerServiceDownPath + "?taskId=task&cid=cid",
+		"http://127.0.0.1:8001" + peerRegisterPath,
+		"http://127.0.0.1:8001" + peerServiceDownPath + "?taskId=task&cid=cid",
+	})
+}
+
 func (s *SupernodeAPITestSuite) TestSupernodeAPI_PullPieceTask(c *check.C) {
 	ip := "127.0.0.1"
 
@@ -109,6 +137,36 @@ func (s *SupernodeAPITestSuite) TestSupernodeAPI_ServiceDown(c *check.C) {
 	c.Check(r.Code, check.Equals, 200)
 }
 
+func (s *SupernodeAPITestSuite) TestSupernodeAPI_CheckHealth(c *check.C) {
+	var urls []string
+	s.mock.get = func(url string, timeout time.Duration) (int, []byte, error) {
+		urls = append(urls, url)
+		return 200, []byte("OK"), nil
+	}
+	c.Check(s.api.CheckHealth("127.0.0.1"), check.IsNil)
+	c.Check(urls, check.DeepEquals, []string{"http://127.0.0.1:8002" + healthCheckPath})
+
+	s.mock.get = s.mock.createGetFunc(404, []byte("not found"), nil)
+	c.Check(s.api.CheckHealth("127.0.0.1"), check.ErrorMatches, "404:not found")
+
+	s.mock.get = s.mock.createGetFunc(0, nil, fmt.Errorf("connection refused"))
+	c.Check(s.api.CheckHealth("127.0.0.1"), check.ErrorMatches, "connection refused")
+}
+
+func (s *SupernodeAPITestSuite) TestSupernodeAPI_ReportContribution(c *check.C) {
+	ip := "127.0.0.1"
+
+	s.mock.postJSON = s.mock.createPostJSONFunc(500, []byte("error"), nil)
+	r, e := s.api.ReportContribution(ip, &types.ReportContributionRequest{})
+	c.Assert(r, check.IsNil)
+	c.Assert(e.Error(), check.Equals, "500:error")
+
+	s.mock.postJSON = s.mock.createPostJSONFunc(200, []byte(`{"Code":200}`), nil)
+	r, e = s.api.ReportContribution(ip, &types.ReportContributionRequest{})
+	c.Check(e, check.IsNil)
+	c.Check(r.Code, check.Equals, 200)
+}
+
 func (s *SupernodeAPITestSuite) TestSupernodeAPI_get(c *check.C) {
 	type testRes struct {
 		A int
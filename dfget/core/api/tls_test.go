@@ -0,0 +1,180 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+	"github.com/go-check/check"
+)
+
+type TLSTestSuite struct {
+	workHome string
+}
+
+func init() {
+	check.Suite(&TLSTestSuite{})
+}
+
+func (s *TLSTestSuite) SetUpSuite(c *check.C) {
+	s.workHome, _ = ioutil.TempDir("/tmp", "dfget-TLSTestSuite-")
+}
+
+func (s *TLSTestSuite) TearDownSuite(c *check.C) {
+	if s.workHome != "" {
+		os.RemoveAll(s.workHome)
+	}
+}
+
+func (s *TLSTestSuite) TestNewSupernodeAPIFromConfig(c *check.C) {
+	certFile, keyFile := s.createClientCert(c)
+	clientCert, _ := tls.LoadX509KeyPair(certFile, keyFile)
+	leaf, _ := x509.ParseCertificate(clientCert.Certificate[0])
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(leaf)
+
+	supernode := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, peerRegisterPath) {
+			w.Write([]byte(`{"code":200,"data":{"fileLength":32}}`))
+			return
+		}
+		w.Write([]byte(`{"code":602}`))
+	}))
+	supernode.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	supernode.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	supernode.StartTLS()
+	defer supernode.Close()
+	node := strings.TrimPrefix(supernode.URL, "https://")
+	caFile := filepath.Join(s.workHome, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: supernode.Certificate().Raw}), 0644)
+
+	var cases = []struct {
+		cfg      *config.Config
+		scheme   string
+		errMsg   string
+		register bool
+	}{
+		{cfg: &config.Config{}, scheme: "http"},
+		{cfg: &config.Config{SupernodeCACert: caFile, SupernodeCert: certFile, SupernodeKey: keyFile},
+			scheme: "https", register: true},
+		{cfg: &config.Config{SupernodeInsecureSkipVerify: true, SupernodeCert: certFile, SupernodeKey: keyFile},
+			scheme: "https", register: true},
+		// the supernode requires the client certificate
+		{cfg: &config.Config{SupernodeCACert: caFile}, scheme: "https"},
+		// the certificate of the supernode isn't trusted
+		{cfg: &config.Config{SupernodeCert: certFile, SupernodeKey: keyFile}, scheme: "https"},
+		{cfg: &config.Config{SupernodeCert: certFile}, errMsg: "client cert.*must be set together"},
+		{cfg: &config.Config{SupernodeCACert: keyFile}, errMsg: "no certificate in CA bundle.*"},
+	}
+	for idx, v := range cases {
+		comment := check.Commentf("case:%d", idx)
+		api, err := NewSupernodeAPIFromConfig(v.cfg)
+		if v.errMsg != "" {
+			c.Assert(err, check.ErrorMatches, v.errMsg, comment)
+			continue
+		}
+		c.Assert(err, check.IsNil, comment)
+		c.Assert(api.(*supernodeAPI).Scheme, check.Equals, v.scheme, comment)
+		if v.scheme == "http" {
+			continue
+		}
+
+		resp, err := api.Register(node, &types.RegisterRequest{})
+		if !v.register {
+			c.Assert(err, check.NotNil, comment)
+			continue
+		}
+		c.Assert(err, check.IsNil, comment)
+		c.Assert(resp.Data.FileLength, check.Equals, int64(32), comment)
+		// the pulls after the registration reuse the secured client.
+		res, err := api.PullPieceTask(node, &types.PullPieceTaskRequest{})
+		c.Assert(err, check.IsNil, comment)
+		c.Assert(res.Code, check.Equals, config.TaskCodeWait, comment)
+	}
+}
+
+func (s *TLSTestSuite) TestNewSupernodeAPIFromConfig_UserAgent(c *check.C) {
+	agents := make(chan string, 2)
+	supernode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.UserAgent()
+		if strings.HasPrefix(r.URL.Path, peerRegisterPath) {
+			w.Write([]byte(`{"code":200,"data":{"fileLength":32}}`))
+		}
+	}))
+	defer supernode.Close()
+	node := strings.TrimPrefix(supernode.URL, "http://")
+
+	for _, v := range []struct {
+		userAgent string
+		expected  string
+	}{
+		{expected: config.DefaultUserAgent},
+		{userAgent: "custom/1.0", expected: "custom/1.0"},
+	} {
+		api, err := NewSupernodeAPIFromConfig(&config.Config{UserAgent: v.userAgent})
+		c.Assert(err, check.IsNil)
+		_, err = api.Register(node, &types.RegisterRequest{})
+		c.Assert(err, check.IsNil)
+		c.Assert(<-agents, check.Equals, v.expected)
+		c.Assert(api.CheckHealth(node), check.IsNil)
+		c.Assert(<-agents, check.Equals, v.expected)
+	}
+}
+
+// createClientCert creates a self-signed client certificate and its key.
+func (s *TLSTestSuite) createClientCert(c *check.C) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dfget"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, check.IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, check.IsNil)
+
+	certFile = filepath.Join(s.workHome, "client.pem")
+	keyFile = filepath.Join(s.workHome, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
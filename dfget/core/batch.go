@@ -0,0 +1,88 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/api"
+	"github.com/dragonflyoss/Dragonfly/dfget/errors"
+)
+
+// BatchItem is a file downloaded by StartBatch.
+type BatchItem struct {
+	URL    string
+	Output string
+	Md5    string
+}
+
+// BatchResult is the result of downloading the Item, Err is nil if it
+// succeeds.
+type BatchResult struct {
+	Item BatchItem
+	Err  *errors.DFGetError
+}
+
+// StartBatch downloads the items with the settings of the cfg, at most
+// parallelism of them are downloaded at the same time and they're
+// downloaded one by one if it isn't positive. The items share one
+// SupernodeAPI, and every item is downloaded by a copy of the cfg with its
+// own sign so that the failure of one item doesn't abort the others.
+// The results are in the order of the items.
+func StartBatch(cfg *config.Config, items []BatchItem, parallelism int) []BatchResult {
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	var (
+		results = make([]BatchResult, len(items))
+		slots   = make(chan struct{}, parallelism)
+		wg      sync.WaitGroup
+	)
+	supernodeAPI, err := api.NewSupernodeAPIFromConfig(cfg)
+	if err != nil {
+		for i, item := range items {
+			results[i] = BatchResult{Item: item, Err: errors.New(1100, err.Error())}
+		}
+		return results
+	}
+	for i, item := range items {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, item BatchItem) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			results[i] = BatchResult{Item: item, Err: start(batchConfig(cfg, item, i), supernodeAPI)}
+		}(i, item)
+	}
+	wg.Wait()
+	return results
+}
+
+// batchConfig copies the cfg to download the idx-th item of the batch.
+func batchConfig(cfg *config.Config, item BatchItem, idx int) *config.Config {
+	c := *cfg
+	c.URL, c.Output, c.Md5 = item.URL, item.Output, item.Md5
+	c.StartTime = time.Now()
+	c.Sign = fmt.Sprintf("%s-%d", cfg.Sign, idx)
+	c.BackSourceReason = 0
+	return &c
+}
@@ -24,7 +24,6 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
@@ -46,11 +45,19 @@ func init() {
 
 // Start function creates a new task and starts it to download file.
 func Start(cfg *config.Config) *errors.DFGetError {
+	supernodeAPI, err := api.NewSupernodeAPIFromConfig(cfg)
+	if err != nil {
+		return errors.New(1100, err.Error())
+	}
+	return start(cfg, supernodeAPI)
+}
+
+// start downloads the file of the cfg by the supernodeAPI.
+func start(cfg *config.Config, supernodeAPI api.SupernodeAPI) *errors.DFGetError {
 	var (
-		supernodeAPI = api.NewSupernodeAPI()
-		register     = regist.NewSupernodeRegister(cfg, supernodeAPI)
-		err          error
-		result       *regist.RegisterResult
+		register = regist.NewSupernodeRegister(cfg, supernodeAPI)
+		err      error
+		result   *regist.RegisterResult
 	)
 
 	util.Printer.Println(fmt.Sprintf("--%s--  %s",
@@ -60,11 +67,25 @@ func Start(cfg *config.Config) *errors.DFGetError {
 		return errors.New(1100, err.Error())
 	}
 
+	if downloader.FromLocalCache(cfg) {
+		os.Remove(cfg.RV.TempTarget)
+		util.Printer.Printf("reuse the file of local cache dir:%s", cfg.LocalCacheDir)
+		return nil
+	}
+
 	if result, err = registerToSuperNode(cfg, register); err != nil {
 		return errors.New(1200, err.Error())
 	}
 
 	if err = downloadFile(cfg, supernodeAPI, register, result); err != nil {
+		if e, ok := err.(*errors.DFGetError); ok &&
+			(e.Code == config.CodeUntrusted || e.Code == config.CodePartial ||
+				e.Code == config.CodeNoInodes) {
+			return e
+		}
+		if e, ok := err.(*downloader.RangeExhaustedError); ok {
+			return errors.New(config.CodeRangeExhausted, e.Error())
+		}
 		return errors.New(1300, err.Error())
 	}
 
@@ -85,7 +106,10 @@ func prepare(cfg *config.Config) (err error) {
 	rv := &cfg.RV
 
 	rv.RealTarget = cfg.Output
+	rv.ResultPath = rv.RealTarget
 	rv.TargetDir = path.Dir(rv.RealTarget)
+	rv.Assembly, err = downloader.SelectAssembly(cfg, rv.RealTarget)
+	panicIf(err)
 	panicIf(util.CreateDirectory(rv.TargetDir))
 	cfg.RV.TempTarget, err = createTempTargetFile(rv.TargetDir, cfg.Sign)
 	panicIf(err)
@@ -96,8 +120,19 @@ func prepare(cfg *config.Config) (err error) {
 	rv.DataDir = cfg.RV.SystemDataDir
 
 	cfg.Node = adjustSupernodeList(cfg.Node)
+	if !util.IsEmptyStr(cfg.ReplayManifest) {
+		m, err := downloader.LoadManifest(cfg.ReplayManifest)
+		panicIf(err)
+		cfg.Node = m.PreferNodes(cfg.Node)
+	}
 	rv.LocalIP = checkConnectSupernode(cfg.Node, cfg.ClientLogger)
-	rv.Cid = getCid(rv.LocalIP, cfg.Sign)
+	rv.PeerIP = rv.LocalIP
+	if !util.IsEmptyStr(cfg.PeerInterface) {
+		rv.PeerIP, err = util.ResolveLocalIP(cfg.PeerInterface)
+		panicIf(err)
+	}
+	// the cid names the peer by the ip it serves the pieces on.
+	rv.Cid = getCid(rv.PeerIP, cfg.Sign)
 	rv.TaskFileName = getTaskFileName(rv.RealTarget, cfg.Sign)
 	rv.TaskURL = getTaskURL(cfg.URL, cfg.Filter)
 	cfg.ClientLogger.Info("runtimeVariable: " + cfg.RV.String())
@@ -122,7 +157,7 @@ func registerToSuperNode(cfg *config.Config, register regist.SupernodeRegister)
 				"reason:%d(%v)", cfg.BackSourceReason, r)
 		}
 	}()
-	if cfg.Pattern == config.PatternSource {
+	if cfg.Pattern == config.PatternSource || cfg.BackSourceOnly {
 		cfg.BackSourceReason = config.BackSourceReasonUserSpecified
 		panic("user specified")
 	}
@@ -132,7 +167,7 @@ func registerToSuperNode(cfg *config.Config, register regist.SupernodeRegister)
 		panic("supernode empty")
 	}
 
-	if cfg.Pattern == config.PatternP2P {
+	if cfg.Pattern == config.PatternP2P && !cfg.DryRun {
 		if e := launchPeerServer(cfg); e != nil {
 			cfg.ClientLogger.Warnf("start peer server error:%v, change to CDN pattern", e)
 		}
@@ -153,22 +188,22 @@ func registerToSuperNode(cfg *config.Config, register regist.SupernodeRegister)
 
 func downloadFile(cfg *config.Config, supernodeAPI api.SupernodeAPI,
 	register regist.SupernodeRegister, result *regist.RegisterResult) error {
-	var getter downloader.Downloader
-	if cfg.BackSourceReason > 0 {
-		getter = downloader.NewBackDownloader(cfg, result)
-	} else {
+	getter, err := downloader.New(cfg, supernodeAPI, register, result)
+	if err != nil {
+		return err
+	}
+	if _, ok := getter.(*downloader.P2PDownloader); ok {
 		util.Printer.Printf("start download by dragonfly")
-		getter = downloader.NewP2PDownloader(cfg, supernodeAPI, register, result)
 	}
 
 	timeout := calculateTimeout(cfg.RV.FileLength, cfg.Timeout)
-	err := downloader.DoDownloadTimeout(getter, timeout)
+	err = downloader.DoDownloadTimeout(getter, timeout)
 	success := "SUCCESS"
 	if err != nil {
 		cfg.ClientLogger.Error(err)
 		success = "FAIL"
-	} else if cfg.RV.FileLength < 0 && util.IsRegularFile(cfg.RV.RealTarget) {
-		if info, err := os.Stat(cfg.RV.RealTarget); err == nil {
+	} else if cfg.RV.FileLength < 0 && util.IsRegularFile(cfg.RV.ResultPath) {
+		if info, err := os.Stat(cfg.RV.ResultPath); err == nil {
 			cfg.RV.FileLength = info.Size()
 		}
 	}
@@ -186,7 +221,7 @@ func reportFinishedTask(cfg *config.Config, getter downloader.Downloader) {
 		return
 	}
 	if getter, ok := getter.(*downloader.P2PDownloader); ok {
-		uploader.FinishTask(cfg.RV.LocalIP, cfg.RV.PeerPort,
+		uploader.FinishTask(cfg.RV.PeerIP, cfg.RV.PeerPort,
 			cfg.RV.TaskFileName, cfg.RV.Cid,
 			getter.GetTaskID(), getter.GetNode())
 	}
@@ -259,16 +294,10 @@ func adjustSupernodeList(nodes []string) []string {
 }
 
 func checkConnectSupernode(nodes []string, clientLogger *logrus.Logger) (localIP string) {
-	var (
-		e    error
-		port = 8002
-	)
+	var e error
 	for _, n := range nodes {
-		nodeFields := strings.Split(n, ":")
-		if len(nodeFields) == 2 {
-			port, _ = strconv.Atoi(nodeFields[1])
-		}
-		if localIP, e = util.CheckConnect(nodeFields[0], port, 1000); e == nil {
+		host, port := util.SplitHostPort(n, 8002)
+		if localIP, e = util.CheckConnect(host, port, 1000); e == nil {
 			return localIP
 		}
 		if clientLogger != nil {
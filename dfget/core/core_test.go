@@ -18,11 +18,14 @@ package core
 
 import (
 	"bytes"
+	"crypto/md5"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"strings"
@@ -69,6 +72,20 @@ func (s *CoreTestSuite) TestPrepare(c *check.C) {
 	fmt.Printf("%s\nerror:%v", buf.String(), err)
 }
 
+func (s *CoreTestSuite) TestPrepare_PeerInterface(c *check.C) {
+	cfg := s.createConfig(&bytes.Buffer{})
+	cfg.Output = path.Join(s.workHome, "peerinterface.output")
+	cfg.PeerInterface = "127.0.0.1"
+	c.Assert(prepare(cfg), check.IsNil)
+	c.Assert(cfg.RV.PeerIP, check.Equals, "127.0.0.1")
+	c.Assert(cfg.RV.Cid, check.Equals, "127.0.0.1-"+cfg.Sign)
+
+	cfg = s.createConfig(&bytes.Buffer{})
+	cfg.Output = path.Join(s.workHome, "peerinterface.output")
+	cfg.PeerInterface = "192.0.2.1"
+	c.Assert(prepare(cfg), check.ErrorMatches, ".*does not belong to any local interface")
+}
+
 func (s *CoreTestSuite) TestRegisterToSupernode(c *check.C) {
 	cfg := s.createConfig(&bytes.Buffer{})
 	m := new(MockSupernodeAPI)
@@ -91,6 +108,10 @@ func (s *CoreTestSuite) TestRegisterToSupernode(c *check.C) {
 	f(config.BackSourceReasonUserSpecified, true, nil)
 
 	cfg.Pattern = config.PatternP2P
+	cfg.Node = []string{"x"}
+	cfg.BackSourceOnly = true
+	f(config.BackSourceReasonUserSpecified, true, nil)
+	cfg.BackSourceOnly = false
 
 	cfg.Node = []string{"x"}
 	cfg.URL = "http://x.com"
@@ -108,6 +129,115 @@ func (s *CoreTestSuite) TestRegisterToSupernode(c *check.C) {
 		FileLength: 100, PieceSize: 10})
 }
 
+func (s *CoreTestSuite) TestStartBatch(c *check.C) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer source.Close()
+
+	cfg := s.createConfig(nil)
+	// no supernode, the items are downloaded from the source.
+	cfg.Node = nil
+	var items []BatchItem
+	for _, name := range []string{"a", "unreachable", "b"} {
+		items = append(items, BatchItem{
+			URL:    source.URL + "/" + name,
+			Output: path.Join(s.workHome, "batch", name),
+		})
+	}
+	items[1].URL = "http://127.0.0.1:1/unreachable"
+	results := StartBatch(cfg, items, 2)
+	c.Assert(len(results), check.Equals, 3)
+	for i, r := range results {
+		c.Assert(r.Item, check.Equals, items[i])
+	}
+	c.Assert(results[0].Err, check.IsNil)
+	c.Assert(results[1].Err, check.NotNil)
+	c.Assert(results[2].Err, check.IsNil)
+	for _, name := range []string{"a", "b"} {
+		content, _ := ioutil.ReadFile(path.Join(s.workHome, "batch", name))
+		c.Assert(string(content), check.Equals, "/"+name)
+	}
+	c.Assert(cfg.URL, check.Equals, "")
+}
+
+func (s *CoreTestSuite) TestStart_LocalCache(c *check.C) {
+	content := []byte("cached")
+	md5Sum := fmt.Sprintf("%x", md5.Sum(content))
+	cfg := s.createConfig(nil)
+	cfg.Node = nil
+	// the source is unreachable, the file is placed from the cache only.
+	cfg.URL = "http://127.0.0.1:1/cached"
+	cfg.Md5 = md5Sum
+	cfg.LocalCacheDir = path.Join(s.workHome, "localcache", "cache")
+	cfg.Output = path.Join(s.workHome, "localcache", "output", "cached")
+	c.Assert(os.MkdirAll(path.Join(cfg.LocalCacheDir, "md5"), 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(cfg.LocalCacheDir, "md5", md5Sum), content, 0644), check.IsNil)
+
+	c.Assert(start(cfg, &MockSupernodeAPI{}), check.IsNil)
+	placed, _ := ioutil.ReadFile(cfg.Output)
+	c.Assert(string(placed), check.Equals, string(content))
+	// the temp target isn't left in the output dir
+	files, _ := ioutil.ReadDir(path.Dir(cfg.Output))
+	c.Assert(len(files), check.Equals, 1)
+}
+
+func (s *CoreTestSuite) TestStartList(c *check.C) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dir/list":
+			w.Write([]byte("# files\na\n\nsub/b\nc 00000000000000000000000000000000\n"))
+		default:
+			w.Write([]byte(r.URL.Path))
+		}
+	}))
+	defer source.Close()
+
+	cfg := s.createConfig(nil)
+	// no supernode, the files are downloaded from the source.
+	cfg.Node = nil
+	cfg.ListURL = source.URL + "/dir/list"
+	cfg.Output = path.Join(s.workHome, "list")
+	results, err := StartList(cfg)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(results), check.Equals, 3)
+	c.Assert(results[0].Item.Output, check.Equals, path.Join(cfg.Output, "a"))
+	c.Assert(results[0].Err, check.IsNil)
+	c.Assert(results[1].Item.Output, check.Equals, path.Join(cfg.Output, "sub", "b"))
+	c.Assert(results[1].Err, check.IsNil)
+	// the md5 of c doesn't match
+	c.Assert(results[2].Item.URL, check.Equals, source.URL+"/dir/c")
+	c.Assert(results[2].Err, check.NotNil)
+	for _, name := range []string{"a", "sub/b"} {
+		content, _ := ioutil.ReadFile(path.Join(cfg.Output, name))
+		c.Assert(string(content), check.Equals, "/dir/"+name)
+	}
+
+	cfg.ListURL = "http://127.0.0.1:1/list"
+	_, err = StartList(cfg)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *CoreTestSuite) TestCheckHealth(c *check.C) {
+	supernode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer supernode.Close()
+
+	cfg := s.createConfig(nil)
+	live := supernode.Listener.Addr().String()
+	cfg.Node = []string{"127.0.0.1:1", live}
+	dead, err := CheckHealth(cfg)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(dead), check.Equals, 1)
+	c.Assert(dead["127.0.0.1:1"], check.NotNil)
+
+	cfg.Node = []string{"127.0.0.1:1"}
+	_, err = CheckHealth(cfg)
+	c.Assert(err, check.NotNil)
+	c.Assert(err.Code, check.Equals, config.CodeUnhealthy)
+}
+
 func (s *CoreTestSuite) TestGetTaskURL(c *check.C) {
 	var cases = []struct {
 		u string
@@ -156,6 +286,13 @@ func (s *CoreTestSuite) TestCheckConnectSupernode(c *check.C) {
 	ip := checkConnectSupernode(nodes, cfg.ClientLogger)
 	c.Assert(ip, check.Equals, "127.0.0.1")
 
+	// test: the ipv6 supernode
+	if ln6, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		defer ln6.Close()
+		ip = checkConnectSupernode([]string{ln6.Addr().String()}, cfg.ClientLogger)
+		c.Assert(ip, check.Equals, "::1")
+	}
+
 	buf.Reset()
 	ip = checkConnectSupernode([]string{"127.0.0.2"}, cfg.ClientLogger)
 	c.Assert(strings.Index(buf.String(), "connect") > 0, check.Equals, true)
@@ -0,0 +1,279 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+// SelectAssembly returns the strategy assembling the downloaded pieces into
+// the target by Cfg.Assembly and the type of the target: the targets which
+// can't be seeked, such as the FIFOs, the devices and the Cfg.OutputWriter,
+// are assembled sequentially, and the others randomly.
+func SelectAssembly(cfg *config.Config, target string) (string, error) {
+	streaming := cfg.OutputWriter != nil || isStreamingTarget(target)
+	strategy := cfg.Assembly
+	switch strategy {
+	case "", config.AssemblyAuto:
+		strategy = config.AssemblyRandom
+		if streaming {
+			strategy = config.AssemblySequential
+		}
+	case config.AssemblyRandom:
+		if streaming {
+			return "", fmt.Errorf("target:%s isn't seekable to be assembled randomly", outputName(cfg, target))
+		}
+	case config.AssemblySequential:
+	default:
+		return "", fmt.Errorf("unknown assembly strategy:%s", strategy)
+	}
+	if strategy == config.AssemblySequential && cfg.NoMove {
+		return "", fmt.Errorf("the sequential assembly of target:%s conflicts with nomove", outputName(cfg, target))
+	}
+	return strategy, nil
+}
+
+// isStreamingTarget returns whether the target exists but isn't a regular
+// file or a directory, which can be written sequentially only.
+func isStreamingTarget(target string) bool {
+	info, err := os.Stat(target)
+	return err == nil && info.Mode()&(os.ModeNamedPipe|os.ModeDevice|os.ModeSocket) != 0
+}
+
+// deliver puts the downloaded file src into the target dst by the assembly
+// strategy after checking its digest if expectMd5 isn't empty: the file is
+// moved if it's assembled randomly, or copied into the dst in order
+// otherwise. The pieces are streamed into the dst already if streamed is
+// true, and then it only checks the md5.
+func deliver(cfg *config.Config, src string, dst string, expectMd5 string, streamed bool) error {
+	if cfg.RV.Assembly != config.AssemblySequential {
+		return moveFile(cfg, src, dst, expectMd5)
+	}
+	if expectMd5 != "" {
+		if realMd5 := fileDigest(src, expectMd5); realMd5 != expectMd5 {
+			return &md5NotMatchError{real: realMd5, expect: expectMd5}
+		}
+	}
+	if streamed {
+		return nil
+	}
+	return streamFile(cfg, src, dst)
+}
+
+// assembledFile returns the regular file whose content is the target's
+// after deliver, which is the src if the target is assembled sequentially
+// since it can't be read back.
+func assembledFile(cfg *config.Config, src string, dst string) string {
+	if cfg.RV.Assembly == config.AssemblySequential {
+		return src
+	}
+	return dst
+}
+
+// streamFile writes the content of src into dst in order without seeking
+// or truncating the dst unless it's a regular file.
+func streamFile(cfg *config.Config, src string, dst string) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	d, err := openStreamingTarget(cfg, dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(d, s); err != nil {
+		d.Close()
+		return fmt.Errorf("stream %s to %s error:%v", src, dst, err)
+	}
+	return d.Close()
+}
+
+// openStreamingTarget opens the dst to be written in order, it's the
+// Cfg.OutputWriter instead if it's set.
+func openStreamingTarget(cfg *config.Config, dst string) (io.WriteCloser, error) {
+	if cfg.OutputWriter != nil {
+		return nopWriteCloser{cfg.OutputWriter}, nil
+	}
+	flag := os.O_WRONLY | os.O_CREATE
+	if !isStreamingTarget(dst) {
+		flag |= os.O_TRUNC
+	}
+	return util.OpenFile(dst, flag, 0755)
+}
+
+// assembler writes the pieces into the target of the TargetWriter.
+type assembler interface {
+	write(piece *Piece) error
+	// seed writes the pieces written into the service file already, which
+	// maps their offsets to their lengths.
+	seed(written map[int64]int64) error
+	// reset discards the written pieces since the download restarts.
+	reset() error
+	close() error
+}
+
+// newAssembler creates the assembler of Cfg.RV.Assembly writing the target
+// dst, the sequential one reads the written pieces from the service file
+// src in order.
+func newAssembler(cfg *config.Config, dst string, src string) (assembler, error) {
+	if cfg.RV.Assembly != config.AssemblySequential {
+		f, err := util.OpenFile(dst, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0755)
+		if err != nil {
+			return nil, err
+		}
+		return &randomAssembler{file: f, src: src, syncQueue: startSyncWriter(nil)}, nil
+	}
+	s, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	d, err := openStreamingTarget(cfg, dst)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &sequentialAssembler{dst: d, src: s, pending: make(map[int64]int64)}, nil
+}
+
+// randomAssembler writes the pieces at their offsets of a seekable file.
+type randomAssembler struct {
+	file       *os.File
+	src        string
+	pieceIndex int
+	syncQueue  util.Queue
+}
+
+func (a *randomAssembler) write(piece *Piece) error {
+	a.pieceIndex++
+	a.file.Seek(pieceOffset(piece), 0)
+	buf := bufio.NewWriterSize(a.file, 4*1024*1024)
+	_, err := io.Copy(buf, piece.RawContent())
+	buf.Flush()
+
+	if a.syncQueue != nil && a.pieceIndex%4 == 0 {
+		a.syncQueue.Put(a.file.Fd())
+	}
+	return err
+}
+
+func (a *randomAssembler) seed(written map[int64]int64) error {
+	s, err := os.Open(a.src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	for offset, n := range written {
+		a.file.Seek(offset, 0)
+		if _, err := io.Copy(a.file, io.NewSectionReader(s, offset, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *randomAssembler) reset() error {
+	return a.file.Truncate(0)
+}
+
+func (a *randomAssembler) close() error {
+	a.file.Sync()
+	return a.file.Close()
+}
+
+// sequentialAssembler streams the contiguous prefix of the pieces written
+// into the service file to the target, so the pieces out of order are not
+// held in memory. The streamed content can't be rewound.
+type sequentialAssembler struct {
+	dst io.WriteCloser
+	src *os.File
+
+	// pending maps the offsets of the pieces not streamed yet to their
+	// lengths, next is the offset to stream from.
+	pending map[int64]int64
+	next    int64
+}
+
+func (a *sequentialAssembler) write(piece *Piece) error {
+	a.pending[pieceOffset(piece)] = int64(piece.RawContent().Len())
+	return a.stream()
+}
+
+func (a *sequentialAssembler) seed(written map[int64]int64) error {
+	for offset, n := range written {
+		a.pending[offset] = n
+	}
+	return a.stream()
+}
+
+// stream writes the pending pieces contiguous from next to the target.
+func (a *sequentialAssembler) stream() error {
+	for {
+		n, ok := a.pending[a.next]
+		if !ok {
+			return nil
+		}
+		if _, err := io.Copy(a.dst, io.NewSectionReader(a.src, a.next, n)); err != nil {
+			return err
+		}
+		delete(a.pending, a.next)
+		a.next += n
+	}
+}
+
+func (a *sequentialAssembler) reset() error {
+	a.pending = make(map[int64]int64)
+	if a.next > 0 {
+		return fmt.Errorf("%d bytes have been streamed to the target", a.next)
+	}
+	return nil
+}
+
+func (a *sequentialAssembler) close() error {
+	a.src.Close()
+	if err := a.dst.Close(); err != nil {
+		return err
+	}
+	if len(a.pending) > 0 {
+		return fmt.Errorf("%d pieces after offset:%d are not streamed", len(a.pending), a.next)
+	}
+	return nil
+}
+
+// nopWriteCloser doesn't close the Cfg.OutputWriter which is owned by the
+// caller.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// outputName describes the target in the messages.
+func outputName(cfg *config.Config, target string) string {
+	if cfg.OutputWriter != nil {
+		return "output writer"
+	}
+	return target
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/go-check/check"
+)
+
+type AssemblyTestSuite struct {
+	workHome string
+}
+
+func init() {
+	check.Suite(&AssemblyTestSuite{})
+}
+
+func (s *AssemblyTestSuite) SetUpSuite(c *check.C) {
+	s.workHome, _ = ioutil.TempDir("/tmp", "dfget-AssemblyTestSuite-")
+}
+
+func (s *AssemblyTestSuite) TearDownSuite(c *check.C) {
+	os.RemoveAll(s.workHome)
+}
+
+func (s *AssemblyTestSuite) TestSelectAssembly(c *check.C) {
+	regular := path.Join(s.workHome, "regular")
+	ioutil.WriteFile(regular, []byte("a"), 0644)
+	fifo := path.Join(s.workHome, "fifo")
+	c.Assert(syscall.Mkfifo(fifo, 0644), check.IsNil)
+
+	var cases = []struct {
+		strategy string
+		target   string
+		noMove   bool
+		expected string
+		ok       bool
+	}{
+		{strategy: "", target: regular, expected: config.AssemblyRandom, ok: true},
+		{strategy: config.AssemblyAuto, target: path.Join(s.workHome, "missing"),
+			expected: config.AssemblyRandom, ok: true},
+		{strategy: config.AssemblyAuto, target: fifo, expected: config.AssemblySequential, ok: true},
+		{strategy: config.AssemblyAuto, target: "/dev/null", expected: config.AssemblySequential, ok: true},
+		{strategy: config.AssemblySequential, target: regular, expected: config.AssemblySequential, ok: true},
+		{strategy: config.AssemblyRandom, target: fifo, ok: false},
+		{strategy: config.AssemblyAuto, target: fifo, noMove: true, ok: false},
+		{strategy: "multipart", target: regular, ok: false},
+	}
+	for idx, v := range cases {
+		cfg := helper.CreateConfig(nil, s.workHome)
+		cfg.Assembly, cfg.NoMove = v.strategy, v.noMove
+		strategy, err := SelectAssembly(cfg, v.target)
+		c.Assert(err == nil, check.Equals, v.ok, check.Commentf("case:%d err:%v", idx, err))
+		c.Assert(strategy, check.Equals, v.expected, check.Commentf("case:%d", idx))
+	}
+
+	// test: the output writer is assembled sequentially
+	cfg := helper.CreateConfig(nil, s.workHome)
+	cfg.OutputWriter = ioutil.Discard
+	strategy, err := SelectAssembly(cfg, regular)
+	c.Assert(err, check.IsNil)
+	c.Assert(strategy, check.Equals, config.AssemblySequential)
+	cfg.Assembly = config.AssemblyRandom
+	_, err = SelectAssembly(cfg, regular)
+	c.Assert(err, check.ErrorMatches, "target:output writer isn't seekable.*")
+}
+
+func (s *AssemblyTestSuite) TestSequentialAssembler(c *check.C) {
+	cfg := helper.CreateConfig(nil, s.workHome)
+	cfg.RV.Assembly = config.AssemblySequential
+	src := path.Join(s.workHome, "sequential.service")
+	dst := path.Join(s.workHome, "sequential.fifo")
+	c.Assert(ioutil.WriteFile(src, []byte("aaaaabbbbbcc"), 0644), check.IsNil)
+	c.Assert(syscall.Mkfifo(dst, 0644), check.IsNil)
+
+	received := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadFile(dst)
+		received <- string(b)
+	}()
+	a, err := newAssembler(cfg, dst, src)
+	c.Assert(err, check.IsNil)
+	contents := []string{"aaaaa", "bbbbb", "cc"}
+	for _, num := range []int{1, 2, 0} {
+		c.Assert(a.write(createTestPiece(num, 10, contents[num])), check.IsNil)
+	}
+	c.Assert(a.reset(), check.NotNil)
+	c.Assert(a.close(), check.IsNil)
+	c.Assert(<-received, check.Equals, "aaaaabbbbbcc")
+
+	// test: the target isn't complete
+	a, err = newAssembler(cfg, path.Join(s.workHome, "sequential.file"), src)
+	c.Assert(err, check.IsNil)
+	c.Assert(a.write(createTestPiece(1, 10, "bbbbb")), check.IsNil)
+	c.Assert(a.reset(), check.IsNil)
+	c.Assert(a.write(createTestPiece(1, 10, "bbbbb")), check.IsNil)
+	c.Assert(a.close(), check.ErrorMatches, ".*after offset:0 are not streamed")
+}
+
+func (s *AssemblyTestSuite) TestDeliver_Sequential(c *check.C) {
+	cfg := helper.CreateConfig(nil, s.workHome)
+	cfg.RV.Assembly = config.AssemblySequential
+	src := path.Join(s.workHome, "deliver.src")
+	dst := path.Join(s.workHome, "deliver.fifo")
+	c.Assert(ioutil.WriteFile(src, []byte("content"), 0644), check.IsNil)
+	c.Assert(syscall.Mkfifo(dst, 0644), check.IsNil)
+
+	received := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadFile(dst)
+		received <- string(b)
+	}()
+	c.Assert(deliver(cfg, src, dst, "", false), check.IsNil)
+	c.Assert(<-received, check.Equals, "content")
+	c.Assert(assembledFile(cfg, src, dst), check.Equals, src)
+
+	info, err := os.Stat(dst)
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Mode()&os.ModeNamedPipe != 0, check.Equals, true)
+	c.Assert(deliver(cfg, src, dst, "mismatched", true), check.FitsTypeOf, &md5NotMatchError{})
+}
@@ -32,13 +32,18 @@ import (
 type BackDownloader struct {
 	Cfg     *config.Config
 	URL     string
+	Mirrors []string
 	Target  string
 	Md5     string
+	Digest  string
 	TaskID  string
 	Node    string
 	Total   int64
 	Success bool
 
+	// digest is the digest of the file computed while downloading.
+	digest string
+
 	tempFileName string
 	cleaned      bool
 }
@@ -50,13 +55,16 @@ func (bd *BackDownloader) Run() error {
 		err  error
 		f    *os.File
 	)
-	log := bd.Cfg.ClientLogger
+	log := bd.Cfg.Log()
 
 	if bd.Cfg.Notbs || bd.Cfg.BackSourceReason == config.BackSourceReasonNoSpace {
 		bd.Cfg.BackSourceReason += config.ForceNotBackSourceAddition
 		err = fmt.Errorf("download fail and not back source: %d", bd.Cfg.BackSourceReason)
 		return err
 	}
+	if err = checkOriginTrusted(bd.Cfg); err != nil {
+		return err
+	}
 
 	util.Printer.Printf("download from source")
 	log.Infof("start download %s from the source station", path.Base(bd.Target))
@@ -70,27 +78,91 @@ func (bd *BackDownloader) Run() error {
 	bd.tempFileName = f.Name()
 	defer f.Close()
 
-	if resp, err = httpGetWithHeaders(bd.URL, convertHeaders(bd.Cfg.Header)); err != nil {
+	if resp, err = bd.get(); err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if !util.IsEmptyStr(bd.Cfg.RequestRange) && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("range:%s isn't supported by the source, status:%d",
+			bd.Cfg.RequestRange, resp.StatusCode)
+	}
 
+	// the file is verified by the Digest instead of the Md5 if it's set.
+	// the range isn't verified by the digest of the whole file.
+	expect, algorithm := bd.Md5, ""
+	if !util.IsEmptyStr(bd.Digest) {
+		expect = bd.Digest
+	}
+	if !util.IsEmptyStr(bd.Cfg.RequestRange) {
+		expect = ""
+	}
+	if expect != "" || bd.Cfg.ReadBackVerify {
+		algorithm, _ = util.ParseDigest(expect)
+	}
+	var body io.ReadCloser = resp.Body
+	if bd.Cfg.BackSourceDecompress && util.IsEmptyStr(bd.Cfg.RequestRange) {
+		if body, err = decodeSourceBody(resp); err != nil {
+			return err
+		}
+		defer body.Close()
+	}
 	buf := make([]byte, 512*1024)
-	reader := NewLimitReader(resp.Body, bd.Cfg.LocalLimit, bd.Md5 != "")
+	reader := NewDigestLimitReader(body, bd.Cfg.LocalLimit, algorithm)
+	defer startHeartbeat(bd.Cfg, reader.Count)()
 	if bd.Total, err = io.CopyBuffer(f, reader, buf); err != nil {
 		return err
 	}
 
-	realMd5 := reader.Md5()
-	if bd.Md5 == "" || bd.Md5 == realMd5 {
-		err = moveFile(bd.tempFileName, bd.Target, "", bd.Cfg.ClientLogger)
+	realMd5 := reader.Digest()
+	if expect == "" || expect == realMd5 {
+		err = deliver(bd.Cfg, bd.tempFileName, bd.Target, "", false)
+		assembled := assembledFile(bd.Cfg, bd.tempFileName, bd.Target)
+		if err == nil {
+			err = linkTargets(bd.Cfg, assembled)
+		}
+		if err == nil && bd.Cfg.ReadBackVerify {
+			err = verifyTargets(bd.Cfg, append([]string{assembled}, bd.Cfg.ExtraTargets...), realMd5)
+		}
+		if err == nil {
+			if e := writeMetadata(bd.Cfg, bd.Target, resp.Header); e != nil {
+				log.Warnf("store metadata of %s error:%v", bd.Target, e)
+			}
+		}
 	} else {
-		err = fmt.Errorf("md5 not match, expected:%s real:%s", bd.Md5, realMd5)
+		err = fmt.Errorf("digest not match, expected:%s real:%s", expect, realMd5)
 	}
 	bd.Success = err == nil
+	bd.digest = realMd5
 	return err
 }
 
+// get requests the file or the Cfg.RequestRange of it from the fastest of
+// the URL and the Mirrors, and falls back to the others if it fails.
+func (bd *BackDownloader) get() (resp *http.Response, err error) {
+	headers := sourceHeaders(bd.Cfg)
+	if !util.IsEmptyStr(bd.Cfg.RequestRange) {
+		headers["Range"] = "bytes=" + bd.Cfg.RequestRange
+	} else if bd.Cfg.BackSourceDecompress {
+		headers = acceptEncoding(headers)
+	}
+	origins := rankOrigins(bd.Cfg, append([]string{bd.URL}, bd.Mirrors...))
+	for i, origin := range origins {
+		resp, err = httpGetWithClient(sourceHTTPClient(bd.Cfg), origin, headers)
+		if i == len(origins)-1 {
+			break
+		}
+		if err == nil && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent) {
+			break
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("unexpected status:%d", resp.StatusCode)
+		}
+		bd.Cfg.Log().Warnf("download from origin:%s error:%v, try the next one", origin, err)
+	}
+	return resp, err
+}
+
 // Cleanup clean all temporary resources generated by executing Run.
 func (bd *BackDownloader) Cleanup() {
 	if bd.cleaned {
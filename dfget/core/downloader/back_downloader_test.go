@@ -17,18 +17,27 @@
 package downloader
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/dragonflyoss/Dragonfly/dfget/config"
 	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/dragonflyoss/Dragonfly/dfget/errors"
 	"github.com/dragonflyoss/Dragonfly/dfget/util"
 	"github.com/go-check/check"
+	"github.com/klauspost/compress/zstd"
 )
 
 type BackDownloaderTestSuite struct {
@@ -94,3 +103,231 @@ func (s *BackDownloaderTestSuite) TestBackDownloader_Run(c *check.C) {
 	bd.Md5 = testFileMd5
 	c.Assert(bd.Run(), check.IsNil)
 }
+
+func (s *BackDownloaderTestSuite) TestBackDownloader_ReadBackVerify(c *check.C) {
+	createTestFile(path.Join(s.workHome, "readback.test"))
+	dst := path.Join(s.workHome, "readback.dst")
+
+	cfg := helper.CreateConfig(nil, s.workHome)
+	cfg.ReadBackVerify = true
+	bd := &BackDownloader{
+		Cfg:    cfg,
+		URL:    "http://" + s.host + "/readback.test",
+		Target: dst,
+	}
+	c.Assert(bd.Run(), check.IsNil)
+	c.Assert(util.PathExist(dst), check.Equals, true)
+
+	// test: the storage layer corrupts the file on writing
+	defer func(f func(string, string) error) { moveFunc = f }(moveFunc)
+	moveFunc = func(src string, dst string) error {
+		if err := util.MoveFile(src, dst); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dst, []byte("corrupted"), 0644)
+	}
+	bd.cleaned = false
+	c.Assert(bd.Run(), check.NotNil)
+	c.Assert(util.PathExist(dst), check.Equals, false)
+
+	// test: the corruption can't be detected without ReadBackVerify
+	cfg.ReadBackVerify = false
+	bd.cleaned = false
+	c.Assert(bd.Run(), check.IsNil)
+}
+
+func (s *BackDownloaderTestSuite) TestBackDownloader_Mirrors(c *check.C) {
+	var newOrigin = func(name string, delay time.Duration, code int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+			if code != http.StatusOK {
+				w.WriteHeader(code)
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(name))
+		}))
+	}
+	slow := newOrigin("slow", 200*time.Millisecond, http.StatusOK)
+	defer slow.Close()
+	fast := newOrigin("fast", 0, http.StatusOK)
+	defer fast.Close()
+	hung := newOrigin("hung", time.Second, http.StatusOK)
+	defer hung.Close()
+	broken := newOrigin("broken", 0, http.StatusInternalServerError)
+	defer broken.Close()
+
+	cfg := helper.CreateConfig(nil, s.workHome)
+	cfg.OriginProbeTimeout = 500 * time.Millisecond
+	c.Assert(rankOrigins(cfg, []string{slow.URL, hung.URL, broken.URL, fast.URL}), check.DeepEquals,
+		[]string{fast.URL, slow.URL, hung.URL, broken.URL})
+	cfg.MaxProbedOrigins = 2
+	c.Assert(rankOrigins(cfg, []string{slow.URL, hung.URL, fast.URL}), check.DeepEquals,
+		[]string{slow.URL, hung.URL, fast.URL})
+
+	// test: download from the fastest origin
+	dst := path.Join(s.workHome, "mirrors.dst")
+	cfg.MaxProbedOrigins = 0
+	bd := &BackDownloader{Cfg: cfg, URL: slow.URL, Mirrors: []string{fast.URL}, Target: dst}
+	c.Assert(bd.Run(), check.IsNil)
+	content, _ := ioutil.ReadFile(dst)
+	c.Assert(string(content), check.Equals, "fast")
+
+	// test: fall back to the next origin if the fastest one fails
+	var requests int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("flaky"))
+	}))
+	defer flaky.Close()
+	bd = &BackDownloader{Cfg: cfg, URL: slow.URL, Mirrors: []string{flaky.URL}, Target: dst}
+	c.Assert(bd.Run(), check.IsNil)
+	content, _ = ioutil.ReadFile(dst)
+	c.Assert(string(content), check.Equals, "slow")
+}
+
+func (s *BackDownloaderTestSuite) TestBackDownloader_Untrusted(c *check.C) {
+	createTestFile(path.Join(s.workHome, "untrusted.test"))
+	dst := path.Join(s.workHome, "untrusted.dst")
+
+	cfg := helper.CreateConfig(nil, s.workHome)
+	cfg.TrustedPeers = []string{"10.0.0.0/8"}
+	bd := &BackDownloader{
+		Cfg:    cfg,
+		URL:    "http://" + s.host + "/untrusted.test",
+		Target: dst,
+	}
+	err := bd.Run()
+	c.Assert(err, check.NotNil)
+	c.Assert(err.(*errors.DFGetError).Code, check.Equals, config.CodeUntrusted)
+	c.Assert(util.PathExist(dst), check.Equals, false)
+
+	cfg.TrustOrigin = true
+	bd.cleaned = false
+	c.Assert(bd.Run(), check.IsNil)
+}
+
+func (s *BackDownloaderTestSuite) TestBackDownloader_Metadata(c *check.C) {
+	createTestFile(path.Join(s.workHome, "meta.txt"))
+	dst := path.Join(s.workHome, "meta.dst")
+
+	cfg := helper.CreateConfig(nil, s.workHome)
+	cfg.URL = "http://" + s.host + "/meta.txt"
+	cfg.MetaHeaders = []string{"content-type", "X-Not-Exist"}
+	bd := &BackDownloader{
+		Cfg:    cfg,
+		URL:    cfg.URL,
+		Target: dst,
+	}
+	c.Assert(bd.Run(), check.IsNil)
+
+	expected := `{"Content-Type":"text/plain; charset=utf-8"}`
+	b, err := ioutil.ReadFile(metaFile(dst))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(b), check.Equals, expected)
+
+	// test: the headers fetched by HEAD request for the p2p downloading
+	header, err := fetchMetadata(cfg)
+	c.Assert(err, check.IsNil)
+	c.Assert(writeMetadata(cfg, dst, header), check.IsNil)
+	b, _ = ioutil.ReadFile(metaFile(dst))
+	c.Assert(string(b), check.Equals, expected)
+}
+
+func (s *BackDownloaderTestSuite) TestBackDownloader_BackSourceHeaders(c *check.C) {
+	var newOrigin = func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("Accept") != "*" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(name))
+		}))
+	}
+	origin := newOrigin("origin")
+	defer origin.Close()
+	dst := path.Join(s.workHome, "headers.dst")
+
+	cfg := helper.CreateConfig(nil, s.workHome)
+	cfg.Header = []string{"Accept: *", "authorization: Basic xxx"}
+	cfg.BackSourceHeaders = map[string]string{"Authorization": "Bearer token"}
+	c.Assert(sourceHeaders(cfg), check.DeepEquals,
+		map[string]string{"Accept": "*", "Authorization": "Bearer token",
+			"User-Agent": config.DefaultUserAgent})
+	bd := &BackDownloader{Cfg: cfg, URL: origin.URL, Target: dst}
+	c.Assert(bd.Run(), check.IsNil)
+	content, _ := ioutil.ReadFile(dst)
+	c.Assert(string(content), check.Equals, "origin")
+
+	// test: the requests to the origins go through the proxy
+	proxy := newOrigin("proxy")
+	defer proxy.Close()
+	cfg.BackSourceProxy = proxy.URL
+	bd = &BackDownloader{Cfg: cfg, URL: "http://origin.invalid/headers", Target: dst}
+	c.Assert(bd.Run(), check.IsNil)
+	content, _ = ioutil.ReadFile(dst)
+	c.Assert(string(content), check.Equals, "proxy")
+}
+
+func (s *BackDownloaderTestSuite) TestBackDownloader_RequestRange(c *check.C) {
+	c.Assert(ioutil.WriteFile(path.Join(s.workHome, "range.test"), []byte("0123456789"), 0644), check.IsNil)
+	dst := path.Join(s.workHome, "range.dst")
+
+	cfg := helper.CreateConfig(nil, s.workHome)
+	cfg.RequestRange = "2-5"
+	bd := &BackDownloader{
+		Cfg:    cfg,
+		URL:    "http://" + s.host + "/range.test",
+		Target: dst,
+		Md5:    "d41d8cd98f00b204e9800998ecf8427e",
+	}
+	c.Assert(bd.Run(), check.IsNil)
+	content, _ := ioutil.ReadFile(dst)
+	c.Assert(string(content), check.Equals, "2345")
+}
+
+func (s *BackDownloaderTestSuite) TestBackDownloader_Decompress(c *check.C) {
+	content := strings.Repeat("compressible ", 1024)
+	var encoded bytes.Buffer
+	zw := gzip.NewWriter(&encoded)
+	zw.Write([]byte(content))
+	zw.Close()
+	var (
+		acceptEncoding string
+		encoding       = "gzip"
+	)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Encoding", encoding)
+		w.Write(encoded.Bytes())
+	}))
+	defer origin.Close()
+	dst := path.Join(s.workHome, "decompress.dst")
+
+	cfg := helper.CreateConfig(nil, s.workHome)
+	cfg.BackSourceDecompress = true
+	bd := &BackDownloader{Cfg: cfg, URL: origin.URL, Target: dst, Md5: fmt.Sprintf("%x", md5.Sum([]byte(content)))}
+	c.Assert(bd.Run(), check.IsNil)
+	c.Assert(acceptEncoding, check.Equals, "zstd, gzip")
+	c.Assert(bd.Total, check.Equals, int64(len(content)))
+	result, _ := ioutil.ReadFile(dst)
+	c.Assert(string(result), check.Equals, content)
+
+	// test: the zstd encoded response
+	zenc, _ := zstd.NewWriter(nil)
+	encoded.Reset()
+	encoded.Write(zenc.EncodeAll([]byte(content), nil))
+	encoding = "zstd"
+	bd = &BackDownloader{Cfg: cfg, URL: origin.URL, Target: dst, Md5: fmt.Sprintf("%x", md5.Sum([]byte(content)))}
+	c.Assert(bd.Run(), check.IsNil)
+	c.Assert(bd.Total, check.Equals, int64(len(content)))
+	result, _ = ioutil.ReadFile(dst)
+	c.Assert(string(result), check.Equals, content)
+
+	// test: the encodings unsupported fail the download
+	encoding = "br"
+	bd = &BackDownloader{Cfg: cfg, URL: origin.URL, Target: dst}
+	c.Assert(bd.Run(), check.ErrorMatches, "unsupported content encoding:br.*")
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+)
+
+// addCandidate records t as a candidate of the range started by first in
+// the same pull, so that the PowerClient tries t once the peer of first
+// fails. The peers already offering the range and the blacklisted ones are
+// ignored, and nothing's recorded if the peers are pinned or replayed since
+// the range must be downloaded from the chosen peer then.
+func (p2p *P2PDownloader) addCandidate(first, t *types.PullPieceTaskResponseContinueData) {
+	if p2p.pins != nil || p2p.replay != nil || p2p.blacklisted(t) {
+		return
+	}
+	if p2p.candidates == nil {
+		p2p.candidates = make(map[string][]*types.PullPieceTaskResponseContinueData)
+	}
+	addr := peerAddr(t)
+	if peerAddr(first) == addr {
+		return
+	}
+	for _, c := range p2p.candidates[t.Range] {
+		if peerAddr(c) == addr {
+			return
+		}
+	}
+	p2p.candidates[t.Range] = append(p2p.candidates[t.Range], t)
+}
+
+// servedByCandidate records the peer of the candidate which served the
+// range instead of the piece task started, it forgets the candidates of the
+// range either way.
+func (p2p *P2PDownloader) servedByCandidate(pieceRange, cid string) {
+	candidates := p2p.candidates[pieceRange]
+	delete(p2p.candidates, pieceRange)
+	for _, c := range candidates {
+		if c.Cid != cid {
+			continue
+		}
+		p2p.Cfg.Log().Infof("range:%s served by the candidate dst:%s", pieceRange, c.PeerIP)
+		p2p.manifest.dispatch(c)
+		if c.PeerIP != p2p.node {
+			p2p.usedPeers[peerAddr(c)] = true
+		}
+		return
+	}
+}
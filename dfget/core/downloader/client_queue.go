@@ -0,0 +1,151 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+// clientQueueSize returns the capacity of the client queue whose pieces of
+// pieceSize take Cfg.ClientQueueMemory at most, it's bounded by
+// config.MinClientQueueSize and config.MaxClientQueueSize.
+func clientQueueSize(cfg *config.Config, pieceSize int32) int {
+	if pieceSize <= 0 {
+		return config.DefaultClientQueueSize
+	}
+	memory := cfg.ClientQueueMemory
+	if memory <= 0 {
+		memory = config.DefaultClientQueueMemory
+	}
+	size := memory / int64(pieceSize)
+	if size < config.MinClientQueueSize {
+		return config.MinClientQueueSize
+	}
+	if size > config.MaxClientQueueSize {
+		return config.MaxClientQueueSize
+	}
+	return int(size)
+}
+
+// resizableQueue is a blocking queue whose capacity can be changed while
+// it's used, the items beyond the new capacity are kept until they're
+// polled.
+type resizableQueue struct {
+	util.Queue
+	mu       sync.Mutex
+	capacity int
+	size     int
+	// space is closed and replaced once the queue has more space.
+	space chan struct{}
+}
+
+func newResizableQueue(capacity int) *resizableQueue {
+	return &resizableQueue{
+		Queue:    util.NewQueue(0),
+		capacity: capacity,
+		space:    make(chan struct{}),
+	}
+}
+
+func (q *resizableQueue) Put(item interface{}) {
+	q.PutTimeout(item, -1)
+}
+
+// PutTimeout blocks until the queue has space if the timeout < 0.
+func (q *resizableQueue) PutTimeout(item interface{}, timeout time.Duration) bool {
+	if util.IsNil(item) {
+		return false
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		q.mu.Lock()
+		if q.size < q.capacity {
+			q.size++
+			q.mu.Unlock()
+			q.Queue.Put(item)
+			return true
+		}
+		space := q.space
+		q.mu.Unlock()
+
+		if timeout < 0 {
+			<-space
+			continue
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return false
+		}
+		select {
+		case <-space:
+		case <-time.After(wait):
+			return false
+		}
+	}
+}
+
+func (q *resizableQueue) Poll() interface{} {
+	item := q.Queue.Poll()
+	q.release()
+	return item
+}
+
+func (q *resizableQueue) PollTimeout(timeout time.Duration) (interface{}, bool) {
+	item, ok := q.Queue.PollTimeout(timeout)
+	if ok {
+		q.release()
+	}
+	return item, ok
+}
+
+// resize changes the capacity of the queue.
+func (q *resizableQueue) resize(capacity int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if capacity > q.capacity {
+		q.notify()
+	}
+	q.capacity = capacity
+}
+
+func (q *resizableQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.size--
+	q.notify()
+}
+
+func (q *resizableQueue) notify() {
+	close(q.space)
+	q.space = make(chan struct{})
+}
+
+// resizeClientQueue fits the capacity of the client queue to the current
+// piece size.
+func (p2p *P2PDownloader) resizeClientQueue() {
+	q, ok := p2p.clientQueue.(*resizableQueue)
+	if !ok {
+		return
+	}
+	size := clientQueueSize(p2p.Cfg, p2p.pieceSizeHistory[1])
+	p2p.Cfg.Log().Infof("resize client queue to %d for piece size:%d", size, p2p.pieceSizeHistory[1])
+	q.resize(size)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/go-check/check"
+)
+
+type ClientQueueTestSuite struct {
+}
+
+func init() {
+	check.Suite(&ClientQueueTestSuite{})
+}
+
+func (s *ClientQueueTestSuite) TestClientQueueSize(c *check.C) {
+	cfg := helper.CreateConfig(nil, "/tmp")
+	c.Assert(clientQueueSize(cfg, 4*1024*1024), check.Equals, config.DefaultClientQueueSize)
+	c.Assert(clientQueueSize(cfg, 0), check.Equals, config.DefaultClientQueueSize)
+	c.Assert(clientQueueSize(cfg, 64*1024*1024), check.Equals, config.MinClientQueueSize)
+	c.Assert(clientQueueSize(cfg, 1024), check.Equals, config.MaxClientQueueSize)
+	cfg.ClientQueueMemory = 10 * 1024 * 1024
+	c.Assert(clientQueueSize(cfg, 1024*1024), check.Equals, 10)
+}
+
+func (s *ClientQueueTestSuite) TestResizableQueue(c *check.C) {
+	q := newResizableQueue(2)
+	c.Assert(q.PutTimeout(1, 0), check.Equals, true)
+	c.Assert(q.PutTimeout(2, 0), check.Equals, true)
+	c.Assert(q.PutTimeout(3, 10*time.Millisecond), check.Equals, false)
+
+	// the blocked put proceeds once the queue grows.
+	done := make(chan struct{})
+	go func() {
+		q.Put(3)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.resize(3)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		c.Fatal("put isn't unblocked by resizing")
+	}
+
+	// the items beyond the shrunk capacity are kept.
+	q.resize(1)
+	c.Assert(q.Len(), check.Equals, 3)
+	c.Assert(q.Poll(), check.Equals, 1)
+	item, ok := q.PollTimeout(0)
+	c.Assert(item, check.Equals, 2)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(q.PutTimeout(4, 0), check.Equals, false)
+	c.Assert(q.Poll(), check.Equals, 3)
+	c.Assert(q.PutTimeout(4, 0), check.Equals, true)
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+// coalesce groups the adjacent piece tasks served by the same peer into the
+// fetch units of at most Cfg.PieceCoalesceFactor pieces and
+// config.MaxCoalescedSize bytes, so that the tiny pieces are downloaded by
+// fewer requests. Every piece task is a group by itself if coalescing is
+// disabled, or the pieces may be reused from the delta base file or the
+// local CDN.
+func (p2p *P2PDownloader) coalesce(tasks []*types.PullPieceTaskResponseContinueData) (
+	groups [][]*types.PullPieceTaskResponseContinueData) {
+	factor := p2p.Cfg.PieceCoalesceFactor
+	if factor <= 1 || p2p.delta != nil || !util.IsEmptyStr(p2p.Cfg.LocalCDN) {
+		for _, t := range tasks {
+			groups = append(groups, []*types.PullPieceTaskResponseContinueData{t})
+		}
+		return groups
+	}
+
+	sorted := make([]*types.PullPieceTaskResponseContinueData, len(tasks))
+	copy(sorted, tasks)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].PieceNum < sorted[j].PieceNum
+	})
+	for _, t := range sorted {
+		if n := len(groups); n > 0 && canCoalesce(groups[n-1], t, factor) {
+			groups[n-1] = append(groups[n-1], t)
+			continue
+		}
+		groups = append(groups, []*types.PullPieceTaskResponseContinueData{t})
+	}
+	return groups
+}
+
+// canCoalesce returns whether the piece task t can be downloaded with the
+// group by one request.
+func canCoalesce(group []*types.PullPieceTaskResponseContinueData,
+	t *types.PullPieceTaskResponseContinueData, factor int) bool {
+	prev := group[len(group)-1]
+	if len(group) >= factor || (len(group)+1)*t.PieceSize > config.MaxCoalescedSize {
+		return false
+	}
+	if t.PeerIP != prev.PeerIP || t.PeerPort != prev.PeerPort || t.Path != prev.Path ||
+		t.PieceSize != prev.PieceSize || t.PieceNum != prev.PieceNum+1 {
+		return false
+	}
+	_, prevEnd, ok1 := parsePieceRange(prev.Range)
+	start, _, ok2 := parsePieceRange(t.Range)
+	return ok1 && ok2 && prevEnd+1 == start
+}
+
+// runCoalesced downloads the adjacent pieces of the PowerClients by one
+// request, and puts them into the queues one by one as if they were
+// downloaded separately, so the result of each piece is still reported to
+// the supernode.
+func runCoalesced(clients []*PowerClient) {
+	// the memory budget of the whole group is reserved at once, the ones
+	// waiting for the budget by piece could hold it all and wait each other.
+	sizes := make([]int64, len(clients))
+	for i, pc := range clients {
+		sizes[i] = int64(pc.pieceTask.PieceSize)
+	}
+	for i, release := range clients[0].budget.acquireAll(sizes) {
+		clients[i].release = release
+	}
+	now := time.Now()
+	for _, pc := range clients {
+		pc.start = now
+	}
+	defer func() {
+		for _, pc := range clients {
+			if pc.release != nil {
+				pc.release()
+			}
+		}
+	}()
+
+	first := clients[0]
+	start, _, _ := parsePieceRange(first.pieceTask.Range)
+	_, end, _ := parsePieceRange(clients[len(clients)-1].pieceTask.Range)
+	contents, err := first.fetchRange(fmt.Sprintf("%d-%d", start, end), end-start+1)
+	if err != nil {
+		first.cfg.Log().Errorf("read coalesced pieces:%d-%d error:%v from dst:%s",
+			start, end, err, first.pieceTask.PeerIP)
+	}
+
+	var offset int64
+	for _, pc := range clients {
+		s, e, _ := parsePieceRange(pc.pieceTask.Range)
+		n := e - s + 1
+		var chunk []byte
+		if err == nil && offset+n <= int64(len(contents)) {
+			chunk = contents[offset : offset+n : offset+n]
+		}
+		offset += n
+
+		pieceMD5 := expectedPieceDigest(pc.pieceTask.PieceMd5)
+		length := expectedPieceLength(pc.pieceTask.PieceMd5)
+		if chunk == nil || (length >= 0 && length != int64(len(chunk))) ||
+			contentDigest(chunk, pieceMD5) != pieceMD5 {
+			pc.queue.Put(NewPiece(pc.taskID, pc.node, pc.pieceTask.Cid, pc.pieceTask.Range,
+				config.ResultFail, config.TaskStatusRunning))
+			continue
+		}
+		pc.putPiece(bytes.NewBuffer(chunk))
+	}
+}
+
+// contentDigest returns the digest of the content in the algorithm of the
+// digest expected.
+func contentDigest(content []byte, expected string) string {
+	algorithm, _ := util.ParseDigest(expected)
+	h := util.NewDigest(algorithm)
+	if h == nil {
+		return ""
+	}
+	h.Write(content)
+	return util.FormatDigest(algorithm, fmt.Sprintf("%x", h.Sum(nil)))
+}
+
+// fetchRange downloads the pieceRange which covers several pieces from the
+// peer of the piece task.
+func (pc *PowerClient) fetchRange(pieceRange string, size int64) ([]byte, error) {
+	dstIP, peerPort := pc.pieceTask.PeerIP, pc.pieceTask.PeerPort
+	if !pc.checkTrusted() {
+		return nil, fmt.Errorf("untrusted peer:%s", dstIP)
+	}
+	defer pc.files.acquire(1)()
+	addr := util.JoinHostPort(dstIP, peerPort)
+	if _, reachable := reachablePeers.Load(addr); !reachable && !pc.files.nearLimit() {
+		if _, err := util.CheckConnectFrom(peerLocalIP(pc.cfg), dstIP, peerPort, -1); err != nil && dstIP != pc.node {
+			return nil, err
+		}
+	}
+
+	url := "http://" + addr + pc.pieceTask.Path
+	headers := map[string]string{
+		"Range":      pieceRange,
+		"pieceNum":   strconv.Itoa(pc.pieceTask.PieceNum),
+		"pieceSize":  strconv.Itoa(pc.pieceTask.PieceSize),
+		"User-Agent": pc.cfg.EffectiveUserAgent(),
+	}
+	resp, err := httpGetWithContext(pc.context(), peerHTTPClient(pc.cfg), url, headers)
+	if err != nil {
+		reachablePeers.Delete(addr)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	total, err := buf.ReadFrom(NewLimitReader(newSharedLimitReader(resp.Body, pc.limiter),
+		pc.cfg.LocalLimit, false))
+	pc.tiers.Add(TierPeer, total)
+	if err == nil {
+		reachablePeers.Store(addr, true)
+	}
+	return buf.Bytes(), err
+}
+
+// parsePieceRange parses the range 'start-end' of a piece task.
+func parsePieceRange(pieceRange string) (start int64, end int64, ok bool) {
+	kv := strings.SplitN(strings.TrimPrefix(pieceRange, "bytes="), "-", 2)
+	if len(kv) != 2 {
+		return 0, 0, false
+	}
+	var err1, err2 error
+	start, err1 = strconv.ParseInt(kv[0], 10, 64)
+	end, err2 = strconv.ParseInt(kv[1], 10, 64)
+	return start, end, err1 == nil && err2 == nil && start <= end
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+	"github.com/go-check/check"
+)
+
+type CoalesceTestSuite struct {
+}
+
+func init() {
+	check.Suite(&CoalesceTestSuite{})
+}
+
+func (s *CoalesceTestSuite) TestCoalesce(c *check.C) {
+	var newTask = func(num int, peer string) *types.PullPieceTaskResponseContinueData {
+		return &types.PullPieceTaskResponseContinueData{
+			Range:     fmt.Sprintf("%d-%d", num*10, num*10+9),
+			PieceNum:  num,
+			PieceSize: 10,
+			PeerIP:    peer,
+		}
+	}
+	tasks := []*types.PullPieceTaskResponseContinueData{
+		newTask(1, "a"), newTask(0, "a"), newTask(2, "a"), newTask(3, "a"),
+		newTask(4, "b"), newTask(6, "b"), newTask(7, "b"),
+	}
+
+	var groupNums = func(groups [][]*types.PullPieceTaskResponseContinueData) (res [][]int) {
+		for _, g := range groups {
+			var nums []int
+			for _, t := range g {
+				nums = append(nums, t.PieceNum)
+			}
+			res = append(res, nums)
+		}
+		return res
+	}
+
+	p2p := &P2PDownloader{Cfg: helper.CreateConfig(nil, "")}
+	c.Assert(len(p2p.coalesce(tasks)), check.Equals, len(tasks))
+
+	p2p.Cfg.PieceCoalesceFactor = 3
+	c.Assert(groupNums(p2p.coalesce(tasks)), check.DeepEquals,
+		[][]int{{0, 1, 2}, {3}, {4}, {6, 7}})
+}
+
+func (s *CoalesceTestSuite) TestRunCoalesced(c *check.C) {
+	peer, tasks := newTinyPiecePeer(4, 10)
+	defer peer.Close()
+	// the third piece is corrupt
+	tasks[2].PieceMd5 = pieceDigest([]byte("corrupt"))
+
+	cfg := helper.CreateConfig(nil, "")
+	p2p := &P2PDownloader{Cfg: cfg, queue: util.NewQueue(0), clientQueue: util.NewQueue(0),
+		tiers: NewTierBytes()}
+	p2p.runClients(p2p.newPowerClients(tasks))
+
+	c.Assert(p2p.queue.Len(), check.Equals, len(tasks))
+	for i := range tasks {
+		item, _ := p2p.queue.PollTimeout(0)
+		piece := item.(*Piece)
+		if i == 2 {
+			c.Assert(piece.Result, check.Equals, config.ResultFail)
+			continue
+		}
+		c.Assert(piece.Result, check.Equals, config.ResultSemiSuc)
+		c.Assert(piece.RawContent().String(), check.Equals, tinyPieceContent(i, 10))
+	}
+	c.Assert(p2p.clientQueue.Len(), check.Equals, len(tasks)-1)
+	c.Assert(p2p.tiers.Get(TierPeer), check.Equals, int64(4*10))
+}
+
+func (s *CoalesceTestSuite) TestRunCoalesced_UserAgent(c *check.C) {
+	var file []byte
+	for i := 0; i < 2; i++ {
+		file = append(file, wrapPieceContent([]byte(tinyPieceContent(i, 10)), 10)...)
+	}
+	var userAgent string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+		w.Write(file)
+	}))
+	defer peer.Close()
+	tiny, tasks := newTinyPiecePeer(2, 10)
+	tiny.Close()
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	peerPort, _ := strconv.Atoi(port)
+	for _, t := range tasks {
+		t.PeerIP, t.PeerPort = host, peerPort
+	}
+
+	cfg := helper.CreateConfig(nil, "")
+	cfg.UserAgent = "custom/1.0"
+	p2p := &P2PDownloader{Cfg: cfg, queue: util.NewQueue(0), clientQueue: util.NewQueue(0),
+		tiers: NewTierBytes()}
+	p2p.runClients(p2p.newPowerClients(tasks))
+	c.Assert(p2p.clientQueue.Len(), check.Equals, len(tasks))
+	c.Assert(userAgent, check.Equals, "custom/1.0")
+}
+
+// newTinyPiecePeer creates a peer serving count pieces of pieceSize, and
+// the piece tasks to download them.
+func newTinyPiecePeer(count int, pieceSize int) (*httptest.Server, []*types.PullPieceTaskResponseContinueData) {
+	var file []byte
+	var tasks []*types.PullPieceTaskResponseContinueData
+	for i := 0; i < count; i++ {
+		wrapped := wrapPieceContent([]byte(tinyPieceContent(i, pieceSize)), int32(pieceSize))
+		tasks = append(tasks, &types.PullPieceTaskResponseContinueData{
+			Range:     fmt.Sprintf("%d-%d", len(file), len(file)+len(wrapped)-1),
+			PieceNum:  i,
+			PieceSize: pieceSize,
+			PieceMd5:  pieceDigest(wrapped),
+			Path:      "/peer/file/tiny",
+		})
+		file = append(file, wrapped...)
+	}
+
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, end, ok := parsePieceRange(r.Header.Get("Range"))
+		if !ok || end >= int64(len(file)) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Write(file[start : end+1])
+	}))
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	peerPort, _ := strconv.Atoi(port)
+	for _, t := range tasks {
+		t.PeerIP, t.PeerPort = host, peerPort
+	}
+	return peer, tasks
+}
+
+func tinyPieceContent(num int, pieceSize int) string {
+	return string(bytes.Repeat([]byte{byte('a' + num%26)}, pieceSize-5))
+}
+
+func benchmarkTinyPieces(b *testing.B, factor int) {
+	const count, pieceSize = 256, 64
+	peer, tasks := newTinyPiecePeer(count, pieceSize)
+	defer peer.Close()
+
+	cfg := helper.CreateConfig(nil, "")
+	cfg.LocalLimit = 1024 * 1024 * 1024
+	cfg.PieceCoalesceFactor = factor
+	p2p := &P2PDownloader{Cfg: cfg, queue: util.NewQueue(0), clientQueue: util.NewQueue(0)}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, group := range p2p.coalesce(tasks) {
+			p2p.runClients(p2p.newPowerClients(group))
+		}
+		for p2p.queue.Len() > 0 {
+			p2p.queue.Poll()
+			p2p.clientQueue.Poll()
+		}
+	}
+	b.SetBytes(int64(count * pieceSize))
+}
+
+func BenchmarkTinyPieces_NoCoalesce(b *testing.B) {
+	benchmarkTinyPieces(b, 0)
+}
+
+func BenchmarkTinyPieces_Coalesce16(b *testing.B) {
+	benchmarkTinyPieces(b, 16)
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"os"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+// compressServiceFile replaces the service file with the compressed one
+// after the download succeeds, the peer server decompresses the pieces on
+// the fly when serving them. The compressed file is renamed over the service
+// file, so the targets hard linked or reflinked to it keep the uncompressed
+// content, which costs the disk of the compressed file more while they're
+// kept. The failure doesn't fail the download.
+func compressServiceFile(cfg *config.Config, serviceFile string, targets []string) {
+	info, err := os.Stat(serviceFile)
+	if err != nil {
+		return
+	}
+	for _, t := range targets {
+		if ti, err := os.Stat(t); err == nil && os.SameFile(info, ti) {
+			cfg.Log().Warnf("service file:%s linked to:%s is replaced by the compressed one, "+
+				"which takes the disk until the target is removed", serviceFile, t)
+		}
+	}
+
+	start := time.Now()
+	tmp := serviceFile + ".z"
+	if err = util.CompressFile(serviceFile, tmp, config.CompressBlockSize); err == nil {
+		err = os.Rename(tmp, serviceFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		cfg.Log().Warnf("compress service file:%s error:%v", serviceFile, err)
+		return
+	}
+	if ci, err := os.Stat(serviceFile); err == nil {
+		cfg.Log().Infof("compress service file:%s from %d to %d bytes cost:%.3fs",
+			serviceFile, info.Size(), ci.Size(), time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+	"github.com/go-check/check"
+)
+
+type CompressTestSuite struct {
+	workHome string
+}
+
+func init() {
+	check.Suite(&CompressTestSuite{})
+}
+
+func (s *CompressTestSuite) SetUpSuite(c *check.C) {
+	s.workHome, _ = ioutil.TempDir("/tmp", "dfget-CompressTestSuite-")
+}
+
+func (s *CompressTestSuite) TearDownSuite(c *check.C) {
+	if s.workHome != "" {
+		if err := os.RemoveAll(s.workHome); err != nil {
+			fmt.Printf("remove path:%s error", s.workHome)
+		}
+	}
+}
+
+func (s *CompressTestSuite) TestCompressServiceFile(c *check.C) {
+	cfg := helper.CreateConfig(nil, s.workHome)
+	content := bytes.Repeat([]byte("aaaaa"), 1000)
+	service := path.Join(s.workHome, "service")
+	target := path.Join(s.workHome, "target")
+	c.Assert(ioutil.WriteFile(service, content, 0644), check.IsNil)
+
+	// test: the target linked to the service file keeps the uncompressed content
+	c.Assert(util.Link(service, target), check.IsNil)
+	compressServiceFile(cfg, service, []string{target})
+	c.Assert(s.isCompressed(service), check.Equals, true)
+	c.Assert(util.PathExist(service+".z"), check.Equals, false)
+	linked, _ := ioutil.ReadFile(target)
+	c.Assert(linked, check.DeepEquals, content)
+
+	f, _ := os.Open(service)
+	defer f.Close()
+	info, _ := f.Stat()
+	cf, err := util.NewCompressedFile(f, info.Size())
+	c.Assert(err, check.IsNil)
+	decompressed, _ := ioutil.ReadAll(io.NewSectionReader(cf, 0, cf.Size()))
+	c.Assert(decompressed, check.DeepEquals, content)
+}
+
+func (s *CompressTestSuite) isCompressed(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	return err == nil && util.IsCompressedFile(f, info.Size())
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"sort"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+)
+
+// contributions accumulates the bytes of the pieces served by each peer by
+// its cid. It's used by the main loop of P2PDownloader only, and a nil
+// contributions accumulates nothing.
+type contributions map[string]int64
+
+func newContributions(enabled bool) contributions {
+	if !enabled {
+		return nil
+	}
+	return make(contributions)
+}
+
+func (c contributions) add(cid string, n int64) {
+	if c == nil || cid == "" {
+		return
+	}
+	c[cid] += n
+}
+
+// request creates the report of at most max peers contributed most, the
+// others are summed up.
+func (c contributions) request(taskID string, cid string, max int) *types.ReportContributionRequest {
+	req := &types.ReportContributionRequest{TaskID: taskID, Cid: cid}
+	for peer, n := range c {
+		req.Peers = append(req.Peers, &types.PeerContribution{Cid: peer, Bytes: n})
+	}
+	sort.Slice(req.Peers, func(i, j int) bool {
+		if req.Peers[i].Bytes != req.Peers[j].Bytes {
+			return req.Peers[i].Bytes > req.Peers[j].Bytes
+		}
+		return req.Peers[i].Cid < req.Peers[j].Cid
+	})
+	if max > 0 && len(req.Peers) > max {
+		for _, p := range req.Peers[max:] {
+			req.OtherPeers++
+			req.OtherBytes += p.Bytes
+		}
+		req.Peers = req.Peers[:max]
+	}
+	return req
+}
+
+// reportContributions reports the contributions of the peers to the
+// supernode, the failure is ignored.
+func (p2p *P2PDownloader) reportContributions() {
+	if p2p.contributions == nil || len(p2p.contributions) == 0 {
+		return
+	}
+	req := p2p.contributions.request(p2p.taskID, p2p.Cfg.RV.Cid, config.MaxReportedContributors)
+	if resp, err := p2p.API.ReportContribution(p2p.node, req); err != nil {
+		p2p.Cfg.Log().Warnf("report contributions of %d peers error:%v",
+			len(p2p.contributions), err)
+	} else if resp != nil && resp.Code != config.Success {
+		p2p.Cfg.Log().Warnf("report contributions of %d peers result:%v",
+			len(p2p.contributions), resp)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+	"github.com/go-check/check"
+)
+
+type ContributionTestSuite struct {
+}
+
+func init() {
+	check.Suite(&ContributionTestSuite{})
+}
+
+func (s *ContributionTestSuite) TestContributions_Request(c *check.C) {
+	var disabled contributions = newContributions(false)
+	disabled.add("a", 1)
+	c.Assert(disabled, check.IsNil)
+
+	cs := newContributions(true)
+	cs.add("a", 10)
+	cs.add("b", 30)
+	cs.add("c", 10)
+	cs.add("a", 5)
+	cs.add("d", 1)
+	cs.add("", 100)
+
+	req := cs.request("task", "cid", 2)
+	c.Assert(req, check.DeepEquals, &types.ReportContributionRequest{
+		TaskID:     "task",
+		Cid:        "cid",
+		Peers:      []*types.PeerContribution{{Cid: "b", Bytes: 30}, {Cid: "a", Bytes: 15}},
+		OtherPeers: 2,
+		OtherBytes: 11,
+	})
+	c.Assert(cs.request("task", "cid", 0).Peers, check.HasLen, 4)
+}
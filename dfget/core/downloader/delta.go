@@ -0,0 +1,161 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+const (
+	// pieceHeadSize is the size of the header wrapped in front of the piece
+	// content, pieceWrapSize is the size of the header and the tail.
+	pieceHeadSize = 4
+	pieceWrapSize = pieceHeadSize + 1
+	pieceTail     = 0x7f
+)
+
+// deltaIndex indexes the blocks of a local base file, such as the previous
+// version of the downloading file, by their piece digests. So the pieces
+// whose contents are unchanged can be read from the base file instead of
+// being downloaded from peers.
+//
+// The base file is split into blocks of the piece content size, and the
+// digest of each block is computed in the same way as the supernode computes
+// the PieceMd5, so building the index costs one full md5 pass over the base
+// file, and it's rebuilt if the piece size changes. Only the unchanged blocks
+// aligned to the piece content size could be reused, because the supernode
+// just provides the strong digests of pieces.
+type deltaIndex struct {
+	path      string
+	pieceSize int32
+	// blocks piece md5 -> the offset of the block in the base file
+	blocks map[string]int64
+}
+
+// newDeltaIndex reads the base file and builds its index.
+func newDeltaIndex(path string, pieceSize int32) (*deltaIndex, error) {
+	contentSize := int64(pieceSize) - pieceWrapSize
+	if contentSize <= 0 {
+		return nil, fmt.Errorf("invalid piece size:%d", pieceSize)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d := &deltaIndex{
+		path:      path,
+		pieceSize: pieceSize,
+		blocks:    make(map[string]int64),
+	}
+	buf := make([]byte, contentSize)
+	for offset := int64(0); ; offset += contentSize {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			key := pieceDigest(wrapPieceContent(buf[:n], pieceSize))
+			if _, ok := d.blocks[key]; !ok {
+				d.blocks[key] = offset
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// lookup returns the wrapped piece content read from the base file whose
+// digest equals pieceMd5.
+func (d *deltaIndex) lookup(pieceMd5 string) (*bytes.Buffer, bool) {
+	offset, ok := d.blocks[pieceMd5]
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(d.path)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	buf := make([]byte, int64(d.pieceSize)-pieceWrapSize)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, false
+	}
+	content := wrapPieceContent(buf[:n], d.pieceSize)
+	// the base file may be modified after building the index.
+	if pieceDigest(content) != pieceMd5 {
+		return nil, false
+	}
+	return bytes.NewBuffer(content), true
+}
+
+// wrapPieceContent wraps the raw content with the header and the tail like
+// the pieces served by supernodes and peers.
+func wrapPieceContent(content []byte, pieceSize int32) []byte {
+	wrapped := make([]byte, len(content)+pieceWrapSize)
+	binary.BigEndian.PutUint32(wrapped,
+		uint32(len(content))|uint32(pieceSize)<<4)
+	copy(wrapped[pieceHeadSize:], content)
+	wrapped[len(wrapped)-1] = pieceTail
+	return wrapped
+}
+
+// expectedPieceDigest returns the digest the piece content is expected to
+// match from the PieceMd5 of the piece task: "md5:length" or
+// "<algorithm>:<hex>:length" for the algorithms other than md5, the digest
+// is in the form of util.ParseDigest.
+func expectedPieceDigest(pieceMd5 string) string {
+	parts := strings.Split(pieceMd5, ":")
+	if len(parts) >= 2 && parts[0] != util.DigestMd5 && util.NewDigest(parts[0]) != nil {
+		return parts[0] + ":" + parts[1]
+	}
+	return parts[0]
+}
+
+// expectedPieceLength returns the length of the wrapped piece from the
+// PieceMd5 of the piece task, or -1 if the PieceMd5 doesn't carry it.
+func expectedPieceLength(pieceMd5 string) int64 {
+	parts := strings.Split(pieceMd5, ":")
+	if len(parts) < 2 {
+		return -1
+	}
+	n, err := strconv.ParseInt(parts[len(parts)-1], 10, 64)
+	if err != nil || n < 0 || (len(parts) == 2 && parts[0] != util.DigestMd5 && util.NewDigest(parts[0]) != nil) {
+		return -1
+	}
+	return n
+}
+
+// pieceDigest returns the digest of the wrapped piece in the format of
+// PieceMd5: "md5:length".
+func pieceDigest(wrapped []byte) string {
+	return fmt.Sprintf("%x:%d", md5.Sum(wrapped), len(wrapped))
+}
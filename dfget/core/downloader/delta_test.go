@@ -0,0 +1,111 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+	"github.com/go-check/check"
+)
+
+type DeltaTestSuite struct {
+	workHome string
+}
+
+func init() {
+	check.Suite(&DeltaTestSuite{})
+}
+
+func (s *DeltaTestSuite) SetUpSuite(c *check.C) {
+	s.workHome, _ = ioutil.TempDir("/tmp", "dfget-DeltaTestSuite-")
+}
+
+func (s *DeltaTestSuite) TearDownSuite(c *check.C) {
+	if s.workHome != "" {
+		if err := os.RemoveAll(s.workHome); err != nil {
+			fmt.Printf("remove path:%s error", s.workHome)
+		}
+	}
+}
+
+func (s *DeltaTestSuite) TestDeltaIndex(c *check.C) {
+	base := path.Join(s.workHome, "base")
+	ioutil.WriteFile(base, []byte("aaaaabbbbbcc"), 0644)
+
+	_, err := newDeltaIndex(base, pieceWrapSize)
+	c.Assert(err, check.NotNil)
+	_, err = newDeltaIndex(path.Join(s.workHome, "notExist"), 10)
+	c.Assert(err, check.NotNil)
+
+	d, err := newDeltaIndex(base, 10)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(d.blocks), check.Equals, 3)
+
+	var cases = []struct {
+		content string
+		ok      bool
+	}{
+		{"bbbbb", true},
+		{"aaaaa", true},
+		{"cc", true},
+		{"zzzzz", false},
+		{"aaaab", false},
+	}
+	for _, v := range cases {
+		wrapped := wrapPieceContent([]byte(v.content), 10)
+		buf, ok := d.lookup(pieceDigest(wrapped))
+		c.Assert(ok, check.Equals, v.ok, check.Commentf("%v", v))
+		if v.ok {
+			c.Assert(buf.Bytes(), check.DeepEquals, wrapped)
+		}
+	}
+}
+
+func (s *DeltaTestSuite) TestPowerClient_ReuseDelta(c *check.C) {
+	base := path.Join(s.workHome, "reuse")
+	ioutil.WriteFile(base, []byte("aaaaabbbbb"), 0644)
+	d, _ := newDeltaIndex(base, 10)
+
+	cfg := helper.CreateConfig(nil, s.workHome)
+	pc := &PowerClient{
+		taskID: "taskID",
+		node:   "node",
+		pieceTask: &types.PullPieceTaskResponseContinueData{
+			Range:     "10-19",
+			PieceNum:  1,
+			PieceSize: 10,
+			PieceMd5:  pieceDigest(wrapPieceContent([]byte("bbbbb"), 10)),
+		},
+		cfg:         cfg,
+		queue:       util.NewQueue(0),
+		clientQueue: util.NewQueue(0),
+		delta:       d,
+	}
+	c.Assert(pc.Run(), check.IsNil)
+	c.Assert(pc.clientQueue.Len(), check.Equals, 1)
+	item, _ := pc.queue.PollTimeout(0)
+	piece := item.(*Piece)
+	c.Assert(piece.Result, check.Equals, config.ResultSemiSuc)
+	c.Assert(piece.RawContent().String(), check.Equals, "bbbbb")
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	dferrors "github.com/dragonflyoss/Dragonfly/dfget/errors"
+)
+
+// The kinds of the DownloadError for the callers to branch on.
+var (
+	// ErrBackSource represents that the download from the source fails
+	// after falling back to it for the other reasons, such as
+	// Cfg.BackSourceOnly or the write error of the service file.
+	ErrBackSource = errors.New("download from the source failed")
+
+	// ErrSourceError represents that the supernode fails to download the
+	// file from the source, and so does dfget.
+	ErrSourceError = errors.New("the source is unavailable")
+
+	// ErrAllPiecesFailed represents that the pieces can't be downloaded from
+	// the peers, and the download from the source fails too.
+	ErrAllPiecesFailed = errors.New("the pieces can't be downloaded from the peers")
+
+	// ErrInsufficientSpace represents that the data dir doesn't have enough
+	// free space for the file, it's checked before pulling any piece.
+	ErrInsufficientSpace = errors.New("insufficient disk space")
+)
+
+// DownloadError represents that the P2PDownloader falls back to the source
+// by Reason, which is the Cfg.BackSourceReason, and fails with Err then. It
+// doesn't fall back for config.BackSourceReasonNoSpace.
+type DownloadError struct {
+	Kind   error
+	Reason int
+	Err    error
+}
+
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("%v(reason:%d): %v", e.Kind, e.Reason, e.Err)
+}
+
+// newDownloadError creates the DownloadError of the failure err of the
+// download from the source by reason. The DFGetErrors are returned as is
+// since they carry their own codes.
+func newDownloadError(reason int, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*dferrors.DFGetError); ok {
+		return err
+	}
+	kind := ErrBackSource
+	switch reason % config.ForceNotBackSourceAddition {
+	case config.BackSourceReasonSourceError:
+		kind = ErrSourceError
+	case config.BackSourceReasonNoSpace:
+		kind = ErrInsufficientSpace
+	case config.BackSourceReasonDownloadError, config.BackSourceReasonQueueTimeout,
+		config.BackSourceReasonPullRetries:
+		kind = ErrAllPiecesFailed
+	}
+	return &DownloadError{Kind: kind, Reason: reason, Err: err}
+}
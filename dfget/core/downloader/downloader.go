@@ -22,16 +22,23 @@
 package downloader
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
-	"strings"
+	"net/url"
+	"os"
+	"path"
+	"sync"
 	"time"
 
 	"github.com/dragonflyoss/Dragonfly/dfget/config"
 	"github.com/dragonflyoss/Dragonfly/dfget/core/api"
 	"github.com/dragonflyoss/Dragonfly/dfget/core/regist"
 	"github.com/dragonflyoss/Dragonfly/dfget/util"
-	"github.com/sirupsen/logrus"
+
+	"golang.org/x/net/http2"
 )
 
 // Downloader is the interface to download files
@@ -40,6 +47,48 @@ type Downloader interface {
 	Cleanup()
 }
 
+// New creates the Downloader selected by the cfg: the BackDownloader if the
+// file is downloaded from the source for Cfg.BackSourceReason, or the
+// P2PDownloader downloading by the registration result otherwise. It returns
+// an error if the cfg can't be downloaded by any of them.
+func New(cfg *config.Config, supernodeAPI api.SupernodeAPI,
+	register regist.SupernodeRegister, result *regist.RegisterResult) (Downloader, error) {
+	if err := validateConfig(cfg, result); err != nil {
+		return nil, err
+	}
+	if cfg.BackSourceReason > 0 {
+		return NewBackDownloader(cfg, result), nil
+	}
+	return NewP2PDownloader(cfg, supernodeAPI, register, result), nil
+}
+
+// validateConfig returns the error of the bad combinations of the cfg for
+// the downloaders created by New.
+func validateConfig(cfg *config.Config, result *regist.RegisterResult) error {
+	if cfg.BackSourceOnly && cfg.Notbs {
+		return fmt.Errorf("back source only conflicts with not back source")
+	}
+	if cfg.Seed && (cfg.BackSourceOnly || !util.IsEmptyStr(cfg.RequestRange)) {
+		return fmt.Errorf("seed conflicts with back source only and the range requested")
+	}
+	if cfg.BackSourceReason <= 0 {
+		if result == nil {
+			return fmt.Errorf("download from peers without registering to the supernodes")
+		}
+		return nil
+	}
+	if cfg.DryRun {
+		return fmt.Errorf("dry run can't register to the supernodes, reason:%d", cfg.BackSourceReason)
+	}
+	if cfg.Seed {
+		return fmt.Errorf("seed can't register to the supernodes, reason:%d", cfg.BackSourceReason)
+	}
+	if util.IsEmptyStr(cfg.URL) {
+		return fmt.Errorf("back source without the url of the source, reason:%d", cfg.BackSourceReason)
+	}
+	return nil
+}
+
 // NewBackDownloader create BackDownloader
 func NewBackDownloader(cfg *config.Config, result *regist.RegisterResult) Downloader {
 	var (
@@ -53,8 +102,10 @@ func NewBackDownloader(cfg *config.Config, result *regist.RegisterResult) Downlo
 	return &BackDownloader{
 		Cfg:     cfg,
 		URL:     cfg.URL,
+		Mirrors: cfg.Mirrors,
 		Target:  cfg.RV.RealTarget,
 		Md5:     cfg.Md5,
+		Digest:  cfg.Digest,
 		TaskID:  taskID,
 		Node:    node,
 		Total:   0,
@@ -78,76 +129,289 @@ func NewP2PDownloader(cfg *config.Config,
 }
 
 // DoDownloadTimeout downloads the file and waits for response during
-// the given timeout duration.
-func DoDownloadTimeout(downloader Downloader, timeout time.Duration) error {
+// the given timeout duration, the downloaders which honor Cfg.Timeout by
+// themselves are waited for longer to stop. Once the timeout expires, the
+// download is stopped and waited for to release its files before writing
+// the partial target and cleaning up, or abandoned with its files left if
+// it doesn't stop in config.TimeoutStopGrace. The download finishing by
+// itself while being stopped returns its own result. The summary of the
+// download is written into Cfg.SummaryFile once it returns.
+func DoDownloadTimeout(downloader Downloader, timeout time.Duration) (err error) {
+	if s, ok := downloader.(summarizer); ok {
+		defer func() { s.writeSummary(err) }()
+	}
 	if timeout <= 0 {
 		return fmt.Errorf("download timeout(%.3fs)", timeout.Seconds())
 	}
+	limit := timeout
+	if th, ok := downloader.(timeoutHonorer); ok {
+		limit = th.runTimeout(timeout)
+	}
 
-	var ch = make(chan error)
+	err = fmt.Errorf("download timeout(%.3fs)", timeout.Seconds())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var ch = make(chan error, 1)
+	s, stoppable := downloader.(stopper)
 	go func() {
+		if stoppable {
+			ch <- s.runUntil(ctx, err)
+			return
+		}
 		ch <- downloader.Run()
 	}()
-	var err error
 	select {
-	case err = <-ch:
-		return err
-	case <-time.After(timeout):
-		err = fmt.Errorf("download timeout(%.3fs)", timeout.Seconds())
-		downloader.Cleanup()
+	case e := <-ch:
+		return e
+	case <-time.After(limit):
 	}
-	return err
-}
 
-func convertHeaders(headers []string) map[string]string {
-	if len(headers) == 0 {
-		return nil
-	}
-	hm := make(map[string]string)
-	for _, header := range headers {
-		kv := strings.SplitN(header, ":", 2)
-		if len(kv) != 2 {
-			continue
-		}
-		k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
-		if v == "" {
-			continue
-		}
-		if _, in := hm[k]; in {
-			hm[k] = hm[k] + "," + v
-		} else {
-			hm[k] = v
+	// the download which can't be stopped is abandoned.
+	cancel()
+	if stoppable {
+		select {
+		case e := <-ch:
+			// only the download stopped by the cancel fails by the timeout,
+			// the one finishing by itself meanwhile returns as is.
+			if e != ctx.Err() && e != err {
+				return e
+			}
+		case <-time.After(config.TimeoutStopGrace):
+			return err
 		}
 	}
-	return hm
+	if pw, ok := downloader.(partialWriter); ok {
+		err = pw.writePartial(err)
+	}
+	downloader.Cleanup()
+	return err
 }
 
-func moveFile(src string, dst string, expectMd5 string, log *logrus.Logger) error {
+func moveFile(cfg *config.Config, src string, dst string, expectMd5 string) error {
+	log := cfg.Log()
 	start := time.Now()
 	if expectMd5 != "" {
-		realMd5 := util.Md5Sum(src)
-		log.Infof("compute raw md5:%s for file:%s cost:%.3fs", realMd5,
+		realMd5 := fileDigest(src, expectMd5)
+		log.Infof("compute raw digest:%s for file:%s cost:%.3fs", realMd5,
 			src, time.Since(start).Seconds())
 		if realMd5 != expectMd5 {
-			return fmt.Errorf("Md5NotMatch, real:%s expect:%s", realMd5, expectMd5)
+			return &md5NotMatchError{real: realMd5, expect: expectMd5}
 		}
 	}
-	err := util.MoveFile(src, dst)
+	err := moveFunc(src, dst)
+	for retries := 0; err != nil && transientReadOnly(cfg, dst, err, start); retries++ {
+		log.Warnf("move src:%s to dst:%s error:%v, retry(%d) after %v",
+			src, dst, err, retries+1, config.MoveRetryInterval)
+		time.Sleep(config.MoveRetryInterval)
+		err = moveFunc(src, dst)
+	}
 
 	log.Infof("move src:%s to dst:%s result:%t cost:%.3f",
 		src, dst, err == nil, time.Since(start).Seconds())
 	return err
 }
 
+// fileDigest computes the digest of the file in the algorithm of the digest
+// expected, which is a md5 or in the form of util.ParseDigest.
+func fileDigest(file string, expected string) string {
+	algorithm, _ := util.ParseDigest(expected)
+	return util.DigestSum(file, algorithm)
+}
+
+// digestAlgorithm returns the algorithm of the digest the downloaded file is
+// verified by, which is the one of Cfg.Digest or md5.
+func digestAlgorithm(cfg *config.Config) string {
+	if util.IsEmptyStr(cfg.Digest) {
+		return util.DigestMd5
+	}
+	algorithm, _ := util.ParseDigest(cfg.Digest)
+	return algorithm
+}
+
+// moveFunc moves the file src to dst, it's replaceable for testing.
+var moveFunc = util.MoveFile
+
+// readOnlyMount reports whether the filesystem the path is on is mounted
+// read-only, it's replaceable for testing.
+var readOnlyMount = util.IsReadOnlyMount
+
+// transientReadOnly returns whether the move failed by err since the dst is
+// read-only for a while, such as the dataset being snapshotted, and it can
+// be retried within Cfg.MoveRetryTimeout since the move started. The dst on
+// a read-only mount fails fast.
+func transientReadOnly(cfg *config.Config, dst string, err error, start time.Time) bool {
+	if cfg.MoveRetryTimeout <= 0 || !util.IsReadOnlyError(err) ||
+		time.Since(start)+config.MoveRetryInterval > cfg.MoveRetryTimeout {
+		return false
+	}
+	return !readOnlyMount(path.Dir(dst))
+}
+
+// readBackVerify re-reads the moved file dst and checks whether its digest
+// equals to expectMd5 to detect corruptions happened in the storage layer.
+// The dst will be removed if it doesn't match.
+func readBackVerify(dst string, expectMd5 string, log Logger) error {
+	start := time.Now()
+	realMd5 := fileDigest(dst, expectMd5)
+	log.Infof("read back digest:%s for file:%s cost:%.3fs", realMd5,
+		dst, time.Since(start).Seconds())
+	if realMd5 != expectMd5 {
+		os.Remove(dst)
+		return fmt.Errorf("read back verify failed, real:%s expect:%s", realMd5, expectMd5)
+	}
+	return nil
+}
+
 func httpGetWithHeaders(url string, headers map[string]string) (*http.Response, error) {
+	return httpGetWithClient(http.DefaultClient, url, headers)
+}
+
+func httpGetWithClient(client *http.Client, url string, headers map[string]string) (*http.Response, error) {
+	return httpGetWithContext(context.Background(), client, url, headers)
+}
+
+// httpGetWithContext sends the request which is aborted once the ctx is
+// done.
+func httpGetWithContext(ctx context.Context, client *http.Client, url string,
+	headers map[string]string) (*http.Response, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ctx)
 
 	for k, v := range headers {
 		req.Header.Add(k, v)
 	}
 
-	return http.DefaultClient.Do(req)
+	return client.Do(req)
+}
+
+// peerHTTPClients caches the http clients used to fetch pieces from peers,
+// the key is the peerClientKey. The clients are shared by all the
+// PowerClients, so that the connections to the peers are kept alive and
+// reused across the pieces.
+var peerHTTPClients sync.Map
+
+// peerClientKey is the settings of the http client fetching pieces from
+// peers: the local ip which the connections are bound to, the idle
+// connections kept per peer and whether HTTP/2 is used.
+type peerClientKey struct {
+	localIP string
+	maxIdle int
+	http2   bool
+}
+
+// reachablePeers are the peers which served a piece by the pooled
+// connections, their connectivity isn't checked before fetching pieces.
+var reachablePeers sync.Map
+
+// peerLocalIP returns the local ip that the connections to peers should be
+// bound to, it's empty if the PeerInterface isn't specified.
+func peerLocalIP(cfg *config.Config) string {
+	if util.IsEmptyStr(cfg.PeerInterface) {
+		return ""
+	}
+	return cfg.RV.PeerIP
+}
+
+// peerHTTPClient returns the http client fetching pieces from peers by the
+// cfg, whose connections are bound to the peerLocalIP and kept alive for
+// Cfg.PeerMaxIdleConnsPerHost per peer. The requests are sent by HTTP/2
+// without TLS if Cfg.PeerHTTP2 is set.
+func peerHTTPClient(cfg *config.Config) *http.Client {
+	key := peerClientKey{
+		localIP: peerLocalIP(cfg),
+		maxIdle: cfg.PeerMaxIdleConnsPerHost,
+		http2:   cfg.PeerHTTP2,
+	}
+	if key.maxIdle <= 0 {
+		key.maxIdle = config.DefaultPeerMaxIdleConnsPerHost
+	}
+	if c, ok := peerHTTPClients.Load(key); ok {
+		return c.(*http.Client)
+	}
+	dialer := util.NewDialer(key.localIP, 30*time.Second)
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: key.maxIdle,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if key.http2 {
+		// the pieces are multiplexed over one connection to each peer.
+		transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+		}
+	}
+	c, _ := peerHTTPClients.LoadOrStore(key, &http.Client{Transport: transport})
+	return c.(*http.Client)
+}
+
+// sourceHTTPClients caches the http clients used to request the origins,
+// the key is the Cfg.BackSourceProxy.
+var sourceHTTPClients sync.Map
+
+// sourceHeaders returns the headers of the requests to the origins, the
+// Cfg.BackSourceHeaders override the Cfg.Header of the same names. The
+// User-Agent of the Cfg is sent unless either of them sets one.
+func sourceHeaders(cfg *config.Config) map[string]string {
+	headers := util.ConvertHeaders(cfg.Header)
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	for k, v := range cfg.BackSourceHeaders {
+		for name := range headers {
+			if http.CanonicalHeaderKey(name) == http.CanonicalHeaderKey(k) {
+				delete(headers, name)
+			}
+		}
+		headers[k] = v
+	}
+	for name := range headers {
+		if http.CanonicalHeaderKey(name) == "User-Agent" {
+			return headers
+		}
+	}
+	headers["User-Agent"] = cfg.EffectiveUserAgent()
+	return headers
+}
+
+// sourceHTTPClient returns the http client whose requests to the origins go
+// through the proxy chosen by sourceProxy.
+func sourceHTTPClient(cfg *config.Config) *http.Client {
+	if c, ok := sourceHTTPClients.Load(cfg.BackSourceProxy); ok {
+		return c.(*http.Client)
+	}
+	defaults := http.DefaultTransport.(*http.Transport)
+	transport := &http.Transport{
+		Proxy:                 sourceProxy(cfg),
+		DialContext:           defaults.DialContext,
+		MaxIdleConns:          defaults.MaxIdleConns,
+		IdleConnTimeout:       defaults.IdleConnTimeout,
+		TLSHandshakeTimeout:   defaults.TLSHandshakeTimeout,
+		ExpectContinueTimeout: defaults.ExpectContinueTimeout,
+	}
+	c, _ := sourceHTTPClients.LoadOrStore(cfg.BackSourceProxy, &http.Client{Transport: transport})
+	return c.(*http.Client)
+}
+
+// sourceProxy returns the proxy of the requests to the origins, which is
+// the Cfg.BackSourceProxy if it's set, or the one of the environment by
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY as the other go http clients.
+func sourceProxy(cfg *config.Config) func(*http.Request) (*url.URL, error) {
+	if util.IsEmptyStr(cfg.BackSourceProxy) {
+		return http.ProxyFromEnvironment
+	}
+	proxy, err := url.Parse(cfg.BackSourceProxy)
+	if err != nil {
+		cfg.Log().Warnf("invalid back source proxy:%s, use the proxy of the environment", cfg.BackSourceProxy)
+		return http.ProxyFromEnvironment
+	}
+	return http.ProxyURL(proxy)
 }
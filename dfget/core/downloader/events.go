@@ -0,0 +1,141 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"time"
+)
+
+// EventType is the type of an Event of the P2PDownloader.
+type EventType string
+
+// The types of the events.
+const (
+	// EventProgress is sent whenever a piece is downloaded.
+	EventProgress EventType = "progress"
+	// EventMigration is sent after registering to another supernode.
+	EventMigration EventType = "migration"
+	// EventBackSource is sent before downloading from the source.
+	EventBackSource EventType = "backSource"
+	// EventComplete is the last event sent when Run returns.
+	EventComplete EventType = "complete"
+)
+
+// Event is a change of the state of the download delivered by
+// P2PDownloader.Events.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Node and TaskID are the supernode and the task the download is from.
+	Node   string
+	TaskID string
+	// Completed is the number of bytes downloaded from peers.
+	Completed int64
+	// Err is the error Run returns for EventComplete, nil if it succeeds.
+	Err error
+}
+
+// Events returns the channel delivering the events of the download if
+// Cfg.EventBufferSize is positive, otherwise it returns nil.
+//
+// The channel is buffered by Cfg.EventBufferSize, and the events are dropped
+// instead of blocking the download if it's full, so the consumer should
+// receive them promptly. The last event is EventComplete, and the channel is
+// closed after Run returns.
+func (p2p *P2PDownloader) Events() <-chan Event {
+	if p2p.events == nil {
+		return nil
+	}
+	return p2p.events
+}
+
+// emit sends the event without blocking, the Node and the TaskID are the
+// current ones if the Node is empty. It's called by the goroutine running
+// Run only.
+func (p2p *P2PDownloader) emit(e Event) {
+	p2p.progress.update(progressState(e), p2p.completed, p2p.Cfg.RV.FileLength)
+	if p2p.events == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Completed = p2p.total
+	if e.Node == "" {
+		e.Node, e.TaskID = p2p.node, p2p.taskID
+	}
+	select {
+	case p2p.events <- e:
+	default:
+		p2p.droppedEvents++
+	}
+}
+
+// reportProgress calls Cfg.ProgressFunc with the downloaded bytes, the
+// length of the file is the downloaded bytes if it's unknown after the
+// download succeeds.
+func (p2p *P2PDownloader) reportProgress(final bool) {
+	if p2p.Cfg.ProgressFunc == nil {
+		return
+	}
+	total := p2p.Cfg.RV.FileLength
+	if final && total < 0 {
+		total = p2p.completed
+	}
+	p2p.Cfg.ProgressFunc(p2p.completed, total)
+}
+
+// pieceDone calls Cfg.OnPieceDone with the piece downloaded from the peer
+// servedBy, the pieces kept without content aren't reported.
+func (p2p *P2PDownloader) pieceDone(item *Piece, servedBy string) {
+	if p2p.Cfg.OnPieceDone == nil || item.Content.Len() == 0 {
+		return
+	}
+	var n int64
+	if raw := item.RawContent(); raw != nil {
+		n = int64(raw.Len())
+	}
+	p2p.Cfg.OnPieceDone(item.Range, servedBy, n, item.cost)
+}
+
+// closeEvents sends EventComplete with the result of Run and closes the
+// channel and the progress stream.
+func (p2p *P2PDownloader) closeEvents(err error) {
+	p2p.emit(Event{Type: EventComplete, Err: err})
+	p2p.progress.close()
+	if p2p.events == nil {
+		return
+	}
+	if p2p.droppedEvents > 0 {
+		p2p.Cfg.Log().Infof("dropped %d events since the channel is full", p2p.droppedEvents)
+	}
+	close(p2p.events)
+}
+
+// progressState returns the state of the progress frame for the event.
+func progressState(e Event) ProgressState {
+	switch e.Type {
+	case EventMigration:
+		return ProgressMigrating
+	case EventBackSource:
+		return ProgressBackSource
+	case EventComplete:
+		if e.Err != nil {
+			return ProgressFailed
+		}
+		return ProgressSucceeded
+	}
+	return ProgressRunning
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+// linkTargets hard links or copies the target to each of the
+// Cfg.ExtraTargets by linkOrCopy.
+func linkTargets(cfg *config.Config, target string) error {
+	for _, extra := range cfg.ExtraTargets {
+		if err := util.CreateDirectory(path.Dir(extra)); err != nil {
+			return err
+		}
+		if err := linkOrCopy(cfg, target, extra); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncTargets fsyncs the targets and their parent directories by Cfg.Fsync,
+// the targets which aren't regular files, such as the stdout, are skipped.
+func syncTargets(cfg *config.Config, targets []string) error {
+	if !cfg.Fsync {
+		return nil
+	}
+	start := time.Now()
+	dirs := make(map[string]bool)
+	for _, target := range targets {
+		if !util.IsRegularFile(target) {
+			continue
+		}
+		if err := util.Fsync(target); err != nil {
+			return fmt.Errorf("fsync file:%s error:%v", target, err)
+		}
+		dirs[path.Dir(target)] = true
+	}
+	for dir := range dirs {
+		if err := util.Fsync(dir); err != nil {
+			return fmt.Errorf("fsync dir:%s error:%v", dir, err)
+		}
+	}
+	cfg.Log().Infof("fsync targets:%v cost:%.3fs", targets, time.Since(start).Seconds())
+	return nil
+}
+
+// linkFunc hard links the src to dst and reflinkFunc clones it, they're
+// replaceable for testing.
+var (
+	linkFunc    = util.Link
+	reflinkFunc = util.Reflink
+)
+
+// linkOrCopy places the src at dst by Cfg.LinkStrategy. By default it hard
+// links the src to dst, and copies the src instead if its size is smaller
+// than Cfg.CopyThreshold or linking fails.
+func linkOrCopy(cfg *config.Config, src string, dst string) error {
+	switch cfg.LinkStrategy {
+	case config.LinkStrategyLink:
+		if err := linkFunc(src, dst); err != nil {
+			return fmt.Errorf("link %s to %s error:%v", dst, src, err)
+		}
+		return nil
+	case config.LinkStrategyCopy:
+		return copyFile(src, dst)
+	case config.LinkStrategyReflink:
+		removeFile(dst)
+		if err := reflinkFunc(src, dst); err != nil {
+			cfg.Log().Warnf("reflink %s to %s error:%v, instead of use copy", dst, src, err)
+			return copyFile(src, dst)
+		}
+		return nil
+	}
+	if cfg.CopyThreshold > 0 {
+		if info, err := os.Stat(src); err == nil && info.Size() < cfg.CopyThreshold {
+			return copyFile(src, dst)
+		}
+	}
+	if err := linkFunc(src, dst); err != nil {
+		cfg.Log().Warnf("link %s to %s error:%v, instead of use copy", dst, src, err)
+		return copyFile(src, dst)
+	}
+	return nil
+}
+
+// hardLinks returns whether the downloaded file may be hard linked by
+// Cfg.LinkStrategy.
+func hardLinks(cfg *config.Config) bool {
+	return cfg.LinkStrategy == "" || cfg.LinkStrategy == config.LinkStrategyAuto ||
+		cfg.LinkStrategy == config.LinkStrategyLink
+}
+
+// copyFile copies the src to dst, the existing dst is replaced as linking
+// does.
+func copyFile(src string, dst string) error {
+	removeFile(dst)
+	if err := util.CopyFile(src, dst); err != nil {
+		return fmt.Errorf("copy %s to %s error:%v", src, dst, err)
+	}
+	return nil
+}
+
+// removeFile removes the file at path if it exists and isn't a directory.
+func removeFile(path string) {
+	if util.PathExist(path) && !util.IsDir(path) {
+		util.DeleteFile(path)
+	}
+}
+
+// verifyTargets verifies the digest of all the targets by readBackVerify with
+// at most Cfg.VerifyConcurrency workers concurrently. It fails if any of
+// the targets doesn't match the expectMd5, and the mismatched ones are
+// removed.
+func verifyTargets(cfg *config.Config, targets []string, expectMd5 string) error {
+	concurrency := cfg.VerifyConcurrency
+	if concurrency <= 0 {
+		concurrency = config.DefaultVerifyConcurrency
+	}
+	if concurrency > len(targets) {
+		concurrency = len(targets)
+	}
+
+	start := time.Now()
+	errs := make([]error, len(targets))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				errs[idx] = readBackVerify(targets[idx], expectMd5, cfg.Log())
+			}
+		}()
+	}
+	for idx := range targets {
+		indexes <- idx
+	}
+	close(indexes)
+	wg.Wait()
+
+	var passed, failed []string
+	for idx, err := range errs {
+		if err != nil {
+			failed = append(failed, targets[idx])
+		} else {
+			passed = append(passed, targets[idx])
+		}
+	}
+	cfg.Log().Infof("verify %d targets cost:%.3fs passed:%v failed:%v",
+		len(targets), time.Since(start).Seconds(), passed, failed)
+	if len(failed) > 0 {
+		return fmt.Errorf("read back verify failed, targets:%v", failed)
+	}
+	return nil
+}
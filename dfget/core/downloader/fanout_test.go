@@ -0,0 +1,167 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+	"github.com/go-check/check"
+)
+
+type FanOutTestSuite struct {
+	workHome string
+}
+
+func init() {
+	check.Suite(&FanOutTestSuite{})
+}
+
+func (s *FanOutTestSuite) SetUpSuite(c *check.C) {
+	s.workHome, _ = ioutil.TempDir("/tmp", "dfget-FanOutTestSuite-")
+}
+
+func (s *FanOutTestSuite) TearDownSuite(c *check.C) {
+	if s.workHome != "" {
+		if err := os.RemoveAll(s.workHome); err != nil {
+			fmt.Printf("remove path:%s error", s.workHome)
+		}
+	}
+}
+
+func (s *FanOutTestSuite) TestVerifyTargets(c *check.C) {
+	target := path.Join(s.workHome, "target")
+	expectMd5 := createTestFile(target)
+
+	cfg := helper.CreateConfig(nil, s.workHome)
+	cfg.VerifyConcurrency = 2
+	for i := 0; i < 5; i++ {
+		cfg.ExtraTargets = append(cfg.ExtraTargets,
+			path.Join(s.workHome, fmt.Sprintf("extra/%d/target", i)))
+	}
+	c.Assert(linkTargets(cfg, target), check.IsNil)
+	targets := append([]string{target}, cfg.ExtraTargets...)
+	c.Assert(verifyTargets(cfg, targets, expectMd5), check.IsNil)
+
+	// test: one of the targets is corrupted after copying
+	corrupted := cfg.ExtraTargets[3]
+	os.Remove(corrupted)
+	c.Assert(ioutil.WriteFile(corrupted, []byte("corrupted"), 0644), check.IsNil)
+	err := verifyTargets(cfg, targets, expectMd5)
+	c.Assert(err, check.NotNil)
+	c.Assert(strings.Contains(err.Error(), corrupted), check.Equals, true)
+	for _, t := range targets {
+		c.Assert(util.PathExist(t), check.Equals, t != corrupted)
+	}
+}
+
+func (s *FanOutTestSuite) TestLinkOrCopy(c *check.C) {
+	src := path.Join(s.workHome, "linkOrCopy")
+	c.Assert(ioutil.WriteFile(src, []byte("0123456789"), 0644), check.IsNil)
+	srcInfo, _ := os.Stat(src)
+
+	var cases = []struct {
+		threshold int64
+		linked    bool
+	}{
+		{threshold: 0, linked: true},
+		{threshold: 10, linked: true},
+		{threshold: 11, linked: false},
+	}
+	for idx, v := range cases {
+		cfg := helper.CreateConfig(nil, s.workHome)
+		cfg.CopyThreshold = v.threshold
+		dst := path.Join(s.workHome, fmt.Sprintf("linkOrCopy.%d", idx))
+		c.Assert(linkOrCopy(cfg, src, dst), check.IsNil)
+
+		dstInfo, err := os.Stat(dst)
+		c.Assert(err, check.IsNil)
+		c.Assert(os.SameFile(srcInfo, dstInfo), check.Equals, v.linked,
+			check.Commentf("threshold:%d", v.threshold))
+		c.Assert(util.Md5Sum(dst), check.Equals, util.Md5Sum(src))
+	}
+}
+
+func (s *FanOutTestSuite) TestLinkOrCopy_Strategy(c *check.C) {
+	src := path.Join(s.workHome, "strategy")
+	c.Assert(ioutil.WriteFile(src, []byte("0123456789"), 0644), check.IsNil)
+	srcInfo, _ := os.Stat(src)
+	defer func() { linkFunc = util.Link }()
+
+	var cases = []struct {
+		strategy   string
+		linkFailed bool
+		linked     bool
+		err        bool
+	}{
+		{strategy: config.LinkStrategyAuto, linked: true},
+		{strategy: config.LinkStrategyAuto, linkFailed: true},
+		{strategy: config.LinkStrategyLink, linked: true},
+		{strategy: config.LinkStrategyLink, linkFailed: true, err: true},
+		{strategy: config.LinkStrategyCopy},
+		{strategy: config.LinkStrategyReflink},
+	}
+	for idx, v := range cases {
+		linkFunc = util.Link
+		if v.linkFailed {
+			linkFunc = func(src string, linkName string) error {
+				return fmt.Errorf("invalid cross-device link")
+			}
+		}
+		cfg := helper.CreateConfig(nil, s.workHome)
+		cfg.LinkStrategy = v.strategy
+		dst := path.Join(s.workHome, fmt.Sprintf("strategy.%d", idx))
+		// the existing dst is replaced
+		c.Assert(ioutil.WriteFile(dst, []byte("stale"), 0644), check.IsNil)
+		err := linkOrCopy(cfg, src, dst)
+		comment := check.Commentf("case:%d strategy:%s", idx, v.strategy)
+		if v.err {
+			c.Assert(err, check.ErrorMatches, ".*cross-device.*", comment)
+			continue
+		}
+		c.Assert(err, check.IsNil, comment)
+
+		dstInfo, err := os.Stat(dst)
+		c.Assert(err, check.IsNil)
+		c.Assert(os.SameFile(srcInfo, dstInfo), check.Equals, v.linked, comment)
+		c.Assert(util.Md5Sum(dst), check.Equals, util.Md5Sum(src), comment)
+	}
+}
+
+func (s *FanOutTestSuite) TestSyncTargets(c *check.C) {
+	target := path.Join(s.workHome, "sync/target")
+	os.MkdirAll(path.Dir(target), 0755)
+	c.Assert(ioutil.WriteFile(target, []byte("0123456789"), 0644), check.IsNil)
+	targets := []string{target, "/dev/stdout"}
+
+	cfg := helper.CreateConfig(nil, s.workHome)
+	logger := &recordingLogger{}
+	cfg.Logger = logger
+	c.Assert(syncTargets(cfg, targets), check.IsNil)
+	c.Assert(logger.logs, check.HasLen, 0)
+
+	cfg.Fsync = true
+	c.Assert(syncTargets(cfg, targets), check.IsNil)
+	c.Assert(logger.logs, check.HasLen, 1)
+	c.Assert(strings.HasPrefix(logger.logs[0], "info fsync targets:"), check.Equals, true)
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+// ListEntry is a file of the list of Cfg.ListURL.
+type ListEntry struct {
+	// Path is the path of the file relative to the list, which is also the
+	// path of it under the output directory.
+	Path string
+	URL  string
+	Md5  string
+}
+
+// FetchList downloads the list of Cfg.ListURL from the source and returns
+// its files matching Cfg.ListPattern.
+func FetchList(cfg *config.Config) ([]ListEntry, error) {
+	base, err := url.Parse(cfg.ListURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid list url:%s error:%v", cfg.ListURL, err)
+	}
+	resp, err := httpGetWithClient(sourceHTTPClient(cfg), cfg.ListURL, sourceHeaders(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("get list:%s error:%v", cfg.ListURL, err)
+	}
+	defer resp.Body.Close()
+	if !util.HTTPStatusOk(resp.StatusCode) {
+		return nil, fmt.Errorf("get list:%s failed, code:%d", cfg.ListURL, resp.StatusCode)
+	}
+	return parseList(base, resp.Body, cfg.ListPattern)
+}
+
+// parseList parses the list whose lines are the paths of the files relative
+// to the base url, each optionally followed by its md5. The blank lines and
+// the ones starting with '#' are ignored, and the paths out of the list's
+// directory are refused.
+func parseList(base *url.URL, r io.Reader, pattern string) ([]ListEntry, error) {
+	var (
+		entries []ListEntry
+		seen    = make(map[string]bool)
+	)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d of list: %q has more than the path and the md5", n, line)
+		}
+		p := path.Clean(fields[0])
+		if path.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+			return nil, fmt.Errorf("line %d of list: path %q is out of the list's directory", n, fields[0])
+		}
+		if seen[p] {
+			return nil, fmt.Errorf("line %d of list: path %q is duplicated", n, p)
+		}
+		seen[p] = true
+		if pattern != "" {
+			matched, err := path.Match(pattern, p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid list pattern:%s error:%v", pattern, err)
+			}
+			if !matched {
+				continue
+			}
+		}
+		entry := ListEntry{Path: p, URL: base.ResolveReference(&url.URL{Path: p}).String()}
+		if len(fields) == 2 {
+			entry.Md5 = fields[1]
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read list error:%v", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/go-check/check"
+)
+
+type FileListTestSuite struct {
+}
+
+func init() {
+	check.Suite(&FileListTestSuite{})
+}
+
+func (s *FileListTestSuite) TestParseList(c *check.C) {
+	base, _ := url.Parse("http://source/dir/list?token=1")
+	entries, err := parseList(base, strings.NewReader(
+		"# images\n a.tar md5a \n\nsub/./b.tar\nc.txt\n"), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.DeepEquals, []ListEntry{
+		{Path: "a.tar", URL: "http://source/dir/a.tar", Md5: "md5a"},
+		{Path: "sub/b.tar", URL: "http://source/dir/sub/b.tar"},
+		{Path: "c.txt", URL: "http://source/dir/c.txt"},
+	})
+
+	entries, err = parseList(base, strings.NewReader("a.tar\nsub/b.tar\nc.txt\n"), "*.tar")
+	c.Assert(err, check.IsNil)
+	c.Assert(len(entries), check.Equals, 1)
+	c.Assert(entries[0].Path, check.Equals, "a.tar")
+
+	for _, list := range []string{
+		"a b c\n",
+		"/etc/passwd\n",
+		"../a\n",
+		"sub/../../a\n",
+		".\n",
+		"a\nsub/../a\n",
+	} {
+		_, err = parseList(base, strings.NewReader(list), "")
+		c.Assert(err, check.NotNil, check.Commentf("list:%q", list))
+	}
+	_, err = parseList(base, strings.NewReader("a\n"), "[")
+	c.Assert(err, check.NotNil)
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+// startHeartbeat touches the Cfg.HeartbeatFile every Cfg.HeartbeatInterval
+// as long as the bytes returned by progress increase, the file won't be
+// touched any more once the download stalls. The returned function stops
+// the heartbeat.
+func startHeartbeat(cfg *config.Config, progress func() int64) (stop func()) {
+	if util.IsEmptyStr(cfg.HeartbeatFile) {
+		return func() {}
+	}
+	interval := cfg.HeartbeatInterval
+	if interval <= 0 {
+		interval = config.DefaultHeartbeatInterval
+	}
+	if err := touchFile(cfg.HeartbeatFile); err != nil {
+		cfg.Log().Warnf("touch heartbeat file:%s error:%v", cfg.HeartbeatFile, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last, stalled := progress(), false
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			cur := progress()
+			if cur <= last {
+				if !stalled {
+					cfg.Log().Warnf("no progress in %.3fs, stop touching heartbeat file",
+						interval.Seconds())
+				}
+				stalled = true
+				continue
+			}
+			last, stalled = cur, false
+			if err := touchFile(cfg.HeartbeatFile); err != nil {
+				cfg.Log().Warnf("touch heartbeat file:%s error:%v", cfg.HeartbeatFile, err)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// touchFile updates the mtime of the file, and creates it if not exist.
+func touchFile(name string) error {
+	now := time.Now()
+	err := os.Chtimes(name, now, now)
+	if !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/go-check/check"
+)
+
+type HeartbeatTestSuite struct {
+	workHome string
+}
+
+func init() {
+	check.Suite(&HeartbeatTestSuite{})
+}
+
+func (s *HeartbeatTestSuite) SetUpSuite(c *check.C) {
+	s.workHome, _ = ioutil.TempDir("/tmp", "dfget-HeartbeatTestSuite-")
+}
+
+func (s *HeartbeatTestSuite) TearDownSuite(c *check.C) {
+	if s.workHome != "" {
+		if err := os.RemoveAll(s.workHome); err != nil {
+			fmt.Printf("remove path:%s error", s.workHome)
+		}
+	}
+}
+
+func (s *HeartbeatTestSuite) TestStartHeartbeat(c *check.C) {
+	cfg := helper.CreateConfig(nil, s.workHome)
+	cfg.HeartbeatFile = path.Join(s.workHome, "heartbeat")
+	cfg.HeartbeatInterval = 20 * time.Millisecond
+
+	var progress int64
+	stop := startHeartbeat(cfg, func() int64 {
+		return atomic.LoadInt64(&progress)
+	})
+	defer stop()
+	start := s.modTime(c, cfg.HeartbeatFile)
+
+	// test: the heartbeat file is touched while making progress
+	for i := 0; i < 5; i++ {
+		atomic.AddInt64(&progress, 1)
+		time.Sleep(cfg.HeartbeatInterval)
+	}
+	touched := s.modTime(c, cfg.HeartbeatFile)
+	c.Assert(touched.After(start), check.Equals, true)
+
+	// test: the heartbeat file isn't touched once the progress stalls
+	time.Sleep(2 * cfg.HeartbeatInterval)
+	stalled := s.modTime(c, cfg.HeartbeatFile)
+	time.Sleep(5 * cfg.HeartbeatInterval)
+	c.Assert(s.modTime(c, cfg.HeartbeatFile), check.Equals, stalled)
+}
+
+func (s *HeartbeatTestSuite) modTime(c *check.C, name string) time.Time {
+	info, err := os.Stat(name)
+	c.Assert(err, check.IsNil)
+	return info.ModTime()
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+// hostLockState is the content of the lock file of a task, it's written by
+// the holder of the lock once it downloads the file successfully.
+type hostLockState struct {
+	ServiceFile string `json:"serviceFile"`
+	FileLength  int64  `json:"fileLength"`
+}
+
+// hostLock is the lock of a task shared by the dfget processes on the host
+// when Cfg.HostDedup is set. It's an flock of the lock file, so it's
+// released by the system once the holder exits, even if it crashes.
+type hostLock struct {
+	path string
+	file *os.File
+	// locked indicates whether the lock is held by this process.
+	locked bool
+}
+
+// newHostLock opens the lock file of the task in the data dir.
+func newHostLock(dataDir, taskID string) (*hostLock, error) {
+	path := filepath.Join(dataDir, taskID+".lock")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &hostLock{path: path, file: f}, nil
+}
+
+// tryLock tries to acquire the lock without blocking, and returns whether
+// it's held by this process.
+func (l *hostLock) tryLock() bool {
+	if !l.locked {
+		l.locked = syscall.Flock(int(l.file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil
+	}
+	return l.locked
+}
+
+// state returns the state written by the previous holder of the lock, it's
+// nil if the previous holder failed or crashed.
+func (l *hostLock) state() *hostLockState {
+	b, err := ioutil.ReadFile(l.path)
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	s := new(hostLockState)
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil
+	}
+	return s
+}
+
+// release records the state if it isn't nil and releases the lock, the
+// stale state is cleared otherwise so that the waiters don't reuse it.
+func (l *hostLock) release(s *hostLockState) {
+	if !l.locked {
+		return
+	}
+	var b []byte
+	if s != nil {
+		b, _ = json.Marshal(s)
+	}
+	if err := l.file.Truncate(0); err == nil {
+		l.file.WriteAt(b, 0)
+	}
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.locked = false
+}
+
+// initHostLock opens the lock of the task and tries to acquire it if
+// Cfg.HostDedup is set, the lock held by another process is waited for by
+// awaitHostLock.
+func (p2p *P2PDownloader) initHostLock() {
+	if !p2p.Cfg.HostDedup || p2p.hostLock != nil {
+		return
+	}
+	lock, err := newHostLock(p2p.Cfg.RV.DataDir, p2p.taskID)
+	if err != nil {
+		p2p.Cfg.Log().Warnf("open lock of task:%s error:%v, download without dedup", p2p.taskID, err)
+		return
+	}
+	p2p.hostLock = lock
+	lock.tryLock()
+}
+
+// awaitHostLock waits for the other process holding the lock of the task
+// until the ctx is done, and returns true if the file it downloaded is
+// reused as the target.
+func (p2p *P2PDownloader) awaitHostLock() (bool, error) {
+	lock := p2p.hostLock
+	if lock == nil {
+		return false, nil
+	}
+	if !lock.locked {
+		p2p.Cfg.Log().Infof("wait for the other process downloading task:%s", p2p.taskID)
+	}
+	for !lock.tryLock() {
+		select {
+		case <-p2p.ctx.Done():
+			return false, p2p.ctx.Err()
+		case <-time.After(config.HostLockPollInterval):
+		}
+	}
+	s := lock.state()
+	if s == nil || !p2p.reusable(s) {
+		return false, nil
+	}
+	if util.IsRegularFile(p2p.targetFile) {
+		os.Remove(p2p.targetFile)
+	}
+	if err := linkOrCopy(p2p.Cfg, s.ServiceFile, p2p.targetFile); err != nil {
+		p2p.Cfg.Log().Warnf("reuse file:%s error:%v, download it again", s.ServiceFile, err)
+		return false, nil
+	}
+	if expect := p2p.expectedDigest(); expect != "" {
+		if err := verifyTargets(p2p.Cfg, []string{p2p.targetFile}, expect); err != nil {
+			p2p.Cfg.Log().Warnf("reuse file:%s error:%v, download it again", s.ServiceFile, err)
+			return false, nil
+		}
+	}
+	p2p.Cfg.Log().Infof("reuse file:%s downloaded by the other process for task:%s",
+		s.ServiceFile, p2p.taskID)
+	// the next waiter reuses the same file
+	lock.release(s)
+	return true, nil
+}
+
+// closeHostLock releases the lock of the task if it's still held and closes
+// the lock file.
+func (p2p *P2PDownloader) closeHostLock() {
+	if p2p.hostLock == nil {
+		return
+	}
+	p2p.hostLock.release(nil)
+	p2p.hostLock.file.Close()
+	p2p.hostLock = nil
+}
+
+// reusable returns whether the service file recorded by the previous holder
+// of the lock is still complete.
+func (p2p *P2PDownloader) reusable(s *hostLockState) bool {
+	info, err := os.Stat(s.ServiceFile)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != s.FileLength {
+		return false
+	}
+	length := p2p.Cfg.RV.FileLength
+	return length <= 0 || length == s.FileLength
+}
+
+// releaseHostLock records the service file downloaded for the waiters and
+// releases the lock of the task once the download succeeds, the failed
+// download releases it by closeHostLock.
+func (p2p *P2PDownloader) releaseHostLock() {
+	if p2p.hostLock == nil {
+		return
+	}
+	var s *hostLockState
+	if p2p.Cfg.RV.PeerPort > 0 && util.PathExist(p2p.serviceFilePath) {
+		// the service file is kept only if it's served by the peer server
+		s = &hostLockState{ServiceFile: p2p.serviceFilePath, FileLength: p2p.completed}
+	}
+	p2p.hostLock.release(s)
+}
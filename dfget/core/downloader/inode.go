@@ -0,0 +1,76 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/errors"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+// inodesNeeded estimates the number of the inodes the download creates in
+// each directory. The pieces are assembled in the service file, so it
+// doesn't depend on the number of the pieces.
+func inodesNeeded(cfg *config.Config) map[string]uint64 {
+	needed := make(map[string]uint64)
+	// the service file and the task file
+	needed[cfg.RV.DataDir] += 2
+	if cfg.CompressServiceFile {
+		needed[cfg.RV.DataDir]++
+	}
+	if len(cfg.MetaHeaders) > 0 {
+		needed[filepath.Dir(cfg.RV.RealTarget)]++
+	}
+	for _, f := range append([]string{cfg.RecordFile, cfg.ManifestFile, cfg.HeartbeatFile},
+		cfg.ExtraTargets...) {
+		if !util.IsEmptyStr(f) {
+			needed[filepath.Dir(f)]++
+		}
+	}
+	return needed
+}
+
+// checkInodes fails with config.CodeNoInodes if any filesystem the download
+// writes to has fewer free inodes than needed plus config.InodeReserve. The
+// filesystems without a fixed number of inodes and the directories that
+// can't be inspected are skipped.
+func checkInodes(cfg *config.Config, freeInodes func(string) (uint64, uint64, error)) error {
+	needed := inodesNeeded(cfg)
+	dirs := make([]string, 0, len(needed))
+	for dir := range needed {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		free, total, err := freeInodes(dir)
+		if err != nil || total == 0 {
+			cfg.Log().Infof("skip checking the inodes of dir:%s total:%d error:%v",
+				dir, total, err)
+			continue
+		}
+		if free < needed[dir]+config.InodeReserve {
+			return errors.New(config.CodeNoInodes, fmt.Sprintf(
+				"no enough free inodes in dir:%s, free:%d needed:%d reserved:%d",
+				dir, free, needed[dir], config.InodeReserve))
+		}
+	}
+	return nil
+}
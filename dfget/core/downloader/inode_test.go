@@ -0,0 +1,67 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/dragonflyoss/Dragonfly/dfget/errors"
+	"github.com/go-check/check"
+)
+
+type InodeTestSuite struct {
+}
+
+func init() {
+	check.Suite(&InodeTestSuite{})
+}
+
+func (s *InodeTestSuite) TestCheckInodes(c *check.C) {
+	cfg := helper.CreateConfig(nil, "/tmp")
+	cfg.RV.DataDir = "/data"
+	cfg.RV.RealTarget = "/target/file"
+	cfg.MetaHeaders = []string{"Content-Type"}
+	cfg.ExtraTargets = []string{"/extra/a", "/extra/b"}
+	c.Assert(inodesNeeded(cfg), check.DeepEquals, map[string]uint64{
+		"/data": 2, "/target": 1, "/extra": 2,
+	})
+
+	var cases = []struct {
+		free  uint64
+		total uint64
+		err   error
+		ok    bool
+	}{
+		{free: 2 + config.InodeReserve, total: 100, ok: true},
+		{free: 1 + config.InodeReserve, total: 100, ok: false},
+		// the filesystems without a fixed number of inodes
+		{free: 0, total: 0, ok: true},
+		{err: fmt.Errorf("not supported"), ok: true},
+	}
+	for idx, v := range cases {
+		err := checkInodes(cfg, func(dir string) (uint64, uint64, error) {
+			return v.free, v.total, v.err
+		})
+		c.Assert(err == nil, check.Equals, v.ok, check.Commentf("case:%d", idx))
+		if !v.ok {
+			e, _ := err.(*errors.DFGetError)
+			c.Assert(e.Code, check.Equals, config.CodeNoInodes)
+		}
+	}
+}
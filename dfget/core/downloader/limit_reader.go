@@ -17,10 +17,11 @@
 package downloader
 
 import (
-	"crypto/md5"
 	"fmt"
 	"hash"
 	"io"
+	"math"
+	"sync/atomic"
 
 	"github.com/dragonflyoss/Dragonfly/dfget/util"
 )
@@ -29,26 +30,36 @@ import (
 // src: reader
 // rate: bytes/second
 func NewLimitReader(src io.Reader, rate int, calculateMd5 bool) *LimitReader {
-	var md5sum hash.Hash
+	algorithm := ""
 	if calculateMd5 {
-		md5sum = md5.New()
+		algorithm = util.DigestMd5
 	}
+	return NewDigestLimitReader(src, rate, algorithm)
+}
+
+// NewDigestLimitReader creates a LimitReader which calculates the digest of
+// the algorithm of all contents read, no digest is calculated if the
+// algorithm is empty.
+func NewDigestLimitReader(src io.Reader, rate int, algorithm string) *LimitReader {
 	if rate <= 0 {
 		rate = 10 * 1024 * 1024
 	}
 	rate = (rate/1000 + 1) * 1000
 	return &LimitReader{
-		Src:     src,
-		Limiter: util.NewRateLimiter(int32(rate), 2),
-		md5sum:  md5sum,
+		Src:       src,
+		Limiter:   util.NewRateLimiter(int32(rate), 2),
+		digest:    util.NewDigest(algorithm),
+		algorithm: algorithm,
 	}
 }
 
 // LimitReader read stream with RateLimiter.
 type LimitReader struct {
-	Src     io.Reader
-	Limiter *util.RateLimiter
-	md5sum  hash.Hash
+	Src       io.Reader
+	Limiter   *util.RateLimiter
+	digest    hash.Hash
+	algorithm string
+	count     int64
 }
 
 func (lr *LimitReader) Read(p []byte) (n int, err error) {
@@ -57,18 +68,70 @@ func (lr *LimitReader) Read(p []byte) (n int, err error) {
 		return n, e
 	}
 	if n > 0 {
-		if lr.md5sum != nil {
-			lr.md5sum.Write(p[:n])
+		if lr.digest != nil {
+			lr.digest.Write(p[:n])
 		}
 		lr.Limiter.AcquireBlocking(int32(n))
+		atomic.AddInt64(&lr.count, int64(n))
 	}
 	return n, e
 }
 
+// Count returns the number of bytes read, it's safe to be called while
+// reading.
+func (lr *LimitReader) Count() int64 {
+	return atomic.LoadInt64(&lr.count)
+}
+
 // Md5 calculate the md5 of all contents read
 func (lr *LimitReader) Md5() string {
-	if lr.md5sum != nil {
-		return fmt.Sprintf("%x", lr.md5sum.Sum(nil))
+	if lr.algorithm != util.DigestMd5 {
+		return ""
+	}
+	return lr.Digest()
+}
+
+// Digest returns the digest of all contents read formatted by
+// util.FormatDigest, it's empty if no digest is calculated.
+func (lr *LimitReader) Digest() string {
+	if lr.digest != nil {
+		return util.FormatDigest(lr.algorithm, fmt.Sprintf("%x", lr.digest.Sum(nil)))
 	}
 	return ""
 }
+
+// newSharedLimiter creates the RateLimiter of rate bytes/second shared by the
+// readers of the pieces downloading concurrently, it returns nil if the rate
+// isn't positive.
+func newSharedLimiter(rate int) *util.RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if rate > math.MaxInt32 {
+		rate = math.MaxInt32
+	}
+	return util.NewRateLimiter(int32(rate), 2)
+}
+
+// sharedLimitReader reads stream with the RateLimiter shared by other readers.
+type sharedLimitReader struct {
+	src     io.Reader
+	limiter *util.RateLimiter
+}
+
+// newSharedLimitReader limits reading src by the shared limiter, src is
+// returned as is if the limiter is nil.
+func newSharedLimitReader(src io.Reader, limiter *util.RateLimiter) io.Reader {
+	if limiter == nil {
+		return src
+	}
+	return &sharedLimitReader{src: src, limiter: limiter}
+}
+
+func (r *sharedLimitReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	if n > 0 {
+		r.limiter.AcquireBlocking(int32(n))
+	}
+	return n, err
+}
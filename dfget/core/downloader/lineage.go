@@ -0,0 +1,85 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+	"sort"
+)
+
+// pieceSource describes the piece whose content is written into the service
+// file at an offset.
+type pieceSource struct {
+	taskID    string
+	pieceSize int32
+	length    int64
+}
+
+// taskLineage is the taskIDs the download has been served by since the
+// pieces were reset last time, the pieces of them can be assembled into one
+// file.
+type taskLineage []string
+
+// add appends the taskID if it differs from the last one.
+func (l taskLineage) add(taskID string) taskLineage {
+	if len(l) > 0 && l[len(l)-1] == taskID {
+		return l
+	}
+	return append(l, taskID)
+}
+
+func (l taskLineage) contains(taskID string) bool {
+	for _, id := range l {
+		if id == taskID {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyLineage checks that the written contents cover the file of
+// fileLength exactly, and every one comes from a task of the lineage with
+// the pieceSize. The coverage isn't checked if fileLength is negative.
+func verifyLineage(sources map[int64]pieceSource, lineage taskLineage,
+	pieceSize int32, fileLength int64) error {
+	offsets := make([]int64, 0, len(sources))
+	for off := range sources {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	var expected int64
+	for _, off := range offsets {
+		src := sources[off]
+		if !lineage.contains(src.taskID) {
+			return fmt.Errorf("offset:%d is written by task:%s out of the lineage:%v",
+				off, src.taskID, lineage)
+		}
+		if src.pieceSize != pieceSize {
+			return fmt.Errorf("offset:%d is written by task:%s with pieceSize:%d, expected:%d",
+				off, src.taskID, src.pieceSize, pieceSize)
+		}
+		if fileLength >= 0 && off != expected {
+			return fmt.Errorf("offset:%d is written but expected:%d", off, expected)
+		}
+		expected = off + src.length
+	}
+	if fileLength >= 0 && expected != fileLength {
+		return fmt.Errorf("%d bytes are written but fileLength:%d", expected, fileLength)
+	}
+	return nil
+}
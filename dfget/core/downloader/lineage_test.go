@@ -0,0 +1,55 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"github.com/go-check/check"
+)
+
+type LineageTestSuite struct {
+}
+
+func init() {
+	check.Suite(&LineageTestSuite{})
+}
+
+func (s *LineageTestSuite) TestVerifyLineage(c *check.C) {
+	var lineage taskLineage
+	lineage = lineage.add("a").add("a").add("b")
+	c.Assert(lineage, check.DeepEquals, taskLineage{"a", "b"})
+
+	var cases = []struct {
+		sources    map[int64]pieceSource
+		fileLength int64
+		ok         bool
+	}{
+		{sources: map[int64]pieceSource{0: {"a", 10, 5}, 5: {"b", 10, 3}}, fileLength: 8, ok: true},
+		{sources: map[int64]pieceSource{0: {"a", 10, 5}, 5: {"b", 10, 3}}, fileLength: -1, ok: true},
+		{sources: map[int64]pieceSource{}, fileLength: 0, ok: true},
+		// a cross-task piece
+		{sources: map[int64]pieceSource{0: {"a", 10, 5}, 5: {"stale", 10, 3}}, fileLength: 8, ok: false},
+		// a piece of the stale piece size
+		{sources: map[int64]pieceSource{0: {"a", 20, 5}, 5: {"b", 10, 3}}, fileLength: 8, ok: false},
+		// a gap
+		{sources: map[int64]pieceSource{0: {"a", 10, 5}, 6: {"b", 10, 2}}, fileLength: 8, ok: false},
+		{sources: map[int64]pieceSource{0: {"a", 10, 5}}, fileLength: 8, ok: false},
+	}
+	for idx, v := range cases {
+		err := verifyLineage(v.sources, lineage, 10, v.fileLength)
+		c.Assert(err == nil, check.Equals, v.ok, check.Commentf("case:%d err:%v", idx, err))
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+// localCachePath returns the path of the file of the digest in the local
+// cache dir, which is '<dir>/<algorithm>/<hex>'.
+func localCachePath(dir string, digest string) string {
+	algorithm, encoded := util.ParseDigest(digest)
+	return filepath.Join(dir, algorithm, encoded)
+}
+
+// FromLocalCache places the file of the digest expected by Cfg.Digest or
+// Cfg.Md5 in Cfg.LocalCacheDir at the output, and returns whether it's
+// placed. The cached file is verified before it's placed, and nothing is
+// placed if it's missing, corrupted or the file can't be downloaded as a
+// whole, so that it's downloaded as usual then.
+func FromLocalCache(cfg *config.Config) bool {
+	if util.IsEmptyStr(cfg.LocalCacheDir) || cfg.OutputWriter != nil ||
+		!util.IsEmptyStr(cfg.RequestRange) {
+		return false
+	}
+	expected := cfg.Digest
+	if util.IsEmptyStr(expected) {
+		expected = cfg.Md5
+	}
+	if util.IsEmptyStr(expected) {
+		cfg.Log().Infof("skip local cache dir:%s without the digest of the file", cfg.LocalCacheDir)
+		return false
+	}
+	cached := localCachePath(cfg.LocalCacheDir, expected)
+	info, err := os.Stat(cached)
+	if err != nil || !info.Mode().IsRegular() {
+		cfg.Log().Infof("no file of digest:%s in local cache dir:%s", expected, cfg.LocalCacheDir)
+		return false
+	}
+	if real := fileDigest(cached, expected); real != expected {
+		cfg.Log().Warnf("cached file:%s is corrupted, real:%s expect:%s", cached, real, expected)
+		return false
+	}
+	if err := linkOrCopy(cfg, cached, cfg.RV.RealTarget); err != nil {
+		cfg.Log().Warnf("place cached file:%s error:%v", cached, err)
+		return false
+	}
+	cfg.RV.FileLength = info.Size()
+	cfg.Log().Infof("place cached file:%s at:%s length:%d", cached, cfg.RV.RealTarget, info.Size())
+	return true
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/go-check/check"
+)
+
+type LocalCacheTestSuite struct {
+	workHome string
+}
+
+func init() {
+	check.Suite(&LocalCacheTestSuite{})
+}
+
+func (s *LocalCacheTestSuite) SetUpSuite(c *check.C) {
+	s.workHome, _ = ioutil.TempDir("/tmp", "dfget-LocalCacheTestSuite-")
+}
+
+func (s *LocalCacheTestSuite) TearDownSuite(c *check.C) {
+	if s.workHome != "" {
+		if err := os.RemoveAll(s.workHome); err != nil {
+			fmt.Printf("remove path:%s error", s.workHome)
+		}
+	}
+}
+
+func (s *LocalCacheTestSuite) TestLocalCachePath(c *check.C) {
+	c.Assert(localCachePath("/cache", "abc"), check.Equals, "/cache/md5/abc")
+	c.Assert(localCachePath("/cache", "sha256:abc"), check.Equals, "/cache/sha256/abc")
+}
+
+func (s *LocalCacheTestSuite) TestFromLocalCache(c *check.C) {
+	content := []byte("cached")
+	md5Sum := fmt.Sprintf("%x", md5.Sum(content))
+	sha256Sum := fmt.Sprintf("%x", sha256.Sum256(content))
+	dir := path.Join(s.workHome, "cache")
+	c.Assert(os.MkdirAll(path.Join(dir, "md5"), 0755), check.IsNil)
+	c.Assert(os.MkdirAll(path.Join(dir, "sha256"), 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "md5", md5Sum), content, 0644), check.IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "sha256", sha256Sum), content, 0644), check.IsNil)
+	// the file named by the digest of another content is corrupted
+	corrupted := fmt.Sprintf("%x", md5.Sum([]byte("other")))
+	c.Assert(ioutil.WriteFile(path.Join(dir, "md5", corrupted), content, 0644), check.IsNil)
+
+	var cases = []struct {
+		md5    string
+		digest string
+		placed bool
+	}{
+		{md5: md5Sum, placed: true},
+		{digest: "sha256:" + sha256Sum, placed: true},
+		// the digest is preferred to the md5
+		{md5: md5Sum, digest: "sha256:" + sha256Sum, placed: true},
+		{md5: corrupted, placed: false},
+		{md5: fmt.Sprintf("%x", md5.Sum([]byte("missing"))), placed: false},
+		{placed: false},
+	}
+	for i, v := range cases {
+		cfg := helper.CreateConfig(nil, s.workHome)
+		cfg.LocalCacheDir = dir
+		cfg.LinkStrategy = config.LinkStrategyCopy
+		cfg.Md5 = v.md5
+		cfg.Digest = v.digest
+		cfg.RV.RealTarget = path.Join(s.workHome, fmt.Sprintf("target.%d", i))
+		comment := check.Commentf("case:%d", i)
+		c.Assert(FromLocalCache(cfg), check.Equals, v.placed, comment)
+		if !v.placed {
+			_, err := os.Stat(cfg.RV.RealTarget)
+			c.Assert(os.IsNotExist(err), check.Equals, true, comment)
+			continue
+		}
+		placed, err := ioutil.ReadFile(cfg.RV.RealTarget)
+		c.Assert(err, check.IsNil, comment)
+		c.Assert(string(placed), check.Equals, string(content), comment)
+		c.Assert(cfg.RV.FileLength, check.Equals, int64(len(content)), comment)
+	}
+
+	// the range requested isn't the whole cached file
+	cfg := helper.CreateConfig(nil, s.workHome)
+	cfg.LocalCacheDir = dir
+	cfg.Md5 = md5Sum
+	cfg.RequestRange = "0-1"
+	cfg.RV.RealTarget = path.Join(s.workHome, "target.range")
+	c.Assert(FromLocalCache(cfg), check.Equals, false)
+}
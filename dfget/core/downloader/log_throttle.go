@@ -0,0 +1,103 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// logThrottle suppresses the repeated messages of the hot error paths when
+// a supernode misbehaves: the first message of a format is logged, then at
+// most one message of it every interval together with the number of the
+// ones suppressed since the last logged. A nil logThrottle logs everything.
+type logThrottle struct {
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	formats map[string]*throttledFormat
+}
+
+type throttledFormat struct {
+	logf       func(string, ...interface{})
+	logged     time.Time
+	suppressed int
+}
+
+// newLogThrottle returns nil if the interval isn't positive or everything
+// should be logged in the verbose mode.
+func newLogThrottle(interval time.Duration, verbose bool) *logThrottle {
+	if interval <= 0 || verbose {
+		return nil
+	}
+	return &logThrottle{
+		interval: interval,
+		now:      time.Now,
+		formats:  make(map[string]*throttledFormat),
+	}
+}
+
+// logf logs the message by logf unless the same format is logged within the
+// interval.
+func (t *logThrottle) logf(logf func(string, ...interface{}), format string, args ...interface{}) {
+	if t == nil {
+		logf(format, args...)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	f, ok := t.formats[format]
+	if !ok {
+		t.formats[format] = &throttledFormat{logf: logf, logged: now}
+		logf(format, args...)
+		return
+	}
+	if now.Sub(f.logged) < t.interval {
+		f.suppressed++
+		return
+	}
+	logf(format+suppressedSuffix(f.suppressed, now.Sub(f.logged)), args...)
+	f.logf, f.logged, f.suppressed = logf, now, 0
+}
+
+// flush logs the number of the messages suppressed since the last logged of
+// every format.
+func (t *logThrottle) flush() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	for format, f := range t.formats {
+		if f.suppressed > 0 {
+			f.logf("suppressed %d messages like %q in %.3fs",
+				f.suppressed, format, now.Sub(f.logged).Seconds())
+			f.logged, f.suppressed = now, 0
+		}
+	}
+}
+
+func suppressedSuffix(suppressed int, elapsed time.Duration) string {
+	if suppressed == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (suppressed %d similar messages in %.3fs)", suppressed, elapsed.Seconds())
+}
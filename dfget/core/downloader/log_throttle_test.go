@@ -0,0 +1,69 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-check/check"
+)
+
+type LogThrottleTestSuite struct {
+}
+
+func init() {
+	check.Suite(&LogThrottleTestSuite{})
+}
+
+func (s *LogThrottleTestSuite) TestLogThrottle(c *check.C) {
+	var lines []string
+	var logf = func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	c.Assert(newLogThrottle(0, false), check.IsNil)
+	c.Assert(newLogThrottle(time.Second, true), check.IsNil)
+	var none *logThrottle
+	none.logf(logf, "error:%d", 1)
+	none.flush()
+	c.Assert(lines, check.DeepEquals, []string{"error:1"})
+
+	lines = nil
+	now := time.Unix(100, 0)
+	t := newLogThrottle(time.Second, false)
+	t.now = func() time.Time { return now }
+
+	// test: a burst is logged once
+	for i := 0; i < 1000; i++ {
+		t.logf(logf, "error:%d", i)
+	}
+	t.logf(logf, "other")
+	c.Assert(lines, check.DeepEquals, []string{"error:0", "other"})
+
+	// test: the suppressed count is logged with the next after the interval
+	now = now.Add(time.Second)
+	t.logf(logf, "error:%d", 1000)
+	t.logf(logf, "error:%d", 1001)
+	c.Assert(lines[2:], check.DeepEquals,
+		[]string{"error:1000 (suppressed 999 similar messages in 1.000s)"})
+
+	now = now.Add(500 * time.Millisecond)
+	t.flush()
+	t.flush()
+	c.Assert(lines[3:], check.DeepEquals,
+		[]string{`suppressed 1 messages like "error:%d" in 0.500s`})
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/go-check/check"
+)
+
+type LoggerTestSuite struct {
+	workHome string
+}
+
+func init() {
+	check.Suite(&LoggerTestSuite{})
+}
+
+func (s *LoggerTestSuite) SetUpSuite(c *check.C) {
+	s.workHome = c.MkDir()
+}
+
+// recordingLogger records the logs, as an embedder routing them into its
+// own logging stack.
+type recordingLogger struct {
+	sync.Mutex
+	logs []string
+}
+
+func (l *recordingLogger) record(level, format string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.logs = append(l.logs, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record("debug", format, args...)
+}
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.record("info", format, args...)
+}
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.record("warn", format, args...)
+}
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record("error", format, args...)
+}
+
+func (s *LoggerTestSuite) TestLogger(c *check.C) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+
+	cfg := helper.CreateConfig(nil, s.workHome)
+	c.Assert(cfg.Log(), check.Equals, Logger(cfg.ClientLogger))
+	logger := &recordingLogger{}
+	cfg.Logger = logger
+	c.Assert(cfg.Log(), check.Equals, Logger(logger))
+
+	bd := &BackDownloader{Cfg: cfg, URL: origin.URL, Target: path.Join(s.workHome, "logger.dst")}
+	c.Assert(bd.Run(), check.IsNil)
+	c.Assert(strings.Join(logger.logs, "\n"), check.Matches, "(?s).*info start download logger.dst from the source station.*")
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+)
+
+// Manifest describes what a download from peers consists of, it's written
+// into Cfg.ManifestFile and can be fed back by Cfg.ReplayManifest to make
+// the same download decisions.
+type Manifest struct {
+	URL        string           `json:"url"`
+	TaskID     string           `json:"taskID"`
+	SuperNodes []string         `json:"superNodes"`
+	PieceSize  int32            `json:"pieceSize"`
+	FileLength int64            `json:"fileLength"`
+	Md5        string           `json:"md5"`
+	Pieces     []*ManifestPiece `json:"pieces"`
+}
+
+// ManifestPiece describes where a piece is downloaded from, the peer fields
+// are empty if the Source is TierOrigin.
+type ManifestPiece struct {
+	Range    string `json:"range"`
+	PieceNum int    `json:"pieceNum"`
+	Source   string `json:"source"`
+	Cid      string `json:"cid,omitempty"`
+	PeerIP   string `json:"peerIP,omitempty"`
+	PeerPort int    `json:"peerPort,omitempty"`
+	Path     string `json:"path,omitempty"`
+}
+
+// LoadManifest reads the manifest written by Cfg.ManifestFile.
+func LoadManifest(path string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := new(Manifest)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PreferNodes reorders the nodes so that the supernodes of the manifest are
+// registered to first in the same order, the others are kept after them.
+func (m *Manifest) PreferNodes(nodes []string) []string {
+	rank := make(map[string]int)
+	for i, n := range m.SuperNodes {
+		if _, ok := rank[n]; !ok {
+			rank[n] = i
+		}
+	}
+	var rankOf = func(n string) int {
+		if r, ok := rank[n]; ok {
+			return r
+		}
+		return len(m.SuperNodes)
+	}
+	sorted := append([]string(nil), nodes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return rankOf(sorted[i]) < rankOf(sorted[j])
+	})
+	return sorted
+}
+
+// apply returns the piece task served by the peer the range was downloaded
+// from in the manifest, or t itself if the range isn't in the manifest. It's
+// used by the main loop of P2PDownloader only, a nil manifest applies
+// nothing.
+func (m *Manifest) apply(t *types.PullPieceTaskResponseContinueData) *types.PullPieceTaskResponseContinueData {
+	if m == nil || int32(t.PieceSize) != m.PieceSize {
+		return t
+	}
+	for _, p := range m.Pieces {
+		if p.Range == t.Range && p.Source == TierPeer {
+			replayed := *t
+			replayed.Cid, replayed.PeerIP, replayed.PeerPort, replayed.Path =
+				p.Cid, p.PeerIP, p.PeerPort, p.Path
+			return &replayed
+		}
+	}
+	return t
+}
+
+// manifestBuilder collects the download decisions of a P2PDownloader for the
+// manifest. It's used by the main loop of P2PDownloader only, and a nil
+// manifestBuilder collects nothing.
+type manifestBuilder struct {
+	nodes      []string
+	dispatched map[string]*types.PullPieceTaskResponseContinueData
+	succeeded  map[string]string
+}
+
+func newManifestBuilder(enabled bool) *manifestBuilder {
+	if !enabled {
+		return nil
+	}
+	return &manifestBuilder{
+		dispatched: make(map[string]*types.PullPieceTaskResponseContinueData),
+		succeeded:  make(map[string]string),
+	}
+}
+
+// node records the supernode the download is from.
+func (b *manifestBuilder) node(node string) {
+	if b == nil || (len(b.nodes) > 0 && b.nodes[len(b.nodes)-1] == node) {
+		return
+	}
+	b.nodes = append(b.nodes, node)
+}
+
+// dispatch records the piece task started for its range.
+func (b *manifestBuilder) dispatch(t *types.PullPieceTaskResponseContinueData) {
+	if b == nil {
+		return
+	}
+	b.dispatched[t.Range] = t
+}
+
+// succeed records the range downloaded successfully from the source.
+func (b *manifestBuilder) succeed(pieceRange string, source string) {
+	if b == nil {
+		return
+	}
+	b.succeeded[pieceRange] = source
+}
+
+// reset forgets the pieces since the piece size changes.
+func (b *manifestBuilder) reset() {
+	if b == nil {
+		return
+	}
+	b.dispatched = make(map[string]*types.PullPieceTaskResponseContinueData)
+	b.succeeded = make(map[string]string)
+}
+
+// build creates the manifest of the succeeded pieces sorted by PieceNum.
+func (b *manifestBuilder) build(m *Manifest) *Manifest {
+	m.SuperNodes = b.nodes
+	for pieceRange, source := range b.succeeded {
+		p := &ManifestPiece{Range: pieceRange, Source: source}
+		if start, _, ok := parsePieceRange(pieceRange); ok && m.PieceSize > 0 {
+			p.PieceNum = int(start / int64(m.PieceSize))
+		}
+		if t, ok := b.dispatched[pieceRange]; ok && source == TierPeer {
+			p.Cid, p.PeerIP, p.PeerPort, p.Path = t.Cid, t.PeerIP, t.PeerPort, t.Path
+		}
+		m.Pieces = append(m.Pieces, p)
+	}
+	sort.Slice(m.Pieces, func(i, j int) bool {
+		return m.Pieces[i].PieceNum < m.Pieces[j].PieceNum
+	})
+	return m
+}
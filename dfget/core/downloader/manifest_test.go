@@ -0,0 +1,78 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+	"github.com/go-check/check"
+)
+
+type ManifestTestSuite struct {
+}
+
+func init() {
+	check.Suite(&ManifestTestSuite{})
+}
+
+func (s *ManifestTestSuite) TestPreferNodes(c *check.C) {
+	m := &Manifest{SuperNodes: []string{"b", "c"}}
+	c.Assert(m.PreferNodes([]string{"a", "c", "d", "b"}), check.DeepEquals,
+		[]string{"b", "c", "a", "d"})
+	c.Assert(m.PreferNodes(nil), check.HasLen, 0)
+}
+
+func (s *ManifestTestSuite) TestManifestBuilder(c *check.C) {
+	var b *manifestBuilder
+	b.node("n")
+	b.succeed("0-9", TierPeer)
+	c.Assert(newManifestBuilder(false), check.IsNil)
+
+	b = newManifestBuilder(true)
+	b.node("n1")
+	b.node("n1")
+	b.dispatch(&types.PullPieceTaskResponseContinueData{Range: "0-9", Cid: "a", PeerIP: "1.1.1.1"})
+	b.succeed("0-9", TierPeer)
+	b.reset()
+	b.node("n2")
+	b.dispatch(&types.PullPieceTaskResponseContinueData{Range: "10-19", Cid: "b", PeerIP: "2.2.2.2"})
+	b.dispatch(&types.PullPieceTaskResponseContinueData{Range: "0-9", Cid: "c", PeerIP: "3.3.3.3"})
+	b.succeed("10-19", TierPeer)
+	b.succeed("0-9", TierOrigin)
+	b.succeed("20-29", TierPeer)
+
+	m := b.build(&Manifest{PieceSize: 10})
+	c.Assert(m.SuperNodes, check.DeepEquals, []string{"n1", "n2"})
+	c.Assert(m.Pieces, check.DeepEquals, []*ManifestPiece{
+		{Range: "0-9", PieceNum: 0, Source: TierOrigin},
+		{Range: "10-19", PieceNum: 1, Source: TierPeer, Cid: "b", PeerIP: "2.2.2.2"},
+		{Range: "20-29", PieceNum: 2, Source: TierPeer},
+	})
+
+	// test: the ranges are served by the peers of the manifest
+	t := &types.PullPieceTaskResponseContinueData{Range: "10-19", PieceSize: 10, Cid: "x", PeerIP: "9.9.9.9"}
+	var none *Manifest
+	c.Assert(none.apply(t), check.Equals, t)
+	replayed := m.apply(t)
+	c.Assert(replayed.Cid, check.Equals, "b")
+	c.Assert(replayed.PeerIP, check.Equals, "2.2.2.2")
+	c.Assert(t.Cid, check.Equals, "x")
+
+	origin := &types.PullPieceTaskResponseContinueData{Range: "0-9", PieceSize: 10}
+	c.Assert(m.apply(origin), check.Equals, origin)
+	resized := &types.PullPieceTaskResponseContinueData{Range: "10-19", PieceSize: 20}
+	c.Assert(m.apply(resized), check.Equals, resized)
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+)
+
+// metaFile returns the path of the sidecar file that stores the captured
+// response headers of the target.
+func metaFile(target string) string {
+	return target + config.MetaFileSuffix
+}
+
+// writeMetadata stores the response headers specified by Cfg.MetaHeaders
+// into the sidecar file of the target. The absent headers are skipped.
+func writeMetadata(cfg *config.Config, target string, header http.Header) error {
+	if len(cfg.MetaHeaders) == 0 {
+		return nil
+	}
+	meta := make(map[string]string)
+	for _, k := range cfg.MetaHeaders {
+		if v := header.Get(k); v != "" {
+			meta[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(metaFile(target), b, 0644)
+}
+
+// fetchMetadata requests the response headers from the source by a HEAD
+// request, it's used when the file is downloaded from peers whose responses
+// don't carry the headers of the source.
+func fetchMetadata(cfg *config.Config) (http.Header, error) {
+	req, err := http.NewRequest("HEAD", cfg.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range sourceHeaders(cfg) {
+		req.Header.Add(k, v)
+	}
+	resp, err := sourceHTTPClient(cfg).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp.Header, nil
+}
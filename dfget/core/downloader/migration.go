@@ -0,0 +1,134 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/regist"
+	"github.com/dragonflyoss/Dragonfly/dfget/errors"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+var (
+	// migrationLimiter limits the rate of migrations of all the
+	// P2PDownloaders in the current process.
+	migrationLimiter *util.RateLimiter
+	migrationMutex   sync.Mutex
+)
+
+// waitMigration blocks before migrating to another supernode according to
+// the MigrationJitter and MigrationRateLimit of the config, so that the
+// downloads failing at the same time don't register to the new supernode
+// simultaneously. It returns the error of the ctx of RunContext once it's
+// done while waiting.
+func (p2p *P2PDownloader) waitMigration() error {
+	if p2p.Cfg.MigrationJitter > 0 {
+		jitter := time.Duration(rand.Int63n(int64(p2p.Cfg.MigrationJitter)))
+		p2p.Cfg.Log().Infof("sleep %.3fs before migrating", jitter.Seconds())
+		if err := p2p.sleep(jitter); err != nil {
+			return err
+		}
+	}
+	if limiter := getMigrationLimiter(p2p.Cfg.MigrationRateLimit); limiter != nil {
+		if _, err := limiter.AcquireContext(p2p.ctx, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getMigrationLimiter(rate int) *util.RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	migrationMutex.Lock()
+	defer migrationMutex.Unlock()
+	if migrationLimiter == nil {
+		// generate one token every 1000/rate milliseconds to spread the
+		// migrations evenly.
+		migrationLimiter = util.NewRateLimiter(int32(rate), 1)
+	} else {
+		migrationLimiter.SetRate(int32(rate))
+	}
+	return migrationLimiter
+}
+
+// migrationDelay returns the delay before the registration of the migration
+// after the given consecutive registrations by Cfg.MigrationMaxBackoff, the
+// first registration isn't delayed.
+func migrationDelay(cfg *config.Config, rng *rand.Rand, registrations int) time.Duration {
+	if cfg.MigrationMaxBackoff <= 0 || registrations <= 0 {
+		return 0
+	}
+	return backoff(config.MigrationBaseBackoff, cfg.MigrationMaxBackoff, rng, registrations-1)
+}
+
+// registerAlternate registers to the remainder nodes for migrating from the
+// failed node, and then to each of Cfg.AlternateNodes in order except the
+// failed one until it succeeds. The error of the last registration is
+// returned if all of them fail. The nodes failing the health check are
+// skipped if Cfg.MigrationHealthCheck is set. The Cfg.Node is kept for the
+// later migrations.
+func (p2p *P2PDownloader) registerAlternate(failed string) (*regist.RegisterResult, *errors.DFGetError) {
+	dead := p2p.deadNodes(failed)
+	nodes := []string{}
+	for _, node := range p2p.Cfg.Node {
+		if node != failed && !dead[node] {
+			nodes = append(nodes, node)
+		}
+	}
+	res, e := p2p.Register.RegisterNodes(p2p.Cfg.RV.PeerPort, nodes)
+	if e == nil {
+		return res, nil
+	}
+	for _, node := range p2p.Cfg.AlternateNodes {
+		if node == failed || dead[node] {
+			continue
+		}
+		p2p.Cfg.Log().Warnf("register to the remainder nodes error:%v, try the alternate node:%s", e, node)
+		if res, e = p2p.Register.RegisterNodes(p2p.Cfg.RV.PeerPort, []string{node}); e == nil {
+			return res, nil
+		}
+	}
+	return nil, e
+}
+
+// deadNodes returns the remainder nodes and the alternate nodes failing the
+// health check if Cfg.MigrationHealthCheck is set, the failed node isn't
+// checked.
+func (p2p *P2PDownloader) deadNodes(failed string) map[string]bool {
+	if !p2p.Cfg.MigrationHealthCheck {
+		return nil
+	}
+	var nodes []string
+	for _, node := range append(append([]string{}, p2p.Cfg.Node...), p2p.Cfg.AlternateNodes...) {
+		if node != failed && !util.ContainsString(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	_, errs := regist.HealthyNodes(p2p.API, nodes)
+	dead := make(map[string]bool, len(errs))
+	for node, err := range errs {
+		p2p.Cfg.Log().Warnf("skip the unhealthy node:%s for migrating, error:%v", node, err)
+		dead[node] = true
+	}
+	return dead
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+)
+
+// rankOrigins probes at most Cfg.MaxProbedOrigins of the origins by a
+// request of the first byte and sorts them by the latency of the responses,
+// so that the back source downloads from the fastest origin first and falls
+// back to the others. The origins failing the probe or not responding within
+// Cfg.OriginProbeTimeout are kept after the responders, and the ones not
+// probed are kept at the end, both in their original order. A single origin
+// isn't probed.
+func rankOrigins(cfg *config.Config, origins []string) []string {
+	if len(origins) <= 1 {
+		return origins
+	}
+	probed := origins
+	if max := cfg.MaxProbedOrigins; max > 0 && max < len(origins) {
+		probed = origins[:max]
+	}
+	timeout := cfg.OriginProbeTimeout
+	if timeout <= 0 {
+		timeout = config.DefaultOriginProbeTimeout
+	}
+
+	latencies := make([]time.Duration, len(probed))
+	done := make(chan int, len(probed))
+	for i, origin := range probed {
+		go func(i int, origin string) {
+			latencies[i] = probeOrigin(cfg, origin, timeout)
+			done <- i
+		}(i, origin)
+	}
+	for range probed {
+		<-done
+	}
+
+	ranked := make([]int, len(probed))
+	for i := range ranked {
+		ranked[i] = i
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		li, lj := latencies[ranked[i]], latencies[ranked[j]]
+		return li >= 0 && (lj < 0 || li < lj)
+	})
+	result := make([]string, 0, len(origins))
+	for _, i := range ranked {
+		result = append(result, probed[i])
+		cfg.Log().Infof("probe origin:%s latency:%v", probed[i], latencies[i])
+	}
+	return append(result, origins[len(probed):]...)
+}
+
+// probeOrigin returns the latency of the origin responding the request of
+// the first byte successfully, or -1 if it fails.
+func probeOrigin(cfg *config.Config, origin string, timeout time.Duration) time.Duration {
+	headers := sourceHeaders(cfg)
+	headers["Range"] = "bytes=0-0"
+	start := time.Now()
+	client := *sourceHTTPClient(cfg)
+	client.Timeout = timeout
+	resp, err := httpGetWithClient(&client, origin, headers)
+	if err != nil {
+		return -1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return -1
+	}
+	return time.Since(start)
+}
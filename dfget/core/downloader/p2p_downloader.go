@@ -18,8 +18,13 @@ package downloader
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/dragonflyoss/Dragonfly/dfget/config"
@@ -43,6 +48,14 @@ type P2PDownloader struct {
 	Register       regist.SupernodeRegister
 	RegisterResult *regist.RegisterResult
 
+	// OnThroughputSample is called with every throughput sample collected
+	// per Cfg.ThroughputSampleInterval if it's not nil.
+	OnThroughputSample func(ThroughputSample)
+
+	// Scheduler decides when to pull the next piece tasks, it's the
+	// DefaultPieceScheduler if it's nil.
+	Scheduler PieceScheduler
+
 	node         string
 	taskID       string
 	targetFile   string
@@ -51,10 +64,18 @@ type P2PDownloader struct {
 	pieceSizeHistory [2]int32
 	queue            util.Queue
 	clientQueue      util.Queue
-	writerDone       chan struct{}
+	// writerDone is closed once the ClientWriter finishes, and writerErr is
+	// the error of it then.
+	writerDone chan struct{}
+	writerErr  error
 
 	clientFilePath  string
 	serviceFilePath string
+	// succeeded indicates whether the file is downloaded from the peers or
+	// seeded successfully by Run, and backSourced whether it falls back to
+	// the source, the intermediate files are removed by Cleanup otherwise.
+	succeeded   bool
+	backSourced bool
 
 	// pieceSet range -> bool
 	// true: if the range is processed successfully
@@ -62,11 +83,176 @@ type P2PDownloader struct {
 	// not in: the range hasn't been processed
 	pieceSet map[string]bool
 	total    int64
+	// stateLock guards the writes of the pieceSet, the total, the completed,
+	// the node, the taskID and backSourced, which are read by Stats
+	// concurrently. They're written by the goroutine running Run only, so
+	// it reads them without the lock.
+	stateLock sync.RWMutex
+	// pollTimeouts is the number of the consecutive timeouts of polling the
+	// queue.
+	pollTimeouts int
+	// pullRetries is the number of the consecutive retries of pulling the
+	// piece tasks, and rng randomizes the delays between them.
+	pullRetries int
+	rng         *rand.Rand
+	// registrations is the number of the consecutive registrations of the
+	// migrations, it's reset once the piece tasks are pulled.
+	registrations int
+	// completed is the bytes of the file content in the total, the 5
+	// bytes wrapping each piece excluded.
+	completed int64
+	// rangeBytes is the bytes of the completed within the Cfg.RequestRange.
+	rangeBytes int64
+
+	// pending are the piece tasks deferred by Cfg.MaxRangesPerPull, they
+	// will be started before the new ones in the subsequent pull cycles.
+	pending []*types.PullPieceTaskResponseContinueData
+
+	// rangeFailures counts the failures of each range served by the current
+	// supernode, the download will migrate to another supernode once a range
+	// fails Cfg.MaxRangeFailures times.
+	rangeFailures map[string]int
+	forceMigrate  bool
+
+	// rangeRetries counts the re-requests of each range caused by failures
+	// from all the supernodes, exhausted is the range exceeding
+	// Cfg.MaxRangeRetries, and rangeBackSourced are the ranges downloaded
+	// from the source by Cfg.RangeBackSource.
+	rangeRetries     map[string]int
+	exhausted        string
+	rangeBackSourced map[string]bool
+
+	// delta indexes the pieces of Cfg.DeltaBaseFile.
+	delta *deltaIndex
+
+	// tiers counts the bytes downloaded from each tier.
+	tiers *TierBytes
+	// migrations counts the migrations to another supernode, and digest is
+	// the digest of the file verified or computed while writing, they're
+	// reported by the summary.
+	migrations int
+	digest     string
+
+	// budget limits the bytes of the pieces buffered in memory.
+	budget *quota
+	// files limits the file descriptors used by the peer sockets and the temp
+	// files.
+	files *quota
+	// pieces limits the pieces downloaded concurrently, it's kept across the
+	// migrations and the restarts since the pieces started may be running.
+	pieces *quota
+	// limiter limits the rate of downloading the pieces by
+	// Cfg.MaxDownloadRate, it's kept across the restarts like pieces.
+	limiter *util.RateLimiter
+
+	// recorder records the piece tasks and contents into Cfg.RecordFile.
+	recorder *recorder
+
+	// trust restricts the peers to Cfg.TrustedPeers.
+	trust *trustDomain
+
+	// sampler collects the throughput samples.
+	sampler *throughputSampler
+
+	// logs throttles the messages of the hot error paths.
+	logs *logThrottle
+
+	// lineage is the taskIDs whose pieces can be assembled into the file.
+	lineage taskLineage
+
+	// kept are the contents written before the piece size changes.
+	kept coverage
+
+	// counted are the ranges of the succeeded pieces of the current piece
+	// size accounted into the total, the succeeded pieces overlapping them
+	// are not accounted again.
+	counted coverage
+
+	// standby is the registration to the next supernode if Cfg.WarmStandby
+	// is set.
+	standby *standby
+
+	// pins forces the pieces to be downloaded from Cfg.PinnedPeers.
+	pins *pinnedPeers
+
+	// manifest collects the download decisions for Cfg.ManifestFile, and
+	// replay is the manifest of Cfg.ReplayManifest to be reproduced.
+	manifest *manifestBuilder
+	replay   *Manifest
+
+	// registered is the result of the latest registration, it's updated
+	// when migrating to another supernode.
+	registered     regist.RegisterResult
+	registeredLock sync.RWMutex
+
+	clientWriter *ClientWriter
+	partialOnce  sync.Once
+
+	// events delivers the events of the download if Cfg.EventBufferSize is
+	// positive.
+	events        chan Event
+	droppedEvents int
+
+	// progress writes the progress frames into Cfg.ProgressSocket.
+	progress *progressStream
+
+	// usedPeers are the peers the current attempt downloads from, they are
+	// added into the blacklist if the attempt fails the md5 check and
+	// Cfg.VerifyRetryBlacklist is set.
+	usedPeers peerSet
+	blacklist peerSet
+
+	// candidates are the other peers offering the ranges started, they're
+	// tried by the PowerClients before the ranges are marked failed.
+	candidates map[string][]*types.PullPieceTaskResponseContinueData
+
+	// hostLock coordinates the processes downloading the same task on the
+	// host if Cfg.HostDedup is set.
+	hostLock *hostLock
+
+	// contributions are the bytes served by each peer reported to the
+	// supernode if Cfg.ReportContributions is set.
+	contributions contributions
+
+	// resumed are the pieces left by an interrupted download if Cfg.Resume
+	// is set, resumeSaved is the last time the written pieces are recorded.
+	resumed     *resumeState
+	resumeSaved time.Time
+
+	// ctx cancels the download started by RunContext, and tasks are the
+	// goroutines downloading the pieces which are waited for once it's
+	// cancelled.
+	ctx   context.Context
+	tasks sync.WaitGroup
+	// timeout is the error of the download once Cfg.Timeout expires, which
+	// is the deadline of the ctx. parentCtx is the ctx of RunContext, the
+	// ctx is done by the timeout only if it isn't done.
+	timeout   error
+	parentCtx context.Context
+	// stopCause is the error of the download once the ctx of RunContext is
+	// cancelled by the stopper.
+	stopCause error
+}
+
+// printPlan prints the piece layout assigned by the supernode for the dry
+// run, the number of the pieces is -1 if the file length is unknown.
+func (p2p *P2PDownloader) printPlan() {
+	pieces := int64(-1)
+	if n := int64(p2p.pieceSizeHistory[1]) - 5; n > 0 && p2p.RegisterResult.FileLength >= 0 {
+		pieces = (p2p.RegisterResult.FileLength + n - 1) / n
+	}
+	util.Printer.Printf("dry run node:%s taskID:%s pieceSize:%d fileLength:%d pieces:%d",
+		p2p.node, p2p.taskID, p2p.pieceSizeHistory[1], p2p.RegisterResult.FileLength, pieces)
+	p2p.Cfg.Log().Infof("dry run task:%s node:%s pieceSize:%d fileLength:%d pieces:%d",
+		p2p.taskID, p2p.node, p2p.pieceSizeHistory[1], p2p.RegisterResult.FileLength, pieces)
 }
 
 func (p2p *P2PDownloader) init() {
+	p2p.setRegistered(p2p.RegisterResult)
+	p2p.stateLock.Lock()
 	p2p.node = p2p.RegisterResult.Node
 	p2p.taskID = p2p.RegisterResult.TaskID
+	p2p.stateLock.Unlock()
 	p2p.targetFile = p2p.Cfg.RV.RealTarget
 	p2p.taskFileName = p2p.Cfg.RV.TaskFileName
 
@@ -76,37 +262,222 @@ func (p2p *P2PDownloader) init() {
 	p2p.queue = util.NewQueue(0)
 	p2p.queue.Put(NewPieceSimple(p2p.taskID, p2p.node, config.TaskStatusStart))
 
-	p2p.clientQueue = util.NewQueue(config.DefaultClientQueueSize)
+	p2p.clientQueue = newResizableQueue(clientQueueSize(p2p.Cfg, p2p.RegisterResult.PieceSize))
 	p2p.writerDone = make(chan struct{})
 
 	p2p.clientFilePath = helper.GetTaskFile(p2p.taskFileName, p2p.Cfg.RV.DataDir)
 	p2p.serviceFilePath = helper.GetServiceFile(p2p.taskFileName, p2p.Cfg.RV.DataDir)
+	p2p.initHostLock()
 
+	if p2p.ctx == nil {
+		p2p.ctx = context.Background()
+	}
+
+	p2p.stateLock.Lock()
 	p2p.pieceSet = make(map[string]bool)
+	p2p.total, p2p.completed, p2p.rangeBytes = 0, 0, 0
+	p2p.stateLock.Unlock()
+	p2p.counted = nil
+	p2p.loadResume()
+	p2p.pollTimeouts = 0
+	p2p.pullRetries = 0
+	p2p.registrations = 0
+	if p2p.rng == nil {
+		p2p.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	p2p.rangeFailures = make(map[string]int)
+	p2p.rangeRetries = make(map[string]int)
+	p2p.rangeBackSourced = make(map[string]bool)
+	if p2p.tiers == nil {
+		p2p.tiers = NewTierBytes()
+	}
+	p2p.usedPeers = make(peerSet)
+	p2p.candidates = make(map[string][]*types.PullPieceTaskResponseContinueData)
+	p2p.contributions = newContributions(p2p.Cfg.ReportContributions)
+	p2p.lineage = nil
+	p2p.kept = nil
+	p2p.budget = newQuota(p2p.Cfg.MaxBufferedBytes)
+	p2p.files = newQuota(int64(openFilesLimit(p2p.Cfg)))
+	if p2p.pieces == nil {
+		p2p.pieces = newQuota(int64(p2p.Cfg.MaxConcurrentPieces))
+	}
+	if p2p.limiter == nil {
+		p2p.limiter = newSharedLimiter(p2p.Cfg.MaxDownloadRate)
+	}
+	p2p.pins = newPinnedPeers(p2p.Cfg.PinnedPeers, p2p.Cfg.PinnedPeersStrict)
+	p2p.manifest = newManifestBuilder(!util.IsEmptyStr(p2p.Cfg.ManifestFile))
+	p2p.manifest.node(p2p.node)
+	if p2p.Cfg.EventBufferSize > 0 && p2p.events == nil {
+		p2p.events = make(chan Event, p2p.Cfg.EventBufferSize)
+	}
 }
 
-// Run starts to download the file.
+// Run starts to download the file. The failure of the download from the
+// source it falls back to is a DownloadError whose Kind tells the cause.
 func (p2p *P2PDownloader) Run() error {
+	return p2p.RunContext(context.Background())
+}
+
+// RunContext starts to download the file until the ctx is done. Once the
+// ctx is cancelled, it stops pulling the piece tasks, waits for the pieces
+// being downloaded and the ClientWriter, and returns the error of the ctx
+// without downloading from the source.
+func (p2p *P2PDownloader) RunContext(ctx context.Context) (err error) {
+	ctx, stop := p2p.withTimeout(ctx)
+	defer stop()
+	p2p.ctx = ctx
+	defer func() {
+		p2p.succeeded = err == nil && !p2p.backSourced
+		p2p.Cleanup()
+		p2p.closeEvents(err)
+	}()
+	if p2p.Cfg.BackSourceOnly {
+		p2p.Cfg.BackSourceReason = config.BackSourceReasonUserSpecified
+		return p2p.backSource()
+	}
+
+	if !util.IsEmptyStr(p2p.Cfg.ProgressSocket) {
+		if p2p.progress, err = newProgressStream(p2p.Cfg.ProgressSocket); err != nil {
+			p2p.Cfg.Log().Warnf("connect progress socket:%s error:%v", p2p.Cfg.ProgressSocket, err)
+		}
+	}
+	if p2p.Cfg.CheckInodes {
+		if err := checkInodes(p2p.Cfg, util.FreeInodes); err != nil {
+			return err
+		}
+	}
+	if err := p2p.checkSpace(util.FreeBytes); err != nil {
+		return err
+	}
+	if p2p.trust, err = newTrustDomain(p2p.Cfg.TrustedPeers); err != nil {
+		return err
+	}
+	if p2p.Cfg.OutputWriter != nil && p2p.Cfg.RV.Assembly != config.AssemblySequential {
+		return fmt.Errorf("output writer must be assembled sequentially, not %q", p2p.Cfg.RV.Assembly)
+	}
+	if !util.IsEmptyStr(p2p.Cfg.RequestRange) {
+		if p2p.Cfg.RV.Assembly == config.AssemblySequential {
+			return fmt.Errorf("range:%s can't be assembled sequentially", p2p.Cfg.RequestRange)
+		}
+		if _, _, ok := p2p.requestRange(); !ok {
+			return fmt.Errorf("range:%s is out of the file", p2p.Cfg.RequestRange)
+		}
+	}
+	if p2p.Cfg.DryRun {
+		p2p.printPlan()
+		return nil
+	}
+	if p2p.Cfg.Seed {
+		return p2p.seed()
+	}
+	defer p2p.closeHostLock()
+	if reused, err := p2p.awaitHostLock(); err != nil || reused {
+		return err
+	}
+	if !util.IsEmptyStr(p2p.Cfg.ReplayManifest) {
+		if p2p.replay, err = LoadManifest(p2p.Cfg.ReplayManifest); err != nil {
+			return err
+		}
+	}
+	if !util.IsEmptyStr(p2p.Cfg.RecordFile) {
+		if p2p.recorder, err = newRecorder(p2p.Cfg.RecordFile); err != nil {
+			p2p.Cfg.Log().Warnf("create record file:%s error:%v", p2p.Cfg.RecordFile, err)
+		} else {
+			p2p.API = &recordingAPI{SupernodeAPI: p2p.API, rec: p2p.recorder}
+			defer p2p.recorder.close()
+		}
+	}
+
+	for retries := 0; ; retries++ {
+		err = p2p.run()
+		if _, ok := err.(*md5NotMatchError); !ok || retries >= p2p.Cfg.MaxVerifyRetries {
+			return err
+		}
+		p2p.Cfg.Log().Warnf("download from scratch(%d/%d) since %v, blacklist peers:%t",
+			retries+1, p2p.Cfg.MaxVerifyRetries, err, p2p.Cfg.VerifyRetryBlacklist)
+		if e := p2p.restart(); e != nil {
+			p2p.Cfg.Log().Errorf("register to download from scratch error:%v", e)
+			return err
+		}
+	}
+}
+
+// run downloads the file once.
+func (p2p *P2PDownloader) run() error {
 	var (
 		lastItem *Piece
 		goNext   bool
+		// limited indicates whether to pull the lastItem again since the
+		// supernode limited the pulls.
+		limited bool
 	)
 
+	p2p.sampler = newThroughputSampler(p2p.Cfg.ThroughputSampleInterval, time.Now(),
+		p2p.OnThroughputSample)
+	p2p.logs = newLogThrottle(p2p.Cfg.LogThrottleInterval, p2p.Cfg.Verbose)
+	if p2p.Cfg.WarmStandby {
+		p2p.standby = registerStandby(p2p.Register, p2p.Cfg.RV.PeerPort)
+	}
+	defer func() {
+		p2p.sampler.finish(time.Now())
+		p2p.logs.flush()
+	}()
+
 	// start ClientWriter
-	clientWriter, err := NewClientWriter(p2p.taskFileName, p2p.Cfg.RV.Cid, p2p.clientFilePath, p2p.serviceFilePath, p2p.clientQueue, p2p.Cfg)
+	clientWriter, err := newClientWriter(p2p.taskFileName, p2p.Cfg.RV.Cid, p2p.clientFilePath, p2p.serviceFilePath,
+		p2p.clientQueue, p2p.Cfg, p2p.resumed)
+	done := p2p.writerDone
 	if err != nil {
+		p2p.writerErr = err
+		close(done)
 		return err
 	}
+	p2p.clientWriter = clientWriter
+	clientWriter.budget = p2p.budget
+	clientWriter.queue = p2p.queue
+	if p2p.resumed != nil {
+		p2p.saveResume(true)
+	}
 	go func() {
 		clientWriter.Run()
+		p2p.writerErr = clientWriter.wait()
+		close(done)
 	}()
+	// the service file and the target file are kept open by the ClientWriter
+	defer p2p.files.acquire(2)()
+	defer startHeartbeat(p2p.Cfg, p2p.tiers.Total)()
 
 	for {
-		goNext, lastItem = p2p.getItem(lastItem)
+		if err := p2p.ctx.Err(); err != nil {
+			return p2p.cancel(err)
+		}
+		if limited {
+			limited, goNext = false, true
+		} else {
+			goNext, lastItem = p2p.getItem(lastItem)
+		}
+		if err := p2p.trust.check(); err != nil {
+			p2p.Cfg.Log().Errorf("P2P download fail: %v", err)
+			return p2p.failTask(err)
+		}
+		if err := p2p.handleExhaustedRange(); err != nil {
+			p2p.Cfg.Log().Errorf("P2P download fail: %v", err)
+			return p2p.failTask(err)
+		}
+		if max := p2p.Cfg.MaxQueuePollTimeouts; max > 0 && p2p.pollTimeouts >= max {
+			p2p.Cfg.Log().Errorf("P2P download stalls for %d consecutive queue poll timeouts", max)
+			p2p.Cfg.BackSourceReason = config.BackSourceReasonQueueTimeout
+			return p2p.backSource()
+		}
+		if p2p.rangeCovered() {
+			err := p2p.finishTask(nil, clientWriter)
+			p2p.reportContributions()
+			return err
+		}
 		if !goNext {
 			continue
 		}
-		p2p.Cfg.ClientLogger.Infof("P2P download:%v", lastItem)
+		p2p.Cfg.Log().Infof("P2P download:%v", lastItem)
 
 		curItem := *lastItem
 		curItem.Content = &bytes.Buffer{}
@@ -116,32 +487,162 @@ func (p2p *P2PDownloader) Run() error {
 		if err == nil {
 			code := response.Code
 			if code == config.TaskCodeContinue {
-				p2p.processPiece(response, &curItem)
+				if err := p2p.processPiece(response, &curItem); err != nil {
+					return p2p.cancel(err)
+				}
 			} else if code == config.TaskCodeFinish {
-				p2p.finishTask(response, clientWriter)
-				return nil
+				err := p2p.finishTask(response, clientWriter)
+				p2p.reportContributions()
+				return err
+			} else if code == config.TaskCodeLimited {
+				delay := p2p.Cfg.LimitedRetryDelay
+				if delay <= 0 {
+					delay = config.DefaultLimitedRetryDelay
+				}
+				p2p.Cfg.Log().Warnf("Pull piece task is limited by node:%s, pull again after %.3fs",
+					curItem.SuperNode, delay.Seconds())
+				if err := p2p.sleep(delay); err != nil {
+					return p2p.cancel(err)
+				}
+				limited, lastItem = true, &curItem
 			} else {
-				p2p.Cfg.ClientLogger.Warnf("Request piece result:%v", response)
+				p2p.Cfg.Log().Warnf("Request piece result:%v", response)
 				if code == config.TaskCodeSourceError {
 					p2p.Cfg.BackSourceReason = config.BackSourceReasonSourceError
 				}
 			}
+		} else if e := p2p.ctx.Err(); e != nil {
+			return p2p.cancel(e)
 		} else {
-			p2p.Cfg.ClientLogger.Errorf("P2P download fail: %v", err)
+			p2p.Cfg.Log().Errorf("P2P download fail: %v", err)
 			if p2p.Cfg.BackSourceReason == 0 {
 				p2p.Cfg.BackSourceReason = config.BackSourceReasonDownloadError
 			}
 		}
 
+		if clientWriter.writeFailed() {
+			p2p.Cfg.BackSourceReason = config.BackSourceReasonWriteError
+		}
 		if p2p.Cfg.BackSourceReason != 0 {
-			backDownloader := NewBackDownloader(p2p.Cfg, p2p.RegisterResult)
-			return backDownloader.Run()
+			return p2p.backSource()
 		}
 	}
 }
 
+// cancel stops the download once the ctx of RunContext is done, the pieces
+// written are recorded if Cfg.Resume is set so that the download can be
+// resumed.
+func (p2p *P2PDownloader) cancel(err error) error {
+	if p2p.expired() {
+		return p2p.expire()
+	}
+	p2p.Cfg.Log().Warnf("P2P download is cancelled: %v", err)
+	p2p.tasks.Wait()
+	p2p.clientQueue.Put(last)
+	p2p.clientWriter.Wait()
+	p2p.saveResume(true)
+	if p2p.stopCause != nil {
+		return p2p.failTask(p2p.stopCause)
+	}
+	return err
+}
+
+// sleep waits for the duration d, it returns the error of the ctx of
+// RunContext once it's done.
+func (p2p *P2PDownloader) sleep(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-p2p.ctx.Done():
+		return p2p.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// backSource downloads the file from the source by Cfg.BackSourceReason, the
+// failure is returned as a DownloadError.
+func (p2p *P2PDownloader) backSource() error {
+	p2p.stateLock.Lock()
+	p2p.backSourced = true
+	p2p.stateLock.Unlock()
+	p2p.emit(Event{Type: EventBackSource})
+	p2p.Cfg.Metrics.Add(config.MetricBackSources, 1)
+	if p2p.Cfg.OnBackSource != nil {
+		p2p.Cfg.OnBackSource(p2p.Cfg.BackSourceReason)
+	}
+	backDownloader := NewBackDownloader(p2p.Cfg, p2p.RegisterResult)
+	err := backDownloader.Run()
+	if bd, ok := backDownloader.(*BackDownloader); ok {
+		p2p.tiers.Add(TierOrigin, bd.Total)
+	}
+	if err == nil {
+		p2p.removeResume()
+	}
+	return p2p.failTask(newDownloadError(p2p.Cfg.BackSourceReason, err))
+}
+
+// failTask waits the ClientWriter to write the received pieces and tries to
+// write the partial target if the download fails by cause.
+func (p2p *P2PDownloader) failTask(cause error) error {
+	if cause == nil || p2p.Cfg.PartialRatio <= 0 || p2p.clientWriter == nil {
+		return cause
+	}
+	p2p.clientQueue.Put(last)
+	p2p.clientWriter.Wait()
+	return p2p.writePartial(cause)
+}
+
 // Cleanup clean all temporary resources generated by executing Run.
+// After a successful download from the peers, it must not remove the client
+// file left in the data dir when Cfg.NoMove is set, which is the result of
+// the download, and the service file is kept while the peer server seeds it
+// to the other peers. After a failed download or a fall back to the source,
+// the client file, the service file and the TempTarget are incomplete and
+// all removed. The service file is kept in both cases if the download can
+// be resumed from it. Nothing is removed if Cfg.KeepIntermediate is set.
 func (p2p *P2PDownloader) Cleanup() {
+	p2p.releaseStandby()
+	if p2p.Cfg.KeepIntermediate {
+		return
+	}
+	if (!p2p.succeeded || !p2p.Cfg.NoMove) && !util.IsEmptyStr(p2p.clientFilePath) {
+		os.Remove(p2p.clientFilePath)
+	}
+	if !p2p.succeeded && !util.IsEmptyStr(p2p.Cfg.RV.TempTarget) {
+		os.Remove(p2p.Cfg.RV.TempTarget)
+	}
+	if p2p.keepServiceFile() {
+		return
+	}
+	os.Remove(p2p.serviceFilePath)
+}
+
+// keepServiceFile returns whether the service file is kept by Cleanup, it's
+// seeded by the peer server only if the download from the peers succeeds.
+func (p2p *P2PDownloader) keepServiceFile() bool {
+	if util.IsEmptyStr(p2p.serviceFilePath) {
+		return true
+	}
+	if p2p.succeeded && p2p.Cfg.RV.PeerPort > 0 {
+		return true
+	}
+	return p2p.Cfg.Resume && util.PathExist(helper.GetResumeFile(p2p.serviceFilePath))
+}
+
+// WriterDone returns the channel closed once the ClientWriter of the
+// download finishes, the pieces received are flushed and synced into the
+// service file then. It's closed before Run returns if the pieces are
+// assembled or the download is cancelled, but never if the download falls
+// back to the source before that.
+func (p2p *P2PDownloader) WriterDone() <-chan struct{} {
+	return p2p.writerDone
+}
+
+// WriterErr returns the first error of writing the service file or the
+// target file, it should be called after WriterDone is closed.
+func (p2p *P2PDownloader) WriterErr() error {
+	return p2p.writerErr
 }
 
 // GetNode returns supernode ip.
@@ -154,6 +655,45 @@ func (p2p *P2PDownloader) GetTaskID() string {
 	return p2p.taskID
 }
 
+// GetRegisterResult returns a copy of the effective registration details,
+// which reflects the supernode, taskID and piece size after migrations.
+func (p2p *P2PDownloader) GetRegisterResult() *regist.RegisterResult {
+	p2p.registeredLock.RLock()
+	defer p2p.registeredLock.RUnlock()
+	res := p2p.registered
+	res.RemainderNodes = append([]string(nil), res.RemainderNodes...)
+	return &res
+}
+
+func (p2p *P2PDownloader) setRegistered(res *regist.RegisterResult) {
+	p2p.registeredLock.Lock()
+	defer p2p.registeredLock.Unlock()
+	p2p.registered = *res
+}
+
+// GetBufferedBytes returns the bytes of the pieces buffered in memory
+// currently, it's always 0 if Cfg.MaxBufferedBytes isn't set.
+func (p2p *P2PDownloader) GetBufferedBytes() int64 {
+	return p2p.budget.Used()
+}
+
+// GetOpenFiles returns the file descriptors used by the peer sockets and the
+// temp files currently, it's always 0 if there's no limit.
+func (p2p *P2PDownloader) GetOpenFiles() int64 {
+	return p2p.files.Used()
+}
+
+// GetThroughputSamples returns the throughput samples collected per
+// Cfg.ThroughputSampleInterval, it's empty if the interval isn't set.
+func (p2p *P2PDownloader) GetThroughputSamples() []ThroughputSample {
+	return p2p.sampler.Samples()
+}
+
+// GetTierBytes returns the bytes downloaded from each tier.
+func (p2p *P2PDownloader) GetTierBytes() map[string]int64 {
+	return p2p.tiers.Snapshot()
+}
+
 func (p2p *P2PDownloader) pullPieceTask(item *Piece) (
 	*types.PullPieceTaskResponse, error) {
 	var (
@@ -169,121 +709,344 @@ func (p2p *P2PDownloader) pullPieceTask(item *Piece) (
 		TaskID: item.TaskID,
 	}
 
+	if p2p.forceMigrate {
+		p2p.forceMigrate = false
+		p2p.Cfg.Log().Warnf("Range:%s failed %d times from node:%s and will migrate",
+			item.Range, p2p.Cfg.MaxRangeFailures, item.SuperNode)
+		return p2p.migrate(item)
+	}
+
+	unknownRetries := 0
 	for {
 		if res, err = p2p.API.PullPieceTask(item.SuperNode, req); err != nil {
-			p2p.Cfg.ClientLogger.Errorf("Pull piece task error: %v", err)
+			p2p.logs.logf(p2p.Cfg.Log().Errorf, "Pull piece task error: %v", err)
+			if e := p2p.ctx.Err(); e != nil {
+				return nil, e
+			}
 		} else if res.Code == config.TaskCodeWait {
-			sleepTime := time.Duration(rand.Intn(1400)+600) * time.Millisecond
-			p2p.Cfg.ClientLogger.Infof("Pull piece task result:%s and sleep %.3fs",
+			if err := p2p.retryPull(); err != nil {
+				return nil, err
+			}
+			sleepTime := pullRetryDelay(p2p.Cfg, p2p.rng, p2p.pullRetries-1)
+			p2p.Cfg.Log().Infof("Pull piece task result:%s and sleep %.3fs",
 				res, sleepTime.Seconds())
-			time.Sleep(sleepTime)
+			if err := p2p.sleep(sleepTime); err != nil {
+				return nil, err
+			}
 			continue
+		} else if !isKnownTaskCode(res.Code) {
+			p2p.logs.logf(p2p.Cfg.Log().Warnf, "Pull piece task got unknown code:%d from node:%s, "+
+				"the supernode may be newer than dfget, policy:%s", res.Code, item.SuperNode,
+				p2p.Cfg.UnknownCodePolicy)
+			switch p2p.Cfg.UnknownCodePolicy {
+			case config.UnknownCodeRetry:
+				if unknownRetries < config.UnknownCodeRetryLimit {
+					unknownRetries++
+					if err := p2p.retryPull(); err != nil {
+						return nil, err
+					}
+					if err := p2p.sleep(pullRetryDelay(p2p.Cfg, p2p.rng, p2p.pullRetries-1)); err != nil {
+						return nil, err
+					}
+					continue
+				}
+			case config.UnknownCodeFatal:
+				return nil, fmt.Errorf("unknown code:%d from node:%s", res.Code, item.SuperNode)
+			}
 		}
 		break
 	}
 
+	// the source error is handled by back source since the other supernodes
+	// can't download from the source either.
 	if res == nil || (res.Code != config.TaskCodeContinue &&
 		res.Code != config.TaskCodeFinish &&
 		res.Code != config.TaskCodeLimited &&
+		res.Code != config.TaskCodeSourceError &&
 		res.Code != config.Success) {
-		p2p.Cfg.ClientLogger.Errorf("Pull piece task fail:%v and will migrate", res)
-
-		var registerRes *regist.RegisterResult
-		if registerRes, err = p2p.Register.Register(p2p.Cfg.RV.PeerPort); err != nil {
+		p2p.logs.logf(p2p.Cfg.Log().Errorf, "Pull piece task fail:%v and will migrate", res)
+		if err := p2p.retryPull(); err != nil {
 			return nil, err
 		}
-		p2p.pieceSizeHistory[1] = registerRes.PieceSize
-		item.Status = config.TaskStatusStart
-		item.SuperNode = registerRes.Node
-		item.TaskID = registerRes.TaskID
-		util.Printer.Println("migrated to node:" + item.SuperNode)
-		return p2p.pullPieceTask(item)
+		return p2p.migrate(item)
 	}
 
+	p2p.pullRetries = 0
+	p2p.registrations = 0
 	return res, err
 }
 
-func (p2p *P2PDownloader) pullRate(data *types.PullPieceTaskResponseContinueData) {
+// isKnownTaskCode returns whether the code of pulling piece tasks is known.
+func isKnownTaskCode(code int) bool {
+	return code == config.Success ||
+		(code >= config.TaskCodeFinish && code <= config.TaskCodeSourceError)
+}
+
+// migrate registers to another supernode and pulls the piece task of the item
+// from it.
+func (p2p *P2PDownloader) migrate(item *Piece) (*types.PullPieceTaskResponse, error) {
+	registerRes, e := p2p.standby.take()
+	if e != nil {
+		p2p.Cfg.Log().Warnf("register to the standby node error:%v", e)
+	}
+	if registerRes != nil {
+		p2p.Cfg.Log().Infof("switch to the standby node:%s", registerRes.Node)
+	} else {
+		if delay := migrationDelay(p2p.Cfg, p2p.rng, p2p.registrations); delay > 0 {
+			p2p.Cfg.Log().Warnf("registered %d times in a row, sleep %.3fs before migrating",
+				p2p.registrations, delay.Seconds())
+			if err := p2p.sleep(delay); err != nil {
+				return nil, err
+			}
+		}
+		p2p.registrations++
+		if err := p2p.waitMigration(); err != nil {
+			return nil, err
+		}
+		if registerRes, e = p2p.registerAlternate(item.SuperNode); e != nil {
+			return nil, e
+		}
+	}
+	p2p.standby = nil
+	if p2p.Cfg.WarmStandby {
+		p2p.standby = registerStandby(p2p.Register, p2p.Cfg.RV.PeerPort)
+	}
+	p2p.setRegistered(registerRes)
+	p2p.Cfg.Metrics.Add(config.MetricMigrations, 1)
+	p2p.migrations++
+	p2p.pieceSizeHistory[1] = registerRes.PieceSize
+	p2p.rangeFailures = make(map[string]int)
+	oldNode := item.SuperNode
+	item.Status = config.TaskStatusStart
+	item.SuperNode = registerRes.Node
+	item.TaskID = registerRes.TaskID
+	util.Printer.Println("migrated to node:" + item.SuperNode)
+	if p2p.Cfg.OnMigrate != nil {
+		p2p.Cfg.OnMigrate(oldNode, item.SuperNode, item.TaskID)
+	}
+	p2p.emit(Event{Type: EventMigration, Node: item.SuperNode, TaskID: item.TaskID})
+	return p2p.pullPieceTask(item)
+}
+
+// countRangeFailure records a failure of the pieceRange and determines
+// whether to migrate to another supernode.
+func (p2p *P2PDownloader) countRangeFailure(pieceRange string) {
+	if p2p.Cfg.MaxRangeFailures <= 0 {
+		return
+	}
+	p2p.rangeFailures[pieceRange]++
+	if p2p.rangeFailures[pieceRange] >= p2p.Cfg.MaxRangeFailures {
+		p2p.forceMigrate = true
+	}
+}
+
+// refuse reports the piece task as failed without downloading it, so that
+// the supernode dispatches the range again.
+func (p2p *P2PDownloader) refuse(pieceTask *types.PullPieceTaskResponseContinueData) {
+	p2p.setPiece(pieceTask.Range, false)
+	p2p.queue.Put(NewPiece(p2p.taskID, p2p.node, pieceTask.Cid, pieceTask.Range,
+		config.ResultFail, config.TaskStatusRunning))
+}
 
+// startTask downloads the piece task, it blocks until there are less than
+// Cfg.MaxConcurrentPieces pieces downloading.
+func (p2p *P2PDownloader) startTask(data *types.PullPieceTaskResponseContinueData,
+	candidates ...*types.PullPieceTaskResponseContinueData) {
+	pc := p2p.newPowerClient(data)
+	pc.candidates = candidates
+	p2p.runClients([]*PowerClient{pc})
 }
 
-func (p2p *P2PDownloader) startTask(data *types.PullPieceTaskResponseContinueData) {
-	powerClient := &PowerClient{
+// runClients runs the PowerClients of a piece or of the adjacent pieces
+// coalesced, it blocks until there are less than Cfg.MaxConcurrentPieces
+// pieces downloading. The PowerClients should be created by the goroutine
+// running Run, since they copy the state changed by it.
+func (p2p *P2PDownloader) runClients(clients []*PowerClient) {
+	defer p2p.pieces.acquire(int64(len(clients)))()
+	if len(clients) == 1 {
+		p2p.runWithDeadline(clients, func() { clients[0].Run() })
+		return
+	}
+	p2p.runWithDeadline(clients, func() { runCoalesced(clients) })
+}
+
+// newPowerClients creates the PowerClients of the group of piece tasks,
+// which are coalesced if there are more than one.
+func (p2p *P2PDownloader) newPowerClients(group []*types.PullPieceTaskResponseContinueData) []*PowerClient {
+	clients := make([]*PowerClient, len(group))
+	for i, t := range group {
+		clients[i] = p2p.newPowerClient(t)
+	}
+	return clients
+}
+
+func (p2p *P2PDownloader) newPowerClient(data *types.PullPieceTaskResponseContinueData) *PowerClient {
+	return &PowerClient{
 		taskID:      p2p.taskID,
 		node:        p2p.node,
 		pieceTask:   data,
 		cfg:         p2p.Cfg,
 		queue:       p2p.queue,
 		clientQueue: p2p.clientQueue,
+		delta:       p2p.delta,
+		tiers:       p2p.tiers,
+		budget:      p2p.budget,
+		files:       p2p.files,
+		recorder:    p2p.recorder,
+		trust:       p2p.trust,
+		ctx:         p2p.ctx,
+		limiter:     p2p.limiter,
+		writer:      p2p.clientWriter,
 	}
-	powerClient.Run()
 }
 
 func (p2p *P2PDownloader) getItem(latestItem *Piece) (bool, *Piece) {
 	var (
-		needMerge = true
+		timedOut = false
 	)
-	if v, ok := p2p.queue.PollTimeout(2 * time.Second); ok {
+	timeout := p2p.Cfg.QueuePollTimeout
+	if timeout <= 0 {
+		timeout = config.DefaultQueuePollTimeout
+	}
+	if v, ok := p2p.queue.PollTimeout(timeout); ok {
+		p2p.pollTimeouts = 0
 		item := v.(*Piece)
 		if item.PieceSize != 0 && item.PieceSize != p2p.pieceSizeHistory[1] {
 			return false, latestItem
 		}
+		fromCurrentNode := item.SuperNode == p2p.node
+		servedBy := item.DstCid
 		if item.SuperNode != p2p.node {
+			// the piece is shared with the ClientWriter which reads its TaskID.
+			copied := *item
+			item = &copied
 			item.DstCid = ""
 			item.SuperNode = p2p.node
 			item.TaskID = p2p.taskID
 		}
 		if item.Range != "" {
+			start, end, valid := parsePieceRange(item.Range)
+			if !valid {
+				p2p.logs.logf(p2p.Cfg.Log().Warnf, "PieceRange:%s is malformed, skip it", item.Range)
+				p2p.deletePiece(item.Range)
+				return false, latestItem
+			}
 			v, ok := p2p.pieceSet[item.Range]
 			if !ok {
-				p2p.Cfg.ClientLogger.Warnf("PieceRange:%s is neither running nor success", item.Range)
+				p2p.logs.logf(p2p.Cfg.Log().Warnf, "PieceRange:%s is neither running nor success", item.Range)
 				return false, latestItem
 			}
-			if !v && (item.Result == config.ResultSemiSuc ||
-				item.Result == config.ResultSuc) {
-				p2p.total += int64(item.Content.Len())
-				p2p.pieceSet[item.Range] = true
+			succeeded := item.Result == config.ResultSemiSuc || item.Result == config.ResultSuc
+			if !v && succeeded && p2p.counted.overlaps(start, end-start+1) {
+				// the bytes are accounted by the overlapped pieces already.
+				p2p.logs.logf(p2p.Cfg.Log().Warnf, "PieceRange:%s overlaps the succeeded pieces, skip accounting it",
+					item.Range)
+				p2p.setPiece(item.Range, true)
+			} else if !v && succeeded {
+				p2p.counted = p2p.counted.add(start, end-start+1)
+				var completed int64
+				if raw := item.RawContent(); raw != nil {
+					completed = int64(raw.Len())
+				}
+				p2p.succeed(item.Range, int64(item.Content.Len()), completed)
+				p2p.Cfg.Metrics.Add(config.MetricPiecesSucceeded, 1)
+				p2p.Cfg.Metrics.Add(config.MetricBytes, int64(item.Content.Len()))
+				p2p.rangeBytes += p2p.rangeOverlap(item.Range, p2p.pieceSizeHistory[1])
+				p2p.sampler.add(int64(item.Content.Len()), time.Now())
+				p2p.servedByCandidate(item.Range, servedBy)
+				p2p.pieceDone(item, servedBy)
+				p2p.emit(Event{Type: EventProgress})
+				p2p.reportProgress(false)
+				p2p.saveResume(false)
+				if p2p.rangeBackSourced[item.Range] {
+					p2p.manifest.succeed(item.Range, TierOrigin)
+				} else {
+					p2p.manifest.succeed(item.Range, TierPeer)
+					p2p.contributions.add(servedBy, int64(item.Content.Len()))
+				}
 			} else if !v {
-				delete(p2p.pieceSet, item.Range)
+				p2p.deletePiece(item.Range)
+				delete(p2p.candidates, item.Range)
+				if item.Result == config.ResultFail {
+					item.Retries = p2p.countRangeRetry(item.Range)
+					p2p.Cfg.Metrics.Add(config.MetricPiecesFailed, 1)
+				}
+				if item.Result == config.ResultFail && fromCurrentNode {
+					p2p.countRangeFailure(item.Range)
+				}
 			}
 		}
 		latestItem = item
 	} else {
-		p2p.Cfg.ClientLogger.Warnf("Get item timeout(2s) from queue.")
-		needMerge = false
+		p2p.pollTimeouts++
+		p2p.Cfg.Log().Warnf("Get item timeout(%v) from queue, %d times in a row.",
+			timeout, p2p.pollTimeouts)
+		timedOut = true
 	}
 	if util.IsNil(latestItem) {
 		return false, latestItem
 	}
-	if latestItem.Result == config.ResultSuc ||
-		latestItem.Result == config.ResultFail ||
-		latestItem.Result == config.ResultInvalid {
-		needMerge = false
+	state := &ScheduleState{
+		Latest:   latestItem,
+		TimedOut: timedOut,
+		QueueLen: p2p.queue.Len(),
+		Running:  p2p.runningCount(),
+		PieceSet: p2p.copyPieceSet(),
+	}
+	return p2p.scheduler().Pull(state), latestItem
+}
+
+// copyPieceSet returns a copy of the pieceSet taken under the stateLock, so
+// that the PieceScheduler can't modify it or read it while it's written.
+func (p2p *P2PDownloader) copyPieceSet() map[string]bool {
+	p2p.stateLock.RLock()
+	defer p2p.stateLock.RUnlock()
+	pieceSet := make(map[string]bool, len(p2p.pieceSet))
+	for k, v := range p2p.pieceSet {
+		pieceSet[k] = v
 	}
-	runningCount := 0
+	return pieceSet
+}
+
+// runningCount returns the number of the ranges in processing.
+func (p2p *P2PDownloader) runningCount() int {
+	n := 0
 	for _, v := range p2p.pieceSet {
 		if !v {
-			runningCount++
+			n++
 		}
 	}
-	if needMerge && (p2p.queue.Len() > 0 || runningCount > 2) {
-		return false, latestItem
-	}
-	return true, latestItem
+	return n
 }
 
 func (p2p *P2PDownloader) processPiece(response *types.PullPieceTaskResponse,
-	item *Piece) {
+	item *Piece) error {
 	var (
 		hasTask  = false
 		sucCount = 0
+		started  = 0
+		skipped  = 0
+		deferred = make(map[string]bool)
+		toStart  []*types.PullPieceTaskResponseContinueData
+		starts   = make(map[string]*types.PullPieceTaskResponseContinueData)
 	)
 	p2p.refresh(item)
+	p2p.prepareDelta()
 
-	data := response.ContinueData()
+	data := append(p2p.pending, response.ContinueData()...)
+	p2p.pending = nil
+	p2p.pins.learn(data)
 	for _, pieceTask := range data {
 		pieceRange := pieceTask.Range
+		if _, _, valid := parsePieceRange(pieceRange); !valid {
+			p2p.logs.logf(p2p.Cfg.Log().Warnf, "Range:%s from the supernode is malformed, skip it", pieceRange)
+			continue
+		}
 		v, ok := p2p.pieceSet[pieceRange]
+		if first := starts[pieceRange]; ok && !v && first != nil {
+			p2p.addCandidate(first, pieceTask)
+			continue
+		}
 		if ok && v {
 			sucCount++
 			p2p.queue.Put(NewPiece(p2p.taskID,
@@ -294,72 +1057,381 @@ func (p2p *P2PDownloader) processPiece(response *types.PullPieceTaskResponse,
 				config.TaskStatusRunning))
 			continue
 		}
+		if !ok && p2p.claimKept(pieceRange, int32(pieceTask.PieceSize)) {
+			sucCount++
+			p2p.queue.Put(NewPiece(p2p.taskID,
+				p2p.node,
+				pieceTask.Cid,
+				pieceRange,
+				config.ResultSemiSuc,
+				config.TaskStatusRunning))
+			continue
+		}
 		if !ok {
-			p2p.pieceSet[pieceRange] = false
-			p2p.pullRate(pieceTask)
-			go p2p.startTask(pieceTask)
+			if !util.IsEmptyStr(p2p.Cfg.RequestRange) &&
+				p2p.rangeOverlap(pieceRange, int32(pieceTask.PieceSize)) == 0 {
+				skipped++
+				continue
+			}
+			if (p2p.Cfg.MaxRangesPerPull > 0 && started >= p2p.Cfg.MaxRangesPerPull) ||
+				(started > 0 && !p2p.budget.fits(int64(started+1)*int64(pieceTask.PieceSize))) ||
+				(started > 0 && !p2p.files.fits(int64(started+1))) {
+				if !deferred[pieceRange] {
+					deferred[pieceRange] = true
+					p2p.pending = append(p2p.pending, pieceTask)
+				}
+				continue
+			}
+			pinned, ok := p2p.pins.pin(p2p.replay.apply(pieceTask))
+			if ok && p2p.blacklisted(pinned) {
+				p2p.Cfg.Log().Warnf("Range:%s refused from the blacklisted peer:%s",
+					pieceRange, peerAddr(pinned))
+				p2p.refuse(pieceTask)
+				continue
+			}
+			if !ok {
+				p2p.logs.logf(p2p.Cfg.Log().Warnf, "Range:%s can't be downloaded from the pinned peers",
+					pieceRange)
+				p2p.refuse(pieceTask)
+				continue
+			}
+			started++
+			p2p.setPiece(pieceRange, false)
+			p2p.manifest.dispatch(pinned)
+			if pinned.PeerIP != p2p.node {
+				p2p.usedPeers[peerAddr(pinned)] = true
+			}
+			toStart = append(toStart, pinned)
+			starts[pieceRange] = pinned
 			hasTask = true
 		}
 	}
-	if !hasTask {
-		p2p.Cfg.ClientLogger.Warnf("Has not available pieceTask,maybe resource lack")
+	p2p.Cfg.Metrics.Add(config.MetricPiecesRequested, int64(len(toStart)))
+	for _, group := range p2p.coalesce(toStart) {
+		clients := p2p.newPowerClients(group)
+		if len(group) == 1 {
+			clients[0].candidates = p2p.candidates[group[0].Range]
+		}
+		p2p.tasks.Add(1)
+		go func(clients []*PowerClient) {
+			defer p2p.tasks.Done()
+			p2p.runClients(clients)
+		}(clients)
+	}
+	if !hasTask && skipped > 0 && sucCount == 0 && p2p.runningCount() == 0 {
+		// nothing will be put into the queue for the next pull since all the
+		// piece tasks are out of the range.
+		if err := p2p.sleep(pullRetryDelay(p2p.Cfg, p2p.rng, 0)); err != nil {
+			return err
+		}
+		p2p.queue.Put(NewPiece(p2p.taskID, p2p.node, "", "", config.ResultInvalid,
+			config.TaskStatusRunning))
+	} else if !hasTask {
+		p2p.logs.logf(p2p.Cfg.Log().Warnf, "Has not available pieceTask,maybe resource lack")
 	}
 	if sucCount > 0 {
-		p2p.Cfg.ClientLogger.Warnf("Already suc item count:%d after a request super", sucCount)
+		p2p.logs.logf(p2p.Cfg.Log().Warnf, "Already suc item count:%d after a request super", sucCount)
+	}
+	if len(p2p.pending) > 0 {
+		p2p.Cfg.Log().Infof("Started %d pieceTasks and deferred %d to the next pull",
+			started, len(p2p.pending))
 	}
+	return nil
 }
 
-func (p2p *P2PDownloader) finishTask(response *types.PullPieceTaskResponse, clientWriter *ClientWriter) {
+func (p2p *P2PDownloader) finishTask(response *types.PullPieceTaskResponse, clientWriter *ClientWriter) (err error) {
+	// the temp path where the downloaded file exists, and the digest of it
+	// once it's verified.
+	var src, digest string
+	// the pieces can't be resumed once the file is assembled or fails
+	// the md5 check.
+	defer func() {
+		if _, ok := err.(*md5NotMatchError); ok {
+			p2p.Cfg.Log().Errorf("file:%s downloaded is corrupted: %v", src, err)
+			p2p.removeCorrupted(src)
+		}
+		if _, ok := err.(*md5NotMatchError); ok || err == nil {
+			p2p.removeResume()
+		}
+		if err == nil {
+			p2p.digest = digest
+			p2p.releaseHostLock()
+		}
+		if err == nil && p2p.Cfg.BackSourceReason == 0 {
+			p2p.reportProgress(true)
+		}
+	}()
+	// no migration happens once the task finishes.
+	p2p.releaseStandby()
 	// wait client writer finished
-	p2p.Cfg.ClientLogger.Infof("Remaining writed piece count:%d", p2p.clientQueue.Len())
+	p2p.Cfg.Log().Infof("Remaining writed piece count:%d", p2p.clientQueue.Len())
 	p2p.clientQueue.Put(last)
 	waitStart := time.Now().Unix()
-	clientWriter.Wait()
-	p2p.Cfg.ClientLogger.Infof("Wait client writer finish cost %d,main qu size:%d,client qu size:%d", time.Now().Unix()-waitStart, p2p.queue.Len(), p2p.clientQueue.Len())
+	writeErr := clientWriter.Wait()
+	p2p.Cfg.Log().Infof("Wait client writer finish cost %d,main qu size:%d,client qu size:%d", time.Now().Unix()-waitStart, p2p.queue.Len(), p2p.clientQueue.Len())
 
+	// the pieces failed to be written are downloaded from the source, the
+	// write error is reported if it fails too.
 	if p2p.Cfg.BackSourceReason > 0 {
-		return
+		err := p2p.backSource()
+		if de, ok := err.(*DownloadError); ok && writeErr != nil {
+			de.Err = fmt.Errorf("%v, after write error: %v", de.Err, writeErr)
+		}
+		return err
+	}
+	if !util.IsEmptyStr(p2p.Cfg.RequestRange) {
+		return p2p.deliverRange()
+	}
+	if p2p.Cfg.VerifyLineage {
+		fileLength := int64(-1)
+		if data := response.FinishData(); data != nil {
+			fileLength = data.FileLength
+		}
+		if err := verifyLineage(clientWriter.Sources(), p2p.lineage,
+			p2p.pieceSizeHistory[1], fileLength); err != nil {
+			p2p.Cfg.Log().Errorf("verify lineage of task:%s error:%v", p2p.taskID, err)
+			return err
+		}
+	}
+
+	// the finish may arrive before the last piece is written, the file
+	// isn't moved then and can be resumed.
+	if length := p2p.Cfg.RV.FileLength; length > 0 && p2p.completed != length {
+		p2p.Cfg.Log().Errorf("assembled %d bytes of task:%s not match the registered length:%d",
+			p2p.completed, p2p.taskID, length)
+		return fmt.Errorf("file length not match, expected:%d real:%d", length, p2p.completed)
 	}
 
-	// get the temp path where the downloaded file exists.
-	var src string
-	if clientWriter.acrossWrite {
+	if clientWriter.direct {
+		src = p2p.targetFile
+	} else if clientWriter.acrossWrite && !p2p.Cfg.NoMove &&
+		p2p.Cfg.RV.Assembly != config.AssemblySequential {
 		src = p2p.Cfg.RV.TempTarget
 	} else {
 		if _, err := os.Stat(p2p.clientFilePath); err != nil {
-			p2p.Cfg.ClientLogger.Infof("Client file path:%s not found", p2p.clientFilePath)
-			if e := util.Link(p2p.serviceFilePath, p2p.clientFilePath); e != nil {
-				p2p.Cfg.ClientLogger.Warnln("Link failed, instead of use copy")
-				util.CopyFile(p2p.serviceFilePath, p2p.clientFilePath)
-			}
+			p2p.Cfg.Log().Infof("Client file path:%s not found", p2p.clientFilePath)
+			linkOrCopy(p2p.Cfg, p2p.serviceFilePath, p2p.clientFilePath)
 		}
 		src = p2p.clientFilePath
 	}
 
-	// move file to the target file path.
-	if err := moveFile(src, p2p.targetFile, p2p.Cfg.Md5, p2p.Cfg.ClientLogger); err != nil {
+	// skip computing md5 by re-reading the file if it has been computed
+	// while writing.
+	expectMd5 := p2p.expectedDigest()
+	realMd5, digested := clientWriter.Digest()
+	if digested && expectMd5 != "" {
+		p2p.Cfg.Log().Infof("digest:%s computed while writing for file:%s", realMd5, src)
+		if realMd5 != expectMd5 {
+			return &md5NotMatchError{real: realMd5, expect: expectMd5}
+		}
+		expectMd5 = ""
+	}
+	knownMd5 := p2p.expectedMd5()
+	if knownMd5 == "" && digested && digestAlgorithm(p2p.Cfg) == util.DigestMd5 {
+		knownMd5 = realMd5
+	}
+	if digest = p2p.expectedDigest(); digested {
+		digest = realMd5
+	}
+
+	// leave the verified file in the data dir for the consumers reading it
+	// in place.
+	if p2p.Cfg.NoMove {
+		if expectMd5 != "" {
+			if realMd5 = fileDigest(src, expectMd5); realMd5 != expectMd5 {
+				return &md5NotMatchError{real: realMd5, expect: expectMd5}
+			}
+		}
+		if err := syncTargets(p2p.Cfg, []string{src}); err != nil {
+			return err
+		}
+		p2p.Cfg.RV.ResultPath = src
+		p2p.writeManifest(src, knownMd5)
+		p2p.Cfg.Log().Infof("Download successfully from dragonfly and leave file at:%s, bytes by tier:%v",
+			src, p2p.tiers.Snapshot())
+		return nil
+	}
+
+	// the digest of the source file is required to verify the target file
+	// after moving.
+	verifyMd5 := p2p.expectedDigest()
+	if p2p.Cfg.ReadBackVerify && verifyMd5 == "" {
+		if digested {
+			verifyMd5 = realMd5
+		} else {
+			verifyMd5 = util.DigestSum(src, digestAlgorithm(p2p.Cfg))
+		}
+	}
+
+	// move file to the target file path, which is written directly already
+	// by Cfg.DirectWrite.
+	if clientWriter.direct {
+		if expectMd5 != "" {
+			if realMd5 = fileDigest(src, expectMd5); realMd5 != expectMd5 {
+				return &md5NotMatchError{real: realMd5, expect: expectMd5}
+			}
+		}
+	} else if err := deliver(p2p.Cfg, src, p2p.targetFile, expectMd5, true); err != nil {
+		return err
+	}
+	assembled := assembledFile(p2p.Cfg, src, p2p.targetFile)
+	if err := linkTargets(p2p.Cfg, assembled); err != nil {
+		return err
+	}
+	if err := syncTargets(p2p.Cfg, append([]string{p2p.targetFile}, p2p.Cfg.ExtraTargets...)); err != nil {
+		return err
+	}
+	if p2p.Cfg.ReadBackVerify {
+		targets := append([]string{assembled}, p2p.Cfg.ExtraTargets...)
+		if err := verifyTargets(p2p.Cfg, targets, verifyMd5); err != nil {
+			return err
+		}
+	}
+	if len(p2p.Cfg.MetaHeaders) > 0 {
+		p2p.storeMetadata()
+	}
+	p2p.writeManifest(assembled, knownMd5)
+	if p2p.Cfg.CompressServiceFile {
+		compressServiceFile(p2p.Cfg, p2p.serviceFilePath,
+			append([]string{p2p.targetFile}, p2p.Cfg.ExtraTargets...))
+	}
+	p2p.Cfg.Log().Infof("Download successfully from dragonfly, bytes by tier:%v peak buffered:%d",
+		p2p.tiers.Snapshot(), p2p.budget.Peak())
+	return nil
+}
+
+// removeCorrupted removes the downloaded file src failing the md5 check, and
+// the target streamed into already, so that a retry downloads it again.
+func (p2p *P2PDownloader) removeCorrupted(src string) {
+	if src != "" {
+		os.Remove(src)
+	}
+	if p2p.Cfg.RV.Assembly == config.AssemblySequential && p2p.Cfg.OutputWriter == nil &&
+		util.IsRegularFile(p2p.targetFile) {
+		os.Remove(p2p.targetFile)
+	}
+}
+
+// expectedMd5 returns the md5 the downloaded file is expected to match, which
+// is Cfg.Md5 or the md5 recorded in the replayed manifest.
+func (p2p *P2PDownloader) expectedMd5() string {
+	if p2p.Cfg.Md5 == "" && p2p.replay != nil {
+		return p2p.replay.Md5
+	}
+	return p2p.Cfg.Md5
+}
+
+// expectedDigest returns the digest the downloaded file is verified by,
+// which is Cfg.Digest or the expected md5 if it's not set.
+func (p2p *P2PDownloader) expectedDigest() string {
+	if !util.IsEmptyStr(p2p.Cfg.Digest) {
+		return p2p.Cfg.Digest
+	}
+	return p2p.expectedMd5()
+}
+
+// writeManifest writes the manifest of the download into Cfg.ManifestFile,
+// the md5 of the file is computed if it's unknown. The failure doesn't fail
+// the download.
+func (p2p *P2PDownloader) writeManifest(file string, md5 string) {
+	if p2p.manifest == nil {
+		return
+	}
+	if md5 == "" {
+		md5 = util.Md5Sum(file)
+	}
+	m := p2p.manifest.build(&Manifest{
+		URL:       p2p.Cfg.URL,
+		TaskID:    p2p.taskID,
+		PieceSize: p2p.pieceSizeHistory[1],
+		Md5:       md5,
+	})
+	if info, err := os.Stat(file); err == nil {
+		m.FileLength = info.Size()
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(p2p.Cfg.ManifestFile, b, 0644)
+	}
+	if err != nil {
+		p2p.Cfg.Log().Warnf("write manifest:%s error:%v", p2p.Cfg.ManifestFile, err)
+	}
+}
+
+// storeMetadata fetches the response headers from the source and stores them
+// into the sidecar file of the target. The failure doesn't fail the download.
+func (p2p *P2PDownloader) storeMetadata() {
+	header, err := fetchMetadata(p2p.Cfg)
+	if err == nil {
+		err = writeMetadata(p2p.Cfg, p2p.targetFile, header)
+	}
+	if err != nil {
+		p2p.Cfg.Log().Warnf("store metadata of %s error:%v", p2p.targetFile, err)
+	}
+}
+
+// prepareDelta indexes the Cfg.DeltaBaseFile with the current piece size.
+func (p2p *P2PDownloader) prepareDelta() {
+	if util.IsEmptyStr(p2p.Cfg.DeltaBaseFile) {
+		return
+	}
+	pieceSize := p2p.pieceSizeHistory[1]
+	if p2p.delta != nil && p2p.delta.pieceSize == pieceSize {
+		return
+	}
+	start := time.Now()
+	delta, err := newDeltaIndex(p2p.Cfg.DeltaBaseFile, pieceSize)
+	if err != nil {
+		p2p.Cfg.Log().Warnf("index delta base file:%s error:%v, download all pieces",
+			p2p.Cfg.DeltaBaseFile, err)
+		p2p.Cfg.DeltaBaseFile = ""
 		return
 	}
-	p2p.Cfg.ClientLogger.Infof("Download successfully from dragonfly")
+	p2p.Cfg.Log().Infof("index delta base file:%s pieceSize:%d blocks:%d cost:%.3fs",
+		p2p.Cfg.DeltaBaseFile, pieceSize, len(delta.blocks), time.Since(start).Seconds())
+	p2p.delta = delta
 }
 
 func (p2p *P2PDownloader) refresh(item *Piece) {
 	needReset := false
-	if p2p.pieceSizeHistory[0] != p2p.pieceSizeHistory[1] {
+	oldSize := p2p.pieceSizeHistory[0]
+	if oldSize != p2p.pieceSizeHistory[1] {
 		p2p.pieceSizeHistory[0] = p2p.pieceSizeHistory[1]
 		needReset = true
 	}
 
 	if needReset {
-		p2p.clientQueue.Put(reset)
-		for k := range p2p.pieceSet {
-			delete(p2p.pieceSet, k)
-			p2p.total = 0
-			// console log reset
+		p2p.resizeClientQueue()
+		p2p.manifest.reset()
+		p2p.pending = nil
+		p2p.rangeRetries = make(map[string]int)
+		p2p.rangeBackSourced = make(map[string]bool)
+		// the lineage verifies the pieces of one piece size only, so the
+		// written contents are discarded.
+		if p2p.Cfg.VerifyLineage {
+			p2p.clientQueue.Put(reset)
+			p2p.lineage = nil
+			p2p.kept = nil
+			p2p.stateLock.Lock()
+			for k := range p2p.pieceSet {
+				delete(p2p.pieceSet, k)
+			}
+			p2p.stateLock.Unlock()
+		} else {
+			p2p.reslice(oldSize)
 		}
+		p2p.stateLock.Lock()
+		p2p.total, p2p.completed, p2p.rangeBytes = 0, 0, 0
+		p2p.stateLock.Unlock()
+		p2p.counted = nil
 	}
 	if p2p.node != item.SuperNode {
+		p2p.pending = nil
+		p2p.manifest.node(item.SuperNode)
+		p2p.stateLock.Lock()
 		p2p.node = item.SuperNode
 		p2p.taskID = item.TaskID
+		p2p.stateLock.Unlock()
 	}
+	p2p.lineage = p2p.lineage.add(p2p.taskID)
 }
@@ -0,0 +1,2516 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/api"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/regist"
+	"github.com/dragonflyoss/Dragonfly/dfget/errors"
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+	"github.com/go-check/check"
+)
+
+type P2PDownloaderTestSuite struct {
+	workHome string
+}
+
+func init() {
+	check.Suite(&P2PDownloaderTestSuite{})
+}
+
+func (s *P2PDownloaderTestSuite) SetUpSuite(c *check.C) {
+	s.workHome, _ = ioutil.TempDir("/tmp", "dfget-P2PDownloaderTestSuite-")
+}
+
+func (s *P2PDownloaderTestSuite) TearDownSuite(c *check.C) {
+	if s.workHome != "" {
+		if err := os.RemoveAll(s.workHome); err != nil {
+			fmt.Printf("remove path:%s error", s.workHome)
+		}
+	}
+}
+
+func (s *P2PDownloaderTestSuite) TestPullPieceTask_MigrationRateLimit(c *check.C) {
+	var migrate = func(count int, rate int) time.Duration {
+		var wg sync.WaitGroup
+		start := time.Now()
+		for i := 0; i < count; i++ {
+			cfg := s.createConfig()
+			cfg.MigrationRateLimit = rate
+			p2p := s.createP2PDownloader(cfg, migrateAPI(), &MockRegister{})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				item := NewPieceSimple("old", "node", config.TaskStatusStart)
+				res, err := p2p.pullPieceTask(item)
+				c.Check(err, check.IsNil)
+				c.Check(res.Code, check.Equals, config.TaskCodeContinue)
+				c.Check(item.TaskID, check.Equals, "new")
+			}()
+		}
+		wg.Wait()
+		return time.Since(start)
+	}
+
+	c.Assert(migrate(5, 0) < 200*time.Millisecond, check.Equals, true)
+	// one migration per 100ms
+	c.Assert(migrate(5, 10) >= 400*time.Millisecond, check.Equals, true)
+}
+
+func (s *P2PDownloaderTestSuite) TestPullPieceTask_MigrationCancelled(c *check.C) {
+	for _, jitter := range []bool{true, false} {
+		comment := check.Commentf("jitter:%t", jitter)
+		cfg := s.createConfig()
+		if jitter {
+			cfg.MigrationJitter = time.Hour
+		} else {
+			cfg.MigrationRateLimit = 1
+			// the tokens of the limiter are taken by the other migrations
+			for getMigrationLimiter(1).AcquireNonBlocking(1) >= 0 {
+			}
+		}
+		p2p := s.createP2PDownloader(cfg, migrateAPI(), &MockRegister{})
+		ctx, cancel := context.WithCancel(context.Background())
+		p2p.ctx = ctx
+		time.AfterFunc(100*time.Millisecond, cancel)
+		start := time.Now()
+		_, err := p2p.pullPieceTask(NewPieceSimple("old", "node", config.TaskStatusStart))
+		c.Assert(err, check.Equals, context.Canceled, comment)
+		c.Assert(time.Since(start) < 500*time.Millisecond, check.Equals, true, comment)
+	}
+}
+
+func (s *P2PDownloaderTestSuite) TestPullPieceTask_OnMigrate(c *check.C) {
+	var migrations [][]string
+	cfg := s.createConfig()
+	cfg.OnMigrate = func(oldNode, newNode, newTaskID string) {
+		migrations = append(migrations, []string{oldNode, newNode, newTaskID})
+	}
+	p2p := s.createP2PDownloader(cfg, migrateAPI(), &MockRegister{})
+	item := NewPieceSimple("old", "node", config.TaskStatusStart)
+	res, err := p2p.pullPieceTask(item)
+	c.Assert(err, check.IsNil)
+	c.Assert(res.Code, check.Equals, config.TaskCodeContinue)
+	c.Assert(migrations, check.DeepEquals, [][]string{{"node", "newNode", "new"}})
+}
+
+func (s *P2PDownloaderTestSuite) TestPullPieceTask_AlternateNodes(c *check.C) {
+	var tried []string
+	cfg := s.createConfig()
+	cfg.Node = []string{"down"}
+	cfg.AlternateNodes = []string{"node", "alt1", "alt2"}
+	register := &MockRegister{
+		RegisterNodesFunc: func(peerPort int, nodes []string) (*regist.RegisterResult, *errors.DFGetError) {
+			node := nodes[0]
+			tried = append(tried, node)
+			if node != "alt2" {
+				return nil, errors.New(config.HTTPError, "connection refused")
+			}
+			return regist.NewRegisterResult(node, nil, "", "new", 100, 10), nil
+		},
+	}
+	p2p := s.createP2PDownloader(cfg, migrateAPI(), register)
+	item := NewPieceSimple("old", "node", config.TaskStatusStart)
+	res, err := p2p.pullPieceTask(item)
+	c.Assert(err, check.IsNil)
+	c.Assert(res.Code, check.Equals, config.TaskCodeContinue)
+	// the node migrated from is skipped.
+	c.Assert(tried, check.DeepEquals, []string{"down", "alt1", "alt2"})
+	c.Assert(item.SuperNode, check.Equals, "alt2")
+	// the remainder nodes are kept for the later migrations.
+	c.Assert(cfg.Node, check.DeepEquals, []string{"down"})
+
+	// all the nodes fail.
+	tried, cfg.Node = nil, []string{"down"}
+	cfg.AlternateNodes = []string{"alt1"}
+	item = NewPieceSimple("old", "node", config.TaskStatusStart)
+	_, err = p2p.pullPieceTask(item)
+	c.Assert(err, check.ErrorMatches, ".*connection refused.*")
+	c.Assert(tried, check.DeepEquals, []string{"down", "alt1"})
+}
+
+func (s *P2PDownloaderTestSuite) TestPullPieceTask_MigrationHealthCheck(c *check.C) {
+	var (
+		tried   []string
+		checked []string
+		mu      sync.Mutex
+	)
+	cfg := s.createConfig()
+	cfg.Node = []string{"down", "rem"}
+	cfg.AlternateNodes = []string{"node", "alt1", "alt2"}
+	cfg.MigrationHealthCheck = true
+	api := migrateAPI()
+	api.CheckHealthFunc = func(ip string) error {
+		mu.Lock()
+		checked = append(checked, ip)
+		mu.Unlock()
+		if ip == "down" || ip == "alt1" {
+			return fmt.Errorf("connection refused")
+		}
+		return nil
+	}
+	register := &MockRegister{
+		RegisterNodesFunc: func(peerPort int, nodes []string) (*regist.RegisterResult, *errors.DFGetError) {
+			node := nodes[0]
+			tried = append(tried, node)
+			if node != "alt2" {
+				return nil, errors.New(config.HTTPError, "register timeout")
+			}
+			return regist.NewRegisterResult(node, nil, "", "new", 100, 10), nil
+		},
+	}
+	p2p := s.createP2PDownloader(cfg, api, register)
+	item := NewPieceSimple("old", "node", config.TaskStatusStart)
+	res, err := p2p.pullPieceTask(item)
+	c.Assert(err, check.IsNil)
+	c.Assert(res.Code, check.Equals, config.TaskCodeContinue)
+	// the unhealthy nodes are skipped and the node migrated from isn't checked.
+	c.Assert(tried, check.DeepEquals, []string{"rem", "alt2"})
+	sort.Strings(checked)
+	c.Assert(checked, check.DeepEquals, []string{"alt1", "alt2", "down", "rem"})
+	c.Assert(item.SuperNode, check.Equals, "alt2")
+	c.Assert(cfg.Node, check.DeepEquals, []string{"down", "rem"})
+}
+
+func (s *P2PDownloaderTestSuite) TestPullPieceTask_UnknownCode(c *check.C) {
+	var pull = func(policy string, unknownPulls int32) (*P2PDownloader, *types.PullPieceTaskResponse, error) {
+		var pulls int32
+		api := &helper.MockSupernodeAPI{
+			PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+				if ip == "node" && atomic.AddInt32(&pulls, 1) <= unknownPulls {
+					return newPullResponse(699), nil
+				}
+				return newPullResponse(config.TaskCodeContinue), nil
+			},
+		}
+		cfg := s.createConfig()
+		cfg.UnknownCodePolicy = policy
+		p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+		res, err := p2p.pullPieceTask(NewPieceSimple("old", "node", config.TaskStatusStart))
+		return p2p, res, err
+	}
+
+	// test: migrate by default
+	p2p, res, err := pull("", 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(res.Code, check.Equals, config.TaskCodeContinue)
+	c.Assert(p2p.GetRegisterResult().Node, check.Equals, "newNode")
+
+	// test: retry the same supernode
+	p2p, res, err = pull(config.UnknownCodeRetry, 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(res.Code, check.Equals, config.TaskCodeContinue)
+	c.Assert(p2p.GetRegisterResult().Node, check.Equals, "node")
+
+	// test: fail the pull
+	_, _, err = pull(config.UnknownCodeFatal, 1)
+	c.Assert(err, check.NotNil)
+	c.Assert(strings.Contains(err.Error(), "699"), check.Equals, true)
+}
+
+func (s *P2PDownloaderTestSuite) TestProcessPiece_MaxRangesPerPull(c *check.C) {
+	var data []*types.PullPieceTaskResponseContinueData
+	for i := 0; i < 5; i++ {
+		data = append(data, &types.PullPieceTaskResponseContinueData{
+			Range:     fmt.Sprintf("%d-%d", i*10, i*10+9),
+			PieceNum:  i,
+			PieceSize: 10,
+			PeerIP:    "127.0.0.1",
+			PeerPort:  1,
+		})
+	}
+	response := newPullResponse(config.TaskCodeContinue)
+	response.Data, _ = json.Marshal(data)
+
+	cfg := s.createConfig()
+	cfg.MaxRangesPerPull = 2
+	p2p := s.createP2PDownloader(cfg, migrateAPI(), &MockRegister{})
+	item := NewPieceSimple("old", "node", config.TaskStatusRunning)
+
+	var expected = []struct {
+		started int
+		pending int
+	}{
+		{started: 2, pending: 3},
+		// the ranges offered again are deferred only once
+		{started: 4, pending: 1},
+		{started: 5, pending: 0},
+	}
+	for idx, v := range expected {
+		p2p.processPiece(response, item)
+		c.Assert(len(p2p.pieceSet), check.Equals, v.started, check.Commentf("cycle:%d", idx))
+		c.Assert(len(p2p.pending), check.Equals, v.pending, check.Commentf("cycle:%d", idx))
+		response = newPullResponse(config.TaskCodeContinue)
+		if idx == 0 {
+			response.Data, _ = json.Marshal(data[2:])
+		}
+	}
+}
+
+func (s *P2PDownloaderTestSuite) TestProcessPiece_Reslice(c *check.C) {
+	var data []*types.PullPieceTaskResponseContinueData
+	for i := 0; i < 2; i++ {
+		data = append(data, &types.PullPieceTaskResponseContinueData{
+			Range:     fmt.Sprintf("%d-%d", i*15, i*15+14),
+			PieceNum:  i,
+			PieceSize: 15,
+			PeerIP:    "127.0.0.1",
+			PeerPort:  1,
+		})
+	}
+	newP2P := func(verifyLineage bool) *P2PDownloader {
+		cfg := s.createConfig()
+		cfg.VerifyLineage = verifyLineage
+		p2p := s.createP2PDownloader(cfg, migrateAPI(), &MockRegister{})
+		// the contents of [0, 15) are written with the piece size 10.
+		for _, r := range []string{"0-9", "10-19", "20-29"} {
+			p2p.pieceSet[r] = true
+		}
+		p2p.pieceSet["30-39"] = false
+		p2p.pieceSizeHistory[1] = 15
+		return p2p
+	}
+	item := NewPieceSimple("old", "node", config.TaskStatusRunning)
+
+	// test: the piece covered by the written contents isn't downloaded again
+	p2p := newP2P(false)
+	response := newPullResponse(config.TaskCodeContinue)
+	response.Data, _ = json.Marshal(data)
+	p2p.processPiece(response, item)
+	c.Assert(p2p.pieceSet, check.DeepEquals, map[string]bool{"0-14": true, "15-29": false})
+	c.Assert(p2p.total, check.Equals, int64(15))
+	c.Assert(p2p.completed, check.Equals, int64(10))
+	c.Assert(p2p.clientQueue.Len(), check.Equals, 0)
+	// the first item is the start put by init
+	p2p.queue.Poll()
+	v, ok := p2p.queue.PollTimeout(time.Second)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(v.(*Piece).Range, check.Equals, "0-14")
+	c.Assert(v.(*Piece).Result, check.Equals, config.ResultSemiSuc)
+
+	// test: the written contents are discarded if the lineage is verified
+	p2p = newP2P(true)
+	response = newPullResponse(config.TaskCodeContinue)
+	response.Data, _ = json.Marshal(data)
+	p2p.processPiece(response, item)
+	c.Assert(p2p.pieceSet, check.DeepEquals, map[string]bool{"0-14": false, "15-29": false})
+	c.Assert(p2p.clientQueue.Len(), check.Equals, 1)
+}
+
+func (s *P2PDownloaderTestSuite) TestProcessPiece_Cancelled(c *check.C) {
+	cfg := s.createConfig()
+	cfg.RequestRange = "0-9"
+	p2p := s.createP2PDownloader(cfg, migrateAPI(), &MockRegister{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p2p.ctx = ctx
+	// all the piece tasks are out of the requested range
+	response := newPullResponse(config.TaskCodeContinue)
+	response.Data, _ = json.Marshal([]*types.PullPieceTaskResponseContinueData{{
+		Range:     "100-109",
+		PieceNum:  10,
+		PieceSize: 10,
+		PeerIP:    "127.0.0.1",
+		PeerPort:  1,
+	}})
+	err := p2p.processPiece(response, NewPieceSimple("old", "node", config.TaskStatusRunning))
+	c.Assert(err, check.Equals, context.Canceled)
+	// the first item is the start put by init
+	p2p.queue.Poll()
+	c.Assert(p2p.queue.Len(), check.Equals, 0)
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_MigrateOnRangeFailures(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the piece cached by the supernode "node" is corrupt
+		if r.URL.Path == "/bad" {
+			w.Write(wrapPieceContent([]byte("xxxxx"), 10))
+			return
+		}
+		w.Write(good)
+	}))
+	defer peer.Close()
+
+	var oldPulls int32
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if ip == "node" {
+				atomic.AddInt32(&oldPulls, 1)
+				return newPieceResponse(peer, "/bad", good), nil
+			}
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "migrate.target")
+	cfg.RV.TaskFileName = "migrate"
+	cfg.MaxRangeFailures = 2
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.GetRegisterResult().Node, check.Equals, "node")
+	c.Assert(p2p.GetRegisterResult().TaskID, check.Equals, "old")
+	c.Assert(p2p.Run(), check.IsNil)
+
+	// the first pull and the reports of the failures before migrating
+	c.Assert(atomic.LoadInt32(&oldPulls), check.Equals, int32(cfg.MaxRangeFailures))
+	c.Assert(p2p.GetNode(), check.Equals, "newNode")
+	res := p2p.GetRegisterResult()
+	c.Assert(res.Node, check.Equals, "newNode")
+	c.Assert(res.TaskID, check.Equals, "new")
+	c.Assert(res.PieceSize, check.Equals, int32(10))
+	content, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+	c.Assert(string(content), check.Equals, "aaaaa")
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_WarmStandby(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if ip == "node" {
+				return nil, fmt.Errorf("supernode is down")
+			}
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+	unregistered := make(chan string, 2)
+	api.ServiceDownFunc = func(ip string, taskID string, cid string) (*types.BaseResponse, error) {
+		unregistered <- ip
+		return nil, nil
+	}
+	var registers int32
+	register := &MockRegister{
+		RegisterFunc: func(peerPort int) (*regist.RegisterResult, *errors.DFGetError) {
+			// only the first registration is made before the failure
+			if atomic.AddInt32(&registers, 1) == 1 {
+				return regist.NewRegisterResult("standby", nil, "", "new", 100, 10), nil
+			}
+			return regist.NewRegisterResult("cold", nil, "", "new", 100, 10), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "standby.target")
+	cfg.RV.TaskFileName = "standby"
+	cfg.WarmStandby = true
+	p2p := s.createP2PDownloader(cfg, api, register)
+	c.Assert(p2p.Run(), check.IsNil)
+
+	c.Assert(p2p.GetRegisterResult().Node, check.Equals, "standby")
+	// the standby registered after the migration is unregistered
+	c.Assert(p2p.standby, check.IsNil)
+	c.Assert(waitUnregistered(c, unregistered), check.Equals, "cold")
+	content, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+	c.Assert(string(content), check.Equals, "aaaaa")
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_WarmStandbyUnused(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	unregistered := make(chan string, 2)
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+		ServiceDownFunc: func(ip string, taskID string, cid string) (*types.BaseResponse, error) {
+			unregistered <- ip + "/" + taskID
+			return nil, nil
+		},
+	}
+	register := &MockRegister{
+		RegisterFunc: func(peerPort int) (*regist.RegisterResult, *errors.DFGetError) {
+			return regist.NewRegisterResult("standby", nil, "", "new", 100, 10), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "standby_unused.target")
+	cfg.RV.TaskFileName = "standby_unused"
+	cfg.WarmStandby = true
+	p2p := s.createP2PDownloader(cfg, api, register)
+	c.Assert(p2p.Run(), check.IsNil)
+
+	// the download succeeds without migrating, the standby is unregistered
+	c.Assert(p2p.GetRegisterResult().Node, check.Equals, "node")
+	c.Assert(p2p.standby, check.IsNil)
+	c.Assert(waitUnregistered(c, unregistered), check.Equals, "standby/new")
+	content, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+	c.Assert(string(content), check.Equals, "aaaaa")
+}
+
+// waitUnregistered waits for the standby released to be unregistered in the
+// background, and returns the node it's unregistered from.
+func waitUnregistered(c *check.C, unregistered chan string) string {
+	select {
+	case node := <-unregistered:
+		return node
+	case <-time.After(time.Second):
+		c.Fatal("the standby isn't unregistered")
+	}
+	return ""
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_Candidates(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	var served int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served, 1)
+		w.Write(good)
+	}))
+	defer peer.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	var failures int32
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultFail {
+				atomic.AddInt32(&failures, 1)
+			}
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			// the range is offered by the dead peer first and the alive one
+			var first, second []*types.PullPieceTaskResponseContinueData
+			json.Unmarshal(newPieceResponse(dead, "/good", good).Data, &first)
+			res := newPieceResponse(peer, "/good", good)
+			json.Unmarshal(res.Data, &second)
+			first[0].Cid = "dead"
+			res.Data, _ = json.Marshal(append(first, second...))
+			return res, nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "candidates.target")
+	cfg.RV.TaskFileName = "candidates"
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Run(), check.IsNil)
+
+	c.Assert(atomic.LoadInt32(&failures), check.Equals, int32(0))
+	c.Assert(atomic.LoadInt32(&served), check.Equals, int32(1))
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	c.Assert(p2p.usedPeers[host+":"+port], check.Equals, true)
+	c.Assert(p2p.candidates, check.HasLen, 0)
+	content, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+	c.Assert(string(content), check.Equals, "aaaaa")
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_WriterDone(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "writerdone.target")
+	cfg.RV.TaskFileName = "writerdone"
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	done := p2p.WriterDone()
+	select {
+	case <-done:
+		c.Fatal("writer done before running")
+	default:
+	}
+	c.Assert(p2p.Run(), check.IsNil)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		c.Fatal("writer isn't done after running")
+	}
+	c.Assert(p2p.WriterErr(), check.IsNil)
+
+	// the write error is returned if the download can't fall back to the
+	// source for it
+	cfg = s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "writefail.target")
+	cfg.RV.TaskFileName = "writefail"
+	cfg.Notbs = true
+	os.MkdirAll(helper.GetServiceFile(cfg.RV.TaskFileName, cfg.RV.DataDir), 0755)
+	p2p = s.createP2PDownloader(cfg, api, &MockRegister{})
+	err := p2p.Run()
+	c.Assert(err, check.FitsTypeOf, &DownloadError{})
+	c.Assert(err.(*DownloadError).Reason%config.ForceNotBackSourceAddition, check.Equals,
+		config.BackSourceReasonWriteError)
+	c.Assert(err, check.ErrorMatches, ".*after write error: write item:.*")
+	<-p2p.WriterDone()
+	c.Assert(p2p.WriterErr(), check.NotNil)
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_HostDedup(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	var served int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served, 1)
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+	createConfig := func(name string) *config.Config {
+		cfg := s.createConfig()
+		cfg.RV.DataDir = path.Join(s.workHome, "dedup")
+		cfg.RV.TaskFileName = name
+		cfg.RV.RealTarget = path.Join(s.workHome, name+".target")
+		cfg.RV.PeerPort = 1
+		cfg.HostDedup = true
+		return cfg
+	}
+	os.MkdirAll(path.Join(s.workHome, "dedup"), 0755)
+
+	// the second process waits for the first one and reuses its file
+	first := s.createP2PDownloader(createConfig("first"), api, &MockRegister{})
+	second := s.createP2PDownloader(createConfig("second"), api, &MockRegister{})
+	c.Assert(first.hostLock.locked, check.Equals, true)
+	c.Assert(second.hostLock.locked, check.Equals, false)
+	done := make(chan error)
+	go func() { done <- second.Run() }()
+	time.Sleep(2 * config.HostLockPollInterval)
+	c.Assert(first.Run(), check.IsNil)
+	c.Assert(<-done, check.IsNil)
+	c.Assert(atomic.LoadInt32(&served), check.Equals, int32(1))
+	content, _ := ioutil.ReadFile(second.targetFile)
+	c.Assert(string(content), check.Equals, "aaaaa")
+
+	// the lock of the crashed process is released by the system, and the
+	// file is downloaded again since there's nothing left to reuse
+	os.Remove(first.serviceFilePath)
+	crashed := s.createP2PDownloader(createConfig("crashed"), api, &MockRegister{})
+	c.Assert(crashed.hostLock.locked, check.Equals, true)
+	crashed.hostLock.file.Close()
+	third := s.createP2PDownloader(createConfig("third"), api, &MockRegister{})
+	c.Assert(third.hostLock.locked, check.Equals, true)
+	c.Assert(third.Run(), check.IsNil)
+	c.Assert(atomic.LoadInt32(&served), check.Equals, int32(2))
+	content, _ = ioutil.ReadFile(third.targetFile)
+	c.Assert(string(content), check.Equals, "aaaaa")
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_Events(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if ip == "node" {
+				return nil, fmt.Errorf("supernode is down")
+			}
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	c.Assert(s.createP2PDownloader(cfg, api, &MockRegister{}).Events(), check.IsNil)
+
+	var cases = []struct {
+		bufferSize int
+		expected   []EventType
+	}{
+		{bufferSize: 16, expected: []EventType{EventMigration, EventProgress, EventComplete}},
+		// the events are dropped if the channel is full
+		{bufferSize: 1, expected: []EventType{EventMigration}},
+	}
+	for idx, v := range cases {
+		cfg := s.createConfig()
+		cfg.RV.RealTarget = path.Join(s.workHome, fmt.Sprintf("events.%d.target", idx))
+		cfg.RV.TaskFileName = fmt.Sprintf("events.%d", idx)
+		cfg.EventBufferSize = v.bufferSize
+		p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+		c.Assert(p2p.Run(), check.IsNil)
+
+		var events []Event
+		for e := range p2p.Events() {
+			events = append(events, e)
+		}
+		c.Assert(len(events), check.Equals, len(v.expected))
+		for i, e := range events {
+			c.Assert(e.Type, check.Equals, v.expected[i])
+		}
+		c.Assert(events[0].Node, check.Equals, "newNode")
+		c.Assert(events[0].TaskID, check.Equals, "new")
+		if len(events) == 3 {
+			c.Assert(events[1].Completed, check.Equals, int64(10))
+			c.Assert(events[2].Err, check.IsNil)
+		}
+	}
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_VerifyRetries(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	bad := wrapPieceContent([]byte("xxxxx"), 10)
+	var newPeer = func(content []byte) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(content)
+		}))
+	}
+	goodPeer, badPeer := newPeer(good), newPeer(bad)
+	defer goodPeer.Close()
+	defer badPeer.Close()
+	// the corrupt piece is dispatched first by every supernode, and the good
+	// one is dispatched after it's refused.
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			switch req.Result {
+			case config.ResultSemiSuc:
+				return newFinishResponse(5), nil
+			case config.ResultFail:
+				return newPieceResponse(goodPeer, "/good", good), nil
+			}
+			return newPieceResponse(badPeer, "/bad", bad), nil
+		},
+	}
+
+	var cases = []struct {
+		retries   int
+		blacklist bool
+		ok        bool
+	}{
+		{retries: 0, blacklist: true, ok: false},
+		{retries: 1, blacklist: false, ok: false},
+		{retries: 1, blacklist: true, ok: true},
+	}
+	for idx, v := range cases {
+		cfg := s.createConfig()
+		cfg.RV.RealTarget = path.Join(s.workHome, fmt.Sprintf("verify.%d.target", idx))
+		cfg.RV.TaskFileName = fmt.Sprintf("verify.%d", idx)
+		cfg.Md5 = fmt.Sprintf("%x", md5.Sum([]byte("aaaaa")))
+		cfg.MaxVerifyRetries = v.retries
+		cfg.VerifyRetryBlacklist = v.blacklist
+		p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+		err := p2p.Run()
+		c.Assert(err == nil, check.Equals, v.ok, check.Commentf("case:%d err:%v", idx, err))
+		if v.ok {
+			c.Assert(p2p.GetRegisterResult().Node, check.Equals, "newNode")
+			content, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+			c.Assert(string(content), check.Equals, "aaaaa")
+		} else {
+			c.Assert(err, check.ErrorMatches, "Md5NotMatch.*")
+		}
+	}
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_Md5NotMatch(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+
+	for idx, assembly := range []string{config.AssemblyRandom, config.AssemblySequential} {
+		cfg := s.createConfig()
+		cfg.RV.RealTarget = path.Join(s.workHome, fmt.Sprintf("md5notmatch.%d.target", idx))
+		cfg.RV.TempTarget = path.Join(s.workHome, fmt.Sprintf("md5notmatch.%d.temp", idx))
+		cfg.RV.TaskFileName = fmt.Sprintf("md5notmatch.%d", idx)
+		cfg.RV.Assembly = assembly
+		cfg.Md5 = fmt.Sprintf("%x", md5.Sum([]byte("bbbbb")))
+		p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+		err := p2p.Run()
+		c.Assert(err, check.ErrorMatches, "Md5NotMatch.*", check.Commentf("assembly:%s", assembly))
+		c.Assert(util.PathExist(cfg.RV.RealTarget), check.Equals, false,
+			check.Commentf("assembly:%s", assembly))
+		c.Assert(util.PathExist(cfg.RV.TempTarget), check.Equals, false,
+			check.Commentf("assembly:%s", assembly))
+		// the intermediate files of the failed download are removed
+		c.Assert(util.PathExist(p2p.clientFilePath), check.Equals, false,
+			check.Commentf("assembly:%s", assembly))
+		c.Assert(util.PathExist(p2p.serviceFilePath), check.Equals, false,
+			check.Commentf("assembly:%s", assembly))
+	}
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_NoMove(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "nomove.target")
+	cfg.RV.ResultPath = cfg.RV.RealTarget
+	cfg.RV.TaskFileName = "nomove"
+	cfg.Md5 = fmt.Sprintf("%x", md5.Sum([]byte("aaaaa")))
+	cfg.NoMove = true
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Run(), check.IsNil)
+
+	c.Assert(cfg.RV.ResultPath, check.Equals, p2p.clientFilePath)
+	c.Assert(util.PathExist(cfg.RV.RealTarget), check.Equals, false)
+	p2p.Cleanup()
+	content, _ := ioutil.ReadFile(cfg.RV.ResultPath)
+	c.Assert(string(content), check.Equals, "aaaaa")
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_LinkStrategy(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+
+	for _, noMove := range []bool{false, true} {
+		cfg := s.createConfig()
+		cfg.RV.RealTarget = path.Join(s.workHome, fmt.Sprintf("strategy-%t.target", noMove))
+		cfg.RV.ResultPath = cfg.RV.RealTarget
+		cfg.RV.TaskFileName = fmt.Sprintf("strategy-%t", noMove)
+		cfg.Md5 = fmt.Sprintf("%x", md5.Sum([]byte("aaaaa")))
+		cfg.NoMove = noMove
+		cfg.LinkStrategy = config.LinkStrategyCopy
+		p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+		c.Assert(p2p.Run(), check.IsNil)
+
+		// test: the result doesn't share the inode with the service file
+		content, _ := ioutil.ReadFile(cfg.RV.ResultPath)
+		c.Assert(string(content), check.Equals, "aaaaa")
+		resultInfo, err := os.Stat(cfg.RV.ResultPath)
+		c.Assert(err, check.IsNil)
+		if serviceInfo, err := os.Stat(p2p.serviceFilePath); err == nil {
+			c.Assert(os.SameFile(resultInfo, serviceInfo), check.Equals, false)
+		}
+		p2p.Cleanup()
+	}
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_DirectWrite(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "direct.target")
+	cfg.RV.TaskFileName = "direct"
+	cfg.Md5 = fmt.Sprintf("%x", md5.Sum([]byte("aaaaa")))
+	cfg.DirectWrite = true
+	cfg.KeepIntermediate = true
+	// the existing target linked by the others is replaced rather than
+	// overwritten.
+	os.MkdirAll(cfg.RV.DataDir, 0755)
+	other := path.Join(s.workHome, "direct.other")
+	ioutil.WriteFile(other, []byte("old"), 0644)
+	c.Assert(os.Link(other, cfg.RV.RealTarget), check.IsNil)
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Run(), check.IsNil)
+
+	content, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+	c.Assert(string(content), check.Equals, "aaaaa")
+	content, _ = ioutil.ReadFile(other)
+	c.Assert(string(content), check.Equals, "old")
+	ti, _ := os.Stat(cfg.RV.RealTarget)
+	si, err := os.Stat(p2p.serviceFilePath)
+	c.Assert(err, check.IsNil)
+	c.Assert(os.SameFile(ti, si), check.Equals, true)
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_Seed(c *check.C) {
+	var reported []string
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			c.Errorf("seed pulls the piece task:%v", req)
+			return nil, fmt.Errorf("unexpected")
+		},
+		ReportFunc: func(ip string, req *types.ReportPieceRequest) (*types.BaseResponse, error) {
+			c.Assert(req.TaskID, check.Equals, "old")
+			reported = append(reported, req.PieceRange)
+			return &types.BaseResponse{Code: config.Success}, nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "seed.target")
+	cfg.RV.TaskFileName = "seed"
+	cfg.Seed = true
+	cfg.KeepIntermediate = true
+	content := []byte("0123456789abcdefghijklm")
+	ioutil.WriteFile(cfg.RV.RealTarget, content, 0644)
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	p2p.RegisterResult.FileLength = int64(len(content))
+
+	cfg.Md5 = fmt.Sprintf("%x", md5.Sum([]byte("other")))
+	_, ok := p2p.Run().(*md5NotMatchError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(reported, check.HasLen, 0)
+
+	cfg.Md5 = fmt.Sprintf("%x", md5.Sum(content))
+	c.Assert(p2p.Run(), check.IsNil)
+	c.Assert(reported, check.DeepEquals, []string{"0-9", "10-19", "20-29", "30-39", "40-47"})
+	served, _ := ioutil.ReadFile(p2p.serviceFilePath)
+	c.Assert(string(served), check.Equals, string(content))
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_ReportContributions(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	var reported []*types.ReportContributionRequest
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+		ReportContributionFunc: func(ip string, req *types.ReportContributionRequest) (*types.BaseResponse, error) {
+			c.Check(ip, check.Equals, "node")
+			reported = append(reported, req)
+			return nil, fmt.Errorf("not supported")
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "contribution.target")
+	cfg.RV.TaskFileName = "contribution"
+	cfg.RV.Cid = "local"
+	cfg.ReportContributions = true
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	// the failure of the report doesn't fail the download
+	c.Assert(p2p.Run(), check.IsNil)
+	c.Assert(reported, check.DeepEquals, []*types.ReportContributionRequest{{
+		TaskID: "old",
+		Cid:    "local",
+		Peers:  []*types.PeerContribution{{Cid: "peer", Bytes: int64(len(good))}},
+	}})
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_RequestRange(c *check.C) {
+	pieces := map[string][]byte{
+		"0-9":   wrapPieceContent([]byte("aaaaa"), 10),
+		"10-19": wrapPieceContent([]byte("bbbbb"), 10),
+		"20-29": wrapPieceContent([]byte("ccccc"), 10),
+	}
+	var fetched []string
+	var lock sync.Mutex
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		fetched = append(fetched, r.Header.Get("Range"))
+		lock.Unlock()
+		w.Write(pieces[r.Header.Get("Range")])
+	}))
+	defer peer.Close()
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	peerPort, _ := strconv.Atoi(port)
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			res := newPullResponse(config.TaskCodeContinue)
+			if req.Status == config.TaskStatusStart {
+				var data []*types.PullPieceTaskResponseContinueData
+				for i, r := range []string{"0-9", "10-19", "20-29"} {
+					data = append(data, &types.PullPieceTaskResponseContinueData{
+						Range: r, PieceNum: i, PieceSize: 10, PieceMd5: pieceDigest(pieces[r]),
+						Cid: "peer", PeerIP: host, PeerPort: peerPort, Path: "/range"})
+				}
+				res.Data, _ = json.Marshal(data)
+			}
+			return res, nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "range.target")
+	cfg.RV.TaskFileName = "range"
+	cfg.RV.FileLength = 15
+	cfg.RequestRange = "6-12"
+	// the md5 of the whole file isn't verified
+	cfg.Md5 = "d41d8cd98f00b204e9800998ecf8427e"
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Run(), check.IsNil)
+	sort.Strings(fetched)
+	c.Assert(fetched, check.DeepEquals, []string{"10-19", "20-29"})
+	content, err := ioutil.ReadFile(cfg.RV.RealTarget)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "bbbbccc")
+
+	// test: the range out of the file
+	cfg.RequestRange = "15-20"
+	cfg.RV.TaskFileName = "outofrange"
+	p2p = s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Run(), check.NotNil)
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_Resume(c *check.C) {
+	second := wrapPieceContent([]byte("bbbbb"), 10)
+	var fetched []string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.Header.Get("Range"))
+		w.Write(second)
+	}))
+	defer peer.Close()
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	peerPort, _ := strconv.Atoi(port)
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Status == config.TaskStatusStart {
+				res := newPullResponse(config.TaskCodeContinue)
+				res.Data, _ = json.Marshal([]*types.PullPieceTaskResponseContinueData{
+					{Range: "0-9", PieceNum: 0, PieceSize: 10, Cid: "peer",
+						PeerIP: host, PeerPort: peerPort, Path: "/resume"},
+					{Range: "10-19", PieceNum: 1, PieceSize: 10, PieceMd5: pieceDigest(second),
+						Cid: "peer", PeerIP: host, PeerPort: peerPort, Path: "/resume"},
+				})
+				return res, nil
+			}
+			if req.Range == "10-19" {
+				return newFinishResponse(10), nil
+			}
+			return newPullResponse(config.TaskCodeContinue), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.URL = "http://dragonfly.io/resume"
+	cfg.RV.RealTarget = path.Join(s.workHome, "resume.target")
+	cfg.RV.TaskFileName = "resume"
+	cfg.Resume = true
+	// the service file and its sidecar left by the interrupted download
+	interrupted := helper.GetServiceFile("interrupted", cfg.RV.DataDir)
+	c.Assert(os.MkdirAll(cfg.RV.DataDir, 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(interrupted, []byte("aaaaa"), 0644), check.IsNil)
+	b, _ := json.Marshal(&resumeState{URL: cfg.URL, Target: cfg.RV.RealTarget,
+		TaskID: "old", PieceSize: 10, Ranges: []string{"0-9"}})
+	c.Assert(ioutil.WriteFile(helper.GetResumeFile(interrupted), b, 0644), check.IsNil)
+
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.pieceSet, check.DeepEquals, map[string]bool{"0-9": true})
+	c.Assert(p2p.Run(), check.IsNil)
+	c.Assert(fetched, check.DeepEquals, []string{"10-19"})
+	content, err := ioutil.ReadFile(cfg.RV.RealTarget)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "aaaaabbbbb")
+	c.Assert(util.PathExist(interrupted), check.Equals, false)
+	c.Assert(util.PathExist(helper.GetResumeFile(interrupted)), check.Equals, false)
+	c.Assert(util.PathExist(helper.GetResumeFile(p2p.serviceFilePath)), check.Equals, false)
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_OutputWriter(c *check.C) {
+	first := wrapPieceContent([]byte("aaaaa"), 10)
+	second := wrapPieceContent([]byte("bbbbb"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first piece arrives after the second one.
+		if r.Header.Get("Range") == "0-9" {
+			time.Sleep(100 * time.Millisecond)
+			w.Write(first)
+			return
+		}
+		w.Write(second)
+	}))
+	defer peer.Close()
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	peerPort, _ := strconv.Atoi(port)
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Status == config.TaskStatusStart {
+				res := newPullResponse(config.TaskCodeContinue)
+				res.Data, _ = json.Marshal([]*types.PullPieceTaskResponseContinueData{
+					{Range: "0-9", PieceNum: 0, PieceSize: 10, PieceMd5: pieceDigest(first),
+						Cid: "peer", PeerIP: host, PeerPort: peerPort, Path: "/output"},
+					{Range: "10-19", PieceNum: 1, PieceSize: 10, PieceMd5: pieceDigest(second),
+						Cid: "peer", PeerIP: host, PeerPort: peerPort, Path: "/output"},
+				})
+				return res, nil
+			}
+			if req.Range == "0-9" {
+				return newFinishResponse(10), nil
+			}
+			return newPullResponse(config.TaskCodeContinue), nil
+		},
+	}
+
+	output := &bytes.Buffer{}
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "output.target")
+	cfg.RV.TaskFileName = "output"
+	cfg.Md5 = fmt.Sprintf("%x", md5.Sum([]byte("aaaaabbbbb")))
+	cfg.OutputWriter = output
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+
+	// test: the output writer can't be assembled randomly
+	c.Assert(p2p.Run(), check.ErrorMatches, "output writer must be assembled sequentially.*")
+
+	cfg.RV.Assembly = config.AssemblySequential
+	p2p = s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Run(), check.IsNil)
+	c.Assert(output.String(), check.Equals, "aaaaabbbbb")
+	c.Assert(util.PathExist(cfg.RV.RealTarget), check.Equals, false)
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_ProgressFunc(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+
+	var progress [][2]int64
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "progressfunc.target")
+	cfg.RV.TaskFileName = "progressfunc"
+	cfg.ProgressFunc = func(downloaded, total int64) {
+		progress = append(progress, [2]int64{downloaded, total})
+	}
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Run(), check.IsNil)
+	// the length of the file is unknown until the download succeeds
+	c.Assert(progress, check.DeepEquals, [][2]int64{{5, -1}, {5, 5}})
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_Metrics(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	var requests int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Write(wrapPieceContent([]byte("xxxxx"), 10))
+			return
+		}
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/metrics", good), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "metrics.target")
+	cfg.RV.TaskFileName = "metrics"
+	cfg.Metrics = config.NewMetrics()
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Run(), check.IsNil)
+	c.Assert(cfg.Metrics.Get(config.MetricPiecesRequested), check.Equals, int64(2))
+	c.Assert(cfg.Metrics.Get(config.MetricPiecesSucceeded), check.Equals, int64(1))
+	c.Assert(cfg.Metrics.Get(config.MetricPiecesFailed), check.Equals, int64(1))
+	c.Assert(cfg.Metrics.Get(config.MetricBytes), check.Equals, int64(len(good)))
+	c.Assert(cfg.Metrics.Get(config.MetricBackSources), check.Equals, int64(0))
+}
+
+func (s *P2PDownloaderTestSuite) TestDoDownloadTimeout_Summary(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/summary", good), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "summary.target")
+	cfg.RV.ResultPath = cfg.RV.RealTarget
+	cfg.RV.TaskFileName = "summary"
+	cfg.RV.FileLength = 5
+	cfg.Md5 = fmt.Sprintf("%x", md5.Sum([]byte("aaaaa")))
+	cfg.SummaryFile = path.Join(s.workHome, "summary.json")
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(DoDownloadTimeout(p2p, time.Minute), check.IsNil)
+
+	summary := &Summary{}
+	data, err := ioutil.ReadFile(cfg.SummaryFile)
+	c.Assert(err, check.IsNil)
+	c.Assert(json.Unmarshal(data, summary), check.IsNil)
+	c.Assert(summary.TaskID, check.Equals, "old")
+	c.Assert(summary.Node, check.Equals, "node")
+	c.Assert(summary.Success, check.Equals, true)
+	c.Assert(summary.Output, check.Equals, cfg.RV.RealTarget)
+	c.Assert(summary.FileLength, check.Equals, int64(5))
+	c.Assert(summary.Digest, check.Equals, cfg.Md5)
+	c.Assert(summary.P2PBytes > 0, check.Equals, true)
+	c.Assert(summary.BackSourceBytes, check.Equals, int64(0))
+	c.Assert(summary.Migrations, check.Equals, 0)
+
+	// the failed download is summarized into the stdout.
+	out := &bytes.Buffer{}
+	stdout := util.Printer.Out
+	util.Printer.Out = out
+	defer func() { util.Printer.Out = stdout }()
+	cfg.SummaryFile = "-"
+	c.Assert(DoDownloadTimeout(p2p, 0), check.NotNil)
+	summary = &Summary{}
+	c.Assert(json.Unmarshal(out.Bytes(), summary), check.IsNil)
+	c.Assert(summary.Success, check.Equals, false)
+	c.Assert(summary.Error, check.Matches, "download timeout.*")
+	c.Assert(summary.Digest, check.Equals, "")
+}
+
+func (s *P2PDownloaderTestSuite) TestStartTask_MaxConcurrentPieces(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	var running, peak int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for p := atomic.LoadInt32(&peak); n > p && !atomic.CompareAndSwapInt32(&peak, p, n); {
+			p = atomic.LoadInt32(&peak)
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write(good)
+	}))
+	defer peer.Close()
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	peerPort, _ := strconv.Atoi(port)
+
+	cfg := s.createConfig()
+	cfg.RV.TaskFileName = "concurrentpieces"
+	cfg.MaxConcurrentPieces = 2
+	p2p := s.createP2PDownloader(cfg, &helper.MockSupernodeAPI{}, &MockRegister{})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p2p.startTask(&types.PullPieceTaskResponseContinueData{
+				Range:     fmt.Sprintf("%d-%d", i*10, i*10+9),
+				PieceNum:  i,
+				PieceSize: 10,
+				PieceMd5:  pieceDigest(good),
+				PeerIP:    host,
+				PeerPort:  peerPort,
+				Path:      "/concurrent",
+			})
+		}(i)
+	}
+	wg.Wait()
+	c.Assert(atomic.LoadInt32(&peak), check.Equals, int32(2))
+	c.Assert(p2p.clientQueue.Len(), check.Equals, 5)
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_MaxBufferedBytes(c *check.C) {
+	var contents [][]byte
+	var expected []byte
+	for i := 0; i < 6; i++ {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 5)
+		contents = append(contents, wrapPieceContent(content, 10))
+		expected = append(expected, content...)
+	}
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start int
+		fmt.Sscanf(r.Header.Get("Range"), "%d-", &start)
+		w.Write(contents[start/10])
+	}))
+	defer peer.Close()
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	peerPort, _ := strconv.Atoi(port)
+	var p2p *P2PDownloader
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Status == config.TaskStatusStart {
+				var data []*types.PullPieceTaskResponseContinueData
+				for i := range contents {
+					data = append(data, &types.PullPieceTaskResponseContinueData{
+						Range: fmt.Sprintf("%d-%d", i*10, i*10+9), PieceNum: i, PieceSize: 10,
+						PieceMd5: pieceDigest(contents[i]), Cid: "peer",
+						PeerIP: host, PeerPort: peerPort, Path: "/buffered"})
+				}
+				res := newPullResponse(config.TaskCodeContinue)
+				res.Data, _ = json.Marshal(data)
+				return res, nil
+			}
+			if p2p.Stats().PiecesDone == len(contents) {
+				return newFinishResponse(int64(len(expected))), nil
+			}
+			return newPullResponse(config.TaskCodeContinue), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "buffered.target")
+	cfg.RV.TaskFileName = "buffered"
+	cfg.RV.Assembly = config.AssemblySequential
+	cfg.Md5 = fmt.Sprintf("%x", md5.Sum(expected))
+	cfg.MaxBufferedBytes = 20
+	output := &slowWriter{delay: 30 * time.Millisecond}
+	cfg.OutputWriter = output
+	p2p = s.createP2PDownloader(cfg, api, &MockRegister{})
+	var exceeded int32
+	output.onWrite = func() {
+		if p2p.budget.Used() > cfg.MaxBufferedBytes {
+			atomic.StoreInt32(&exceeded, 1)
+		}
+	}
+
+	// test: the pieces are deferred while the slow writer holds the budget
+	c.Assert(p2p.Run(), check.IsNil)
+	c.Assert(output.String(), check.Equals, string(expected))
+	c.Assert(atomic.LoadInt32(&exceeded), check.Equals, int32(0))
+	c.Assert(p2p.budget.Peak() <= cfg.MaxBufferedBytes, check.Equals, true,
+		check.Commentf("peak:%d", p2p.budget.Peak()))
+	c.Assert(p2p.budget.Used(), check.Equals, int64(0))
+}
+
+func (s *P2PDownloaderTestSuite) TestGetItem_InvalidRange(c *check.C) {
+	p2p := s.createP2PDownloader(s.createConfig(), &helper.MockSupernodeAPI{}, &MockRegister{})
+	p2p.queue.Poll()
+	var put = func(pieceRange string) {
+		p2p.pieceSet[pieceRange] = false
+		piece := NewPieceContent(p2p.taskID, p2p.node, "peer", pieceRange, config.ResultSemiSuc,
+			config.TaskStatusRunning, bytes.NewBuffer(wrapPieceContent([]byte("aaaaa"), 10)))
+		piece.PieceSize = 10
+		p2p.queue.Put(piece)
+		p2p.getItem(nil)
+	}
+
+	put("0-9")
+	c.Assert(p2p.total, check.Equals, int64(10))
+
+	// test: the piece overlapping the succeeded ones isn't accounted again
+	put("5-14")
+	c.Assert(p2p.total, check.Equals, int64(10))
+	c.Assert(p2p.pieceSet["5-14"], check.Equals, true)
+
+	// test: the malformed range is skipped
+	for _, r := range []string{"x-9", "20", "29-20"} {
+		put(r)
+		_, ok := p2p.pieceSet[r]
+		c.Assert(ok, check.Equals, false, check.Commentf("range:%s", r))
+	}
+	c.Assert(p2p.total, check.Equals, int64(10))
+
+	put("bytes=10-19")
+	c.Assert(p2p.total, check.Equals, int64(20))
+}
+
+func (s *P2PDownloaderTestSuite) TestRunWithDeadline(c *check.C) {
+	cfg := s.createConfig()
+	cfg.PieceTimeout = 50 * time.Millisecond
+	p2p := s.createP2PDownloader(cfg, &helper.MockSupernodeAPI{}, &MockRegister{})
+	p2p.queue.Poll()
+	p2p.pieceSet["0-9"] = false
+	pc := p2p.newPowerClient(&types.PullPieceTaskResponseContinueData{Range: "0-9", Cid: "peer", PieceSize: 10})
+	service, _ := ioutil.TempFile(s.workHome, "deadline")
+	defer service.Close()
+	pc.writer = &ClientWriter{writesAt: true, serviceFile: service}
+	pc.budget = newQuota(100)
+
+	// test: the PowerClient never returns
+	hung := make(chan struct{})
+	returned := make(chan struct{})
+	ran := make(chan struct{})
+	go func() {
+		defer close(returned)
+		p2p.runWithDeadline([]*PowerClient{pc}, func() {
+			defer close(ran)
+			pc.release = pc.budget.acquire(10)
+			defer pc.release()
+			<-hung
+			pc.putPiece(bytes.NewBuffer(wrapPieceContent([]byte("late"), 10)))
+		})
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		c.Fatal("runWithDeadline doesn't return after the piece timeout")
+	}
+	_, item := p2p.getItem(nil)
+	c.Assert(item.Range, check.Equals, "0-9")
+	c.Assert(item.Result, check.Equals, config.ResultFail)
+	_, ok := p2p.pieceSet["0-9"]
+	c.Assert(ok, check.Equals, false)
+
+	// test: the piece downloaded after the timeout is dropped without being
+	// written, and its memory budget is released
+	close(hung)
+	<-ran
+	c.Assert(p2p.queue.Len(), check.Equals, 0)
+	c.Assert(p2p.clientQueue.Len(), check.Equals, 0)
+	info, _ := service.Stat()
+	c.Assert(info.Size(), check.Equals, int64(0))
+	c.Assert(pc.budget.used, check.Equals, int64(0))
+
+	// test: the piece put into the queue after the timeout releases its
+	// memory budget
+	piece := NewPiece("task", "node", "peer", "0-9", config.ResultSemiSuc, config.TaskStatusRunning)
+	piece.release = pc.budget.acquire(10)
+	pc.clientQueue.Put(piece)
+	c.Assert(pc.budget.used, check.Equals, int64(0))
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_PieceTimeout(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	var requests int32
+	hung := make(chan struct{})
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			<-hung
+			return
+		}
+		w.Write(good)
+	}))
+	defer peer.Close()
+	defer close(hung)
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/timeout", good), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "timeout.target")
+	cfg.RV.TaskFileName = "timeout"
+	cfg.PieceTimeout = 100 * time.Millisecond
+	cfg.WaitFunc = func(int) time.Duration { return 0 }
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Run(), check.IsNil)
+	c.Assert(atomic.LoadInt32(&requests), check.Equals, int32(2))
+	content, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+	c.Assert(string(content), check.Equals, "aaaaa")
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_PullPieceMaxRetries(c *check.C) {
+	var pulls int32
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			atomic.AddInt32(&pulls, 1)
+			return newPullResponse(config.TaskCodeWait), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.TaskFileName = "pullretries"
+	cfg.Notbs = true
+	cfg.PullPieceMaxRetries = 3
+	cfg.PullPieceMaxBackoff = time.Millisecond
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	err := p2p.Run()
+	c.Assert(err, check.FitsTypeOf, &DownloadError{})
+	c.Assert(err.(*DownloadError).Kind, check.Equals, ErrAllPiecesFailed)
+	c.Assert(cfg.BackSourceReason, check.Equals,
+		config.BackSourceReasonPullRetries+config.ForceNotBackSourceAddition)
+	c.Assert(atomic.LoadInt32(&pulls), check.Equals, int32(4))
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_Limited(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	var (
+		pulls    int32
+		statuses []int
+	)
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			statuses = append(statuses, req.Status)
+			switch atomic.AddInt32(&pulls, 1) {
+			case 1, 2:
+				return newPullResponse(config.TaskCodeLimited), nil
+			case 3:
+				return newPieceResponse(peer, "/limited", good), nil
+			}
+			return newFinishResponse(5), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "limited.target")
+	cfg.RV.TaskFileName = "limited"
+	cfg.LimitedRetryDelay = 50 * time.Millisecond
+	cfg.MaxQueuePollTimeouts = 1
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	start := time.Now()
+	c.Assert(p2p.Run(), check.IsNil)
+	c.Assert(time.Since(start) >= 100*time.Millisecond, check.Equals, true)
+	c.Assert(cfg.BackSourceReason, check.Equals, 0)
+	// the start item is pulled again after the limits.
+	c.Assert(statuses[:3], check.DeepEquals, []int{config.TaskStatusStart,
+		config.TaskStatusStart, config.TaskStatusStart})
+	content, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+	c.Assert(string(content), check.Equals, "aaaaa")
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_SourceError(c *check.C) {
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			return newPullResponse(config.TaskCodeSourceError), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.TaskFileName = "sourceerror"
+	cfg.Notbs = true
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	err := p2p.Run()
+	c.Assert(err, check.FitsTypeOf, &DownloadError{})
+	c.Assert(err.(*DownloadError).Kind, check.Equals, ErrSourceError)
+	c.Assert(err.(*DownloadError).Reason, check.Equals,
+		config.BackSourceReasonSourceError+config.ForceNotBackSourceAddition)
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_OnBackSource(c *check.C) {
+	var cases = []struct {
+		code   int
+		err    error
+		reason int
+	}{
+		{code: config.TaskCodeSourceError, reason: config.BackSourceReasonSourceError},
+		{err: fmt.Errorf("connection refused"), reason: config.BackSourceReasonDownloadError},
+	}
+	for idx, v := range cases {
+		comment := check.Commentf("case:%d", idx)
+		api := &helper.MockSupernodeAPI{
+			PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+				if v.err != nil {
+					return nil, v.err
+				}
+				return newPullResponse(v.code), nil
+			},
+		}
+
+		cfg := s.createConfig()
+		cfg.RV.TaskFileName = "onbacksource"
+		cfg.Notbs = true
+		var reasons []int
+		cfg.OnBackSource = func(reason int) {
+			reasons = append(reasons, reason)
+		}
+		// the migration fails since no supernode can be registered to
+		p2p := s.createP2PDownloader(cfg, api, &MockRegister{
+			RegisterFunc: func(peerPort int) (*regist.RegisterResult, *errors.DFGetError) {
+				return nil, errors.New(config.HTTPError, "connection refused")
+			},
+		})
+		c.Assert(p2p.Run(), check.NotNil, comment)
+		c.Assert(reasons, check.DeepEquals, []int{v.reason}, comment)
+	}
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_OnPieceDone(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+
+	type pieceDone struct {
+		pieceRange, cid string
+		bytes           int64
+		cost            time.Duration
+	}
+	var done []pieceDone
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "piecedone.target")
+	cfg.RV.TaskFileName = "piecedone"
+	cfg.Md5 = fmt.Sprintf("%x", md5.Sum([]byte("aaaaa")))
+	cfg.OnPieceDone = func(pieceRange, cid string, bytes int64, cost time.Duration) {
+		done = append(done, pieceDone{pieceRange, cid, bytes, cost})
+	}
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Run(), check.IsNil)
+
+	c.Assert(len(done), check.Equals, 1)
+	c.Assert(done[0].pieceRange, check.Equals, "0-9")
+	c.Assert(done[0].cid, check.Equals, "peer")
+	c.Assert(done[0].bytes, check.Equals, int64(5))
+	c.Assert(done[0].cost >= 50*time.Millisecond, check.Equals, true,
+		check.Commentf("cost:%v", done[0].cost))
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_WriteAt(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "writeat.target")
+	cfg.RV.TaskFileName = "writeat"
+	cfg.RV.FileLength = 5
+	cfg.Md5 = fmt.Sprintf("%x", md5.Sum([]byte("aaaaa")))
+	cfg.WriteAt = true
+	// the target is linked to the client file in the data dir
+	cfg.RV.TempTarget = path.Join(s.workHome, "writeat.temp")
+	c.Assert(ioutil.WriteFile(cfg.RV.TempTarget, nil, 0644), check.IsNil)
+	c.Assert(os.MkdirAll(cfg.RV.DataDir, 0755), check.IsNil)
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Run(), check.IsNil)
+
+	c.Assert(p2p.clientWriter.writesAt, check.Equals, true)
+	c.Assert(p2p.clientWriter.preallocated, check.Equals, true)
+	b, err := ioutil.ReadFile(cfg.RV.RealTarget)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(b), check.Equals, "aaaaa")
+}
+
+func (s *P2PDownloaderTestSuite) TestStats(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "stats.target")
+	cfg.RV.TaskFileName = "stats"
+	cfg.Md5 = fmt.Sprintf("%x", md5.Sum([]byte("aaaaa")))
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Stats(), check.DeepEquals, Stats{Node: "node", TaskID: "old"})
+
+	c.Assert(p2p.Run(), check.IsNil)
+	c.Assert(p2p.Stats(), check.DeepEquals, Stats{Node: "node", TaskID: "old",
+		PiecesDone: 1, Bytes: 10, Completed: 5})
+}
+
+// TestRun_ConcurrentStats reads Stats while the pieces are downloaded
+// concurrently, the races are reported by 'go test -race'.
+func (s *P2PDownloaderTestSuite) TestRun_ConcurrentStats(c *check.C) {
+	var contents [][]byte
+	var expected []byte
+	for i := 0; i < 8; i++ {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 5)
+		contents = append(contents, wrapPieceContent(content, 10))
+		expected = append(expected, content...)
+	}
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start int
+		fmt.Sscanf(r.Header.Get("Range"), "%d-", &start)
+		time.Sleep(time.Duration(start/10) * time.Millisecond)
+		w.Write(contents[start/10])
+	}))
+	defer peer.Close()
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	peerPort, _ := strconv.Atoi(port)
+	var p2p *P2PDownloader
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Status == config.TaskStatusStart {
+				var data []*types.PullPieceTaskResponseContinueData
+				for i := range contents {
+					data = append(data, &types.PullPieceTaskResponseContinueData{
+						Range: fmt.Sprintf("%d-%d", i*10, i*10+9), PieceNum: i, PieceSize: 10,
+						PieceMd5: pieceDigest(contents[i]), Cid: "peer",
+						PeerIP: host, PeerPort: peerPort, Path: "/concurrent"})
+				}
+				res := newPullResponse(config.TaskCodeContinue)
+				res.Data, _ = json.Marshal(data)
+				return res, nil
+			}
+			// the successes of the pieces drained together are reported
+			// by one pull, so the task finishes once all are accounted.
+			if p2p.Stats().PiecesDone == len(contents) {
+				return newFinishResponse(int64(len(expected))), nil
+			}
+			return newPullResponse(config.TaskCodeContinue), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "concurrent.target")
+	cfg.RV.TaskFileName = "concurrent"
+	cfg.Md5 = fmt.Sprintf("%x", md5.Sum(expected))
+	p2p = s.createP2PDownloader(cfg, api, &MockRegister{})
+
+	stop := make(chan struct{})
+	var (
+		wg        sync.WaitGroup
+		decreased int32
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var last Stats
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Millisecond):
+				}
+				st := p2p.Stats()
+				if st.PiecesDone < last.PiecesDone || st.Bytes < last.Bytes {
+					atomic.StoreInt32(&decreased, 1)
+				}
+				last = st
+				p2p.GetRegisterResult()
+				p2p.GetBufferedBytes()
+			}
+		}()
+	}
+	c.Assert(p2p.Run(), check.IsNil)
+	close(stop)
+	wg.Wait()
+
+	c.Assert(atomic.LoadInt32(&decreased), check.Equals, int32(0))
+	st := p2p.Stats()
+	c.Assert(st.PiecesDone, check.Equals, len(contents))
+	c.Assert(st.PiecesRunning, check.Equals, 0)
+	c.Assert(st.Bytes, check.Equals, int64(10*len(contents)))
+	content, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+	c.Assert(string(content), check.Equals, string(expected))
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_WriteBuffer(c *check.C) {
+	var contents [][]byte
+	var expected []byte
+	for i := 0; i < 4; i++ {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 5)
+		contents = append(contents, wrapPieceContent(content, 10))
+		expected = append(expected, content...)
+	}
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start int
+		fmt.Sscanf(r.Header.Get("Range"), "%d-", &start)
+		w.Write(contents[start/10])
+	}))
+	defer peer.Close()
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	peerPort, _ := strconv.Atoi(port)
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "writebuffer.target")
+	cfg.RV.TaskFileName = "writebuffer"
+	cfg.Md5 = fmt.Sprintf("%x", md5.Sum(expected))
+	cfg.WriteBufferSize = 1000
+	serviceFile := helper.GetServiceFile(cfg.RV.TaskFileName, cfg.RV.DataDir)
+	var (
+		p2p       *P2PDownloader
+		unflushed []string
+		mu        sync.Mutex
+	)
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Status == config.TaskStatusStart {
+				var data []*types.PullPieceTaskResponseContinueData
+				for i := range contents {
+					data = append(data, &types.PullPieceTaskResponseContinueData{
+						Range: fmt.Sprintf("%d-%d", i*10, i*10+9), PieceNum: i, PieceSize: 10,
+						PieceMd5: pieceDigest(contents[i]), Cid: "peer",
+						PeerIP: host, PeerPort: peerPort, Path: "/writebuffer"})
+				}
+				res := newPullResponse(config.TaskCodeContinue)
+				res.Data, _ = json.Marshal(data)
+				return res, nil
+			}
+			// the pieces reported succeeded are written already
+			if req.Result == config.ResultSemiSuc {
+				var start int
+				fmt.Sscanf(req.Range, "%d-", &start)
+				written, _ := ioutil.ReadFile(serviceFile)
+				offset := start / 10 * 5
+				if len(written) < offset+5 || !bytes.Equal(written[offset:offset+5], expected[offset:offset+5]) {
+					mu.Lock()
+					unflushed = append(unflushed, req.Range)
+					mu.Unlock()
+				}
+			}
+			if p2p.Stats().PiecesDone == len(contents) {
+				return newFinishResponse(int64(len(expected))), nil
+			}
+			return newPullResponse(config.TaskCodeWait), nil
+		},
+	}
+	p2p = s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Run(), check.IsNil)
+	c.Assert(unflushed, check.HasLen, 0)
+	content, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+	c.Assert(string(content), check.Equals, string(expected))
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_BackSourceOnly(c *check.C) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("source"))
+	}))
+	defer source.Close()
+	var pulls int32
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			atomic.AddInt32(&pulls, 1)
+			return newPullResponse(config.TaskCodeWait), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.URL = source.URL
+	cfg.RV.RealTarget = path.Join(s.workHome, "backsourceonly.target")
+	cfg.RV.TaskFileName = "backsourceonly"
+	cfg.BackSourceOnly = true
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Run(), check.IsNil)
+	c.Assert(cfg.BackSourceReason, check.Equals, config.BackSourceReasonUserSpecified)
+	c.Assert(atomic.LoadInt32(&pulls), check.Equals, int32(0))
+	c.Assert(p2p.Stats().BackSource, check.Equals, true)
+	content, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+	c.Assert(string(content), check.Equals, "source")
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_LastPieceDropped(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			// the finish arrives before the last piece "10-19" is dispatched
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(10), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "dropped.target")
+	cfg.RV.TaskFileName = "dropped"
+	cfg.RV.FileLength = 10
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Run(), check.ErrorMatches, "file length not match, expected:10 real:5")
+	c.Assert(util.PathExist(cfg.RV.RealTarget), check.Equals, false)
+}
+
+func (s *P2PDownloaderTestSuite) TestCleanup(c *check.C) {
+	var cases = []struct {
+		failed           bool
+		keepIntermediate bool
+		noMove           bool
+		peerPort         int
+		resume           bool
+		clientKept       bool
+		serviceKept      bool
+	}{
+		{},
+		{keepIntermediate: true, clientKept: true, serviceKept: true},
+		{noMove: true, clientKept: true},
+		// the service file is seeded by the peer server
+		{peerPort: 15001, serviceKept: true},
+		// the download can be resumed from the service file
+		{resume: true, serviceKept: true},
+		// the incomplete files of the failed download are removed
+		{failed: true},
+		{failed: true, noMove: true},
+		{failed: true, peerPort: 15001},
+		{failed: true, resume: true, serviceKept: true},
+		{failed: true, keepIntermediate: true, clientKept: true, serviceKept: true},
+	}
+
+	for idx, v := range cases {
+		cfg := s.createConfig()
+		cfg.RV.TaskFileName = fmt.Sprintf("cleanup.%d", idx)
+		cfg.KeepIntermediate = v.keepIntermediate
+		cfg.NoMove = v.noMove
+		cfg.RV.PeerPort = v.peerPort
+		cfg.Resume = v.resume
+		cfg.RV.TempTarget = path.Join(s.workHome, fmt.Sprintf("cleanup.%d.temp", idx))
+		p2p := s.createP2PDownloader(cfg, &helper.MockSupernodeAPI{}, &MockRegister{})
+		p2p.succeeded = !v.failed
+		util.CreateDirectory(cfg.RV.DataDir)
+		files := []string{p2p.clientFilePath, p2p.serviceFilePath, cfg.RV.TempTarget}
+		if v.resume {
+			files = append(files, helper.GetResumeFile(p2p.serviceFilePath))
+		}
+		for _, f := range files {
+			ioutil.WriteFile(f, []byte("cleanup"), 0644)
+		}
+
+		p2p.Cleanup()
+		comment := check.Commentf("case:%d", idx)
+		c.Assert(util.PathExist(p2p.clientFilePath), check.Equals, v.clientKept, comment)
+		c.Assert(util.PathExist(p2p.serviceFilePath), check.Equals, v.serviceKept, comment)
+		c.Assert(util.PathExist(cfg.RV.TempTarget), check.Equals, !v.failed || v.keepIntermediate, comment)
+	}
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_DryRun(c *check.C) {
+	var pulls int32
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			atomic.AddInt32(&pulls, 1)
+			return newPullResponse(config.TaskCodeWait), nil
+		},
+	}
+	out := &bytes.Buffer{}
+	stdout := util.Printer.Out
+	util.Printer.Out = out
+	defer func() { util.Printer.Out = stdout }()
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "dryrun.target")
+	cfg.RV.TaskFileName = "dryrun"
+	cfg.DryRun = true
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	c.Assert(p2p.Run(), check.IsNil)
+	c.Assert(atomic.LoadInt32(&pulls), check.Equals, int32(0))
+	c.Assert(util.PathExist(cfg.RV.RealTarget), check.Equals, false)
+	c.Assert(out.String(), check.Matches,
+		"(?s).*node:node taskID:old pieceSize:10 fileLength:100 pieces:20.*")
+}
+
+func (s *P2PDownloaderTestSuite) TestRunContext_Cancel(c *check.C) {
+	aborted := make(chan struct{})
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer peer.Close()
+	var pulls int32
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if atomic.AddInt32(&pulls, 1) == 1 {
+				return newPieceResponse(peer, "/cancel", wrapPieceContent([]byte("hello"), 10)), nil
+			}
+			return newPullResponse(config.TaskCodeWait), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.TaskFileName = "cancel"
+	cfg.QueuePollTimeout = 50 * time.Millisecond
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	c.Assert(p2p.RunContext(ctx), check.Equals, context.Canceled)
+	c.Assert(time.Since(start) < time.Second, check.Equals, true)
+	c.Assert(cfg.BackSourceReason, check.Equals, 0)
+	// the request of the piece being downloaded is aborted
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		c.Fatal("the request to the peer isn't aborted")
+	}
+}
+
+func (s *P2PDownloaderTestSuite) TestRunContext_Timeout(c *check.C) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("source"))
+	}))
+	defer source.Close()
+	for _, backSource := range []bool{false, true} {
+		comment := check.Commentf("backSource:%t", backSource)
+		aborted := make(chan struct{})
+		peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			close(aborted)
+		}))
+		var pulls int32
+		api := &helper.MockSupernodeAPI{
+			PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+				if atomic.AddInt32(&pulls, 1) == 1 {
+					return newPieceResponse(peer, "/timeout", wrapPieceContent([]byte("hello"), 10)), nil
+				}
+				return newPullResponse(config.TaskCodeWait), nil
+			},
+		}
+
+		cfg := s.createConfig()
+		cfg.URL = source.URL
+		cfg.RV.RealTarget = path.Join(s.workHome, "timeout.target")
+		cfg.RV.TaskFileName = "timeout"
+		cfg.QueuePollTimeout = 50 * time.Millisecond
+		cfg.PullPieceMaxBackoff = 10 * time.Millisecond
+		cfg.Timeout = 1
+		cfg.TimeoutBackSource = backSource
+		p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+		start := time.Now()
+		err := DoDownloadTimeout(p2p, time.Second)
+		c.Assert(time.Since(start) < 2*time.Second, check.Equals, true, comment)
+		// the request of the piece being downloaded is aborted
+		select {
+		case <-aborted:
+		case <-time.After(time.Second):
+			c.Fatal("the request to the peer isn't aborted")
+		}
+		peer.Close()
+		if !backSource {
+			c.Assert(err, check.ErrorMatches, `download timeout\(1.000s\)`, comment)
+			c.Assert(cfg.BackSourceReason, check.Equals, 0, comment)
+			continue
+		}
+		c.Assert(err, check.IsNil, comment)
+		c.Assert(cfg.BackSourceReason, check.Equals, config.BackSourceReasonTimeout, comment)
+		content, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+		c.Assert(string(content), check.Equals, "source", comment)
+	}
+}
+
+func (s *P2PDownloaderTestSuite) TestRunTimeout(c *check.C) {
+	cfg := s.createConfig()
+	p2p := s.createP2PDownloader(cfg, &helper.MockSupernodeAPI{}, &MockRegister{})
+	c.Assert(p2p.runTimeout(time.Second), check.Equals, time.Second)
+
+	// the Run stopped by the timeout is waited for longer, and for the back
+	// source after it too
+	cfg.Timeout = 1
+	c.Assert(p2p.runTimeout(time.Second), check.Equals, time.Second+config.TimeoutStopGrace)
+	cfg.TimeoutBackSource = true
+	c.Assert(p2p.runTimeout(time.Second), check.Equals, 2*time.Second+config.TimeoutStopGrace)
+	cfg.BackSourceOnly = true
+	c.Assert(p2p.runTimeout(time.Second), check.Equals, time.Second)
+}
+
+func (s *P2PDownloaderTestSuite) TestPullRetryDelay(c *check.C) {
+	cfg := s.createConfig()
+	cfg.PullPieceMaxBackoff = 5 * time.Second
+	var delays = func(seed int64) (delays []time.Duration) {
+		rng := rand.New(rand.NewSource(seed))
+		for retries := 0; retries < 6; retries++ {
+			delays = append(delays, pullRetryDelay(cfg, rng, retries))
+		}
+		return delays
+	}
+	first := delays(1)
+	c.Assert(delays(1), check.DeepEquals, first)
+	for retries, d := range first {
+		expected := config.PullPieceBaseBackoff << uint(retries)
+		if expected > cfg.PullPieceMaxBackoff {
+			expected = cfg.PullPieceMaxBackoff
+		}
+		c.Assert(d >= expected/2 && d <= expected, check.Equals, true,
+			check.Commentf("retries:%d delay:%v", retries, d))
+	}
+
+	// the delay is 0.6s~2s without the backoff
+	cfg.PullPieceMaxBackoff = 0
+	d := pullRetryDelay(cfg, rand.New(rand.NewSource(1)), 10)
+	c.Assert(d >= 600*time.Millisecond && d < 2*time.Second, check.Equals, true)
+
+	// test: the WaitFunc overrides the delay
+	var attempts []int
+	cfg.WaitFunc = func(attempt int) time.Duration {
+		attempts = append(attempts, attempt)
+		return 0
+	}
+	c.Assert(pullRetryDelay(cfg, rand.New(rand.NewSource(1)), 3), check.Equals, time.Duration(0))
+	c.Assert(attempts, check.DeepEquals, []int{3})
+}
+
+func (s *P2PDownloaderTestSuite) TestMigrationDelay(c *check.C) {
+	cfg := s.createConfig()
+	rng := rand.New(rand.NewSource(1))
+	c.Assert(migrationDelay(cfg, rng, 3), check.Equals, time.Duration(0))
+
+	cfg.MigrationMaxBackoff = 5 * time.Second
+	// the first registration isn't delayed
+	c.Assert(migrationDelay(cfg, rng, 0), check.Equals, time.Duration(0))
+	for registrations := 1; registrations < 6; registrations++ {
+		d := migrationDelay(cfg, rng, registrations)
+		expected := config.MigrationBaseBackoff << uint(registrations-1)
+		if expected > cfg.MigrationMaxBackoff {
+			expected = cfg.MigrationMaxBackoff
+		}
+		c.Assert(d >= expected/2 && d <= expected, check.Equals, true,
+			check.Commentf("registrations:%d delay:%v", registrations, d))
+	}
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_QueuePollTimeout(c *check.C) {
+	var pulls int32
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			atomic.AddInt32(&pulls, 1)
+			return newPullResponse(config.TaskCodeContinue), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.TaskFileName = "polltimeout"
+	cfg.Notbs = true
+	cfg.QueuePollTimeout = 10 * time.Millisecond
+	cfg.MaxQueuePollTimeouts = 3
+	p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+	start := time.Now()
+	c.Assert(p2p.Run(), check.NotNil)
+	c.Assert(time.Since(start) < time.Second, check.Equals, true)
+	c.Assert(cfg.BackSourceReason, check.Equals,
+		config.BackSourceReasonQueueTimeout+config.ForceNotBackSourceAddition)
+	c.Assert(p2p.pollTimeouts, check.Equals, 3)
+	c.Assert(atomic.LoadInt32(&pulls) > 0, check.Equals, true)
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_RecordAndReplay(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "record.target")
+	cfg.RV.TaskFileName = "record"
+	cfg.RecordFile = path.Join(s.workHome, "record.json")
+	c.Assert(s.createP2PDownloader(cfg, api, &MockRegister{}).Run(), check.IsNil)
+	peer.Close()
+
+	records, err := LoadRecords(cfg.RecordFile)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(records) >= 3, check.Equals, true)
+
+	// test: replay the download when neither the supernode nor the peer exists
+	replayer := NewReplayer(records)
+	server := httptest.NewServer(replayer)
+	defer server.Close()
+	replayer.PeerAddr = server.Listener.Addr().String()
+
+	cfg = s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "replay.target")
+	cfg.RV.TaskFileName = "replay"
+	c.Assert(s.createP2PDownloader(cfg, replayer, &MockRegister{}).Run(),
+		check.IsNil)
+	content, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+	c.Assert(string(content), check.Equals, "aaaaa")
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_Manifest(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer dead.Close()
+	var newAPI = func(p *httptest.Server) *helper.MockSupernodeAPI {
+		return &helper.MockSupernodeAPI{
+			PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+				if req.Result == config.ResultSemiSuc {
+					return newFinishResponse(5), nil
+				}
+				return newPieceResponse(p, "/good", good), nil
+			},
+		}
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "manifest.target")
+	cfg.RV.TaskFileName = "manifest"
+	cfg.ManifestFile = path.Join(s.workHome, "manifest.json")
+	c.Assert(s.createP2PDownloader(cfg, newAPI(peer), &MockRegister{}).Run(), check.IsNil)
+
+	m, err := LoadManifest(cfg.ManifestFile)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.SuperNodes, check.DeepEquals, []string{"node"})
+	c.Assert(m.PieceSize, check.Equals, int32(10))
+	c.Assert(m.FileLength, check.Equals, int64(5))
+	c.Assert(m.Md5, check.Equals, fmt.Sprintf("%x", md5.Sum([]byte("aaaaa"))))
+	c.Assert(len(m.Pieces), check.Equals, 1)
+	c.Assert(m.Pieces[0].Source, check.Equals, TierPeer)
+	c.Assert(m.Pieces[0].PeerIP, check.Equals, "127.0.0.1")
+
+	// test: the pieces are downloaded from the peers of the manifest
+	cfg = s.createConfig()
+	cfg.RV.RealTarget = path.Join(s.workHome, "manifest.replay.target")
+	cfg.RV.TaskFileName = "manifest.replay"
+	cfg.ReplayManifest = path.Join(s.workHome, "manifest.json")
+	c.Assert(s.createP2PDownloader(cfg, newAPI(dead), &MockRegister{}).Run(), check.IsNil)
+	content, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+	c.Assert(string(content), check.Equals, "aaaaa")
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_UntrustedPeer(c *check.C) {
+	var peerRequests int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&peerRequests, 1)
+	}))
+	defer peer.Close()
+	var pulls int32
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			atomic.AddInt32(&pulls, 1)
+			return newPieceResponse(peer, "/untrusted", []byte("piece")), nil
+		},
+	}
+
+	cfg := s.createConfig()
+	cfg.RV.TaskFileName = "untrusted"
+	cfg.TrustedPeers = []string{"10.0.0.0/8"}
+	err := s.createP2PDownloader(cfg, api, &MockRegister{}).Run()
+
+	// test: fail closed rather than downloading from the untrusted peer or
+	// the source
+	c.Assert(err, check.NotNil)
+	c.Assert(err.(*errors.DFGetError).Code, check.Equals, config.CodeUntrusted)
+	c.Assert(atomic.LoadInt32(&peerRequests), check.Equals, int32(0))
+	c.Assert(atomic.LoadInt32(&pulls), check.Equals, int32(config.UntrustedRetryLimit))
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_RangeRetries(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(wrapPieceContent([]byte("xxxxx"), 10))
+	}))
+	defer peer.Close()
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("aaaaa"))
+	}))
+	defer source.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.Result == config.ResultSemiSuc {
+				return newFinishResponse(5), nil
+			}
+			return newPieceResponse(peer, "/bad", good), nil
+		},
+	}
+
+	for idx, rangeBackSource := range []bool{false, true} {
+		cfg := s.createConfig()
+		cfg.URL = source.URL
+		cfg.RV.RealTarget = path.Join(s.workHome, fmt.Sprintf("retries.%d.target", idx))
+		cfg.RV.TaskFileName = fmt.Sprintf("retries.%d", idx)
+		cfg.MaxRangeRetries = 2
+		cfg.RangeBackSource = rangeBackSource
+		p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+		err := p2p.Run()
+
+		if !rangeBackSource {
+			e, ok := err.(*RangeExhaustedError)
+			c.Assert(ok, check.Equals, true)
+			c.Assert(e.Range, check.Equals, "0-9")
+			c.Assert(e.Retries, check.Equals, cfg.MaxRangeRetries+1)
+			continue
+		}
+		c.Assert(err, check.IsNil)
+		c.Assert(p2p.GetTierBytes()[TierOrigin], check.Equals, int64(5))
+		content, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+		c.Assert(string(content), check.Equals, "aaaaa")
+	}
+}
+
+func (s *P2PDownloaderTestSuite) TestDoDownloadTimeout_Stop(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			// the second piece is never dispatched
+			if req.Status == config.TaskStatusStart {
+				return newPieceResponse(peer, "/stop", good), nil
+			}
+			return newPullResponse(config.TaskCodeWait), nil
+		},
+	}
+
+	for _, ratio := range []float64{0, 0.5} {
+		comment := check.Commentf("ratio:%f", ratio)
+		cfg := s.createConfig()
+		cfg.RV.RealTarget = path.Join(s.workHome, "stop.target")
+		cfg.RV.TaskFileName = "stop"
+		cfg.RV.FileLength = 10
+		cfg.QueuePollTimeout = 50 * time.Millisecond
+		cfg.PullPieceMaxBackoff = 10 * time.Millisecond
+		cfg.PartialRatio = ratio
+		p2p := s.createP2PDownloader(cfg, api, &MockRegister{})
+		err := DoDownloadTimeout(p2p, 500*time.Millisecond)
+		// the download is stopped before the files are written and removed
+		c.Assert(util.PathExist(p2p.serviceFilePath), check.Equals, false, comment)
+		if ratio == 0 {
+			c.Assert(err, check.ErrorMatches, `download timeout\(0.500s\)`, comment)
+			continue
+		}
+		e, ok := err.(*errors.DFGetError)
+		c.Assert(ok && e.Code == config.CodePartial, check.Equals, true, comment)
+		content, _ := ioutil.ReadFile(cfg.RV.ResultPath)
+		c.Assert(string(content), check.Equals, "aaaaa", comment)
+		os.Remove(cfg.RV.ResultPath)
+	}
+}
+
+func (s *P2PDownloaderTestSuite) TestRun_Partial(c *check.C) {
+	good := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(good)
+	}))
+	defer peer.Close()
+	api := &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			// the second piece is never dispatched
+			if req.Result == config.ResultSemiSuc {
+				return nil, fmt.Errorf("supernode is down")
+			}
+			return newPieceResponse(peer, "/good", good), nil
+		},
+	}
+	register := &MockRegister{
+		RegisterFunc: func(peerPort int) (*regist.RegisterResult, *errors.DFGetError) {
+			return nil, errors.New(1200, "no available supernode")
+		},
+	}
+
+	var cases = []struct {
+		ratio   float64
+		partial bool
+	}{
+		{ratio: 0, partial: false},
+		{ratio: 0.6, partial: false},
+		{ratio: 0.5, partial: true},
+	}
+	for idx, v := range cases {
+		cfg := s.createConfig()
+		cfg.RV.RealTarget = path.Join(s.workHome, fmt.Sprintf("partial.%d.target", idx))
+		cfg.RV.TaskFileName = fmt.Sprintf("partial.%d", idx)
+		cfg.RV.FileLength = 10
+		cfg.Notbs = true
+		cfg.PartialRatio = v.ratio
+		err := s.createP2PDownloader(cfg, api, register).Run()
+		c.Assert(err, check.NotNil)
+
+		e, ok := err.(*errors.DFGetError)
+		c.Assert(ok && e.Code == config.CodePartial, check.Equals, v.partial,
+			check.Commentf("ratio:%f", v.ratio))
+		c.Assert(util.PathExist(cfg.RV.RealTarget), check.Equals, v.partial)
+		if v.partial {
+			content, _ := ioutil.ReadFile(cfg.RV.ResultPath)
+			c.Assert(string(content), check.Equals, "aaaaa")
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+// helper functions
+
+func (s *P2PDownloaderTestSuite) createConfig() *config.Config {
+	cfg := helper.CreateConfig(nil, s.workHome)
+	cfg.RV.DataDir = path.Join(s.workHome, "data")
+	cfg.RV.TaskFileName = "task"
+	cfg.RV.RealTarget = path.Join(s.workHome, "target")
+	cfg.RV.TempTarget = path.Join(s.workHome, "temp")
+	return cfg
+}
+
+func (s *P2PDownloaderTestSuite) createP2PDownloader(cfg *config.Config,
+	api api.SupernodeAPI, register regist.SupernodeRegister) *P2PDownloader {
+	result := regist.NewRegisterResult("node", nil, cfg.URL, "old", 100, 10)
+	return NewP2PDownloader(cfg, api, register, result).(*P2PDownloader)
+}
+
+// migrateAPI creates a MockSupernodeAPI that fails the old task and
+// continues the new task.
+func migrateAPI() *helper.MockSupernodeAPI {
+	return &helper.MockSupernodeAPI{
+		PullFunc: func(ip string, req *types.PullPieceTaskRequest) (*types.PullPieceTaskResponse, error) {
+			if req.TaskID == "new" {
+				return newPullResponse(config.TaskCodeContinue), nil
+			}
+			return newPullResponse(config.TaskCodeSuperFail), nil
+		},
+	}
+}
+
+// newPieceResponse creates a response which dispatches the piece "0-9"
+// served by peer at piecePath, the piece is expected to be wrapped.
+func newPieceResponse(peer *httptest.Server, piecePath string, wrapped []byte) *types.PullPieceTaskResponse {
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	peerPort, _ := strconv.Atoi(port)
+	res := newPullResponse(config.TaskCodeContinue)
+	res.Data, _ = json.Marshal([]*types.PullPieceTaskResponseContinueData{{
+		Range:     "0-9",
+		PieceNum:  0,
+		PieceSize: 10,
+		PieceMd5:  pieceDigest(wrapped),
+		Cid:       "peer",
+		PeerIP:    host,
+		PeerPort:  peerPort,
+		Path:      piecePath,
+	}})
+	return res
+}
+
+func newFinishResponse(fileLength int64) *types.PullPieceTaskResponse {
+	res := newPullResponse(config.TaskCodeFinish)
+	res.Data, _ = json.Marshal(&types.PullPieceTaskResponseFinishData{FileLength: fileLength})
+	return res
+}
+
+func newPullResponse(code int) *types.PullPieceTaskResponse {
+	return &types.PullPieceTaskResponse{
+		BaseResponse: &types.BaseResponse{Code: code},
+	}
+}
+
+// slowWriter is an output writer which sleeps for the delay before every
+// write, onWrite is called before writing if it's set.
+type slowWriter struct {
+	bytes.Buffer
+	delay   time.Duration
+	onWrite func()
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	if w.onWrite != nil {
+		w.onWrite()
+	}
+	return w.Buffer.Write(p)
+}
+
+// MockRegister mocks regist.SupernodeRegister.
+type MockRegister struct {
+	RegisterFunc      func(peerPort int) (*regist.RegisterResult, *errors.DFGetError)
+	RegisterNodesFunc func(peerPort int, nodes []string) (*regist.RegisterResult, *errors.DFGetError)
+}
+
+// Register implements regist.SupernodeRegister#Register.
+func (m *MockRegister) Register(peerPort int) (*regist.RegisterResult, *errors.DFGetError) {
+	if m.RegisterFunc != nil {
+		return m.RegisterFunc(peerPort)
+	}
+	return regist.NewRegisterResult("newNode", nil, "", "new", 100, 10), nil
+}
+
+// RegisterNodes implements regist.SupernodeRegister#RegisterNodes, it's
+// the Register of the MockRegister unless RegisterNodesFunc is set.
+func (m *MockRegister) RegisterNodes(peerPort int, nodes []string) (*regist.RegisterResult, *errors.DFGetError) {
+	if m.RegisterNodesFunc != nil {
+		return m.RegisterNodesFunc(peerPort, nodes)
+	}
+	return m.Register(peerPort)
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/errors"
+)
+
+// partialWriter is implemented by the downloaders supporting the soft-fail
+// mode specified by Cfg.PartialRatio.
+type partialWriter interface {
+	// writePartial writes the partial result if possible when the download
+	// fails by cause, and returns the error of the download.
+	writePartial(cause error) error
+}
+
+// writePartial writes the contiguous prefix written by the ClientWriter to
+// the target if it's at least Cfg.PartialRatio of the file, and returns a
+// DFGetError with config.CodePartial instead of the cause. The md5 of the
+// partial target isn't checked. It takes effect at most once, and returns
+// the cause as is if the partial target isn't written.
+func (p2p *P2PDownloader) writePartial(cause error) error {
+	// the prefix has been streamed into the output writer already.
+	if cause == nil || p2p.Cfg.PartialRatio <= 0 || p2p.Cfg.OutputWriter != nil {
+		return cause
+	}
+	// fail closed instead of leaving a result in the strict trust domain mode.
+	if e, ok := cause.(*errors.DFGetError); ok && e.Code == config.CodeUntrusted {
+		return cause
+	}
+
+	err := cause
+	p2p.partialOnce.Do(func() {
+		cw := p2p.clientWriter
+		total := p2p.Cfg.RV.FileLength
+		if cw == nil || total <= 0 {
+			return
+		}
+		prefix := cw.Prefix()
+		if prefix >= total || float64(prefix) < float64(total)*p2p.Cfg.PartialRatio {
+			p2p.Cfg.Log().Infof("skip writing partial target, prefix:%d total:%d ratio:%.3f",
+				prefix, total, p2p.Cfg.PartialRatio)
+			return
+		}
+		if e := copyPrefix(p2p.serviceFilePath, p2p.targetFile, prefix); e != nil {
+			p2p.Cfg.Log().Errorf("write partial target:%s error:%v", p2p.targetFile, e)
+			return
+		}
+		p2p.Cfg.RV.ResultPath = p2p.targetFile
+		p2p.Cfg.Log().Warnf("write partial target:%s %d/%d bytes without md5 check, cause:%v",
+			p2p.targetFile, prefix, total, cause)
+		err = errors.New(config.CodePartial,
+			fmt.Sprintf("partial download %d/%d bytes without md5 check: %v", prefix, total, cause))
+	})
+	return err
+}
+
+// copyPrefix copies the first n bytes of src to dst by a temp file in the
+// directory of dst, so that dst is replaced atomically.
+func copyPrefix(src string, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(path.Dir(dst), ".partial-")
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(out, in, n); err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+	}
+	return err
+}
@@ -19,6 +19,7 @@ package downloader
 import (
 	"bytes"
 	"encoding/json"
+	"time"
 
 	"github.com/dragonflyoss/Dragonfly/dfget/config"
 	"github.com/dragonflyoss/Dragonfly/dfget/util"
@@ -35,6 +36,29 @@ type Piece struct {
 	PieceSize int32         `json:"pieceSize"`
 	PieceNum  int           `json:"pieceNum"`
 	Content   *bytes.Buffer `json:"-"`
+
+	// Retries is the number of the re-requests of the range caused by
+	// failures, it's set for the failed pieces if Cfg.MaxRangeRetries is set.
+	Retries int `json:"retries,omitempty"`
+
+	// release releases the memory budget reserved for the Content, it's
+	// called once the Content has been written to disk.
+	release func()
+
+	// cost is the time of fetching the Content by the PowerClient.
+	cost time.Duration
+
+	// written is the length of the content written at the offset of the
+	// piece in the service file by Cfg.WriteAt already, the ClientWriter
+	// only records it then and the Content is empty.
+	written int64
+}
+
+// releaseBuffer releases the memory budget reserved for the piece.
+func (p *Piece) releaseBuffer() {
+	if p.release != nil {
+		p.release()
+	}
 }
 
 // RawContent return raw contents.
@@ -0,0 +1,171 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+// pieceDeadline records the pieces put by the PowerClients before the
+// deadline of their piece tasks, the pieces put after it are dropped. It's
+// the token the PowerClients own the delivery of their pieces by, so that
+// the abandoned ones don't write into the service file either.
+type pieceDeadline struct {
+	sync.Mutex
+	expired bool
+	put     map[string]bool
+	// delivering counts the pieces being delivered, which are waited for
+	// once it expires.
+	delivering sync.WaitGroup
+}
+
+// begin starts delivering a piece, it returns false if the deadline expired
+// and the piece must be dropped. end must be called after delivering if it
+// returns true. A nil pieceDeadline never expires.
+func (d *pieceDeadline) begin() bool {
+	if d == nil {
+		return true
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.expired {
+		return false
+	}
+	d.delivering.Add(1)
+	return true
+}
+
+// end ends delivering the piece started by begin.
+func (d *pieceDeadline) end() {
+	if d != nil {
+		d.delivering.Done()
+	}
+}
+
+// expire drops the pieces put from now on, and waits for the ones being
+// delivered.
+func (d *pieceDeadline) expire() {
+	d.Lock()
+	d.expired = true
+	d.Unlock()
+	d.delivering.Wait()
+}
+
+// deadlineQueue is the queue of the PowerClients running under a
+// pieceDeadline.
+type deadlineQueue struct {
+	util.Queue
+	deadline *pieceDeadline
+	// record indicates whether the ranges of the pieces put are recorded,
+	// it's set for the queue of the P2PDownloader only.
+	record bool
+}
+
+func (q *deadlineQueue) Put(item interface{}) {
+	q.PutTimeout(item, -1)
+}
+
+func (q *deadlineQueue) PutTimeout(item interface{}, timeout time.Duration) bool {
+	q.deadline.Lock()
+	defer q.deadline.Unlock()
+	if q.deadline.expired {
+		// the piece dropped is never written, its memory budget is
+		// released here.
+		if piece, ok := item.(*Piece); ok {
+			piece.releaseBuffer()
+		}
+		return true
+	}
+	if piece, ok := item.(*Piece); ok && q.record {
+		q.deadline.put[piece.Range] = true
+	}
+	if timeout < 0 {
+		q.Queue.Put(item)
+		return true
+	}
+	return q.Queue.PutTimeout(item, timeout)
+}
+
+// runWithDeadline runs the PowerClients by run within Cfg.PieceTimeout. The
+// pieces not put into the queue before the timeout are marked failed, so
+// that they're removed from the pieceSet and requested again by the next
+// pull, and the PowerClients are abandoned: their requests to the peers are
+// cancelled and whatever they deliver later is dropped, including the writes
+// into the service file by Cfg.WriteAt.
+func (p2p *P2PDownloader) runWithDeadline(clients []*PowerClient, run func()) {
+	timeout := p2p.Cfg.PieceTimeout
+	if timeout <= 0 {
+		run()
+		return
+	}
+	parent := p2p.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	deadline := &pieceDeadline{put: make(map[string]bool)}
+	// the PowerClients switch their pieceTasks to the candidates on failure
+	tasks := make([]*types.PullPieceTaskResponseContinueData, len(clients))
+	for i, pc := range clients {
+		tasks[i] = pc.pieceTask
+		pc.ctx = ctx
+		pc.deadline = deadline
+		pc.queue = &deadlineQueue{Queue: pc.queue, deadline: deadline, record: true}
+		pc.clientQueue = &deadlineQueue{Queue: pc.clientQueue, deadline: deadline}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run()
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	if parent.Err() != nil || ctx.Err() != context.DeadlineExceeded {
+		// the download is cancelled or exceeds Cfg.Timeout, the
+		// PowerClients return soon.
+		<-done
+		return
+	}
+
+	// abort the requests of the abandoned PowerClients, and wait for the
+	// pieces they're delivering so that nothing is written after returning.
+	cancel()
+	deadline.expire()
+	deadline.Lock()
+	defer deadline.Unlock()
+	for i, pc := range clients {
+		task := tasks[i]
+		if deadline.put[task.Range] {
+			continue
+		}
+		p2p.Cfg.Log().Warnf("range:%s from dst:%s timeout(%v), request it again",
+			task.Range, task.PeerIP, timeout)
+		p2p.queue.Put(NewPiece(pc.taskID, pc.node, task.Cid, task.Range,
+			config.ResultFail, config.TaskStatusRunning))
+	}
+}
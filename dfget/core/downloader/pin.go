@@ -0,0 +1,84 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+)
+
+// pinnedPeers forces the piece tasks to be served by the peers specified by
+// Cfg.PinnedPeers. Only the Cids of the peers are configured, so their
+// addresses are learned from the piece tasks dispatched by the supernode.
+// It's used by the main loop of P2PDownloader only, and a nil pinnedPeers
+// pins nothing.
+type pinnedPeers struct {
+	cids   []string
+	strict bool
+
+	// known maps the Cid of a pinned peer to a piece task served by it.
+	known map[string]*types.PullPieceTaskResponseContinueData
+}
+
+func newPinnedPeers(cids []string, strict bool) *pinnedPeers {
+	if len(cids) == 0 {
+		return nil
+	}
+	return &pinnedPeers{
+		cids:   cids,
+		strict: strict,
+		known:  make(map[string]*types.PullPieceTaskResponseContinueData),
+	}
+}
+
+// learn records the addresses of the pinned peers serving the tasks.
+func (p *pinnedPeers) learn(tasks []*types.PullPieceTaskResponseContinueData) {
+	if p == nil {
+		return
+	}
+	for _, t := range tasks {
+		for _, cid := range p.cids {
+			if t.Cid == cid {
+				p.known[cid] = t
+			}
+		}
+	}
+}
+
+// pin returns the piece task to be started instead of t, which is served by
+// the first known pinned peer. It returns t itself if t is served by a
+// pinned peer already or no pinned peer is known in the soft mode, and
+// returns false if the range should fail in the strict mode.
+func (p *pinnedPeers) pin(t *types.PullPieceTaskResponseContinueData) (
+	*types.PullPieceTaskResponseContinueData, bool) {
+	if p == nil {
+		return t, true
+	}
+	for _, cid := range p.cids {
+		if t.Cid == cid {
+			return t, true
+		}
+	}
+	for _, cid := range p.cids {
+		if peer, ok := p.known[cid]; ok {
+			pinned := *t
+			pinned.Cid, pinned.PeerIP, pinned.PeerPort, pinned.Path =
+				peer.Cid, peer.PeerIP, peer.PeerPort, peer.Path
+			return &pinned, true
+		}
+	}
+	return t, !p.strict
+}
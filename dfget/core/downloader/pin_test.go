@@ -0,0 +1,67 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+	"github.com/go-check/check"
+)
+
+type PinTestSuite struct {
+}
+
+func init() {
+	check.Suite(&PinTestSuite{})
+}
+
+func (s *PinTestSuite) TestPinnedPeers(c *check.C) {
+	var newTask = func(pieceRange string, cid string, ip string) *types.PullPieceTaskResponseContinueData {
+		return &types.PullPieceTaskResponseContinueData{
+			Range:    pieceRange,
+			Cid:      cid,
+			PeerIP:   ip,
+			PeerPort: 1,
+			Path:     "/peer/file/" + cid,
+		}
+	}
+
+	var p *pinnedPeers
+	t := newTask("0-9", "a", "1.1.1.1")
+	pinned, ok := p.pin(t)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(pinned, check.Equals, t)
+	c.Assert(newPinnedPeers(nil, true), check.IsNil)
+
+	for _, strict := range []bool{false, true} {
+		p = newPinnedPeers([]string{"b"}, strict)
+
+		// test: no pinned peer is known yet
+		pinned, ok = p.pin(t)
+		c.Assert(ok, check.Equals, !strict)
+		c.Assert(pinned, check.Equals, t)
+
+		// test: the range is rewritten to the learned pinned peer
+		p.learn([]*types.PullPieceTaskResponseContinueData{t, newTask("10-19", "b", "2.2.2.2")})
+		pinned, ok = p.pin(t)
+		c.Assert(ok, check.Equals, true)
+		c.Assert(pinned.Range, check.Equals, "0-9")
+		c.Assert(pinned.Cid, check.Equals, "b")
+		c.Assert(pinned.PeerIP, check.Equals, "2.2.2.2")
+		c.Assert(pinned.Path, check.Equals, "/peer/file/b")
+		c.Assert(t.Cid, check.Equals, "a")
+	}
+}
@@ -19,11 +19,19 @@ package downloader
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dragonflyoss/Dragonfly/dfget/config"
@@ -34,6 +42,11 @@ import (
 // ----------------------------------------------------------------------------
 // PowerClient
 
+var (
+	errPeerRefused     = errors.New("peer refused by the trust domain")
+	errPeerUnreachable = errors.New("peer unreachable")
+)
+
 // PowerClient downloads file from dragonfly.
 type PowerClient struct {
 	taskID      string
@@ -42,78 +55,301 @@ type PowerClient struct {
 	cfg         *config.Config
 	queue       util.Queue
 	clientQueue util.Queue
+	delta       *deltaIndex
+	tiers       *TierBytes
+	budget      *quota
+	files       *quota
+	recorder    *recorder
+	trust       *trustDomain
+
+	// writer writes the piece into the service file by Cfg.WriteAt, the
+	// piece is queued for it otherwise.
+	writer *ClientWriter
+
+	// limiter limits the rate of downloading the pieces by
+	// Cfg.MaxDownloadRate, it's shared by all the PowerClients of the
+	// download and nil if there's no limit.
+	limiter *util.RateLimiter
+
+	// ctx aborts the requests to the peers once the download is cancelled,
+	// it's never done if it's nil.
+	ctx context.Context
+
+	// deadline owns the delivery of the piece, the piece downloaded after
+	// it expires is dropped. It never expires if it's nil.
+	deadline *pieceDeadline
+
+	// release releases the memory budget reserved for the piece, it's
+	// handed over to the piece once the piece is put into the queues.
+	release func()
+
+	// candidates are the other peers offering the same range of the piece,
+	// they're tried in order before the piece is marked failed.
+	candidates []*types.PullPieceTaskResponseContinueData
+
+	// start is the time fetching the piece starts, after the memory budget
+	// is reserved.
+	start time.Time
 }
 
 // Run starts run the task.
 func (pc *PowerClient) Run() (err error) {
-	pieceMetaArr := strings.Split(pc.pieceTask.PieceMd5, ":")
-	pieceMD5 := pieceMetaArr[0]
-	dstIP := pc.pieceTask.PeerIP
-	peerPort := pc.pieceTask.PeerPort
-
+	pc.release = pc.budget.acquire(int64(pc.pieceTask.PieceSize))
+	pc.start = time.Now()
 	defer func() {
-		if err != nil {
-			pc.cfg.ClientLogger.Errorf("read piece cont error:%s from dst:%s", err, dstIP)
-			// TODO handle dst_ip == self.node
+		if pc.release != nil {
+			pc.release()
 		}
 	}()
 
-	_, err = util.CheckConnect(dstIP, peerPort, -1)
-	if dstIP == pc.node || err == nil {
-		url := fmt.Sprintf("http://%s:%d%s", dstIP, peerPort, pc.pieceTask.Path)
-		startTime := time.Now().Unix()
-
-		headers := make(map[string]string)
-		headers["Range"] = pc.pieceTask.Range
-		headers["pieceNum"] = strconv.Itoa(pc.pieceTask.PieceNum)
-		headers["pieceSize"] = strconv.Itoa(pc.pieceTask.PieceSize)
-		resp, err := httpGetWithHeaders(url, headers)
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-
-		buf := make([]byte, 256*1024)
-		pieceCont := bytes.NewBuffer(buf)
-		reader := NewLimitReader(resp.Body, pc.cfg.LocalLimit, pieceMD5 != "")
-		total, err := pieceCont.ReadFrom(reader)
-		pc.cfg.ClientLogger.Infof("get pieceCont total: %d", total)
-		if err != nil {
-			return err
+	if pc.delta != nil {
+		if content, ok := pc.delta.lookup(pc.pieceTask.PieceMd5); ok {
+			pc.cfg.Log().Debugf("reuse piece range:%s from delta base file",
+				pc.pieceTask.Range)
+			pc.putPiece(content)
+			return nil
 		}
-		// TODO handle read timeout
+	}
 
-		readFinish := time.Now().Unix()
-		realMd5 := reader.Md5()
-		if realMd5 != pieceMD5 {
-			pc.cfg.ClientLogger.Errorf("piece range:%s error,realMd5:%s,expectedMd5:%s,dstIp:%s,total:%d", pc.pieceTask.Range, realMd5, pieceMD5, dstIP, total)
-			return fmt.Errorf("md5 not match, expected:%s real:%s", pieceMD5, realMd5)
-		}
-		piece := NewPieceContent(pc.taskID, pc.node, pc.pieceTask.Cid, pc.pieceTask.Range, config.ResultSemiSuc, config.TaskStatusRunning, pieceCont)
-		// NOTE should unify the type
-		piece.PieceSize = int32(pc.pieceTask.PieceSize)
-		piece.PieceNum = pc.pieceTask.PieceNum
-		pc.clientQueue.Put(piece)
-		pc.queue.Put(piece)
+	pieceMD5 := expectedPieceDigest(pc.pieceTask.PieceMd5)
+	if !util.IsEmptyStr(pc.cfg.LocalCDN) && pc.downloadFromLocalCDN(pieceMD5) {
+		return nil
+	}
 
-		endTime := time.Now().Unix()
-		timeDuring := endTime - startTime
-		if timeDuring > 2.0 {
-			pc.cfg.ClientLogger.Warnf("client range:%s cost:%.3f from peer:%s,its readCost:%.3f,cont length:%d", pc.pieceTask.Range, timeDuring, dstIP, readFinish-startTime, total)
+	for {
+		if err = pc.download(pieceMD5); err == nil || !pc.nextCandidate(err) {
+			break
 		}
+	}
+	if err == nil {
 		return nil
 	}
+	pc.queue.Put(NewPiece(pc.taskID, pc.node, pc.pieceTask.Cid, pc.pieceTask.Range,
+		config.ResultFail, config.TaskStatusRunning))
+	if err == errPeerRefused || err == errPeerUnreachable {
+		return nil
+	}
+	pc.cfg.Log().Errorf("read piece cont error:%s from dst:%s", err, pc.pieceTask.PeerIP)
+	return err
+}
 
-	piece := NewPiece(pc.taskID, pc.node, pc.pieceTask.Cid, pc.pieceTask.Range, config.ResultFail, config.TaskStatusRunning)
-	pc.queue.Put(piece)
+// nextCandidate switches the pieceTask to the next candidate after the
+// peer of the pieceTask failed with err, it returns false if there's no
+// candidate left or the download is cancelled.
+func (pc *PowerClient) nextCandidate(err error) bool {
+	if len(pc.candidates) == 0 || pc.context().Err() != nil {
+		return false
+	}
+	next := pc.candidates[0]
+	pc.candidates = pc.candidates[1:]
+	pc.cfg.Log().Warnf("range:%s from dst:%s failed:%v, try dst:%s",
+		pc.pieceTask.Range, pc.pieceTask.PeerIP, err, next.PeerIP)
+	pc.pieceTask = next
+	return true
+}
+
+// download downloads the piece from the peer of the pieceTask.
+func (pc *PowerClient) download(pieceMD5 string) (err error) {
+	dstIP := pc.pieceTask.PeerIP
+	peerPort := pc.pieceTask.PeerPort
+	if !pc.checkTrusted() {
+		return errPeerRefused
+	}
+
+	defer pc.files.acquire(1)()
+	addr := util.JoinHostPort(dstIP, peerPort)
+	if _, reachable := reachablePeers.Load(addr); !reachable && !pc.files.nearLimit() {
+		// the check costs one more socket, it's skipped near the limit or if
+		// the peer served a piece already to reuse the pooled connection
+		_, err = util.CheckConnectFrom(peerLocalIP(pc.cfg), dstIP, peerPort, -1)
+	}
+	if dstIP != pc.node && err != nil {
+		return errPeerUnreachable
+	}
+	url := "http://" + addr + pc.pieceTask.Path
+	startTime := time.Now().Unix()
+
+	headers := make(map[string]string)
+	headers["Range"] = pc.pieceTask.Range
+	headers["pieceNum"] = strconv.Itoa(pc.pieceTask.PieceNum)
+	headers["pieceSize"] = strconv.Itoa(pc.pieceTask.PieceSize)
+	headers["User-Agent"] = pc.cfg.EffectiveUserAgent()
+	resp, err := httpGetWithContext(pc.context(), peerHTTPClient(pc.cfg), url, headers)
+	if err != nil {
+		reachablePeers.Delete(addr)
+		return err
+	}
+	defer resp.Body.Close()
+
+	pieceCont, total, err := pc.readPiece(resp, pieceMD5, dstIP)
+	if err != nil {
+		return err
+	}
+	// TODO handle read timeout
+
+	readFinish := time.Now().Unix()
+	reachablePeers.Store(addr, true)
+	pc.tiers.Add(TierPeer, total)
+	pc.putPiece(pieceCont)
+
+	endTime := time.Now().Unix()
+	timeDuring := endTime - startTime
+	if timeDuring > 2.0 {
+		pc.cfg.Log().Warnf("client range:%s cost:%ds from peer:%s,its readCost:%ds,cont length:%d", pc.pieceTask.Range, timeDuring, dstIP, readFinish-startTime, total)
+	}
 	return nil
 }
 
+// context returns the context of the requests to the peers.
+func (pc *PowerClient) context() context.Context {
+	if pc.ctx == nil {
+		return context.Background()
+	}
+	return pc.ctx
+}
+
+// checkTrusted returns whether the peer of the piece task is trusted, the
+// refused piece task is recorded by the trustDomain.
+func (pc *PowerClient) checkTrusted() bool {
+	dstIP := pc.pieceTask.PeerIP
+	if dstIP == pc.node || pc.trust.trusted(dstIP) {
+		return true
+	}
+	pc.cfg.Log().Warnf("refuse to download range:%s from untrusted peer:%s",
+		pc.pieceTask.Range, dstIP)
+	pc.trust.refuse(pc.pieceTask.Range)
+	return false
+}
+
+// downloadFromLocalCDN tries to download the piece from the local CDN
+// specified by LocalCDN. It returns false if the local CDN doesn't have
+// the piece, and then the piece should be downloaded from peers.
+func (pc *PowerClient) downloadFromLocalCDN(pieceMD5 string) bool {
+	if len(pc.taskID) < 3 {
+		return false
+	}
+	defer pc.files.acquire(1)()
+	url := fmt.Sprintf("%s%s%s/%s", strings.TrimRight(pc.cfg.LocalCDN, "/"),
+		config.CDNPathPrefix, pc.taskID[:3], pc.taskID)
+	pieceRange := pc.pieceTask.Range
+	if !strings.HasPrefix(pieceRange, "bytes=") {
+		pieceRange = "bytes=" + pieceRange
+	}
+	resp, err := httpGetWithContext(pc.context(), http.DefaultClient, url,
+		map[string]string{"Range": pieceRange, "User-Agent": pc.cfg.EffectiveUserAgent()})
+	if err != nil {
+		pc.cfg.Log().Warnf("download piece range:%s from local cdn error:%v",
+			pc.pieceTask.Range, err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		pc.cfg.Log().Debugf("local cdn misses piece range:%s, code:%d",
+			pc.pieceTask.Range, resp.StatusCode)
+		return false
+	}
+
+	pieceCont, total, err := pc.readPiece(resp, pieceMD5, pc.cfg.LocalCDN)
+	if err != nil {
+		return false
+	}
+	pc.tiers.Add(TierLocalCDN, total)
+	pc.putPiece(pieceCont)
+	return true
+}
+
+// readPiece reads the piece content from the response and checks its
+// digest in the algorithm of pieceMD5.
+func (pc *PowerClient) readPiece(resp *http.Response, pieceMD5 string, dst string) (
+	*bytes.Buffer, int64, error) {
+	pieceCont := bytes.NewBuffer(make([]byte, 0, 256*1024))
+	algorithm := ""
+	if pieceMD5 != "" {
+		algorithm, _ = util.ParseDigest(pieceMD5)
+	}
+	reader := NewDigestLimitReader(newSharedLimitReader(resp.Body, pc.limiter),
+		pc.cfg.LocalLimit, algorithm)
+	total, err := pieceCont.ReadFrom(reader)
+	pc.cfg.Log().Infof("get pieceCont total: %d", total)
+	if err != nil {
+		return nil, total, err
+	}
+
+	if n := expectedPieceLength(pc.pieceTask.PieceMd5); n >= 0 && n != total {
+		pc.cfg.Log().Errorf("piece range:%s error,length:%d,expectedLength:%d,dst:%s",
+			pc.pieceTask.Range, total, n, dst)
+		return nil, total, fmt.Errorf("length not match, expected:%d real:%d", n, total)
+	}
+	realMd5 := reader.Digest()
+	if realMd5 != pieceMD5 {
+		pc.cfg.Log().Errorf("piece range:%s error,realMd5:%s,expectedMd5:%s,dst:%s,total:%d", pc.pieceTask.Range, realMd5, pieceMD5, dst, total)
+		return nil, total, fmt.Errorf("md5 not match, expected:%s real:%s", pieceMD5, realMd5)
+	}
+	return pieceCont, total, nil
+}
+
+// putPiece puts the successfully downloaded piece into the queues.
+func (pc *PowerClient) putPiece(content *bytes.Buffer) {
+	if !pc.deadline.begin() {
+		pc.cfg.Log().Warnf("drop piece range:%s downloaded after its deadline", pc.pieceTask.Range)
+		return
+	}
+	defer pc.deadline.end()
+	piece := NewPieceContent(pc.taskID, pc.node, pc.pieceTask.Cid, pc.pieceTask.Range, config.ResultSemiSuc, config.TaskStatusRunning, content)
+	// NOTE should unify the type
+	piece.PieceSize = int32(pc.pieceTask.PieceSize)
+	piece.PieceNum = pc.pieceTask.PieceNum
+	piece.release, pc.release = pc.release, nil
+	if !pc.start.IsZero() {
+		piece.cost = time.Since(pc.start)
+	}
+	pc.recorder.recordPiece(pc.pieceTask.Range, content.Bytes())
+	if recorded := pc.writeAt(piece); recorded != nil {
+		pc.clientQueue.Put(recorded)
+		pc.queue.Put(piece)
+		return
+	}
+	pc.clientQueue.Put(piece)
+	// the ClientWriter reports the buffered piece once it's flushed.
+	if !buffersPieces(pc.cfg) {
+		pc.queue.Put(piece)
+	}
+}
+
+// writeAt writes the piece at its offset of the service file by
+// Cfg.WriteAt and releases its memory budget, it returns the piece without
+// content to be recorded by the ClientWriter. It returns nil if the piece
+// isn't written, and then it's queued for the ClientWriter as usual.
+func (pc *PowerClient) writeAt(piece *Piece) *Piece {
+	if pc.writer == nil || !pc.writer.writesAt {
+		return nil
+	}
+	n, err := pc.writer.writeAt(piece)
+	if err != nil {
+		pc.cfg.Log().Warnf("write piece range:%s at its offset error:%v, queue it for the writer",
+			piece.Range, err)
+		return nil
+	}
+	piece.releaseBuffer()
+	piece.release = nil
+	recorded := *piece
+	recorded.Content = new(bytes.Buffer)
+	recorded.written = n
+	return &recorded
+}
+
 // ----------------------------------------------------------------------------
 // ClientWriter
 
 // NewClientWriter creates and initialize a ClientWriter instance.
 func NewClientWriter(taskFileName, cid, clientFilePath, serviceFilePath string, clientQueue util.Queue, Cfg *config.Config) (*ClientWriter, error) {
+	return newClientWriter(taskFileName, cid, clientFilePath, serviceFilePath, clientQueue, Cfg, nil)
+}
+
+// newClientWriter creates a ClientWriter which keeps the pieces of the
+// resumed state written into the service file if it's not nil.
+func newClientWriter(taskFileName, cid, clientFilePath, serviceFilePath string, clientQueue util.Queue,
+	Cfg *config.Config, resumed *resumeState) (*ClientWriter, error) {
 	clientWriter := &ClientWriter{
 		taskFileName:    taskFileName,
 		cid:             cid,
@@ -121,6 +357,7 @@ func NewClientWriter(taskFileName, cid, clientFilePath, serviceFilePath string,
 		Cfg:             Cfg,
 		clientFilePath:  clientFilePath,
 		serviceFilePath: serviceFilePath,
+		resumed:         resumed,
 	}
 	if err := clientWriter.init(); err != nil {
 		return nil, err
@@ -145,104 +382,611 @@ type ClientWriter struct {
 	acrossWrite bool
 	total       int
 
+	// err is the first error of writing, syncing or closing the service
+	// file and the target file, it's returned by Wait. failed is set
+	// atomically then, so that the download falls back to the source once
+	// it's checked by writeFailed.
+	err    error
+	failed int32
+
+	// direct indicates that the service file is the target file hard linked
+	// into the data dir by Cfg.DirectWrite, there's nothing to move then.
+	direct bool
+
 	targetFinish chan struct{}
 	targetQueue  util.Queue
 	targetWriter *TargetWriter
 
+	// digest computes the md5 of the contiguous prefix of the written
+	// contents, digestOffset is the end of it. The pieces written in order
+	// are digested while writing, and the ones written ahead of it are read
+	// back once the prefix reaches them. digest is set to nil once a piece
+	// is rewritten within the prefix.
+	digest       hash.Hash
+	digestOffset int64
+
+	// written maps the offset of each piece written into the service file
+	// to its length, it's used to compute the contiguous prefix. sources
+	// maps it to the piece written if Cfg.VerifyLineage is set, and ranges
+	// maps the range of each piece written to its piece size.
+	written     map[int64]int64
+	sources     map[int64]pieceSource
+	ranges      map[string]int32
+	writtenLock sync.Mutex
+
+	// resumed are the pieces written into the service file by an
+	// interrupted download.
+	resumed *resumeState
+
+	// writesAt indicates that the pieces are written into the service file
+	// by the PowerClients by Cfg.WriteAt, fileLock serializes their writes
+	// with truncating the service file. preallocated indicates that the
+	// service file is preallocated to the file length, and it's truncated to
+	// the end of the written pieces once they are all written.
+	writesAt     bool
+	preallocated bool
+	fileLock     sync.RWMutex
+
+	// buffered are the pieces held in memory by Cfg.WriteBufferSize, budget
+	// is the memory budget they are reserved from. queue is the queue of the
+	// P2PDownloader which the buffered pieces are reported succeeded into
+	// once they're written.
+	buffered      []*Piece
+	bufferedBytes int64
+	budget        *quota
+	queue         util.Queue
+
 	Cfg *config.Config
 }
 
 func (cw *ClientWriter) init() (err error) {
-	if e := util.Link(cw.Cfg.RV.TempTarget, cw.clientFilePath); e != nil {
-		cw.Cfg.ClientLogger.Warn(e)
+	// the target assembled sequentially is written by the TargetWriter
+	// directly instead of being linked to the service file.
+	target := cw.Cfg.RV.TempTarget
+	if cw.Cfg.RV.Assembly == config.AssemblySequential {
+		target = cw.Cfg.RV.RealTarget
+		cw.acrossWrite = true
+	} else if cw.direct = cw.writeDirectly(); cw.direct {
+		if err = cw.openTarget(); err != nil {
+			return err
+		}
+	} else if !hardLinks(cw.Cfg) {
+		// the target is written by the TargetWriter instead of sharing the
+		// inode with the client file.
+		cw.acrossWrite = true
+	} else if e := util.Link(target, cw.clientFilePath); e != nil {
+		cw.Cfg.Log().Warnf("%v", e)
 		cw.acrossWrite = true
 	}
 
-	cw.serviceFile, _ = util.OpenFile(cw.serviceFilePath, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0755)
+	flag := os.O_RDWR | os.O_TRUNC | os.O_CREATE
+	if cw.resumed != nil {
+		flag &^= os.O_TRUNC
+	}
+	if !cw.direct {
+		cw.serviceFile, _ = util.OpenFile(cw.serviceFilePath, flag, 0755)
+	}
 
-	util.Link(cw.serviceFilePath, cw.clientFilePath)
+	if hardLinks(cw.Cfg) {
+		util.Link(cw.serviceFilePath, cw.clientFilePath)
+	}
+	if cw.Cfg.WriteAt && !cw.acrossWrite && cw.serviceFile != nil {
+		cw.writesAt = true
+		if cw.resumed == nil {
+			cw.preallocate()
+		}
+	}
 
 	cw.result = true
 	cw.targetQueue = util.NewQueue(0)
-	cw.targetWriter, err = NewTargetWriter(cw.Cfg.RV.TempTarget, cw.targetQueue, cw.Cfg)
+	cw.targetWriter, err = NewTargetWriter(target, cw.serviceFilePath, cw.targetQueue, cw.Cfg)
 	if err != nil {
 		return
 	}
-	go cw.targetWriter.Run()
 
 	cw.syncQueue = startSyncWriter(nil)
 
+	// the digest can't cover the resumed pieces which aren't written.
+	if cw.Cfg.DigestOnWrite && cw.resumed == nil {
+		cw.digest = util.NewDigest(digestAlgorithm(cw.Cfg))
+	}
+
+	cw.written = make(map[int64]int64)
+	cw.sources = make(map[int64]pieceSource)
+	cw.ranges = make(map[string]int32)
+	if cw.resumed != nil {
+		cw.resume()
+		if cw.acrossWrite {
+			if err = cw.targetWriter.assembler.seed(cw.written); err != nil {
+				return fmt.Errorf("write resumed pieces into target:%s error:%v", target, err)
+			}
+		}
+	}
+	go cw.targetWriter.Run()
 	cw.finish = make(chan struct{})
 	return
 }
 
+// writeDirectly returns whether the pieces are written into the target file
+// directly by Cfg.DirectWrite, which hard links the target into the data dir.
+func (cw *ClientWriter) writeDirectly() bool {
+	cfg := cw.Cfg
+	if !cfg.DirectWrite || cfg.NoMove || cw.resumed != nil || !util.IsEmptyStr(cfg.RequestRange) ||
+		!hardLinks(cfg) {
+		return false
+	}
+	same, err := util.SameDevice(cfg.RV.DataDir, filepath.Dir(cfg.RV.RealTarget))
+	if err != nil || !same {
+		cfg.Log().Infof("write target:%s through the data dir:%s, same device:%t error:%v",
+			cfg.RV.RealTarget, cfg.RV.DataDir, same, err)
+		return false
+	}
+	return true
+}
+
+// openTarget creates the target file as the service file and hard links it
+// into the data dir. The existing target is unlinked rather than truncated
+// as moving the client file into it would do, since it may be linked by
+// the others.
+func (cw *ClientWriter) openTarget() (err error) {
+	target := cw.Cfg.RV.RealTarget
+	os.Remove(target)
+	if cw.serviceFile, err = util.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755); err != nil {
+		return fmt.Errorf("open target file:%s error:%v", target, err)
+	}
+	if err = util.Link(target, cw.serviceFilePath); err != nil {
+		cw.serviceFile.Close()
+		return fmt.Errorf("link target file:%s to %s error:%v", target, cw.serviceFilePath, err)
+	}
+	cw.Cfg.Log().Infof("write target:%s directly", target)
+	return nil
+}
+
+// resume records the pieces of the resumed state as written.
+func (cw *ClientWriter) resume() {
+	pieceSize := cw.resumed.PieceSize
+	for _, r := range cw.resumed.Ranges {
+		offset, n, ok := pieceContent(r, pieceSize)
+		if !ok {
+			continue
+		}
+		cw.written[offset] = n
+		cw.ranges[r] = pieceSize
+		if cw.Cfg.VerifyLineage {
+			cw.sources[offset] = pieceSource{taskID: cw.resumed.TaskID,
+				pieceSize: pieceSize, length: n}
+		}
+	}
+}
+
 // Run starts writing downloading file.
 func (cw *ClientWriter) Run() {
 	for {
-		item := cw.clintQueue.Poll()
+		var item interface{}
+		if len(cw.buffered) == 0 {
+			item = cw.clintQueue.Poll()
+		} else if v, ok := cw.clintQueue.PollTimeout(config.WriteBufferFlushInterval); ok {
+			item = v
+		} else {
+			cw.flush()
+			continue
+		}
 		state, ok := item.(string)
 		if ok && state == last {
-			if !cw.acrossWrite {
-				cw.serviceFile.Sync()
+			cw.flush()
+			if cw.preallocated && cw.result {
+				if err := cw.serviceFile.Truncate(cw.writtenEnd()); err != nil {
+					cw.fail(fmt.Errorf("truncate service file:%s error:%v", cw.serviceFilePath, err))
+				}
+			}
+			if !cw.acrossWrite && cw.serviceFile != nil && cw.result {
+				if err := cw.serviceFile.Sync(); err != nil {
+					cw.fail(fmt.Errorf("sync service file:%s error:%v", cw.serviceFilePath, err))
+				}
 			}
 			break
 		}
 		if ok && state == reset {
+			for _, piece := range cw.buffered {
+				piece.releaseBuffer()
+			}
+			cw.buffered, cw.bufferedBytes = nil, 0
+			cw.fileLock.Lock()
 			cw.serviceFile.Truncate(0)
+			if cw.preallocated {
+				cw.preallocate()
+			}
+			cw.fileLock.Unlock()
+			cw.writtenLock.Lock()
+			cw.written = make(map[int64]int64)
+			cw.sources = make(map[int64]pieceSource)
+			cw.ranges = make(map[string]int32)
+			cw.writtenLock.Unlock()
 			if cw.acrossWrite {
 				cw.targetQueue.Put(state)
 			}
+			if cw.Cfg.DigestOnWrite {
+				cw.digest = util.NewDigest(digestAlgorithm(cw.Cfg))
+				cw.digestOffset = 0
+			}
+			continue
+		}
+		piece, ok := item.(*Piece)
+		if !ok {
 			continue
 		}
 		if !cw.result {
+			piece.releaseBuffer()
 			continue
 		}
-
-		piece, ok := item.(*Piece)
-		if !ok {
+		if piece.written > 0 {
+			cw.record(piece)
+			continue
+		}
+		if buffersPieces(cw.Cfg) {
+			cw.buffer(piece)
 			continue
 		}
 		if err := cw.write(piece, time.Now()); err != nil {
-			cw.Cfg.ClientLogger.Errorf("write item:%s error:%v", piece, err)
-			cw.Cfg.BackSourceReason = config.BackSourceReasonWriteError
-			cw.result = false
+			cw.fail(fmt.Errorf("write item:%s error:%v", piece, err))
+		}
+		// the TargetWriter releases the piece after writing it otherwise.
+		if !cw.acrossWrite {
+			piece.releaseBuffer()
+		}
+	}
+	if cw.serviceFile != nil {
+		if err := cw.serviceFile.Close(); err != nil && cw.result {
+			cw.fail(fmt.Errorf("close service file:%s error:%v", cw.serviceFilePath, err))
 		}
 	}
-	cw.serviceFile.Close()
 	cw.targetQueue.Put(last)
-	cw.targetWriter.Wait()
+	if err := cw.targetWriter.Wait(); err != nil && cw.err == nil {
+		cw.err = err
+	}
 	close(cw.finish)
 }
 
-// Wait for Run whether is finished.
-func (cw *ClientWriter) Wait() {
+// fail stops writing the pieces after err, and the download falls back to
+// the source for the write error.
+func (cw *ClientWriter) fail(err error) {
+	cw.Cfg.Log().Errorf("%v", err)
+	atomic.StoreInt32(&cw.failed, 1)
+	cw.result = false
+	if cw.err == nil {
+		cw.err = err
+	}
+}
+
+// Wait for Run whether is finished, the pieces received are flushed and
+// synced into the service file then. It returns the first error of writing
+// the service file or the target file.
+func (cw *ClientWriter) Wait() error {
+	err := cw.wait()
+	if cw.writeFailed() {
+		cw.Cfg.BackSourceReason = config.BackSourceReasonWriteError
+	}
+	return err
+}
+
+// wait is Wait without setting the Cfg.BackSourceReason, it's used by the
+// goroutines other than the one running the download.
+func (cw *ClientWriter) wait() error {
 	if cw.finish != nil {
 		<-cw.finish
 	}
+	return cw.err
+}
+
+// writeFailed returns whether writing the service file or the target file
+// fails, it's safe to call while the ClientWriter is running.
+func (cw *ClientWriter) writeFailed() bool {
+	if atomic.LoadInt32(&cw.failed) != 0 {
+		return true
+	}
+	return cw.targetWriter != nil && atomic.LoadInt32(&cw.targetWriter.failed) != 0
+}
+
+// Digest returns the digest of the written contents computed while writing
+// in the algorithm of Cfg.Digest or md5, formatted by util.FormatDigest.
+// It returns false if the digest is unavailable because DigestOnWrite is
+// disabled, a piece was rewritten or the pieces written don't cover a
+// contiguous prefix, and then the caller should compute it from the file.
+// It should be called after Wait.
+func (cw *ClientWriter) Digest() (string, bool) {
+	if cw.digest == nil {
+		return "", false
+	}
+	cw.writtenLock.Lock()
+	defer cw.writtenLock.Unlock()
+	for offset := range cw.written {
+		if offset >= cw.digestOffset {
+			return "", false
+		}
+	}
+	return util.FormatDigest(digestAlgorithm(cw.Cfg), fmt.Sprintf("%x", cw.digest.Sum(nil))), true
+}
+
+// Prefix returns the length of the contiguous prefix written into the
+// service file from the beginning, it's safe to be called while writing.
+func (cw *ClientWriter) Prefix() int64 {
+	cw.writtenLock.Lock()
+	defer cw.writtenLock.Unlock()
+	var offset int64
+	for {
+		n, ok := cw.written[offset]
+		if !ok || n <= 0 {
+			return offset
+		}
+		offset += n
+	}
+}
+
+// Sources returns the pieces written into the service file by their offsets
+// if Cfg.VerifyLineage is set. It should be called after Wait.
+func (cw *ClientWriter) Sources() map[int64]pieceSource {
+	cw.writtenLock.Lock()
+	defer cw.writtenLock.Unlock()
+	return cw.sources
+}
+
+// Ranges returns the sorted ranges of the pieces of pieceSize written into
+// the service file, it's safe to be called while writing.
+func (cw *ClientWriter) Ranges(pieceSize int32) []string {
+	cw.writtenLock.Lock()
+	defer cw.writtenLock.Unlock()
+	ranges := make([]string, 0, len(cw.ranges))
+	for r, size := range cw.ranges {
+		if size == pieceSize {
+			ranges = append(ranges, r)
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		si, _, _ := parsePieceRange(ranges[i])
+		sj, _, _ := parsePieceRange(ranges[j])
+		return si < sj
+	})
+	return ranges
 }
 
 func (cw *ClientWriter) write(piece *Piece, startTime time.Time) error {
-	start := int64(piece.PieceNum) * (int64(piece.PieceSize) - 5)
+	return cw.writeRun([]*Piece{piece})
+}
 
-	cw.pieceIndex++
+// writeRun writes the pieces adjacent in the service file by one sequential
+// write.
+func (cw *ClientWriter) writeRun(pieces []*Piece) error {
+	start := pieceOffset(pieces[0])
+
+	cw.pieceIndex += len(pieces)
 	cw.serviceFile.Seek(start, 0)
 	buf := bufio.NewWriterSize(cw.serviceFile, 4*1024*1024)
-	_, err := io.Copy(buf, piece.RawContent())
-	buf.Flush()
+	var w io.Writer = buf
+	digesting := cw.digest != nil && start == cw.digestOffset
+	if digesting {
+		w = io.MultiWriter(buf, cw.digest)
+	} else if cw.digest != nil && start < cw.digestOffset {
+		cw.Cfg.Log().Infof("piece:%s is rewritten within the digested contents, "+
+			"fall back to compute md5 after assembly", pieces[0].Range)
+		cw.digest = nil
+	}
+	var (
+		err     error
+		offset  = start
+		lengths = make([]int64, 0, len(pieces))
+	)
+	for _, piece := range pieces {
+		var n int64
+		n, err = io.Copy(w, piece.RawContent())
+		lengths = append(lengths, n)
+		offset += n
+		if err != nil {
+			break
+		}
+	}
+	if flushErr := buf.Flush(); err == nil {
+		err = flushErr
+	}
+	if digesting {
+		cw.digestOffset = offset
+	}
+	if err == nil {
+		cw.writtenLock.Lock()
+		offset = start
+		for i, n := range lengths {
+			cw.written[offset] = n
+			cw.ranges[pieces[i].Range] = pieces[i].PieceSize
+			if cw.Cfg.VerifyLineage {
+				cw.sources[offset] = pieceSource{taskID: pieces[i].TaskID,
+					pieceSize: pieces[i].PieceSize, length: n}
+			}
+			offset += n
+		}
+		cw.writtenLock.Unlock()
+	}
+	if digesting {
+		cw.catchUpDigest()
+	}
 	if cw.acrossWrite {
-		cw.targetQueue.Put(piece)
+		for _, piece := range pieces {
+			cw.targetQueue.Put(piece)
+		}
 	}
 
 	return err
 }
 
+// preallocate preallocates the service file to the registered file length
+// for the pieces written at their offsets, the pieces are still written if
+// it fails.
+func (cw *ClientWriter) preallocate() {
+	length := cw.Cfg.RV.FileLength
+	if length <= 0 {
+		return
+	}
+	if err := util.Preallocate(cw.serviceFile, length); err != nil {
+		cw.Cfg.Log().Warnf("preallocate service file:%s to %d bytes error:%v",
+			cw.serviceFilePath, length, err)
+		return
+	}
+	cw.preallocated = true
+}
+
+// writeAt writes the content of the piece at its offset of the service file
+// by Cfg.WriteAt, it's called by the PowerClients concurrently.
+func (cw *ClientWriter) writeAt(piece *Piece) (int64, error) {
+	raw := piece.RawContent()
+	if raw == nil || raw.Len() == 0 {
+		return 0, fmt.Errorf("empty content")
+	}
+	cw.fileLock.RLock()
+	defer cw.fileLock.RUnlock()
+	n, err := cw.serviceFile.WriteAt(raw.Bytes(), pieceOffset(piece))
+	return int64(n), err
+}
+
+// record records the piece written into the service file by writeAt, and
+// extends the digest over it if it's adjacent.
+func (cw *ClientWriter) record(piece *Piece) {
+	offset := pieceOffset(piece)
+	cw.pieceIndex++
+	if cw.digest != nil && offset < cw.digestOffset {
+		cw.Cfg.Log().Infof("piece:%s is rewritten within the digested contents, "+
+			"fall back to compute md5 after assembly", piece.Range)
+		cw.digest = nil
+	}
+	cw.writtenLock.Lock()
+	cw.written[offset] = piece.written
+	cw.ranges[piece.Range] = piece.PieceSize
+	if cw.Cfg.VerifyLineage {
+		cw.sources[offset] = pieceSource{taskID: piece.TaskID,
+			pieceSize: piece.PieceSize, length: piece.written}
+	}
+	cw.writtenLock.Unlock()
+	cw.catchUpDigest()
+}
+
+// writtenEnd returns the end of the pieces written into the service file.
+func (cw *ClientWriter) writtenEnd() int64 {
+	cw.writtenLock.Lock()
+	defer cw.writtenLock.Unlock()
+	var end int64
+	for offset, n := range cw.written {
+		if offset+n > end {
+			end = offset + n
+		}
+	}
+	return end
+}
+
+// catchUpDigest extends the digest over the pieces written ahead of it,
+// which are read back from the service file while they're likely cached.
+func (cw *ClientWriter) catchUpDigest() {
+	for cw.digest != nil {
+		cw.writtenLock.Lock()
+		n, ok := cw.written[cw.digestOffset]
+		cw.writtenLock.Unlock()
+		if !ok || n <= 0 {
+			return
+		}
+		if _, err := io.Copy(cw.digest, io.NewSectionReader(cw.serviceFile, cw.digestOffset, n)); err != nil {
+			cw.Cfg.Log().Warnf("read back written contents at:%d error:%v, "+
+				"fall back to compute md5 after assembly", cw.digestOffset, err)
+			cw.digest = nil
+			return
+		}
+		cw.digestOffset += n
+	}
+}
+
+// buffersPieces returns whether the pieces are buffered by the ClientWriter
+// before they're written, they're reported succeeded by it once they're
+// written then.
+func buffersPieces(cfg *config.Config) bool {
+	return cfg.WriteBufferSize > 0
+}
+
+// buffer holds the piece in memory until Cfg.WriteBufferSize bytes are
+// buffered, the memory budget is near its limit or all the pieces are
+// downloaded, and then writes all the buffered pieces.
+func (cw *ClientWriter) buffer(piece *Piece) {
+	cw.buffered = append(cw.buffered, piece)
+	cw.bufferedBytes += int64(piece.Content.Len())
+	if cw.bufferedBytes >= cw.Cfg.WriteBufferSize || cw.budget.nearLimit() || cw.allBuffered() {
+		cw.flush()
+	}
+}
+
+// allBuffered returns whether the buffered pieces are all the rest of the
+// file, no more pieces are downloaded before they're reported then.
+func (cw *ClientWriter) allBuffered() bool {
+	length := cw.Cfg.RV.FileLength
+	if length <= 0 {
+		return false
+	}
+	var total int64
+	for _, piece := range cw.buffered {
+		if raw := piece.RawContent(); raw != nil {
+			total += int64(raw.Len())
+		}
+	}
+	cw.writtenLock.Lock()
+	for _, n := range cw.written {
+		total += n
+	}
+	cw.writtenLock.Unlock()
+	return total >= length
+}
+
+// flush writes the buffered pieces sorted by their offsets, the adjacent ones
+// are written by one sequential write, and reports the written ones
+// succeeded.
+func (cw *ClientWriter) flush() {
+	pieces := cw.buffered
+	cw.buffered, cw.bufferedBytes = nil, 0
+	sort.SliceStable(pieces, func(i, j int) bool {
+		return pieceOffset(pieces[i]) < pieceOffset(pieces[j])
+	})
+	for i := 0; i < len(pieces); {
+		j, end := i+1, pieceOffset(pieces[i])+int64(pieces[i].RawContent().Len())
+		for ; j < len(pieces) && pieceOffset(pieces[j]) == end; j++ {
+			end += int64(pieces[j].RawContent().Len())
+		}
+		written := cw.result
+		if written {
+			if err := cw.writeRun(pieces[i:j]); err != nil {
+				cw.fail(fmt.Errorf("write items:%s-%s error:%v", pieces[i], pieces[j-1], err))
+			} else if cw.queue != nil {
+				for _, piece := range pieces[i:j] {
+					cw.queue.Put(piece)
+				}
+			}
+		}
+		// the TargetWriter releases the pieces after writing them otherwise.
+		if !written || !cw.acrossWrite {
+			for _, piece := range pieces[i:j] {
+				piece.releaseBuffer()
+			}
+		}
+		i = j
+	}
+}
+
+// pieceOffset returns the offset of the piece content in the file.
+func pieceOffset(piece *Piece) int64 {
+	return int64(piece.PieceNum) * (int64(piece.PieceSize) - 5)
+}
+
 // ----------------------------------------------------------------------------
 // TargetWriter
 
-// NewTargetWriter creates and initialize a TargetWriter instance.
-func NewTargetWriter(dst string, queue util.Queue, Cfg *config.Config) (*TargetWriter, error) {
+// NewTargetWriter creates and initialize a TargetWriter instance, the pieces
+// are read from the service file src if the target dst is assembled
+// sequentially.
+func NewTargetWriter(dst string, src string, queue util.Queue, Cfg *config.Config) (*TargetWriter, error) {
 	targetWriter := &TargetWriter{
 		dst:        dst,
+		src:        src,
 		pieceQueue: queue,
 		Cfg:        Cfg,
 	}
@@ -255,26 +999,25 @@ func NewTargetWriter(dst string, queue util.Queue, Cfg *config.Config) (*TargetW
 // TargetWriter writes downloading file to disk.
 type TargetWriter struct {
 	dst        string
-	dstFile    *os.File
+	src        string
+	assembler  assembler
 	pieceQueue util.Queue
 	finish     chan struct{}
-	pieceIndex int
 	result     bool
-	syncQueue  util.Queue
+	err        error
+	failed     int32
 	Cfg        *config.Config
 }
 
 func (tw *TargetWriter) init() error {
 	var err error
-	tw.dstFile, err = util.OpenFile(tw.dst, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0755)
+	tw.assembler, err = newAssembler(tw.Cfg, tw.dst, tw.src)
 	if err != nil {
 		return fmt.Errorf("open target file:%s error:%v", tw.dst, err)
 	}
 
 	tw.finish = make(chan struct{})
-	tw.pieceIndex = 0
 	tw.result = true
-	tw.syncQueue = startSyncWriter(nil)
 	return nil
 }
 
@@ -284,14 +1027,14 @@ func (tw *TargetWriter) Run() {
 		item := tw.pieceQueue.Poll()
 		state, ok := item.(string)
 		if ok && state == last {
-			tw.dstFile.Sync()
 			break
 		}
-		if !tw.result {
-			continue
-		}
 		if ok && state == reset {
-			tw.dstFile.Truncate(0)
+			if tw.result {
+				if err := tw.assembler.reset(); err != nil {
+					tw.fail(fmt.Errorf("reset target file:%s error:%v", tw.dst, err))
+				}
+			}
 			continue
 		}
 
@@ -299,37 +1042,35 @@ func (tw *TargetWriter) Run() {
 		if !ok {
 			continue
 		}
-		if err := tw.write(piece); err != nil {
-			tw.Cfg.ClientLogger.Errorf("write item:%s error:%v", piece, err)
-			tw.Cfg.BackSourceReason = config.BackSourceReasonWriteError
-			tw.result = false
+		if tw.result {
+			if err := tw.assembler.write(piece); err != nil {
+				tw.fail(fmt.Errorf("write item:%s error:%v", piece, err))
+			}
 		}
+		piece.releaseBuffer()
+	}
+	if err := tw.assembler.close(); err != nil && tw.result {
+		tw.fail(fmt.Errorf("close target file:%s error:%v", tw.dst, err))
 	}
-	tw.dstFile.Close()
 	close(tw.finish)
 }
 
-// Wait the Run is finished.
-func (tw *TargetWriter) Wait() {
-	if tw.finish != nil {
-		<-tw.finish
+func (tw *TargetWriter) fail(err error) {
+	tw.Cfg.Log().Errorf("%v", err)
+	atomic.StoreInt32(&tw.failed, 1)
+	tw.result = false
+	if tw.err == nil {
+		tw.err = err
 	}
 }
 
-func (tw *TargetWriter) write(piece *Piece) error {
-	start := int64(piece.PieceNum) * (int64(piece.PieceSize) - 5)
-
-	tw.pieceIndex++
-	tw.dstFile.Seek(start, 0)
-	buf := bufio.NewWriterSize(tw.dstFile, 4*1024*1024)
-	_, err := io.Copy(buf, piece.RawContent())
-	buf.Flush()
-
-	if tw.syncQueue != nil && tw.pieceIndex%4 == 0 {
-		tw.syncQueue.Put(tw.dstFile.Fd())
+// Wait the Run is finished, and returns the first error of writing the
+// target file.
+func (tw *TargetWriter) Wait() error {
+	if tw.finish != nil {
+		<-tw.finish
 	}
-
-	return err
+	return tw.err
 }
 
 func startSyncWriter(queue util.Queue) util.Queue {
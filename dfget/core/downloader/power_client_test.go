@@ -0,0 +1,746 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+	"github.com/go-check/check"
+)
+
+type PowerClientTestSuite struct {
+	workHome string
+}
+
+func init() {
+	check.Suite(&PowerClientTestSuite{})
+}
+
+func (s *PowerClientTestSuite) SetUpSuite(c *check.C) {
+	s.workHome, _ = ioutil.TempDir("/tmp", "dfget-PowerClientTestSuite-")
+}
+
+func (s *PowerClientTestSuite) TearDownSuite(c *check.C) {
+	if s.workHome != "" {
+		if err := os.RemoveAll(s.workHome); err != nil {
+			fmt.Printf("remove path:%s error", s.workHome)
+		}
+	}
+}
+
+func (s *PowerClientTestSuite) TestClientWriter_Digest(c *check.C) {
+	contents := []string{"aaaaa", "bbbbb", "cc"}
+	expected := fmt.Sprintf("%x", md5.Sum([]byte("aaaaabbbbbcc")))
+
+	var cases = []struct {
+		digestOnWrite bool
+		sequential    bool
+		order         []int
+		ok            bool
+	}{
+		{digestOnWrite: false, order: []int{0, 1, 2}, ok: false},
+		{digestOnWrite: true, order: []int{0, 1, 2}, ok: true},
+		// the pieces written ahead are read back once the gap is written
+		{digestOnWrite: true, order: []int{1, 0, 2}, ok: true},
+		{digestOnWrite: true, order: []int{2, 1, 0}, ok: true},
+		{digestOnWrite: true, sequential: true, order: []int{2, 0, 1}, ok: true},
+		// the rewritten piece may differ from the digested one
+		{digestOnWrite: true, order: []int{0, 1, 0, 2}, ok: false},
+	}
+
+	for idx, v := range cases {
+		cfg := s.createConfig(20 + idx)
+		cfg.DigestOnWrite = v.digestOnWrite
+		if v.sequential {
+			cfg.RV.Assembly = config.AssemblySequential
+			cfg.RV.RealTarget = path.Join(s.workHome, fmt.Sprintf("target.%d", 20+idx))
+		}
+		cw := s.createClientWriter(c, cfg, 20+idx)
+
+		for _, num := range v.order {
+			cw.clintQueue.Put(createTestPiece(num, 10, contents[num]))
+		}
+		cw.clintQueue.Put(last)
+		cw.Wait()
+
+		digest, ok := cw.Digest()
+		c.Assert(ok, check.Equals, v.ok, check.Commentf("case:%d", idx))
+		if v.ok {
+			c.Assert(digest, check.Equals, expected)
+		}
+		c.Assert(util.Md5Sum(cw.serviceFilePath), check.Equals, expected)
+	}
+
+	// test: the digest doesn't cover the pieces beyond a gap
+	cfg := s.createConfig(30)
+	cfg.DigestOnWrite = true
+	cw := s.createClientWriter(c, cfg, 30)
+	cw.clintQueue.Put(createTestPiece(0, 10, contents[0]))
+	cw.clintQueue.Put(createTestPiece(2, 10, contents[2]))
+	cw.clintQueue.Put(last)
+	cw.Wait()
+	_, ok := cw.Digest()
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *PowerClientTestSuite) TestClientWriter_WaitError(c *check.C) {
+	cfg := s.createConfig(40)
+	cw := s.createClientWriter(c, cfg, 40)
+	cw.clintQueue.Put(createTestPiece(0, 10, "aaaaa"))
+	cw.clintQueue.Put(last)
+	c.Assert(cw.Wait(), check.IsNil)
+
+	cfg = s.createConfig(41)
+	cw = s.createClientWriter(c, cfg, 41)
+	// the writes into the closed service file fail
+	cw.serviceFile.Close()
+	cw.clintQueue.Put(createTestPiece(0, 10, "aaaaa"))
+	cw.clintQueue.Put(createTestPiece(1, 10, "bbbbb"))
+	cw.clintQueue.Put(last)
+	c.Assert(cw.Wait(), check.ErrorMatches, "write item:.*0-0.* error:.*")
+	c.Assert(cfg.BackSourceReason, check.Equals, config.BackSourceReasonWriteError)
+}
+
+func (s *PowerClientTestSuite) TestClientWriter_DigestSha256(c *check.C) {
+	cfg := s.createConfig(0)
+	cfg.DigestOnWrite = true
+	cfg.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("aaaaabbbbb")))
+	cw := s.createClientWriter(c, cfg, 0)
+	cw.clintQueue.Put(createTestPiece(0, 10, "aaaaa"))
+	cw.clintQueue.Put(createTestPiece(1, 10, "bbbbb"))
+	cw.clintQueue.Put(last)
+	cw.Wait()
+
+	digest, ok := cw.Digest()
+	c.Assert(ok, check.Equals, true)
+	c.Assert(digest, check.Equals, cfg.Digest)
+}
+
+func (s *PowerClientTestSuite) TestPowerClient_PieceDigest(c *check.C) {
+	wrapped := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(wrapped)
+	}))
+	defer peer.Close()
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	peerPort, _ := strconv.Atoi(port)
+
+	var cases = []struct {
+		pieceMd5 string
+		result   int
+	}{
+		{pieceMd5: pieceDigest(wrapped), result: config.ResultSemiSuc},
+		{pieceMd5: fmt.Sprintf("sha256:%x:%d", sha256.Sum256(wrapped), len(wrapped)),
+			result: config.ResultSemiSuc},
+		{pieceMd5: fmt.Sprintf("sha256:%x:%d", md5.Sum(wrapped), len(wrapped)),
+			result: config.ResultFail},
+		{pieceMd5: fmt.Sprintf("sha256:%x", sha256.Sum256(wrapped)), result: config.ResultSemiSuc},
+		// the content matches the digest but not the length
+		{pieceMd5: fmt.Sprintf("%x:%d", md5.Sum(wrapped), len(wrapped)+1), result: config.ResultFail},
+	}
+	for idx, v := range cases {
+		pc := &PowerClient{
+			taskID: "taskID",
+			node:   "node",
+			pieceTask: &types.PullPieceTaskResponseContinueData{
+				Range:     "0-9",
+				PieceSize: 10,
+				PieceMd5:  v.pieceMd5,
+				PeerIP:    host,
+				PeerPort:  peerPort,
+			},
+			cfg:         s.createConfig(idx),
+			queue:       util.NewQueue(0),
+			clientQueue: util.NewQueue(0),
+			tiers:       NewTierBytes(),
+		}
+		pc.Run()
+		item, _ := pc.queue.PollTimeout(0)
+		c.Assert(item.(*Piece).Result, check.Equals, v.result, check.Commentf("case:%d", idx))
+	}
+}
+
+func (s *PowerClientTestSuite) TestPowerClient_UserAgent(c *check.C) {
+	wrapped := wrapPieceContent([]byte("aaaaa"), 10)
+	var userAgent string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+		w.Write(wrapped)
+	}))
+	defer peer.Close()
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	peerPort, _ := strconv.Atoi(port)
+
+	cfg := s.createConfig(16)
+	cfg.UserAgent = "custom/1.0"
+	pc := &PowerClient{
+		taskID: "taskID",
+		node:   "node",
+		pieceTask: &types.PullPieceTaskResponseContinueData{
+			Range:     "0-9",
+			PieceSize: 10,
+			PieceMd5:  pieceDigest(wrapped),
+			PeerIP:    host,
+			PeerPort:  peerPort,
+		},
+		cfg:         cfg,
+		queue:       util.NewQueue(0),
+		clientQueue: util.NewQueue(0),
+		tiers:       NewTierBytes(),
+	}
+	c.Assert(pc.Run(), check.IsNil)
+	c.Assert(userAgent, check.Equals, "custom/1.0")
+}
+
+func (s *PowerClientTestSuite) TestPowerClient_IPv6Peer(c *check.C) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		c.Skip("ipv6 isn't available: " + err.Error())
+	}
+	wrapped := wrapPieceContent([]byte("aaaaa"), 10)
+	peer := &httptest.Server{
+		Listener: ln,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(wrapped)
+		})},
+	}
+	peer.Start()
+	defer peer.Close()
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	peerPort, _ := strconv.Atoi(port)
+
+	pc := &PowerClient{
+		taskID: "taskID",
+		node:   "node",
+		pieceTask: &types.PullPieceTaskResponseContinueData{
+			Range:     "0-9",
+			PieceSize: 10,
+			PieceMd5:  pieceDigest(wrapped),
+			PeerIP:    host,
+			PeerPort:  peerPort,
+		},
+		cfg:         s.createConfig(0),
+		queue:       util.NewQueue(0),
+		clientQueue: util.NewQueue(0),
+		tiers:       NewTierBytes(),
+	}
+	c.Assert(host, check.Equals, "::1")
+	c.Assert(pc.Run(), check.IsNil)
+	item, _ := pc.queue.PollTimeout(0)
+	c.Assert(item.(*Piece).Result, check.Equals, config.ResultSemiSuc)
+}
+
+func (s *PowerClientTestSuite) TestPowerClient_ConnectionReuse(c *check.C) {
+	wrapped := wrapPieceContent([]byte("aaaaa"), 10)
+	var fetch = func(http2 bool) (conns int32, protos map[int]bool) {
+		protos = make(map[int]bool)
+		var mu sync.Mutex
+		peer := httptest.NewUnstartedServer(util.NewH2CHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			protos[r.ProtoMajor] = true
+			mu.Unlock()
+			w.Write(wrapped)
+		})))
+		peer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&conns, 1)
+			}
+		}
+		peer.Start()
+		defer peer.Close()
+		host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+		peerPort, _ := strconv.Atoi(port)
+
+		cfg := s.createConfig(0)
+		cfg.PeerHTTP2 = http2
+		// 200 pieces by 4 concurrent fetches.
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					pc := &PowerClient{
+						taskID: "taskID",
+						node:   "node",
+						pieceTask: &types.PullPieceTaskResponseContinueData{
+							Range:     "0-9",
+							PieceSize: 10,
+							PieceMd5:  pieceDigest(wrapped),
+							PeerIP:    host,
+							PeerPort:  peerPort,
+						},
+						cfg:         cfg,
+						queue:       util.NewQueue(0),
+						clientQueue: util.NewQueue(0),
+						tiers:       NewTierBytes(),
+					}
+					c.Check(pc.Run(), check.IsNil)
+				}
+			}()
+		}
+		wg.Wait()
+		return atomic.LoadInt32(&conns), protos
+	}
+
+	// the connectivity checks and the first fetches of the concurrent ones
+	// connect at most.
+	conns, protos := fetch(false)
+	c.Assert(conns <= 8, check.Equals, true, check.Commentf("connections:%d", conns))
+	c.Assert(protos, check.DeepEquals, map[int]bool{1: true})
+	conns, protos = fetch(true)
+	c.Assert(conns <= 8, check.Equals, true, check.Commentf("connections:%d", conns))
+	c.Assert(protos, check.DeepEquals, map[int]bool{2: true})
+}
+
+func (s *PowerClientTestSuite) TestPowerClient_MaxDownloadRate(c *check.C) {
+	wrapped := wrapPieceContent(bytes.Repeat([]byte("a"), 2000), 2005)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(wrapped)
+	}))
+	defer peer.Close()
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	peerPort, _ := strconv.Atoi(port)
+
+	// the pieces downloading concurrently share the rate of 8000 bytes/s.
+	limiter := newSharedLimiter(8000)
+	queue := util.NewQueue(0)
+	start := time.Now()
+	done := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		pc := &PowerClient{
+			taskID: "taskID",
+			node:   "node",
+			pieceTask: &types.PullPieceTaskResponseContinueData{
+				Range:     fmt.Sprintf("%d-%d", i*2005, i*2005+2004),
+				PieceNum:  i,
+				PieceSize: 2005,
+				PieceMd5:  pieceDigest(wrapped),
+				PeerIP:    host,
+				PeerPort:  peerPort,
+			},
+			cfg:         s.createConfig(i),
+			queue:       queue,
+			clientQueue: util.NewQueue(0),
+			tiers:       NewTierBytes(),
+			limiter:     limiter,
+		}
+		go func() {
+			pc.Run()
+			done <- struct{}{}
+		}()
+	}
+	<-done
+	<-done
+	c.Assert(time.Since(start) >= 400*time.Millisecond, check.Equals, true,
+		check.Commentf("elapsed:%v", time.Since(start)))
+	for i := 0; i < 2; i++ {
+		item, _ := queue.PollTimeout(0)
+		c.Assert(item.(*Piece).Result, check.Equals, config.ResultSemiSuc)
+	}
+	c.Assert(newSharedLimiter(0), check.IsNil)
+}
+
+func (s *PowerClientTestSuite) TestClientWriter_ReleaseBuffer(c *check.C) {
+	cfg := s.createConfig(10)
+	cw := s.createClientWriter(c, cfg, 10)
+	budget := newQuota(100)
+	for i := 0; i < 3; i++ {
+		piece := createTestPiece(i, 10, "aaaaa")
+		piece.release = budget.acquire(10)
+		cw.clintQueue.Put(piece)
+	}
+	cw.clintQueue.Put(last)
+	cw.Wait()
+	c.Assert(budget.Peak() > 0, check.Equals, true)
+	c.Assert(budget.Used(), check.Equals, int64(0))
+}
+
+func (s *PowerClientTestSuite) TestClientWriter_Prefix(c *check.C) {
+	cfg := s.createConfig(11)
+	cw := s.createClientWriter(c, cfg, 11)
+	for _, num := range []int{0, 2} {
+		cw.clintQueue.Put(createTestPiece(num, 10, "aaaaa"))
+	}
+	cw.clintQueue.Put(reset)
+	for _, num := range []int{2, 0} {
+		cw.clintQueue.Put(createTestPiece(num, 10, "aaaaa"))
+	}
+	cw.clintQueue.Put(last)
+	cw.Wait()
+	c.Assert(cw.Prefix(), check.Equals, int64(5))
+
+	cw.written[5] = 5
+	c.Assert(cw.Prefix(), check.Equals, int64(15))
+}
+
+func (s *PowerClientTestSuite) TestClientWriter_Sources(c *check.C) {
+	cfg := s.createConfig(12)
+	cfg.VerifyLineage = true
+	cw := s.createClientWriter(c, cfg, 12)
+	stale := createTestPiece(1, 10, "bbbbb")
+	stale.TaskID = "stale"
+	cw.clintQueue.Put(createTestPiece(0, 10, "aaaaa"))
+	cw.clintQueue.Put(stale)
+	cw.clintQueue.Put(last)
+	cw.Wait()
+
+	c.Assert(cw.Sources(), check.DeepEquals, map[int64]pieceSource{
+		0: {taskID: "taskID", pieceSize: 10, length: 5},
+		5: {taskID: "stale", pieceSize: 10, length: 5},
+	})
+	c.Assert(verifyLineage(cw.Sources(), taskLineage{"taskID"}, 10, 10), check.ErrorMatches,
+		".*task:stale out of the lineage.*")
+}
+
+func (s *PowerClientTestSuite) TestClientWriter_WriteBuffer(c *check.C) {
+	cfg := s.createConfig(13)
+	cfg.DigestOnWrite = true
+	cfg.WriteBufferSize = 30
+	cw := s.createClientWriter(c, cfg, 13)
+	budget := newQuota(100)
+	cw.budget = budget
+	contents := []string{"aaaaa", "bbbbb", "ccccc", "dd"}
+	for _, num := range []int{1, 0, 2, 3} {
+		piece := createTestPiece(num, 10, contents[num])
+		piece.release = budget.acquire(10)
+		cw.clintQueue.Put(piece)
+	}
+	cw.clintQueue.Put(last)
+	cw.Wait()
+
+	// the pieces are written in order after being buffered
+	digest, ok := cw.Digest()
+	c.Assert(ok, check.Equals, true)
+	c.Assert(digest, check.Equals, fmt.Sprintf("%x", md5.Sum([]byte("aaaaabbbbbcccccdd"))))
+	c.Assert(util.Md5Sum(cw.serviceFilePath), check.Equals, digest)
+	c.Assert(cw.Prefix(), check.Equals, int64(17))
+	c.Assert(budget.Used(), check.Equals, int64(0))
+}
+
+func (s *PowerClientTestSuite) TestClientWriter_WriteBufferReport(c *check.C) {
+	var newClientWriter = func(idx int, cfg *config.Config) *ClientWriter {
+		taskFileName := fmt.Sprintf("task.%d", idx)
+		cw, err := NewClientWriter(taskFileName, "cid",
+			helper.GetTaskFile(taskFileName, cfg.RV.DataDir),
+			helper.GetServiceFile(taskFileName, cfg.RV.DataDir),
+			util.NewQueue(0), cfg)
+		c.Assert(err, check.IsNil)
+		cw.queue = util.NewQueue(0)
+		go cw.Run()
+		return cw
+	}
+
+	// the buffered pieces are reported once they're flushed for no more
+	// pieces queued
+	cfg := s.createConfig(16)
+	cfg.WriteBufferSize = 100
+	cw := newClientWriter(16, cfg)
+	cw.clintQueue.Put(createTestPiece(0, 10, "aaaaa"))
+	cw.clintQueue.Put(createTestPiece(1, 10, "bbbbb"))
+	_, reported := cw.queue.PollTimeout(config.WriteBufferFlushInterval / 2)
+	c.Assert(reported, check.Equals, false)
+	for i := 0; i < 2; i++ {
+		_, reported = cw.queue.PollTimeout(2 * config.WriteBufferFlushInterval)
+		c.Assert(reported, check.Equals, true)
+	}
+	c.Assert(cw.Prefix(), check.Equals, int64(10))
+	cw.clintQueue.Put(last)
+	c.Assert(cw.Wait(), check.IsNil)
+
+	// the buffered pieces are flushed at once if they're the rest of the file
+	cfg = s.createConfig(17)
+	cfg.WriteBufferSize = 100
+	cfg.RV.FileLength = 10
+	cw = newClientWriter(17, cfg)
+	cw.clintQueue.Put(createTestPiece(1, 10, "bbbbb"))
+	cw.clintQueue.Put(createTestPiece(0, 10, "aaaaa"))
+	for i := 0; i < 2; i++ {
+		_, reported = cw.queue.PollTimeout(config.WriteBufferFlushInterval / 2)
+		c.Assert(reported, check.Equals, true)
+	}
+	cw.clintQueue.Put(last)
+	c.Assert(cw.Wait(), check.IsNil)
+}
+
+func (s *PowerClientTestSuite) TestClientWriter_Sequential(c *check.C) {
+	cfg := s.createConfig(14)
+	cfg.RV.Assembly = config.AssemblySequential
+	cfg.RV.RealTarget = path.Join(s.workHome, "target.14")
+	c.Assert(syscall.Mkfifo(cfg.RV.RealTarget, 0644), check.IsNil)
+	received := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadFile(cfg.RV.RealTarget)
+		received <- string(b)
+	}()
+
+	cw := s.createClientWriter(c, cfg, 14)
+	contents := []string{"aaaaa", "bbbbb", "cc"}
+	for _, num := range []int{2, 0, 1} {
+		cw.clintQueue.Put(createTestPiece(num, 10, contents[num]))
+	}
+	cw.clintQueue.Put(last)
+	cw.Wait()
+	c.Assert(<-received, check.Equals, "aaaaabbbbbcc")
+	c.Assert(cfg.BackSourceReason, check.Equals, 0)
+	c.Assert(util.Md5Sum(cw.serviceFilePath), check.Equals,
+		fmt.Sprintf("%x", md5.Sum([]byte("aaaaabbbbbcc"))))
+}
+
+func (s *PowerClientTestSuite) TestClientWriter_WriteAt(c *check.C) {
+	cfg := s.createConfig(15)
+	cfg.DigestOnWrite = true
+	cfg.WriteAt = true
+	// the registered length is longer than the written pieces
+	cfg.RV.FileLength = 30
+	// the target is linked to the client file
+	c.Assert(ioutil.WriteFile(cfg.RV.TempTarget, nil, 0644), check.IsNil)
+	c.Assert(os.MkdirAll(cfg.RV.DataDir, 0755), check.IsNil)
+	cw := s.createClientWriter(c, cfg, 15)
+	c.Assert(cw.writesAt, check.Equals, true)
+	info, err := os.Stat(cw.serviceFilePath)
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Size(), check.Equals, int64(30))
+
+	budget := newQuota(100)
+	pc := &PowerClient{cfg: cfg, writer: cw}
+	contents := []string{"aaaaa", "bbbbb", "cc"}
+	for _, num := range []int{2, 0, 1} {
+		piece := createTestPiece(num, 10, contents[num])
+		piece.release = budget.acquire(10)
+		recorded := pc.writeAt(piece)
+		c.Assert(recorded, check.NotNil)
+		c.Assert(recorded.Content.Len(), check.Equals, 0)
+		cw.clintQueue.Put(recorded)
+	}
+	// the budget is released once the pieces are written
+	c.Assert(budget.Used(), check.Equals, int64(0))
+	cw.clintQueue.Put(last)
+	c.Assert(cw.Wait(), check.IsNil)
+
+	md5sum := fmt.Sprintf("%x", md5.Sum([]byte("aaaaabbbbbcc")))
+	digest, ok := cw.Digest()
+	c.Assert(ok, check.Equals, true)
+	c.Assert(digest, check.Equals, md5sum)
+	c.Assert(util.Md5Sum(cw.serviceFilePath), check.Equals, md5sum)
+	c.Assert(cw.Prefix(), check.Equals, int64(12))
+}
+
+func (s *PowerClientTestSuite) TestPowerClient_LocalCDN(c *check.C) {
+	cdnFile := append(wrapPieceContent([]byte("aaaaa"), 10),
+		wrapPieceContent([]byte("bbbbb"), 10)...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != config.CDNPathPrefix+"cdn/cdnTaskID" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(cdnFile))
+	}))
+	defer server.Close()
+
+	var newPowerClient = func(taskID string) *PowerClient {
+		cfg := s.createConfig(0)
+		cfg.LocalCDN = server.URL
+		return &PowerClient{
+			taskID: taskID,
+			node:   "node",
+			pieceTask: &types.PullPieceTaskResponseContinueData{
+				Range:     "10-19",
+				PieceNum:  1,
+				PieceSize: 10,
+				PieceMd5:  pieceDigest(wrapPieceContent([]byte("bbbbb"), 10)),
+				PeerIP:    "127.0.0.2",
+				PeerPort:  1,
+			},
+			cfg:         cfg,
+			queue:       util.NewQueue(0),
+			clientQueue: util.NewQueue(0),
+			tiers:       NewTierBytes(),
+		}
+	}
+
+	pc := newPowerClient("cdnTaskID")
+	c.Assert(pc.Run(), check.IsNil)
+	item, _ := pc.queue.PollTimeout(0)
+	c.Assert(item.(*Piece).Result, check.Equals, config.ResultSemiSuc)
+	c.Assert(item.(*Piece).RawContent().String(), check.Equals, "bbbbb")
+	c.Assert(pc.tiers.Get(TierLocalCDN), check.Equals, int64(10))
+	c.Assert(pc.tiers.Get(TierPeer), check.Equals, int64(0))
+
+	// test: the local cdn misses the piece and falls back to the peer
+	pc = newPowerClient("missTaskID")
+	c.Assert(pc.Run(), check.IsNil)
+	item, _ = pc.queue.PollTimeout(0)
+	c.Assert(item.(*Piece).Result, check.Equals, config.ResultFail)
+	c.Assert(pc.tiers.Get(TierLocalCDN), check.Equals, int64(0))
+}
+
+func benchmarkClientWriter(b *testing.B, writeBufferSize int64) {
+	workHome, _ := ioutil.TempDir("/tmp", "dfget-BenchmarkClientWriter-")
+	defer os.RemoveAll(workHome)
+	cfg := helper.CreateConfig(nil, workHome)
+	cfg.RV.DataDir = path.Join(workHome, "data")
+	cfg.WriteBufferSize = writeBufferSize
+	const count, pieceSize = 1024, 4096
+	content := strings.Repeat("a", pieceSize-5)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cfg.RV.TempTarget = path.Join(workHome, fmt.Sprintf("temp.%d", i))
+		name := fmt.Sprintf("task.%d", i)
+		cw, _ := NewClientWriter(name, "cid", helper.GetTaskFile(name, cfg.RV.DataDir),
+			helper.GetServiceFile(name, cfg.RV.DataDir), util.NewQueue(0), cfg)
+		go cw.Run()
+		for num := 0; num < count; num++ {
+			cw.clintQueue.Put(createTestPiece(num, pieceSize, content))
+		}
+		cw.clintQueue.Put(last)
+		cw.Wait()
+	}
+	b.SetBytes(int64(count * pieceSize))
+}
+
+func BenchmarkClientWriter_PerPiece(b *testing.B) {
+	benchmarkClientWriter(b, 0)
+}
+
+func BenchmarkClientWriter_Buffered(b *testing.B) {
+	benchmarkClientWriter(b, 4*1024*1024)
+}
+
+// benchmarkPeerConnections fetches 200 pieces by 4 concurrent fetches from
+// one peer and reports the tcp connections the peer accepted per fetch.
+// The peer closes every connection after a piece if keepAlive isn't set.
+func benchmarkPeerConnections(b *testing.B, keepAlive, http2 bool) {
+	wrapped := wrapPieceContent([]byte("aaaaa"), 10)
+	var conns int64
+	peer := httptest.NewUnstartedServer(util.NewH2CHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(wrapped)
+	})))
+	peer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	peer.Config.SetKeepAlivesEnabled(keepAlive)
+	peer.Start()
+	defer peer.Close()
+	host, port, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	peerPort, _ := strconv.Atoi(port)
+	cfg := helper.CreateConfig(nil, "")
+	cfg.LocalLimit = 1024 * 1024 * 1024
+	cfg.PeerHTTP2 = http2
+
+	const concurrency, count = 4, 200
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < concurrency; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < count/concurrency; k++ {
+					pc := &PowerClient{
+						taskID: "taskID",
+						node:   "node",
+						pieceTask: &types.PullPieceTaskResponseContinueData{
+							Range:     "0-9",
+							PieceSize: 10,
+							PieceMd5:  pieceDigest(wrapped),
+							PeerIP:    host,
+							PeerPort:  peerPort,
+						},
+						cfg:         cfg,
+						queue:       util.NewQueue(0),
+						clientQueue: util.NewQueue(0),
+						tiers:       NewTierBytes(),
+					}
+					pc.Run()
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&conns))/float64(b.N), "conns/op")
+}
+
+func BenchmarkPeerConnections_Close(b *testing.B) {
+	benchmarkPeerConnections(b, false, false)
+}
+
+func BenchmarkPeerConnections_KeepAlive(b *testing.B) {
+	benchmarkPeerConnections(b, true, false)
+}
+
+func BenchmarkPeerConnections_HTTP2(b *testing.B) {
+	benchmarkPeerConnections(b, true, true)
+}
+
+// ----------------------------------------------------------------------------
+// helper functions
+
+func (s *PowerClientTestSuite) createConfig(idx int) *config.Config {
+	cfg := helper.CreateConfig(nil, s.workHome)
+	cfg.RV.DataDir = path.Join(s.workHome, "data")
+	cfg.RV.TempTarget = path.Join(s.workHome, fmt.Sprintf("temp.%d", idx))
+	return cfg
+}
+
+func (s *PowerClientTestSuite) createClientWriter(c *check.C, cfg *config.Config, idx int) *ClientWriter {
+	taskFileName := fmt.Sprintf("task.%d", idx)
+	cw, err := NewClientWriter(taskFileName, "cid",
+		helper.GetTaskFile(taskFileName, cfg.RV.DataDir),
+		helper.GetServiceFile(taskFileName, cfg.RV.DataDir),
+		util.NewQueue(0), cfg)
+	c.Assert(err, check.IsNil)
+	go cw.Run()
+	return cw
+}
+
+// createTestPiece creates a piece whose content is wrapped with a 4 bytes
+// header and a 1 byte tail as the pieces served by peers.
+func createTestPiece(pieceNum int, pieceSize int32, content string) *Piece {
+	buf := bytes.NewBufferString("head")
+	buf.WriteString(content)
+	buf.WriteByte('t')
+	piece := NewPieceContent("taskID", "node", "cid",
+		fmt.Sprintf("%d-%d", pieceNum, pieceNum), config.ResultSemiSuc,
+		config.TaskStatusRunning, buf)
+	piece.PieceNum = pieceNum
+	piece.PieceSize = pieceSize
+	return piece
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// The progress stream written into Cfg.ProgressSocket consists of the
+// frames, each of which is a big endian length prefix followed by the body:
+//
+//	length:     uint16, the length of the body
+//	version:    uint8, ProgressFrameVersion
+//	state:      uint8, the ProgressState
+//	completed:  uint64, the bytes downloaded
+//	total:      int64, the length of the file, -1 if it's unknown
+//	throughput: uint64, the average bytes per second since the download started
+//
+// The decoders should skip the bytes of the body beyond the known fields,
+// which are reserved for the later versions.
+const (
+	ProgressFrameVersion = 1
+
+	progressBodySize = 1 + 1 + 8 + 8 + 8
+
+	progressCloseTimeout = time.Second
+)
+
+// ProgressState is the state of the download in a progress frame.
+type ProgressState uint8
+
+// The states of the download.
+const (
+	ProgressRunning    ProgressState = 1
+	ProgressMigrating  ProgressState = 2
+	ProgressBackSource ProgressState = 3
+	ProgressSucceeded  ProgressState = 4
+	ProgressFailed     ProgressState = 5
+)
+
+// ProgressFrame is a frame of the progress stream.
+type ProgressFrame struct {
+	Version    uint8
+	State      ProgressState
+	Completed  uint64
+	Total      int64
+	Throughput uint64
+}
+
+// DecodeProgressFrame reads the next frame of the progress stream from r.
+func DecodeProgressFrame(r io.Reader) (*ProgressFrame, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint16(prefix[:]))
+	if length < progressBodySize {
+		return nil, fmt.Errorf("invalid progress frame length:%d", length)
+	}
+	var body [progressBodySize]byte
+	if _, err := io.ReadFull(r, body[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, length-progressBodySize); err != nil {
+		return nil, err
+	}
+	return &ProgressFrame{
+		Version:    body[0],
+		State:      ProgressState(body[1]),
+		Completed:  binary.BigEndian.Uint64(body[2:]),
+		Total:      int64(binary.BigEndian.Uint64(body[10:])),
+		Throughput: binary.BigEndian.Uint64(body[18:]),
+	}, nil
+}
+
+func encodeProgressFrame(f *ProgressFrame) []byte {
+	b := make([]byte, 2+progressBodySize)
+	binary.BigEndian.PutUint16(b, progressBodySize)
+	b[2], b[3] = f.Version, uint8(f.State)
+	binary.BigEndian.PutUint64(b[4:], f.Completed)
+	binary.BigEndian.PutUint64(b[12:], uint64(f.Total))
+	binary.BigEndian.PutUint64(b[20:], f.Throughput)
+	return b
+}
+
+// progressStream writes the progress frames into a unix socket by a
+// goroutine. The updates are coalesced into the latest one while the
+// consumer is slow, so the download is never blocked by it, but the final
+// state is always written. A nil progressStream writes nothing.
+type progressStream struct {
+	conn  net.Conn
+	start time.Time
+
+	mu      sync.Mutex
+	latest  *ProgressFrame
+	closed  bool
+	pending chan struct{}
+	done    chan struct{}
+}
+
+func newProgressStream(socket string) (*progressStream, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	s := &progressStream{
+		conn:    conn,
+		start:   time.Now(),
+		pending: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// update replaces the frame to be written.
+func (s *progressStream) update(state ProgressState, completed int64, total int64) {
+	if s == nil {
+		return
+	}
+	f := &ProgressFrame{
+		Version:   ProgressFrameVersion,
+		State:     state,
+		Completed: uint64(completed),
+		Total:     total,
+	}
+	if elapsed := time.Since(s.start); elapsed > 0 {
+		f.Throughput = uint64(float64(completed) / elapsed.Seconds())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.latest = f
+	select {
+	case s.pending <- struct{}{}:
+	default:
+	}
+}
+
+// close writes the last frame and closes the socket, it waits the consumer
+// at most progressCloseTimeout.
+func (s *progressStream) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.closed = true
+	close(s.pending)
+	s.mu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(progressCloseTimeout))
+	<-s.done
+	s.conn.Close()
+}
+
+func (s *progressStream) run() {
+	defer close(s.done)
+	for range s.pending {
+		s.mu.Lock()
+		f := s.latest
+		s.latest = nil
+		s.mu.Unlock()
+		if f == nil {
+			continue
+		}
+		if _, err := s.conn.Write(encodeProgressFrame(f)); err != nil {
+			// drain the updates until closed
+			for range s.pending {
+			}
+			return
+		}
+	}
+}
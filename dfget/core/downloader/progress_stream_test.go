@@ -0,0 +1,120 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+
+	"github.com/go-check/check"
+)
+
+type ProgressStreamTestSuite struct {
+	workHome string
+}
+
+func init() {
+	check.Suite(&ProgressStreamTestSuite{})
+}
+
+func (s *ProgressStreamTestSuite) SetUpSuite(c *check.C) {
+	s.workHome, _ = ioutil.TempDir("/tmp", "dfget-ProgressStreamTestSuite-")
+}
+
+func (s *ProgressStreamTestSuite) TearDownSuite(c *check.C) {
+	os.RemoveAll(s.workHome)
+}
+
+func (s *ProgressStreamTestSuite) TestDecodeProgressFrame(c *check.C) {
+	frame := &ProgressFrame{Version: ProgressFrameVersion, State: ProgressRunning,
+		Completed: 10, Total: -1, Throughput: 100}
+	var buf bytes.Buffer
+	buf.Write(encodeProgressFrame(frame))
+	// a frame of the later version with the extra fields
+	extended := encodeProgressFrame(&ProgressFrame{Version: 2, State: ProgressSucceeded,
+		Completed: 20, Total: 20})
+	binary.BigEndian.PutUint16(extended, progressBodySize+3)
+	buf.Write(append(extended, 1, 2, 3))
+
+	decoded, err := DecodeProgressFrame(&buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(decoded, check.DeepEquals, frame)
+	decoded, err = DecodeProgressFrame(&buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(decoded, check.DeepEquals, &ProgressFrame{Version: 2, State: ProgressSucceeded,
+		Completed: 20, Total: 20})
+	_, err = DecodeProgressFrame(&buf)
+	c.Assert(err, check.Equals, io.EOF)
+
+	_, err = DecodeProgressFrame(bytes.NewReader([]byte{0, 1, 0}))
+	c.Assert(err, check.ErrorMatches, "invalid progress frame length:1")
+}
+
+func (s *ProgressStreamTestSuite) TestProgressStream(c *check.C) {
+	socket := path.Join(s.workHome, "progress.sock")
+	ln, err := net.Listen("unix", socket)
+	c.Assert(err, check.IsNil)
+	defer ln.Close()
+	frames := make(chan []*ProgressFrame)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(frames)
+			return
+		}
+		defer conn.Close()
+		var received []*ProgressFrame
+		r := bufio.NewReader(conn)
+		for {
+			f, err := DecodeProgressFrame(r)
+			if err != nil {
+				break
+			}
+			received = append(received, f)
+		}
+		frames <- received
+	}()
+
+	var disabled *progressStream
+	disabled.update(ProgressRunning, 1, 1)
+	disabled.close()
+
+	ps, err := newProgressStream(socket)
+	c.Assert(err, check.IsNil)
+	for i := 1; i <= 1000; i++ {
+		ps.update(ProgressRunning, int64(i), 1000)
+	}
+	ps.update(ProgressSucceeded, 1000, 1000)
+	ps.close()
+	ps.update(ProgressFailed, 1000, 1000)
+
+	received := <-frames
+	c.Assert(len(received) > 0 && len(received) <= 1001, check.Equals, true)
+	last := received[len(received)-1]
+	c.Assert(last.State, check.Equals, ProgressSucceeded)
+	c.Assert(last.Completed, check.Equals, uint64(1000))
+	c.Assert(last.Total, check.Equals, int64(1000))
+	for i := 1; i < len(received); i++ {
+		c.Assert(received[i].Completed >= received[i-1].Completed, check.Equals, true)
+	}
+}
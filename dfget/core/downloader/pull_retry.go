@@ -0,0 +1,69 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+)
+
+// pullRetryDelay returns the delay before the retry of pulling the piece
+// tasks after the given retries: it's 0.6s~2s randomly if
+// Cfg.PullPieceMaxBackoff isn't set, or it doubles from
+// config.PullPieceBaseBackoff up to Cfg.PullPieceMaxBackoff, and the half of
+// it is random to spread the retries. The rng makes it deterministic, and
+// Cfg.WaitFunc overrides it if it's set.
+func pullRetryDelay(cfg *config.Config, rng *rand.Rand, retries int) time.Duration {
+	if cfg.WaitFunc != nil {
+		return cfg.WaitFunc(retries)
+	}
+	max := cfg.PullPieceMaxBackoff
+	if max <= 0 {
+		return time.Duration(rng.Intn(1400)+600) * time.Millisecond
+	}
+	return backoff(config.PullPieceBaseBackoff, max, rng, retries)
+}
+
+// backoff returns the delay doubling from base up to max after the given
+// retries, and the half of it is random to spread the retries.
+func backoff(base, max time.Duration, rng *rand.Rand, retries int) time.Duration {
+	delay := base
+	for i := 0; i < retries && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	half := int64(delay / 2)
+	return time.Duration(half + rng.Int63n(half+1))
+}
+
+// retryPull counts a retry of pulling the piece tasks, and returns the
+// error and sets the BackSourceReason once the retries exceed
+// Cfg.PullPieceMaxRetries. The count is reset once the piece tasks or the
+// finish are pulled.
+func (p2p *P2PDownloader) retryPull() error {
+	p2p.pullRetries++
+	if max := p2p.Cfg.PullPieceMaxRetries; max > 0 && p2p.pullRetries > max {
+		p2p.Cfg.BackSourceReason = config.BackSourceReasonPullRetries
+		return fmt.Errorf("pull piece task failed after %d retries", max)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+)
+
+// quota limits the amount of a resource used concurrently, such as the bytes
+// of the piece contents buffered in memory or the open file descriptors.
+// It's safe for concurrent use, and a nil quota limits nothing.
+type quota struct {
+	limit int64
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	used int64
+	peak int64
+}
+
+// newQuota creates a quota, it returns nil if the limit is not positive.
+func newQuota(limit int64) *quota {
+	if limit <= 0 {
+		return nil
+	}
+	b := &quota{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks until n more can be used, and returns the function to
+// release them which can be called more than once. The n larger than the
+// limit is reduced to the limit to avoid blocking forever.
+func (b *quota) acquire(n int64) (release func()) {
+	if b == nil || n <= 0 {
+		return func() {}
+	}
+	if n > b.limit {
+		n = b.limit
+	}
+	b.mu.Lock()
+	for b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+	if b.used > b.peak {
+		b.peak = b.used
+	}
+	b.mu.Unlock()
+	return b.releaser(n)
+}
+
+// acquireAll blocks until the sum of the sizes can be used at once, and
+// returns the function releasing each of them, so that a group of them is
+// never held partially while waiting for the rest. The sum larger than the
+// limit is reduced to the limit like acquire, from the last sizes.
+func (b *quota) acquireAll(sizes []int64) (releases []func()) {
+	releases = make([]func(), len(sizes))
+	if b == nil {
+		for i := range releases {
+			releases[i] = func() {}
+		}
+		return releases
+	}
+	var total int64
+	for _, n := range sizes {
+		if n > 0 {
+			total += n
+		}
+	}
+	b.acquire(total)
+	left := total
+	if left > b.limit {
+		left = b.limit
+	}
+	for i, n := range sizes {
+		if n < 0 {
+			n = 0
+		}
+		if n > left {
+			n = left
+		}
+		left -= n
+		releases[i] = b.releaser(n)
+	}
+	return releases
+}
+
+// releaser returns the function releasing n used, which can be called more
+// than once.
+func (b *quota) releaser(n int64) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if n <= 0 {
+				return
+			}
+			b.mu.Lock()
+			b.used -= n
+			b.mu.Unlock()
+			b.cond.Broadcast()
+		})
+	}
+}
+
+// fits returns whether n more can be used without blocking.
+func (b *quota) fits(n int64) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used+n <= b.limit
+}
+
+// Used returns the amount used currently.
+func (b *quota) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// nearLimit returns whether more than 80% of the limit is used.
+func (b *quota) nearLimit() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used*5 >= b.limit*4
+}
+
+// Peak returns the maximum amount used at the same time.
+func (b *quota) Peak() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.peak
+}
+
+// openFilesLimit returns the limit of the file descriptors used by a
+// download, it's a fraction of the soft limit of open files if
+// Cfg.MaxOpenFiles isn't set, and 0 means no limit.
+func openFilesLimit(cfg *config.Config) int {
+	limit := cfg.MaxOpenFiles
+	if limit < 0 {
+		return 0
+	}
+	if limit == 0 {
+		var rlimit syscall.Rlimit
+		if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+			return 0
+		}
+		limit = int(float64(rlimit.Cur) * config.OpenFilesRatio)
+	}
+	// leaves at least one for the sockets besides the service file and the
+	// target file
+	if limit < 3 {
+		limit = 3
+	}
+	return limit
+}
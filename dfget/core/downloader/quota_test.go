@@ -0,0 +1,146 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/go-check/check"
+)
+
+type QuotaTestSuite struct {
+}
+
+func init() {
+	check.Suite(&QuotaTestSuite{})
+}
+
+func (s *QuotaTestSuite) TestQuota(c *check.C) {
+	var b *quota
+	b.acquire(100)()
+	c.Assert(b.fits(100), check.Equals, true)
+	c.Assert(newQuota(0), check.IsNil)
+
+	b = newQuota(10)
+	r1 := b.acquire(6)
+	c.Assert(b.Used(), check.Equals, int64(6))
+	c.Assert(b.fits(4), check.Equals, true)
+	c.Assert(b.fits(5), check.Equals, false)
+
+	acquired := make(chan struct{})
+	go func() {
+		b.acquire(6)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		c.Fatal("acquire should block when the budget is exceeded")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	r1()
+	// test: releasing more than once takes no effect
+	r1()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		c.Fatal("acquire should return after releasing")
+	}
+	c.Assert(b.Used(), check.Equals, int64(6))
+	c.Assert(b.Peak(), check.Equals, int64(6))
+
+	// test: the bytes larger than the limit are reduced to the limit
+	b = newQuota(10)
+	b.acquire(20)()
+	c.Assert(b.Peak(), check.Equals, int64(10))
+	c.Assert(b.Used(), check.Equals, int64(0))
+
+	// test: nearLimit
+	release := b.acquire(7)
+	c.Assert(b.nearLimit(), check.Equals, false)
+	b.acquire(1)
+	c.Assert(b.nearLimit(), check.Equals, true)
+	release()
+	c.Assert(b.nearLimit(), check.Equals, false)
+}
+
+func (s *QuotaTestSuite) TestQuota_AcquireAll(c *check.C) {
+	var b *quota
+	for _, release := range b.acquireAll([]int64{1, 2}) {
+		release()
+	}
+
+	b = newQuota(10)
+	releases := b.acquireAll([]int64{4, 4})
+	c.Assert(b.Used(), check.Equals, int64(8))
+	releases[0]()
+	releases[0]()
+	c.Assert(b.Used(), check.Equals, int64(4))
+
+	// test: the group waits for the budget of all its sizes at once
+	acquired := make(chan []func())
+	go func() {
+		acquired <- b.acquireAll([]int64{4, 4})
+	}()
+	select {
+	case <-acquired:
+		c.Fatal("acquireAll should block until all the sizes fit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Assert(b.Used(), check.Equals, int64(4))
+	releases[1]()
+	select {
+	case releases = <-acquired:
+	case <-time.After(time.Second):
+		c.Fatal("acquireAll should return after releasing")
+	}
+	c.Assert(b.Used(), check.Equals, int64(8))
+	for _, release := range releases {
+		release()
+	}
+	c.Assert(b.Used(), check.Equals, int64(0))
+
+	// test: the sum larger than the limit is reduced to the limit
+	releases = b.acquireAll([]int64{6, 6, 6})
+	c.Assert(b.Used(), check.Equals, int64(10))
+	for _, release := range releases {
+		release()
+	}
+	c.Assert(b.Used(), check.Equals, int64(0))
+}
+
+func (s *QuotaTestSuite) TestOpenFilesLimit(c *check.C) {
+	var rlimit syscall.Rlimit
+	c.Assert(syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit), check.IsNil)
+
+	var cases = []struct {
+		maxOpenFiles int
+		expected     int
+	}{
+		{maxOpenFiles: 10, expected: 10},
+		{maxOpenFiles: 1, expected: 3},
+		{maxOpenFiles: -1, expected: 0},
+		{maxOpenFiles: 0, expected: int(float64(rlimit.Cur) * config.OpenFilesRatio)},
+	}
+	for _, v := range cases {
+		cfg := &config.Config{MaxOpenFiles: v.maxOpenFiles}
+		c.Assert(openFilesLimit(cfg), check.Equals, v.expected,
+			check.Commentf("maxOpenFiles:%d", v.maxOpenFiles))
+	}
+}
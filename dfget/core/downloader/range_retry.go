@@ -0,0 +1,126 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+)
+
+// RangeExhaustedError represents that a range has failed more than
+// Cfg.MaxRangeRetries times, and the download is given up.
+type RangeExhaustedError struct {
+	Range   string
+	Retries int
+}
+
+func (e *RangeExhaustedError) Error() string {
+	return fmt.Sprintf("range:%s failed %d times and exhausted the retries",
+		e.Range, e.Retries)
+}
+
+// countRangeRetry records a re-request of the range caused by a failure,
+// and marks the range exhausted once it exceeds Cfg.MaxRangeRetries.
+// It returns the number of the re-requests of the range.
+func (p2p *P2PDownloader) countRangeRetry(pieceRange string) int {
+	if p2p.Cfg.MaxRangeRetries <= 0 {
+		return 0
+	}
+	p2p.rangeRetries[pieceRange]++
+	if p2p.rangeRetries[pieceRange] > p2p.Cfg.MaxRangeRetries && p2p.exhausted == "" {
+		p2p.exhausted = pieceRange
+	}
+	return p2p.rangeRetries[pieceRange]
+}
+
+// handleExhaustedRange downloads the exhausted range from the source in the
+// background if Cfg.RangeBackSource is set and it hasn't been tried, or
+// returns a RangeExhaustedError to fail the download.
+func (p2p *P2PDownloader) handleExhaustedRange() error {
+	pieceRange := p2p.exhausted
+	if pieceRange == "" {
+		return nil
+	}
+	p2p.exhausted = ""
+	if !p2p.Cfg.RangeBackSource || p2p.rangeBackSourced[pieceRange] {
+		return &RangeExhaustedError{Range: pieceRange, Retries: p2p.rangeRetries[pieceRange]}
+	}
+
+	p2p.Cfg.Log().Warnf("Range:%s failed %d times and will download it from source",
+		pieceRange, p2p.rangeRetries[pieceRange])
+	p2p.rangeBackSourced[pieceRange] = true
+	p2p.setPiece(pieceRange, false)
+	go p2p.downloadRangeFromSource(p2p.taskID, p2p.node, pieceRange, p2p.pieceSizeHistory[1])
+	return nil
+}
+
+// downloadRangeFromSource downloads the content of the range from the source
+// and puts it into the queues as if it was downloaded from a peer.
+func (p2p *P2PDownloader) downloadRangeFromSource(taskID, node, pieceRange string, pieceSize int32) {
+	start, _, _ := parsePieceRange(pieceRange)
+	content, err := fetchSourceRange(p2p.Cfg, pieceRange, pieceSize)
+	if err != nil {
+		p2p.Cfg.Log().Errorf("download range:%s from source error:%v", pieceRange, err)
+		p2p.queue.Put(NewPiece(taskID, node, "", pieceRange, config.ResultFail,
+			config.TaskStatusRunning))
+		return
+	}
+	p2p.tiers.Add(TierOrigin, int64(len(content)))
+	piece := NewPieceContent(taskID, node, "", pieceRange, config.ResultSemiSuc,
+		config.TaskStatusRunning, bytes.NewBuffer(wrapPieceContent(content, pieceSize)))
+	piece.PieceSize = pieceSize
+	piece.PieceNum = int(start / int64(pieceSize))
+	p2p.clientQueue.Put(piece)
+	if !buffersPieces(p2p.Cfg) {
+		p2p.queue.Put(piece)
+	}
+}
+
+// fetchSourceRange downloads the raw content of the piece range from the
+// source by a range request.
+func fetchSourceRange(cfg *config.Config, pieceRange string, pieceSize int32) ([]byte, error) {
+	start, end, ok := parsePieceRange(pieceRange)
+	length := end - start + 1 - pieceWrapSize
+	if !ok || pieceSize <= pieceWrapSize || length <= 0 {
+		return nil, fmt.Errorf("invalid range:%s pieceSize:%d", pieceRange, pieceSize)
+	}
+	if err := checkOriginTrusted(cfg); err != nil {
+		return nil, err
+	}
+	offset := start / int64(pieceSize) * int64(pieceSize-pieceWrapSize)
+
+	headers := sourceHeaders(cfg)
+	headers["Range"] = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	resp, err := httpGetWithClient(sourceHTTPClient(cfg), cfg.URL, headers)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("unexpected status code:%d", resp.StatusCode)
+	}
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(NewLimitReader(resp.Body, cfg.LocalLimit, false), content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/api"
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+)
+
+/* the types of the records */
+const (
+	RecordTypePull  = "pull"
+	RecordTypePiece = "piece"
+)
+
+// Record is one event of a download recorded by Cfg.RecordFile.
+// A RecordTypePull record contains a piece task pulled from the supernode,
+// and a RecordTypePiece record contains the content of a piece downloaded
+// by a PowerClient.
+type Record struct {
+	Type     string                       `json:"type"`
+	Node     string                       `json:"node,omitempty"`
+	Request  *types.PullPieceTaskRequest  `json:"request,omitempty"`
+	Response *types.PullPieceTaskResponse `json:"response,omitempty"`
+	Error    string                       `json:"error,omitempty"`
+	Range    string                       `json:"range,omitempty"`
+	Content  []byte                       `json:"content,omitempty"`
+}
+
+// recorder writes the records into a file in json lines format.
+// It's safe for concurrent use, and a nil recorder records nothing.
+type recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newRecorder(path string) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{file: f, encoder: json.NewEncoder(f)}, nil
+}
+
+func (r *recorder) record(rec *Record) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.encoder != nil {
+		r.encoder.Encode(rec)
+	}
+}
+
+func (r *recorder) recordPiece(pieceRange string, content []byte) {
+	if r == nil {
+		return
+	}
+	r.record(&Record{Type: RecordTypePiece, Range: pieceRange, Content: content})
+}
+
+func (r *recorder) close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.encoder = nil
+	return r.file.Close()
+}
+
+// recordingAPI records the piece tasks pulled by the wrapped SupernodeAPI.
+type recordingAPI struct {
+	api.SupernodeAPI
+	rec *recorder
+}
+
+// PullPieceTask implements SupernodeAPI#PullPieceTask.
+func (r *recordingAPI) PullPieceTask(ip string, req *types.PullPieceTaskRequest) (
+	*types.PullPieceTaskResponse, error) {
+	resp, err := r.SupernodeAPI.PullPieceTask(ip, req)
+	rec := &Record{Type: RecordTypePull, Node: ip, Request: req, Response: resp}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	r.rec.record(rec)
+	return resp, err
+}
+
+// LoadRecords reads the records from the file written by Cfg.RecordFile.
+func LoadRecords(path string) ([]*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*Record
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for {
+		rec := new(Record)
+		if err := decoder.Decode(rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// Replayer replays a recorded download offline. It implements SupernodeAPI
+// which returns the recorded piece tasks in order, and http.Handler which
+// serves the recorded piece contents as the peers. The peers in the replayed
+// piece tasks are replaced by PeerAddr, where the Replayer should be served.
+type Replayer struct {
+	// PeerAddr is the address 'ip:port' the Replayer is served at.
+	PeerAddr string
+
+	mu     sync.Mutex
+	pulls  []*Record
+	pieces map[string][]byte
+}
+
+// NewReplayer creates a Replayer from the records.
+func NewReplayer(records []*Record) *Replayer {
+	r := &Replayer{pieces: make(map[string][]byte)}
+	for _, rec := range records {
+		switch rec.Type {
+		case RecordTypePull:
+			r.pulls = append(r.pulls, rec)
+		case RecordTypePiece:
+			r.pieces[rec.Range] = rec.Content
+		}
+	}
+	return r
+}
+
+// Register implements SupernodeAPI#Register, the registrations aren't
+// recorded.
+func (r *Replayer) Register(ip string, req *types.RegisterRequest) (*types.RegisterResponse, error) {
+	return nil, fmt.Errorf("register to %s is not recorded", ip)
+}
+
+// PullPieceTask implements SupernodeAPI#PullPieceTask, it returns the next
+// recorded piece task regardless of the request.
+func (r *Replayer) PullPieceTask(ip string, req *types.PullPieceTaskRequest) (
+	*types.PullPieceTaskResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pulls) == 0 {
+		return nil, fmt.Errorf("no more recorded piece tasks")
+	}
+	rec := r.pulls[0]
+	r.pulls = r.pulls[1:]
+	if rec.Error != "" {
+		return nil, fmt.Errorf("%s", rec.Error)
+	}
+	if rec.Response == nil {
+		return nil, nil
+	}
+
+	resp := &types.PullPieceTaskResponse{
+		BaseResponse: rec.Response.BaseResponse,
+		Data:         rec.Response.Data,
+	}
+	if data := resp.ContinueData(); data != nil && r.PeerAddr != "" {
+		host, port, err := net.SplitHostPort(r.PeerAddr)
+		if err != nil {
+			return nil, err
+		}
+		peerPort, _ := strconv.Atoi(port)
+		for _, d := range data {
+			d.PeerIP, d.PeerPort = host, peerPort
+		}
+		resp = &types.PullPieceTaskResponse{BaseResponse: rec.Response.BaseResponse}
+		resp.Data, _ = json.Marshal(data)
+	}
+	return resp, nil
+}
+
+// ReportPiece implements SupernodeAPI#ReportPiece.
+func (r *Replayer) ReportPiece(ip string, req *types.ReportPieceRequest) (*types.BaseResponse, error) {
+	return &types.BaseResponse{Code: config.Success}, nil
+}
+
+// ServiceDown implements SupernodeAPI#ServiceDown.
+func (r *Replayer) ServiceDown(ip string, taskID string, cid string) (*types.BaseResponse, error) {
+	return &types.BaseResponse{Code: config.Success}, nil
+}
+
+// ReportContribution implements SupernodeAPI#ReportContribution.
+func (r *Replayer) ReportContribution(ip string, req *types.ReportContributionRequest) (*types.BaseResponse, error) {
+	return &types.BaseResponse{Code: config.Success}, nil
+}
+
+// CheckHealth implements SupernodeAPI#CheckHealth.
+func (r *Replayer) CheckHealth(ip string) error {
+	return nil
+}
+
+// ServeHTTP serves the recorded piece content by the 'Range' header.
+func (r *Replayer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	content, ok := r.pieces[req.Header.Get("Range")]
+	r.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Write(content)
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+// requestRange returns the inclusive bounds of the Cfg.RequestRange in the
+// file, the end is clamped into the file if its length is known. It returns
+// false if the range isn't requested or is out of the file.
+func (p2p *P2PDownloader) requestRange() (start int64, end int64, ok bool) {
+	start, end, ok = config.ParseRequestRange(p2p.Cfg.RequestRange)
+	if length := p2p.Cfg.RV.FileLength; ok && length > 0 && end >= length {
+		end = length - 1
+	}
+	return start, end, ok && start <= end
+}
+
+// rangeOverlap returns the bytes of the content of the piece pieceRange
+// within the Cfg.RequestRange.
+func (p2p *P2PDownloader) rangeOverlap(pieceRange string, pieceSize int32) int64 {
+	start, end, ok := p2p.requestRange()
+	if !ok {
+		return 0
+	}
+	offset, n, ok := pieceContent(pieceRange, pieceSize)
+	if !ok {
+		return 0
+	}
+	if offset > start {
+		start = offset
+	}
+	if offset+n-1 < end {
+		end = offset + n - 1
+	}
+	if end < start {
+		return 0
+	}
+	return end - start + 1
+}
+
+// rangeCovered returns whether all the bytes of the Cfg.RequestRange are
+// downloaded, and then the download finishes without the other pieces.
+func (p2p *P2PDownloader) rangeCovered() bool {
+	start, end, ok := p2p.requestRange()
+	return ok && p2p.rangeBytes >= end-start+1
+}
+
+// deliverRange writes the bytes of the Cfg.RequestRange in the service file
+// into the target whose offset 0 is the start of the range, or leaves it at
+// the client file if Cfg.NoMove is set. It's called after the ClientWriter
+// finishes.
+func (p2p *P2PDownloader) deliverRange() error {
+	start, end, ok := p2p.requestRange()
+	if !ok {
+		return fmt.Errorf("range:%s is out of the file", p2p.Cfg.RequestRange)
+	}
+	src, err := os.Open(p2p.serviceFilePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// the file may be a link of the service file, it's recreated rather
+	// than truncated.
+	dst := p2p.Cfg.RV.TempTarget
+	if p2p.Cfg.NoMove {
+		dst = p2p.clientFilePath
+	}
+	os.Remove(dst)
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.NewSectionReader(src, start, end-start+1))
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil && n != end-start+1 {
+		err = fmt.Errorf("range:%d-%d is truncated at %d bytes", start, end, n)
+	}
+	if err != nil {
+		util.DeleteFile(dst)
+		return err
+	}
+
+	if p2p.Cfg.NoMove {
+		p2p.Cfg.RV.ResultPath = dst
+	} else if err := moveFile(p2p.Cfg, dst, p2p.targetFile, ""); err != nil {
+		return err
+	} else if err := linkTargets(p2p.Cfg, p2p.targetFile); err != nil {
+		return err
+	}
+	p2p.Cfg.Log().Infof("Download range:%d-%d successfully from dragonfly, bytes by tier:%v",
+		start, end, p2p.tiers.Snapshot())
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"sort"
+)
+
+// segment is the content of [offset, offset+length) in the service file.
+type segment struct {
+	offset int64
+	length int64
+}
+
+// coverage is the sorted and disjoint segments of the service file.
+type coverage []segment
+
+// add merges the segment into the coverage.
+func (c coverage) add(offset, length int64) coverage {
+	if length <= 0 {
+		return c
+	}
+	c = append(c, segment{offset, length})
+	sort.Slice(c, func(i, j int) bool { return c[i].offset < c[j].offset })
+	merged := c[:1]
+	for _, s := range c[1:] {
+		last := &merged[len(merged)-1]
+		if s.offset > last.offset+last.length {
+			merged = append(merged, s)
+			continue
+		}
+		if end := s.offset + s.length; end > last.offset+last.length {
+			last.length = end - last.offset
+		}
+	}
+	return merged
+}
+
+// overlaps returns whether any byte of [offset, offset+length) is covered.
+func (c coverage) overlaps(offset, length int64) bool {
+	i := sort.Search(len(c), func(i int) bool { return c[i].offset+c[i].length > offset })
+	return i < len(c) && c[i].offset < offset+length
+}
+
+// contains returns whether [offset, offset+length) is covered entirely.
+func (c coverage) contains(offset, length int64) bool {
+	i := sort.Search(len(c), func(i int) bool { return c[i].offset+c[i].length > offset })
+	return i < len(c) && c[i].offset <= offset && offset+length <= c[i].offset+c[i].length
+}
+
+// reslice keeps the contents of the pieces of oldSize succeeded so far when
+// the piece size changes, so that the pieces of the new size covered by them
+// needn't be downloaded again. The pieces in processing are forgotten.
+func (p2p *P2PDownloader) reslice(oldSize int32) {
+	p2p.stateLock.Lock()
+	for r, v := range p2p.pieceSet {
+		if offset, n, ok := pieceContent(r, oldSize); v && ok {
+			p2p.kept = p2p.kept.add(offset, n)
+		}
+		delete(p2p.pieceSet, r)
+	}
+	p2p.stateLock.Unlock()
+	p2p.Cfg.Log().Infof("piece size changes from %d to %d, keep %d segments written",
+		oldSize, p2p.pieceSizeHistory[1], len(p2p.kept))
+}
+
+// claimKept marks the piece succeeded if its content is kept by reslice.
+func (p2p *P2PDownloader) claimKept(pieceRange string, pieceSize int32) bool {
+	offset, n, ok := pieceContent(pieceRange, pieceSize)
+	if !ok || !p2p.kept.contains(offset, n) {
+		return false
+	}
+	if start, end, ok := parsePieceRange(pieceRange); ok {
+		p2p.counted = p2p.counted.add(start, end-start+1)
+	}
+	p2p.succeed(pieceRange, n+5, n)
+	p2p.rangeBytes += p2p.rangeOverlap(pieceRange, pieceSize)
+	p2p.manifest.succeed(pieceRange, TierPeer)
+	return true
+}
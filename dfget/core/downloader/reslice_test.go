@@ -0,0 +1,67 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"github.com/go-check/check"
+)
+
+type ResliceTestSuite struct {
+}
+
+func init() {
+	check.Suite(&ResliceTestSuite{})
+}
+
+func (s *ResliceTestSuite) TestCoverage(c *check.C) {
+	var cov coverage
+	cov = cov.add(10, 5).add(0, 5).add(5, 3).add(20, 0).add(12, 6)
+	c.Assert(cov, check.DeepEquals, coverage{{0, 8}, {10, 8}})
+
+	var cases = []struct {
+		offset   int64
+		length   int64
+		contains bool
+	}{
+		{offset: 0, length: 8, contains: true},
+		{offset: 3, length: 2, contains: true},
+		{offset: 11, length: 7, contains: true},
+		{offset: 0, length: 9, contains: false},
+		{offset: 6, length: 6, contains: false},
+		{offset: 17, length: 2, contains: false},
+		{offset: 30, length: 1, contains: false},
+	}
+	for idx, v := range cases {
+		c.Assert(cov.contains(v.offset, v.length), check.Equals, v.contains, check.Commentf("case:%d", idx))
+	}
+	c.Assert(coverage(nil).contains(0, 1), check.Equals, false)
+
+	for idx, v := range []struct {
+		offset   int64
+		length   int64
+		overlaps bool
+	}{
+		{offset: 7, length: 1, overlaps: true},
+		{offset: 6, length: 6, overlaps: true},
+		{offset: 8, length: 2, overlaps: false},
+		{offset: 17, length: 2, overlaps: true},
+		{offset: 18, length: 2, overlaps: false},
+	} {
+		c.Assert(cov.overlaps(v.offset, v.length), check.Equals, v.overlaps, check.Commentf("case:%d", idx))
+	}
+	c.Assert(coverage(nil).overlaps(0, 1), check.Equals, false)
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+)
+
+// resumeState is stored in the sidecar file of the service file if
+// Cfg.Resume is set, it records the pieces written into the service file so
+// that the download interrupted by a restart of dfget can skip them.
+type resumeState struct {
+	URL       string   `json:"url"`
+	Target    string   `json:"target"`
+	TaskID    string   `json:"taskID"`
+	PieceSize int32    `json:"pieceSize"`
+	Ranges    []string `json:"ranges"`
+}
+
+// readResumeState reads the resume state from the sidecar file.
+func readResumeState(path string) (*resumeState, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := new(resumeState)
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// pieceContent returns the offset and the length of the content of the
+// piece pieceRange in the service file.
+func pieceContent(pieceRange string, pieceSize int32) (offset int64, length int64, ok bool) {
+	start, end, ok := parsePieceRange(pieceRange)
+	if !ok || pieceSize <= 5 || end-start+1 <= 5 {
+		return 0, 0, false
+	}
+	pieceNum := start / int64(pieceSize)
+	return pieceNum * (int64(pieceSize) - 5), end - start + 1 - 5, true
+}
+
+// covered returns whether all the pieces of the state are in the file.
+func (s *resumeState) covered(file string) bool {
+	info, err := os.Stat(file)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	for _, r := range s.Ranges {
+		offset, n, ok := pieceContent(r, s.PieceSize)
+		if !ok || offset+n > info.Size() {
+			return false
+		}
+	}
+	return true
+}
+
+// loadResume looks for the sidecar file left by an interrupted download of
+// the same url to the same target, and takes over its service file if the
+// pieces can be reused by the current task. The pieces recorded are marked
+// as succeeded then. The sidecar files of the target are removed since they
+// are stale anyway.
+func (p2p *P2PDownloader) loadResume() {
+	p2p.resumed, p2p.resumeSaved = nil, time.Time{}
+	if !p2p.Cfg.Resume {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(p2p.Cfg.RV.DataDir, "*"))
+	for _, f := range files {
+		if !helper.IsResumeFile(f) || f == helper.GetResumeFile(p2p.serviceFilePath) {
+			continue
+		}
+		s, err := readResumeState(f)
+		if err != nil || s.URL != p2p.Cfg.URL || s.Target != p2p.targetFile {
+			continue
+		}
+		os.Remove(f)
+		serviceFile := strings.TrimSuffix(f, filepath.Ext(f))
+		if p2p.resumed != nil || s.TaskID != p2p.taskID ||
+			s.PieceSize != p2p.pieceSizeHistory[1] || !s.covered(serviceFile) {
+			continue
+		}
+		if err := os.Rename(serviceFile, p2p.serviceFilePath); err != nil {
+			p2p.Cfg.Log().Warnf("resume from service file:%s error:%v", serviceFile, err)
+			continue
+		}
+		p2p.resumed = s
+	}
+	if p2p.resumed == nil {
+		return
+	}
+	for _, r := range p2p.resumed.Ranges {
+		if _, n, ok := pieceContent(r, p2p.resumed.PieceSize); ok {
+			if start, end, ok := parsePieceRange(r); ok {
+				p2p.counted = p2p.counted.add(start, end-start+1)
+			}
+			p2p.succeed(r, n+5, n)
+			p2p.rangeBytes += p2p.rangeOverlap(r, p2p.resumed.PieceSize)
+		}
+	}
+	p2p.Cfg.Log().Infof("resume %d pieces of task:%s, %d bytes",
+		len(p2p.resumed.Ranges), p2p.taskID, p2p.completed)
+}
+
+// saveResume records the pieces written by the ClientWriter into the
+// sidecar file of the service file, it's done at most once per
+// config.ResumeSaveInterval unless forced. The failure doesn't fail the
+// download.
+func (p2p *P2PDownloader) saveResume(force bool) {
+	if !p2p.Cfg.Resume || p2p.clientWriter == nil {
+		return
+	}
+	now := time.Now()
+	if !force && now.Sub(p2p.resumeSaved) < config.ResumeSaveInterval {
+		return
+	}
+	p2p.resumeSaved = now
+	pieceSize := p2p.pieceSizeHistory[1]
+	b, err := json.Marshal(&resumeState{
+		URL:       p2p.Cfg.URL,
+		Target:    p2p.targetFile,
+		TaskID:    p2p.taskID,
+		PieceSize: pieceSize,
+		Ranges:    p2p.clientWriter.Ranges(pieceSize),
+	})
+	path := helper.GetResumeFile(p2p.serviceFilePath)
+	if err == nil {
+		if err = ioutil.WriteFile(path+".tmp", b, 0644); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		p2p.Cfg.Log().Warnf("save resume file:%s error:%v", path, err)
+	}
+}
+
+// removeResume removes the sidecar file of the service file once the
+// download needn't be resumed.
+func (p2p *P2PDownloader) removeResume() {
+	if p2p.Cfg.Resume {
+		os.Remove(helper.GetResumeFile(p2p.serviceFilePath))
+	}
+}
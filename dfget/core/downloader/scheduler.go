@@ -0,0 +1,83 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+)
+
+// ScheduleState is the state of the download a PieceScheduler decides by.
+type ScheduleState struct {
+	// Latest is the latest piece result polled from the queue, which is
+	// reported to the supernode by the next pull.
+	Latest *Piece
+	// TimedOut indicates that no piece result is polled within
+	// Cfg.QueuePollTimeout, then the Latest is the one polled before.
+	TimedOut bool
+	// QueueLen is the number of the piece results left in the queue.
+	QueueLen int
+	// Running is the number of the ranges in processing.
+	Running int
+	// PieceSet maps the ranges in processing to false and the ones
+	// downloaded to true. It's a copy taken when asking the PieceScheduler.
+	PieceSet map[string]bool
+}
+
+// PieceScheduler decides when the P2PDownloader pulls the next piece tasks
+// from the supernode. It's asked after every poll of the piece results, and
+// the P2PDownloader polls the next result instead of pulling if it returns
+// false, so that the results are merged into one pull.
+type PieceScheduler interface {
+	Pull(state *ScheduleState) bool
+}
+
+// DefaultPieceScheduler pulls the next piece tasks once the piece results
+// queued are merged and at most MaxRunning ranges are in processing. It
+// pulls immediately if the poll times out or the latest result is final
+// rather than a piece downloaded.
+type DefaultPieceScheduler struct {
+	// MaxRunning is the ranges in processing allowed for pulling, it's
+	// config.DefaultSchedulerMaxRunning if it's 0.
+	MaxRunning int
+}
+
+// Pull implements PieceScheduler#Pull.
+func (s *DefaultPieceScheduler) Pull(state *ScheduleState) bool {
+	if state.TimedOut || state.Latest == nil {
+		return true
+	}
+	switch state.Latest.Result {
+	case config.ResultSuc, config.ResultFail, config.ResultInvalid:
+		return true
+	}
+	maxRunning := s.MaxRunning
+	if maxRunning <= 0 {
+		maxRunning = config.DefaultSchedulerMaxRunning
+	}
+	return state.QueueLen == 0 && state.Running <= maxRunning
+}
+
+// defaultScheduler is the PieceScheduler of the P2PDownloaders without one.
+var defaultScheduler PieceScheduler = &DefaultPieceScheduler{}
+
+// scheduler returns the PieceScheduler of the download.
+func (p2p *P2PDownloader) scheduler() PieceScheduler {
+	if p2p.Scheduler != nil {
+		return p2p.Scheduler
+	}
+	return defaultScheduler
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/regist"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+	"github.com/go-check/check"
+)
+
+type SchedulerTestSuite struct {
+}
+
+func init() {
+	check.Suite(&SchedulerTestSuite{})
+}
+
+func (s *SchedulerTestSuite) TestDefaultPieceScheduler(c *check.C) {
+	piece := func(result int) *Piece {
+		return NewPiece("task", "node", "cid", "0-9", result, config.TaskStatusRunning)
+	}
+	var cases = []struct {
+		maxRunning int
+		state      *ScheduleState
+		pull       bool
+	}{
+		{state: &ScheduleState{Latest: piece(config.ResultSemiSuc)}, pull: true},
+		{state: &ScheduleState{Latest: piece(config.ResultSemiSuc), QueueLen: 1}, pull: false},
+		{state: &ScheduleState{Latest: piece(config.ResultSemiSuc), Running: 2}, pull: true},
+		{state: &ScheduleState{Latest: piece(config.ResultSemiSuc), Running: 3}, pull: false},
+		{maxRunning: 3, state: &ScheduleState{Latest: piece(config.ResultSemiSuc), Running: 3}, pull: true},
+		// the final results and the poll timeouts aren't merged.
+		{state: &ScheduleState{Latest: piece(config.ResultFail), QueueLen: 1}, pull: true},
+		{state: &ScheduleState{Latest: piece(config.ResultSuc), Running: 3}, pull: true},
+		{state: &ScheduleState{Latest: piece(config.ResultInvalid), QueueLen: 1}, pull: true},
+		{state: &ScheduleState{Latest: piece(config.ResultSemiSuc), TimedOut: true, Running: 3}, pull: true},
+	}
+	for idx, v := range cases {
+		scheduler := &DefaultPieceScheduler{MaxRunning: v.maxRunning}
+		c.Assert(scheduler.Pull(v.state), check.Equals, v.pull, check.Commentf("case:%d", idx))
+	}
+}
+
+// sequentialScheduler pulls only if the range of the latest result is
+// expected, for testing the custom schedulers.
+type sequentialScheduler struct {
+	next   string
+	states []ScheduleState
+}
+
+func (s *sequentialScheduler) Pull(state *ScheduleState) bool {
+	s.states = append(s.states, *state)
+	return state.Latest.Range == s.next
+}
+
+func (s *SchedulerTestSuite) TestGetItem_Scheduler(c *check.C) {
+	cfg := helper.CreateConfig(nil, "/tmp")
+	cfg.QueuePollTimeout = 1
+	result := regist.NewRegisterResult("node", nil, cfg.URL, "task", 100, 10)
+	p2p := NewP2PDownloader(cfg, nil, &MockRegister{}, result).(*P2PDownloader)
+	scheduler := &sequentialScheduler{next: "0-9"}
+	p2p.Scheduler = scheduler
+	p2p.queue = util.NewQueue(0)
+	p2p.pieceSet = map[string]bool{"0-9": false, "10-19": false}
+
+	p2p.queue.Put(NewPiece("task", "node", "cid", "10-19", config.ResultSemiSuc, config.TaskStatusRunning))
+	goNext, item := p2p.getItem(nil)
+	c.Assert(goNext, check.Equals, false)
+	c.Assert(item.Range, check.Equals, "10-19")
+
+	p2p.queue.Put(NewPiece("task", "node", "cid", "0-9", config.ResultSemiSuc, config.TaskStatusRunning))
+	goNext, item = p2p.getItem(item)
+	c.Assert(goNext, check.Equals, true)
+	c.Assert(item.Range, check.Equals, "0-9")
+	c.Assert(scheduler.states, check.HasLen, 2)
+	c.Assert(scheduler.states[0].Running, check.Equals, 1)
+	c.Assert(scheduler.states[1].Running, check.Equals, 0)
+	c.Assert(scheduler.states[1].PieceSet, check.DeepEquals, map[string]bool{"0-9": true, "10-19": true})
+
+	// test: the schedulers get the copies of the pieceSet
+	c.Assert(scheduler.states[0].PieceSet, check.DeepEquals, map[string]bool{"0-9": false, "10-19": true})
+	delete(scheduler.states[1].PieceSet, "0-9")
+	c.Assert(p2p.pieceSet, check.HasLen, 2)
+}
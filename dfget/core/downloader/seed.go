@@ -0,0 +1,90 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+)
+
+// seed serves the existing target by Cfg.Seed instead of downloading it:
+// the target is checked against the registered task, linked as the service
+// file for the peer server, and all its pieces are reported to the
+// supernode so that it schedules the other peers to this one.
+func (p2p *P2PDownloader) seed() error {
+	src := p2p.targetFile
+	info, err := os.Stat(src)
+	if err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("seed file:%s isn't a regular file", src)
+	}
+	if length := p2p.RegisterResult.FileLength; length >= 0 && info.Size() != length {
+		return fmt.Errorf("seed file:%s has %d bytes but the task:%s has %d",
+			src, info.Size(), p2p.taskID, length)
+	}
+	if expect := p2p.expectedDigest(); expect != "" {
+		if realMd5 := fileDigest(src, expect); realMd5 != expect {
+			return &md5NotMatchError{real: realMd5, expect: expect}
+		}
+	}
+	if err := linkOrCopy(p2p.Cfg, src, p2p.serviceFilePath); err != nil {
+		return err
+	}
+
+	ranges := seedRanges(info.Size(), p2p.pieceSizeHistory[1])
+	for _, r := range ranges {
+		req := &types.ReportPieceRequest{
+			TaskID:     p2p.taskID,
+			Cid:        p2p.Cfg.RV.Cid,
+			DstCid:     p2p.Cfg.RV.Cid,
+			PieceRange: r,
+		}
+		resp, err := p2p.API.ReportPiece(p2p.node, req)
+		if err == nil && resp != nil && resp.Code != config.Success {
+			err = fmt.Errorf("result:%v", resp)
+		}
+		if err != nil {
+			return fmt.Errorf("report piece:%s of task:%s to node:%s error:%v",
+				r, p2p.taskID, p2p.node, err)
+		}
+	}
+	p2p.Cfg.RV.ResultPath = src
+	p2p.Cfg.Log().Infof("seed file:%s as task:%s with %d pieces to node:%s",
+		src, p2p.taskID, len(ranges), p2p.node)
+	return nil
+}
+
+// seedRanges returns the ranges of the pieces of pieceSize the file of the
+// length is split into, each of them is wrapped by the 5 bytes.
+func seedRanges(length int64, pieceSize int32) []string {
+	size := int64(pieceSize) - 5
+	if size <= 0 {
+		return nil
+	}
+	var ranges []string
+	for offset, num := int64(0), int64(0); offset < length; offset, num = offset+size, num+1 {
+		n := size
+		if offset+n > length {
+			n = length - offset
+		}
+		start := num * int64(pieceSize)
+		ranges = append(ranges, fmt.Sprintf("%d-%d", start, start+n+5-1))
+	}
+	return ranges
+}
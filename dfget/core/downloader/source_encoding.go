@@ -0,0 +1,63 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// acceptEncoding adds the 'Accept-Encoding' of the encodings supported by
+// decodeSourceBody to the headers sent to the origins, unless it's set by
+// the user.
+func acceptEncoding(headers map[string]string) map[string]string {
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	for k := range headers {
+		if http.CanonicalHeaderKey(k) == "Accept-Encoding" {
+			return headers
+		}
+	}
+	headers["Accept-Encoding"] = "zstd, gzip"
+	return headers
+}
+
+// decodeSourceBody returns the body of the response of the origin decoded
+// by its 'Content-Encoding'. The body is returned as-is if it's not encoded
+// or it's decoded by the http client already.
+func decodeSourceBody(resp *http.Response) (io.ReadCloser, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "zstd":
+		d, err := zstd.NewReader(resp.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding:%s from the source", encoding)
+	}
+}
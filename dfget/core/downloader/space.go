@@ -0,0 +1,56 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+)
+
+// checkSpace fails with ErrInsufficientSpace if the data dir has fewer free
+// bytes than the registered file, or the range of it to download, takes
+// times Cfg.DiskSpaceHeadroom. The bytes resumed are already in the data dir,
+// and the check is skipped if the file length is unknown, the data dir can't
+// be inspected, or the existing file is seeded by Cfg.Seed.
+func (p2p *P2PDownloader) checkSpace(freeBytes func(string) (uint64, error)) error {
+	length := p2p.RegisterResult.FileLength
+	if start, end, ok := p2p.requestRange(); ok {
+		length = end - start + 1
+	}
+	if length -= p2p.completed; length <= 0 || p2p.Cfg.Seed {
+		return nil
+	}
+	headroom := p2p.Cfg.DiskSpaceHeadroom
+	if headroom <= 0 {
+		headroom = config.DefaultDiskSpaceHeadroom
+	}
+	needed := uint64(float64(length) * headroom)
+	dir := p2p.Cfg.RV.DataDir
+	free, err := freeBytes(dir)
+	if err != nil {
+		p2p.Cfg.Log().Infof("skip checking the free space of dir:%s error:%v", dir, err)
+		return nil
+	}
+	if free < needed {
+		p2p.Cfg.BackSourceReason = config.BackSourceReasonNoSpace
+		return newDownloadError(config.BackSourceReasonNoSpace, fmt.Errorf(
+			"no enough free space in dir:%s, free:%d needed:%d(%d bytes x %.2f)",
+			dir, free, needed, length, headroom))
+	}
+	return nil
+}
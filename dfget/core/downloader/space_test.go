@@ -0,0 +1,73 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/regist"
+	"github.com/go-check/check"
+)
+
+type SpaceTestSuite struct {
+}
+
+func init() {
+	check.Suite(&SpaceTestSuite{})
+}
+
+func (s *SpaceTestSuite) TestCheckSpace(c *check.C) {
+	var cases = []struct {
+		headroom  float64
+		reqRange  string
+		completed int64
+		free      uint64
+		err       error
+		ok        bool
+	}{
+		{free: 100, ok: true},
+		{free: 99, ok: false},
+		{headroom: 2, free: 199, ok: false},
+		{headroom: 2, free: 200, ok: true},
+		{reqRange: "0-9", free: 10, ok: true},
+		{completed: 60, free: 40, ok: true},
+		{err: fmt.Errorf("not supported"), ok: true},
+	}
+	for idx, v := range cases {
+		cfg := helper.CreateConfig(nil, "/tmp")
+		cfg.RV.DataDir = "/data"
+		cfg.DiskSpaceHeadroom = v.headroom
+		cfg.RequestRange = v.reqRange
+		p2p := &P2PDownloader{
+			Cfg:            cfg,
+			RegisterResult: &regist.RegisterResult{FileLength: 100},
+			completed:      v.completed,
+		}
+		err := p2p.checkSpace(func(dir string) (uint64, error) {
+			c.Assert(dir, check.Equals, "/data")
+			return v.free, v.err
+		})
+		c.Assert(err == nil, check.Equals, v.ok, check.Commentf("case:%d", idx))
+		if !v.ok {
+			e, _ := err.(*DownloadError)
+			c.Assert(e.Kind, check.Equals, ErrInsufficientSpace)
+			c.Assert(cfg.BackSourceReason, check.Equals, config.BackSourceReasonNoSpace)
+		}
+	}
+}
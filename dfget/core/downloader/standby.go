@@ -0,0 +1,71 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"github.com/dragonflyoss/Dragonfly/dfget/core/regist"
+	"github.com/dragonflyoss/Dragonfly/dfget/errors"
+)
+
+// standby is the registration to the next supernode made in the background
+// while downloading from the current one, so that the task is warm on it
+// and the migration switches to it without registering. A nil standby has
+// nothing registered.
+type standby struct {
+	done   chan struct{}
+	result *regist.RegisterResult
+	err    *errors.DFGetError
+}
+
+// registerStandby starts registering to the next supernode of the remainder
+// ones by the register.
+func registerStandby(register regist.SupernodeRegister, peerPort int) *standby {
+	s := &standby{done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		s.result, s.err = register.Register(peerPort)
+	}()
+	return s
+}
+
+// take waits for the registration to finish and returns its result.
+func (s *standby) take() (*regist.RegisterResult, *errors.DFGetError) {
+	if s == nil {
+		return nil, nil
+	}
+	<-s.done
+	return s.result, s.err
+}
+
+// releaseStandby releases the standby which is no longer needed without
+// waiting for its registration: it's unregistered from its supernode in the
+// background once the registration succeeds.
+func (p2p *P2PDownloader) releaseStandby() {
+	s := p2p.standby
+	p2p.standby = nil
+	if s == nil {
+		return
+	}
+	go func() {
+		res, _ := s.take()
+		if res == nil {
+			return
+		}
+		_, err := p2p.API.ServiceDown(res.Node, res.TaskID, p2p.Cfg.RV.Cid)
+		p2p.Cfg.Log().Infof("unregister from the standby node:%s, error:%v", res.Node, err)
+	}()
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+// Stats is the live state of the download reported by Stats.
+type Stats struct {
+	// Node and TaskID are the current supernode and task, they change when
+	// the download migrates to another supernode.
+	Node   string
+	TaskID string
+
+	// PiecesDone and PiecesRunning are the pieces of the current piece size
+	// succeeded and in processing.
+	PiecesDone    int
+	PiecesRunning int
+
+	// Bytes is the bytes of the succeeded pieces including the header and
+	// the tail wrapping each piece, and Completed is the bytes of their
+	// contents in the file.
+	Bytes     int64
+	Completed int64
+
+	// BackSource indicates that the download falls back to the source.
+	BackSource bool
+}
+
+// Stats returns the live state of the download, it's safe to be called
+// while the download is running.
+func (p2p *P2PDownloader) Stats() Stats {
+	p2p.stateLock.RLock()
+	defer p2p.stateLock.RUnlock()
+	s := Stats{
+		Node:       p2p.node,
+		TaskID:     p2p.taskID,
+		Bytes:      p2p.total,
+		Completed:  p2p.completed,
+		BackSource: p2p.backSourced,
+	}
+	for _, done := range p2p.pieceSet {
+		if done {
+			s.PiecesDone++
+		} else {
+			s.PiecesRunning++
+		}
+	}
+	return s
+}
+
+// setPiece marks the range succeeded if done is true, or in processing.
+func (p2p *P2PDownloader) setPiece(pieceRange string, done bool) {
+	p2p.stateLock.Lock()
+	p2p.pieceSet[pieceRange] = done
+	p2p.stateLock.Unlock()
+}
+
+// deletePiece forgets the range, which is requested again by the next pull.
+func (p2p *P2PDownloader) deletePiece(pieceRange string) {
+	p2p.stateLock.Lock()
+	delete(p2p.pieceSet, pieceRange)
+	p2p.stateLock.Unlock()
+}
+
+// succeed marks the range succeeded and accounts the bytes of the piece,
+// which are total with the wrapping bytes and completed without them.
+func (p2p *P2PDownloader) succeed(pieceRange string, total, completed int64) {
+	p2p.stateLock.Lock()
+	p2p.pieceSet[pieceRange] = true
+	p2p.total += total
+	p2p.completed += completed
+	p2p.stateLock.Unlock()
+}
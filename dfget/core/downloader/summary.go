@@ -0,0 +1,110 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+// Summary is the machine-readable summary of a download, which is written
+// into Cfg.SummaryFile as JSON once the download finishes.
+type Summary struct {
+	TaskID  string `json:"taskId,omitempty"`
+	Node    string `json:"node,omitempty"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	Output  string `json:"output,omitempty"`
+	// FileLength is -1 if the length of the file is unknown.
+	FileLength int64 `json:"fileLength"`
+	// Digest is the digest of the output in the algorithm of Cfg.Digest or
+	// md5, formatted by util.FormatDigest. It's empty if the download fails.
+	Digest string `json:"digest,omitempty"`
+
+	P2PBytes        int64 `json:"p2pBytes"`
+	LocalCDNBytes   int64 `json:"localCdnBytes,omitempty"`
+	BackSourceBytes int64 `json:"backSourceBytes"`
+
+	BackSourceReason int     `json:"backSourceReason,omitempty"`
+	Migrations       int     `json:"migrations"`
+	ElapsedSeconds   float64 `json:"elapsedSeconds"`
+}
+
+// summarizer is implemented by the Downloaders which write the summary of
+// the download into Cfg.SummaryFile.
+type summarizer interface {
+	writeSummary(err error)
+}
+
+func (p2p *P2PDownloader) writeSummary(err error) {
+	tiers := p2p.tiers.Snapshot()
+	emitSummary(p2p.Cfg, &Summary{
+		TaskID:          p2p.taskID,
+		Node:            p2p.node,
+		Digest:          p2p.digest,
+		P2PBytes:        tiers[TierPeer],
+		LocalCDNBytes:   tiers[TierLocalCDN],
+		BackSourceBytes: tiers[TierOrigin],
+		Migrations:      p2p.migrations,
+	}, err)
+}
+
+func (bd *BackDownloader) writeSummary(err error) {
+	emitSummary(bd.Cfg, &Summary{
+		TaskID:          bd.TaskID,
+		Node:            bd.Node,
+		Digest:          bd.digest,
+		BackSourceBytes: bd.Total,
+	}, err)
+}
+
+// emitSummary completes the summary s of the download finished by err and
+// writes it into Cfg.SummaryFile, '-' means the stdout. The digest of the
+// output is computed if it isn't known yet. The failure doesn't fail the
+// download.
+func emitSummary(cfg *config.Config, s *Summary, err error) {
+	if util.IsEmptyStr(cfg.SummaryFile) {
+		return
+	}
+	s.Success = err == nil
+	if err != nil {
+		s.Error, s.Digest = err.Error(), ""
+	}
+	s.Output = cfg.RV.ResultPath
+	s.FileLength = cfg.RV.FileLength
+	s.BackSourceReason = cfg.BackSourceReason
+	if !cfg.StartTime.IsZero() {
+		s.ElapsedSeconds = time.Since(cfg.StartTime).Seconds()
+	}
+	if s.Success && s.Digest == "" && cfg.OutputWriter == nil {
+		s.Digest = util.DigestSum(s.Output, digestAlgorithm(cfg))
+	}
+
+	data, e := json.Marshal(s)
+	if e == nil && cfg.SummaryFile == "-" {
+		util.Printer.Println(string(data))
+	} else if e == nil {
+		e = ioutil.WriteFile(cfg.SummaryFile, append(data, '\n'), 0644)
+	}
+	if e != nil {
+		cfg.Log().Warnf("write summary into %s error:%v", cfg.SummaryFile, e)
+	}
+}
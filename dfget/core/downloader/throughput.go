@@ -0,0 +1,137 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"sync"
+	"time"
+)
+
+// ThroughputSample is the throughput of the download during an interval.
+type ThroughputSample struct {
+	// Offset is the start of the interval since the download started.
+	Offset time.Duration `json:"offset"`
+	// Duration is the length of the interval, it's shorter than the sampling
+	// interval for the last sample.
+	Duration time.Duration `json:"duration"`
+	// Bytes is the number of bytes downloaded during the interval.
+	Bytes int64 `json:"bytes"`
+}
+
+// BytesPerSecond returns the throughput of the sample.
+func (s ThroughputSample) BytesPerSecond() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Duration.Seconds()
+}
+
+// throughputSampler collects the bytes downloaded in every interval into
+// the ThroughputSamples, the intervals without any bytes are sampled as 0.
+// It's safe for concurrent use, and a nil throughputSampler samples nothing.
+type throughputSampler struct {
+	interval time.Duration
+	start    time.Time
+	onSample func(ThroughputSample)
+
+	mu          sync.Mutex
+	bucketStart time.Time
+	bucket      int64
+	samples     []ThroughputSample
+	finished    bool
+}
+
+// newThroughputSampler creates a throughputSampler, it returns nil if the
+// interval is not positive. The onSample is called with every sample if
+// it's not nil.
+func newThroughputSampler(interval time.Duration, start time.Time,
+	onSample func(ThroughputSample)) *throughputSampler {
+	if interval <= 0 {
+		return nil
+	}
+	return &throughputSampler{
+		interval:    interval,
+		start:       start,
+		onSample:    onSample,
+		bucketStart: start,
+	}
+}
+
+// add records n bytes downloaded at now.
+func (t *throughputSampler) add(n int64, now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return
+	}
+	t.flush(now)
+	t.bucket += n
+}
+
+// finish samples the last partial interval, and no more bytes will be
+// recorded after that.
+func (t *throughputSampler) finish(now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return
+	}
+	t.flush(now)
+	if d := now.Sub(t.bucketStart); d > 0 {
+		t.sample(d)
+	}
+	t.finished = true
+}
+
+// flush samples all the intervals ended before now.
+func (t *throughputSampler) flush(now time.Time) {
+	for !now.Before(t.bucketStart.Add(t.interval)) {
+		t.sample(t.interval)
+	}
+}
+
+func (t *throughputSampler) sample(d time.Duration) {
+	s := ThroughputSample{
+		Offset:   t.bucketStart.Sub(t.start),
+		Duration: d,
+		Bytes:    t.bucket,
+	}
+	t.samples = append(t.samples, s)
+	t.bucketStart = t.bucketStart.Add(d)
+	t.bucket = 0
+	if t.onSample != nil {
+		t.onSample(s)
+	}
+}
+
+// Samples returns a copy of the collected samples.
+func (t *throughputSampler) Samples() []ThroughputSample {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := make([]ThroughputSample, len(t.samples))
+	copy(res, t.samples)
+	return res
+}
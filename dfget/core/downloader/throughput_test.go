@@ -0,0 +1,60 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"time"
+
+	"github.com/go-check/check"
+)
+
+type ThroughputTestSuite struct {
+}
+
+func init() {
+	check.Suite(&ThroughputTestSuite{})
+}
+
+func (s *ThroughputTestSuite) TestThroughputSampler(c *check.C) {
+	var nilSampler *throughputSampler
+	nilSampler.add(1, time.Now())
+	nilSampler.finish(time.Now())
+	c.Assert(nilSampler.Samples(), check.IsNil)
+	c.Assert(newThroughputSampler(0, time.Now(), nil), check.IsNil)
+
+	start := time.Now()
+	var called []ThroughputSample
+	t := newThroughputSampler(time.Second, start, func(s ThroughputSample) {
+		called = append(called, s)
+	})
+	t.add(100, start)
+	t.add(200, start.Add(500*time.Millisecond))
+	// nothing is downloaded during the second interval
+	t.add(50, start.Add(2200*time.Millisecond))
+	t.finish(start.Add(2500 * time.Millisecond))
+	t.add(1000, start.Add(2600*time.Millisecond))
+
+	expected := []ThroughputSample{
+		{Offset: 0, Duration: time.Second, Bytes: 300},
+		{Offset: time.Second, Duration: time.Second, Bytes: 0},
+		{Offset: 2 * time.Second, Duration: 500 * time.Millisecond, Bytes: 50},
+	}
+	c.Assert(t.Samples(), check.DeepEquals, expected)
+	c.Assert(called, check.DeepEquals, expected)
+	c.Assert(expected[0].BytesPerSecond(), check.Equals, float64(300))
+	c.Assert(expected[2].BytesPerSecond(), check.Equals, float64(100))
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"sync"
+)
+
+/* the tiers where the contents are downloaded from */
+const (
+	// TierLocalCDN represents the local CDN specified by LocalCDN.
+	TierLocalCDN = "local-cdn"
+	// TierPeer represents the peers and supernodes in the P2P network.
+	TierPeer = "peer"
+	// TierOrigin represents the source station.
+	TierOrigin = "origin"
+)
+
+// TierBytes counts the bytes downloaded from each tier.
+// It's safe for concurrent use, and a nil TierBytes counts nothing.
+type TierBytes struct {
+	mu    sync.Mutex
+	bytes map[string]int64
+}
+
+// NewTierBytes creates a TierBytes instance.
+func NewTierBytes() *TierBytes {
+	return &TierBytes{bytes: make(map[string]int64)}
+}
+
+// Add adds n bytes downloaded from the tier.
+func (t *TierBytes) Add(tier string, n int64) {
+	if t == nil || n <= 0 {
+		return
+	}
+	t.mu.Lock()
+	t.bytes[tier] += n
+	t.mu.Unlock()
+}
+
+// Get returns the bytes downloaded from the tier.
+func (t *TierBytes) Get(tier string) int64 {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.bytes[tier]
+}
+
+// Total returns the bytes downloaded from all the tiers.
+func (t *TierBytes) Total() int64 {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var total int64
+	for _, v := range t.bytes {
+		total += v
+	}
+	return total
+}
+
+// Snapshot returns a copy of the bytes downloaded from all the tiers.
+func (t *TierBytes) Snapshot() map[string]int64 {
+	res := make(map[string]int64)
+	if t == nil {
+		return res
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, v := range t.bytes {
+		res[k] = v
+	}
+	return res
+}
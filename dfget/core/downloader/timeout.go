@@ -0,0 +1,102 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+)
+
+// timeoutHonorer is implemented by the downloaders which stop by themselves
+// once Cfg.Timeout expires, so that DoDownloadTimeout waits for them longer
+// rather than abandoning them at the timeout.
+type timeoutHonorer interface {
+	// runTimeout returns the wall-clock limit of Run for the timeout, which
+	// covers stopping the download and the back source after it.
+	runTimeout(timeout time.Duration) time.Duration
+}
+
+// stopper is implemented by the downloaders which DoDownloadTimeout stops
+// once its timeout expires rather than abandoning them.
+type stopper interface {
+	// runUntil runs the download until the ctx is done, and then stops it
+	// and fails it by the cause.
+	runUntil(ctx context.Context, cause error) error
+}
+
+// runUntil implements stopper, the download cancelled by the ctx waits for
+// the pieces being downloaded and the ClientWriter, and fails by the cause
+// after writing the partial target by Cfg.PartialRatio.
+func (p2p *P2PDownloader) runUntil(ctx context.Context, cause error) error {
+	p2p.stopCause = cause
+	return p2p.RunContext(ctx)
+}
+
+// withTimeout returns the ctx of the download started by RunContext, which
+// is done once Cfg.Timeout expires. Then the PowerClients started abort
+// their requests to the peers, and the pull loop stops by expire.
+func (p2p *P2PDownloader) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	p2p.timeout = nil
+	if p2p.Cfg.Timeout <= 0 || p2p.Cfg.BackSourceOnly {
+		return ctx, func() {}
+	}
+	timeout := time.Duration(p2p.Cfg.Timeout) * time.Second
+	p2p.timeout = fmt.Errorf("download timeout(%.3fs)", timeout.Seconds())
+	p2p.parentCtx = ctx
+	return context.WithTimeout(ctx, timeout)
+}
+
+// expired reports whether the download is stopped by Cfg.Timeout rather
+// than the cancellation of the ctx of RunContext.
+func (p2p *P2PDownloader) expired() bool {
+	return p2p.timeout != nil && p2p.ctx.Err() == context.DeadlineExceeded &&
+		p2p.parentCtx.Err() == nil
+}
+
+// expire stops the download once Cfg.Timeout expires: it waits for the
+// pieces being downloaded and the ClientWriter, then downloads from the
+// source if Cfg.TimeoutBackSource is set or fails.
+func (p2p *P2PDownloader) expire() error {
+	p2p.Cfg.Log().Warnf("P2P download exceeds the timeout(%ds), back source:%t",
+		p2p.Cfg.Timeout, p2p.Cfg.TimeoutBackSource)
+	p2p.tasks.Wait()
+	p2p.clientQueue.Put(last)
+	p2p.clientWriter.Wait()
+	p2p.saveResume(true)
+	if p2p.Cfg.TimeoutBackSource {
+		p2p.Cfg.BackSourceReason = config.BackSourceReasonTimeout
+		return p2p.backSource()
+	}
+	return p2p.failTask(p2p.timeout)
+}
+
+// runTimeout implements timeoutHonorer, the download stops by itself once
+// Cfg.Timeout expires, and the back source after it by Cfg.TimeoutBackSource
+// is limited by the timeout too.
+func (p2p *P2PDownloader) runTimeout(timeout time.Duration) time.Duration {
+	if p2p.Cfg.Timeout <= 0 || p2p.Cfg.BackSourceOnly {
+		return timeout
+	}
+	timeout += config.TimeoutStopGrace
+	if p2p.Cfg.TimeoutBackSource {
+		timeout += time.Duration(p2p.Cfg.Timeout) * time.Second
+	}
+	return timeout
+}
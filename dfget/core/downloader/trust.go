@@ -0,0 +1,117 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/errors"
+)
+
+// trustDomain restricts the peers the pieces can be downloaded from to
+// Cfg.TrustedPeers, and counts the pieces refused because of the untrusted
+// peers. It's safe for concurrent use, and a nil trustDomain trusts all
+// the peers.
+type trustDomain struct {
+	nets []*net.IPNet
+
+	mu      sync.Mutex
+	refused map[string]int
+}
+
+// newTrustDomain creates a trustDomain from the CIDRs or ips, it returns nil
+// if cidrs is empty.
+func newTrustDomain(cidrs []string) (*trustDomain, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+	t := &trustDomain{refused: make(map[string]int)}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted peer:%s", cidr)
+			}
+			cidr = fmt.Sprintf("%s/%d", cidr, len(ip.To16())*8)
+			if ip.To4() != nil {
+				cidr = fmt.Sprintf("%s/32", ip.To4())
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted peer:%s, %v", cidr, err)
+		}
+		t.nets = append(t.nets, ipNet)
+	}
+	return t, nil
+}
+
+// trusted returns whether the peer ip is in the trust domain.
+func (t *trustDomain) trusted(ip string) bool {
+	if t == nil {
+		return true
+	}
+	peer := net.ParseIP(ip)
+	if peer == nil {
+		return false
+	}
+	for _, n := range t.nets {
+		if n.Contains(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// refuse records that the pieceRange is refused to be downloaded from an
+// untrusted peer.
+func (t *trustDomain) refuse(pieceRange string) {
+	t.mu.Lock()
+	t.refused[pieceRange]++
+	t.mu.Unlock()
+}
+
+// check returns an error if a range has been refused for
+// config.UntrustedRetryLimit times, which means the supernode can only
+// offer the untrusted peers for it.
+func (t *trustDomain) check() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for pieceRange, count := range t.refused {
+		if count >= config.UntrustedRetryLimit {
+			return errors.Newf(config.CodeUntrusted,
+				"range:%s is only available from untrusted peers", pieceRange)
+		}
+	}
+	return nil
+}
+
+// checkOriginTrusted returns an error if downloading from the source is not
+// allowed in the strict trust domain mode.
+func checkOriginTrusted(cfg *config.Config) error {
+	if len(cfg.TrustedPeers) == 0 || cfg.TrustOrigin {
+		return nil
+	}
+	return errors.New(config.CodeUntrusted, "the source is not trusted")
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/errors"
+	"github.com/go-check/check"
+)
+
+type TrustTestSuite struct {
+}
+
+func init() {
+	check.Suite(&TrustTestSuite{})
+}
+
+func (s *TrustTestSuite) TestTrustDomain(c *check.C) {
+	t, err := newTrustDomain(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(t.trusted("1.1.1.1"), check.Equals, true)
+	c.Assert(t.check(), check.IsNil)
+
+	_, err = newTrustDomain([]string{"10.0.0.0/33"})
+	c.Assert(err, check.NotNil)
+	_, err = newTrustDomain([]string{"host"})
+	c.Assert(err, check.NotNil)
+
+	t, err = newTrustDomain([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	c.Assert(err, check.IsNil)
+	var cases = map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"fd00::1":     true,
+		"127.0.0.1":   false,
+		"":            false,
+	}
+	for ip, expected := range cases {
+		c.Assert(t.trusted(ip), check.Equals, expected, check.Commentf("ip:%s", ip))
+	}
+
+	for i := 0; i < config.UntrustedRetryLimit; i++ {
+		c.Assert(t.check(), check.IsNil)
+		t.refuse("0-9")
+	}
+	err = t.check()
+	c.Assert(err, check.NotNil)
+	c.Assert(err.(*errors.DFGetError).Code, check.Equals, config.CodeUntrusted)
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
+)
+
+// md5NotMatchError represents that the assembled file doesn't match the
+// expected md5.
+type md5NotMatchError struct {
+	real   string
+	expect string
+}
+
+func (e *md5NotMatchError) Error() string {
+	return fmt.Sprintf("Md5NotMatch, real:%s expect:%s", e.real, e.expect)
+}
+
+// peerSet is a set of the peers by their addresses.
+type peerSet map[string]bool
+
+func peerAddr(t *types.PullPieceTaskResponseContinueData) string {
+	return util.JoinHostPort(t.PeerIP, t.PeerPort)
+}
+
+// blacklisted returns whether the piece task is served by a peer used by the
+// failed attempts, the supernode is never blacklisted.
+func (p2p *P2PDownloader) blacklisted(t *types.PullPieceTaskResponseContinueData) bool {
+	return t.PeerIP != p2p.node && p2p.blacklist[peerAddr(t)]
+}
+
+// restart prepares downloading the file from scratch after the md5 of the
+// assembled file doesn't match: it registers to the supernodes again and
+// resets the states of the download. The peers used by the failed attempt
+// are blacklisted if Cfg.VerifyRetryBlacklist is set.
+func (p2p *P2PDownloader) restart() error {
+	// the ClientWriter of the failed attempt records its error before init
+	// resets the states.
+	<-p2p.writerDone
+	if p2p.Cfg.VerifyRetryBlacklist {
+		if p2p.blacklist == nil {
+			p2p.blacklist = make(peerSet)
+		}
+		for addr := range p2p.usedPeers {
+			p2p.blacklist[addr] = true
+		}
+	}
+	// the standby registration consumes the supernodes too.
+	p2p.releaseStandby()
+	registered := p2p.GetRegisterResult()
+	nodes := append([]string{registered.Node}, registered.RemainderNodes...)
+	res, e := p2p.Register.RegisterNodes(p2p.Cfg.RV.PeerPort, nodes)
+	if e != nil {
+		return e
+	}
+	p2p.RegisterResult = res
+	p2p.init()
+	return nil
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/api"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/regist"
+	"github.com/dragonflyoss/Dragonfly/dfget/errors"
+)
+
+// CheckHealth checks the health of the supernodes of cfg.Node and returns
+// the errors of the unhealthy ones keyed by the node, it fails with
+// CodeUnhealthy if none of them is healthy.
+func CheckHealth(cfg *config.Config) (map[string]error, *errors.DFGetError) {
+	supernodeAPI, err := api.NewSupernodeAPIFromConfig(cfg)
+	if err != nil {
+		return nil, errors.New(1100, err.Error())
+	}
+	healthy, dead := regist.HealthyNodes(supernodeAPI, cfg.Node)
+	cfg.ClientLogger.Infof("check health of supernodes:%v, healthy:%v", cfg.Node, healthy)
+	if len(healthy) == 0 {
+		return dead, errors.Newf(config.CodeUnhealthy, "none of the supernodes %v is healthy", cfg.Node)
+	}
+	return dead, nil
+}
@@ -31,6 +31,18 @@ func GetServiceFile(taskFileName, dataDir string) string {
 	return GetTaskFile(taskFileName, dataDir) + ".service"
 }
 
+// GetResumeFile returns file path of the sidecar file which records the
+// pieces written into serviceFile.
+func GetResumeFile(serviceFile string) string {
+	return serviceFile + ".resume"
+}
+
+// IsResumeFile returns whether the file is a sidecar file returned by
+// GetResumeFile.
+func IsResumeFile(file string) bool {
+	return strings.HasSuffix(file, ".service.resume")
+}
+
 // GetTaskName extracts and returns task name from serviceFile.
 func GetTaskName(serviceFile string) string {
 	if idx := strings.LastIndex(serviceFile, ".service"); idx != -1 {
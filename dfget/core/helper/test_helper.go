@@ -37,9 +37,12 @@ func CreateConfig(writer io.Writer, workHome string) *config.Config {
 	cfg.RV.MetaPath = path.Join(cfg.WorkHome, "meta", "host.meta")
 	cfg.RV.SystemDataDir = path.Join(cfg.WorkHome, "data")
 
-	logrus.StandardLogger().Out = writer
-	cfg.ClientLogger = logrus.StandardLogger()
-	cfg.ServerLogger = logrus.StandardLogger()
+	// the logger isn't shared, so the goroutines left by the other tests
+	// don't race with it.
+	logger := logrus.New()
+	logger.Out = writer
+	cfg.ClientLogger = logger
+	cfg.ServerLogger = logger
 	return cfg
 }
 
@@ -58,12 +61,21 @@ type ReportFuncType func(ip string, req *types.ReportPieceRequest) (*types.BaseR
 // ServiceDownFuncType function type of SupernodeAPI#ServiceDown
 type ServiceDownFuncType func(ip string, taskID string, cid string) (*types.BaseResponse, error)
 
+// ReportContributionFuncType function type of SupernodeAPI#ReportContribution
+type ReportContributionFuncType func(ip string, req *types.ReportContributionRequest) (*types.BaseResponse, error)
+
+// CheckHealthFuncType function type of SupernodeAPI#CheckHealth
+type CheckHealthFuncType func(ip string) error
+
 // MockSupernodeAPI mock SupernodeAPI
 type MockSupernodeAPI struct {
 	RegisterFunc    RegisterFuncType
 	PullFunc        PullFuncType
 	ReportFunc      ReportFuncType
 	ServiceDownFunc ServiceDownFuncType
+
+	ReportContributionFunc ReportContributionFuncType
+	CheckHealthFunc        CheckHealthFuncType
 }
 
 // Register implements SupernodeAPI#Register
@@ -102,6 +114,23 @@ func (m *MockSupernodeAPI) ServiceDown(ip string, taskID string, cid string) (
 	return nil, nil
 }
 
+// ReportContribution implements SupernodeAPI#ReportContribution
+func (m *MockSupernodeAPI) ReportContribution(ip string, req *types.ReportContributionRequest) (
+	*types.BaseResponse, error) {
+	if m.ReportContributionFunc != nil {
+		return m.ReportContributionFunc(ip, req)
+	}
+	return nil, nil
+}
+
+// CheckHealth implements SupernodeAPI#CheckHealth
+func (m *MockSupernodeAPI) CheckHealth(ip string) error {
+	if m.CheckHealthFunc != nil {
+		return m.CheckHealthFunc(ip)
+	}
+	return nil
+}
+
 // CreateRegisterFunc creates a mock register function
 func CreateRegisterFunc() RegisterFuncType {
 	var newResponse = func(code int, msg string) *types.RegisterResponse {
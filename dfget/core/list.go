@@ -0,0 +1,46 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"path/filepath"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/core/downloader"
+	"github.com/dragonflyoss/Dragonfly/dfget/errors"
+)
+
+// StartList downloads the files of cfg.ListURL into the directory
+// cfg.Output by their relative paths in the list, which are downloaded by
+// StartBatch with cfg.ListParallelism. It fails only if the list can't be
+// fetched, the failures of the files are in their results.
+func StartList(cfg *config.Config) ([]BatchResult, *errors.DFGetError) {
+	entries, err := downloader.FetchList(cfg)
+	if err != nil {
+		return nil, errors.New(1100, err.Error())
+	}
+	cfg.ClientLogger.Infof("download %d files of list:%s into:%s", len(entries), cfg.ListURL, cfg.Output)
+	items := make([]BatchItem, len(entries))
+	for i, e := range entries {
+		items[i] = BatchItem{
+			URL:    e.URL,
+			Output: filepath.Join(cfg.Output, filepath.FromSlash(e.Path)),
+			Md5:    e.Md5,
+		}
+	}
+	return StartBatch(cfg, items, cfg.ListParallelism), nil
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package regist
+
+import (
+	"sync"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/core/api"
+)
+
+// HealthyNodes checks the health of the nodes concurrently by the api, and
+// returns the healthy ones in their order and the errors of the others
+// keyed by the node.
+func HealthyNodes(supernodeAPI api.SupernodeAPI, nodes []string) ([]string, map[string]error) {
+	var (
+		errs = make([]error, len(nodes))
+		wg   sync.WaitGroup
+	)
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			errs[i] = supernodeAPI.CheckHealth(node)
+		}(i, node)
+	}
+	wg.Wait()
+
+	healthy := []string{}
+	dead := make(map[string]error)
+	for i, node := range nodes {
+		if errs[i] != nil {
+			dead[node] = errs[i]
+			continue
+		}
+		healthy = append(healthy, node)
+	}
+	return healthy, dead
+}
@@ -17,6 +17,7 @@
 package regist
 
 import (
+	"context"
 	"os"
 	"time"
 
@@ -31,6 +32,11 @@ import (
 // SupernodeRegister encapsulates the Register steps into a struct.
 type SupernodeRegister interface {
 	Register(peerPort int) (*RegisterResult, *errors.DFGetError)
+
+	// RegisterNodes registers to one of the nodes as Register, but it
+	// neither reads nor changes Cfg.Node, the nodes left are the
+	// RemainderNodes of the result.
+	RegisterNodes(peerPort int, nodes []string) (*RegisterResult, *errors.DFGetError)
 }
 
 type supernodeRegister struct {
@@ -46,8 +52,28 @@ func NewSupernodeRegister(cfg *config.Config, api api.SupernodeAPI) SupernodeReg
 	}
 }
 
-// Register processes the flow of register.
+// Register processes the flow of register, the supernodes are registered
+// to concurrently if Cfg.RegisterFanout is greater than 1. The Cfg.Node is
+// replaced by the nodes left.
 func (s *supernodeRegister) Register(peerPort int) (*RegisterResult, *errors.DFGetError) {
+	result, remainder, err := s.register(peerPort, s.cfg.Node)
+	s.cfg.Node = remainder
+	return result, err
+}
+
+// RegisterNodes implements SupernodeRegister#RegisterNodes.
+func (s *supernodeRegister) RegisterNodes(peerPort int, nodes []string) (*RegisterResult, *errors.DFGetError) {
+	result, _, err := s.register(peerPort, nodes)
+	return result, err
+}
+
+// register registers to one of the nodes, and returns the nodes left which
+// are neither registered to nor failed.
+func (s *supernodeRegister) register(peerPort int, nodes []string) (
+	*RegisterResult, []string, *errors.DFGetError) {
+	if s.cfg.RegisterFanout > 1 && len(nodes) > 1 {
+		return s.registerConcurrently(peerPort, nodes)
+	}
 	var (
 		resp       *types.RegisterResponse
 		e          error
@@ -56,8 +82,8 @@ func (s *supernodeRegister) Register(peerPort int) (*RegisterResult, *errors.DFG
 		start      = time.Now()
 	)
 
-	s.cfg.ClientLogger.Infof("do register to one of %v", s.cfg.Node)
-	nodes, nLen := s.cfg.Node, len(s.cfg.Node)
+	s.cfg.ClientLogger.Infof("do register to one of %v", nodes)
+	nLen := len(nodes)
 	req := s.constructRegisterRequest(peerPort)
 	for i = 0; i < nLen; i++ {
 		req.SupernodeIP = nodes[i]
@@ -77,18 +103,141 @@ func (s *supernodeRegister) Register(peerPort int) (*RegisterResult, *errors.DFG
 			time.Sleep(2500 * time.Millisecond)
 		}
 	}
-	s.setRemainderNodes(i)
+	remainder := remainderNodes(nodes, i)
 	if err := s.checkResponse(resp, e); err != nil {
 		s.cfg.ClientLogger.Errorf("register fail:%v", err)
-		return nil, err
+		return nil, remainder, err
 	}
 
-	result := NewRegisterResult(nodes[i], s.cfg.Node, s.cfg.URL,
+	result := NewRegisterResult(nodes[i], remainder, s.cfg.URL,
 		resp.Data.TaskID, resp.Data.FileLength, resp.Data.PieceSize)
 
 	s.cfg.ClientLogger.Infof("do register result:%s and cost:%.3fs", resp,
 		time.Since(start).Seconds())
-	return result, nil
+	return result, remainder, nil
+}
+
+// registerAttempt is the response of registering to the node nodes[idx].
+type registerAttempt struct {
+	idx  int
+	resp *types.RegisterResponse
+	err  error
+}
+
+// registerConcurrently registers to Cfg.RegisterFanout supernodes at a time
+// and adopts the first one succeeding, the others of the batch are cancelled
+// and kept as the remainder nodes unless they have failed. The ones which
+// succeed after the winner are unregistered. The next batch is tried only if
+// all the nodes of the batch fail.
+func (s *supernodeRegister) registerConcurrently(peerPort int, nodes []string) (
+	*RegisterResult, []string, *errors.DFGetError) {
+	var (
+		resp   *types.RegisterResponse
+		e      error
+		winner = -1
+		failed = make(map[int]bool)
+		start  = time.Now()
+	)
+
+	fanout := s.cfg.RegisterFanout
+	s.cfg.ClientLogger.Infof("do register to %d of %v concurrently", fanout, nodes)
+	req := s.constructRegisterRequest(peerPort)
+	for begin := 0; begin < len(nodes) && winner < 0; begin += fanout {
+		end := begin + fanout
+		if end > len(nodes) {
+			end = len(nodes)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		// it's buffered so that the ones not waited for won't block.
+		attempts := make(chan registerAttempt, end-begin)
+		for i := begin; i < end; i++ {
+			go func(i int) {
+				r := *req
+				r.SupernodeIP = nodes[i]
+				resp, err := s.registerTo(ctx, nodes[i], &r)
+				attempts <- registerAttempt{idx: i, resp: resp, err: err}
+			}(i)
+		}
+		waited := begin
+		for ; waited < end; waited++ {
+			a := <-attempts
+			if a.err == nil && a.resp != nil && a.resp.Code == config.Success {
+				winner, resp, e = a.idx, a.resp, nil
+				waited++
+				break
+			}
+			failed[a.idx] = true
+			// the need of auth is reported in preference to the other errors.
+			if resp == nil || resp.Code != config.TaskCodeNeedAuth {
+				resp, e = a.resp, a.err
+			}
+		}
+		cancel()
+		if waited < end {
+			go s.unregisterLosers(attempts, nodes, end-waited)
+		}
+	}
+
+	remainder := []string{}
+	for i, node := range nodes {
+		if i != winner && !failed[i] {
+			remainder = append(remainder, node)
+		}
+	}
+	if winner < 0 {
+		err := s.checkResponse(resp, e)
+		s.cfg.ClientLogger.Errorf("register fail:%v", err)
+		return nil, remainder, err
+	}
+
+	result := NewRegisterResult(nodes[winner], remainder, s.cfg.URL,
+		resp.Data.TaskID, resp.Data.FileLength, resp.Data.PieceSize)
+	s.cfg.ClientLogger.Infof("do register result:%s, node:%s wins among %v and cost:%.3fs",
+		resp, nodes[winner], nodes, time.Since(start).Seconds())
+	return result, remainder, nil
+}
+
+// unregisterLosers waits for the n attempts left after the winner, and
+// unregisters the peer from the nodes which it's registered to by them.
+func (s *supernodeRegister) unregisterLosers(attempts <-chan registerAttempt, nodes []string, n int) {
+	for ; n > 0; n-- {
+		a := <-attempts
+		if a.err != nil || a.resp == nil || a.resp.Code != config.Success || a.resp.Data == nil {
+			continue
+		}
+		node := nodes[a.idx]
+		_, err := s.api.ServiceDown(node, a.resp.Data.TaskID, s.cfg.RV.Cid)
+		s.cfg.ClientLogger.Infof("unregister from node:%s which loses the register, error:%v", node, err)
+	}
+}
+
+// registerTo registers to the node, and retries at most 3 times while the
+// node is waiting for the auth. It returns the error of the ctx once it's
+// cancelled before registering or while waiting.
+func (s *supernodeRegister) registerTo(ctx context.Context, node string, req *types.RegisterRequest) (
+	*types.RegisterResponse, error) {
+	for retryTimes := 0; ; retryTimes++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		resp, e := s.api.Register(node, req)
+		s.cfg.ClientLogger.Infof("do register to %s, res:%s error:%v", node, resp, e)
+		if e != nil {
+			s.cfg.ClientLogger.Errorf("register to node:%s error:%v", node, e)
+			return nil, e
+		}
+		if resp == nil || resp.Code != config.TaskCodeWaitAuth || retryTimes >= 3 {
+			return resp, nil
+		}
+		s.cfg.ClientLogger.Infof("sleep 2.5s to wait auth of node:%s(%d/3)...", node, retryTimes+1)
+		timer := time.NewTimer(2500 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
 }
 
 func (s *supernodeRegister) checkResponse(resp *types.RegisterResponse, e error) *errors.DFGetError {
@@ -104,16 +253,12 @@ func (s *supernodeRegister) checkResponse(resp *types.RegisterResponse, e error)
 	return nil
 }
 
-func (s *supernodeRegister) setRemainderNodes(idx int) {
-	nLen := len(s.cfg.Node)
-	if nLen <= 0 {
-		return
-	}
-	if idx < nLen {
-		s.cfg.Node = s.cfg.Node[idx+1:]
-	} else {
-		s.cfg.Node = []string{}
+// remainderNodes returns the nodes after the one at idx.
+func remainderNodes(nodes []string, idx int) []string {
+	if idx < len(nodes) {
+		return nodes[idx+1:]
 	}
+	return []string{}
 }
 
 func (s *supernodeRegister) constructRegisterRequest(port int) *types.RegisterRequest {
@@ -123,7 +268,7 @@ func (s *supernodeRegister) constructRegisterRequest(port int) *types.RegisterRe
 		RawURL:     cfg.URL,
 		TaskURL:    cfg.RV.TaskURL,
 		Cid:        cfg.RV.Cid,
-		IP:         cfg.RV.LocalIP,
+		IP:         cfg.RV.PeerIP,
 		HostName:   hostname,
 		Port:       port,
 		Path:       getTaskPath(cfg.RV.TaskFileName),
@@ -23,10 +23,14 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dragonflyoss/Dragonfly/dfget/config"
 	. "github.com/dragonflyoss/Dragonfly/dfget/core/helper"
+	"github.com/dragonflyoss/Dragonfly/dfget/types"
 	"github.com/go-check/check"
 )
 
@@ -112,6 +116,127 @@ func (s *RegistTestSuite) TestSupernodeRegister_Register(c *check.C) {
 	f(config.HTTPError, "empty response, unknown error", nil)
 }
 
+func (s *RegistTestSuite) TestSupernodeRegister_RegisterNodes(c *check.C) {
+	cfg := s.createConfig(&bytes.Buffer{})
+	cfg.URL = "http://lowzj.com"
+	cfg.Node = []string{"a", "b"}
+	m := new(MockSupernodeAPI)
+	m.RegisterFunc = CreateRegisterFunc()
+	register := NewSupernodeRegister(cfg, m)
+
+	result, e := register.RegisterNodes(0, []string{"", "x", "y"})
+	c.Assert(e, check.IsNil)
+	c.Assert(result.Node, check.Equals, "x")
+	c.Assert(result.RemainderNodes, check.DeepEquals, []string{"y"})
+	c.Assert(cfg.Node, check.DeepEquals, []string{"a", "b"})
+}
+
+func (s *RegistTestSuite) TestSupernodeRegister_RegisterConcurrently(c *check.C) {
+	var newResponse = func(code int) *types.RegisterResponse {
+		return &types.RegisterResponse{
+			BaseResponse: &types.BaseResponse{Code: code},
+			Data:         &types.RegisterResponseData{TaskID: "task", FileLength: 100, PieceSize: 10},
+		}
+	}
+	var lock sync.Mutex
+	var requested []string
+	m := new(MockSupernodeAPI)
+	m.RegisterFunc = func(ip string, req *types.RegisterRequest) (*types.RegisterResponse, error) {
+		lock.Lock()
+		requested = append(requested, ip+"/"+req.SupernodeIP)
+		lock.Unlock()
+		switch ip {
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+		case "fast":
+			time.Sleep(20 * time.Millisecond)
+		case "fail":
+			return nil, fmt.Errorf("connection refused")
+		case "auth":
+			return newResponse(config.TaskCodeNeedAuth), nil
+		case "waitauth":
+			return newResponse(config.TaskCodeWaitAuth), nil
+		}
+		return newResponse(config.Success), nil
+	}
+	unregistered := make(chan string, 10)
+	m.ServiceDownFunc = func(ip string, taskID string, cid string) (*types.BaseResponse, error) {
+		unregistered <- ip + "/" + taskID
+		return &types.BaseResponse{Code: config.Success}, nil
+	}
+
+	cfg := s.createConfig(&bytes.Buffer{})
+	cfg.RegisterFanout = 3
+	cfg.Node = []string{"slow", "fail", "fast", "late"}
+	register := NewSupernodeRegister(cfg, m)
+	start := time.Now()
+	result, e := register.Register(0)
+	c.Assert(e, check.IsNil)
+	c.Assert(time.Since(start) < 200*time.Millisecond, check.Equals, true)
+	c.Assert(result.Node, check.Equals, "fast")
+	c.Assert(result.TaskID, check.Equals, "task")
+	c.Assert(result.RemainderNodes, check.DeepEquals, []string{"slow", "late"})
+	lock.Lock()
+	sort.Strings(requested)
+	c.Assert(requested, check.DeepEquals, []string{"fail/fail", "fast/fast", "slow/slow"})
+	lock.Unlock()
+	// the node succeeding after the winner is unregistered
+	select {
+	case node := <-unregistered:
+		c.Assert(node, check.Equals, "slow/task")
+	case <-time.After(time.Second):
+		c.Fatal("the node losing the register isn't unregistered")
+	}
+
+	// test: the losing attempts waiting for the auth are cancelled
+	requested = nil
+	cfg.RegisterFanout = 2
+	cfg.Node = []string{"waitauth", "fast"}
+	result, e = register.Register(0)
+	c.Assert(e, check.IsNil)
+	c.Assert(result.Node, check.Equals, "fast")
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	sort.Strings(requested)
+	c.Assert(requested, check.DeepEquals, []string{"fast/fast", "waitauth/waitauth"})
+	lock.Unlock()
+	c.Assert(len(unregistered), check.Equals, 0)
+
+	// test: the next batch is tried after all the nodes of the batch fail
+	cfg.RegisterFanout = 2
+	cfg.Node = []string{"fail", "auth", "fast"}
+	result, e = register.Register(0)
+	c.Assert(e, check.IsNil)
+	c.Assert(result.Node, check.Equals, "fast")
+	c.Assert(result.RemainderNodes, check.DeepEquals, []string{})
+
+	// test: the need of auth is reported if no node succeeds
+	cfg.Node = []string{"fail", "auth", "fail"}
+	result, e = register.Register(0)
+	c.Assert(result, check.IsNil)
+	c.Assert(e.Code, check.Equals, config.TaskCodeNeedAuth)
+	c.Assert(cfg.Node, check.DeepEquals, []string{})
+}
+
+func (s *RegistTestSuite) TestHealthyNodes(c *check.C) {
+	m := &MockSupernodeAPI{
+		CheckHealthFunc: func(ip string) error {
+			if ip == "dead" {
+				return fmt.Errorf("connection refused")
+			}
+			return nil
+		},
+	}
+	healthy, dead := HealthyNodes(m, []string{"a", "dead", "b"})
+	c.Assert(healthy, check.DeepEquals, []string{"a", "b"})
+	c.Assert(len(dead), check.Equals, 1)
+	c.Assert(dead["dead"], check.ErrorMatches, "connection refused")
+
+	healthy, dead = HealthyNodes(m, nil)
+	c.Assert(healthy, check.DeepEquals, []string{})
+	c.Assert(len(dead), check.Equals, 0)
+}
+
 func (s *RegistTestSuite) TestSupernodeRegister_constructRegisterRequest(c *check.C) {
 	buf := &bytes.Buffer{}
 	cfg := s.createConfig(buf)
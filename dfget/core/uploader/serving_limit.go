@@ -0,0 +1,96 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package uploader
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// servingLimiter caps the number of the pieces served to the peers
+// concurrently, the requests beyond it wait for a free stream at most the
+// queue timeout and are rejected then. It limits nothing if the max isn't
+// positive, but the streams are still counted.
+type servingLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+
+	serving  int64
+	rejected int64
+}
+
+// servingStats is the serving concurrency exposed by the peer server.
+type servingStats struct {
+	Serving    int64 `json:"serving"`
+	MaxServing int   `json:"maxServing"`
+	Rejected   int64 `json:"rejected"`
+}
+
+func newServingLimiter(max int, timeout time.Duration) *servingLimiter {
+	l := &servingLimiter{timeout: timeout}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+	return l
+}
+
+// acquire returns the function to release the stream, or false if there is
+// no free stream within the queue timeout.
+func (l *servingLimiter) acquire() (release func(), ok bool) {
+	if l.slots != nil && !l.wait() {
+		atomic.AddInt64(&l.rejected, 1)
+		return nil, false
+	}
+	atomic.AddInt64(&l.serving, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&l.serving, -1)
+			if l.slots != nil {
+				<-l.slots
+			}
+		})
+	}, true
+}
+
+func (l *servingLimiter) wait() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.timeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (l *servingLimiter) stats() servingStats {
+	return servingStats{
+		Serving:    atomic.LoadInt64(&l.serving),
+		MaxServing: cap(l.slots),
+		Rejected:   atomic.LoadInt64(&l.rejected),
+	}
+}
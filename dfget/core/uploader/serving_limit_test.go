@@ -0,0 +1,104 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package uploader
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	"github.com/dragonflyoss/Dragonfly/dfget/config"
+
+	"github.com/go-check/check"
+)
+
+type ServingLimiterTestSuite struct{}
+
+func init() {
+	check.Suite(&ServingLimiterTestSuite{})
+}
+
+func (s *ServingLimiterTestSuite) TestAcquire_Cap(c *check.C) {
+	l := newServingLimiter(2, 0)
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, ok := l.acquire()
+		c.Assert(ok, check.Equals, true)
+		releases = append(releases, release)
+	}
+	_, ok := l.acquire()
+	c.Assert(ok, check.Equals, false)
+	c.Assert(l.stats(), check.Equals, servingStats{Serving: 2, MaxServing: 2, Rejected: 1})
+
+	// releasing twice frees one stream only
+	releases[0]()
+	releases[0]()
+	release, ok := l.acquire()
+	c.Assert(ok, check.Equals, true)
+	_, ok = l.acquire()
+	c.Assert(ok, check.Equals, false)
+	release()
+	releases[1]()
+	c.Assert(l.stats(), check.Equals, servingStats{Serving: 0, MaxServing: 2, Rejected: 2})
+}
+
+func (s *ServingLimiterTestSuite) TestAcquire_Queue(c *check.C) {
+	l := newServingLimiter(1, time.Second)
+	release, _ := l.acquire()
+	time.AfterFunc(50*time.Millisecond, release)
+
+	start := time.Now()
+	queued, ok := l.acquire()
+	c.Assert(ok, check.Equals, true)
+	c.Assert(time.Since(start) >= 50*time.Millisecond, check.Equals, true)
+
+	l.timeout = 50 * time.Millisecond
+	_, ok = l.acquire()
+	c.Assert(ok, check.Equals, false)
+	queued()
+}
+
+func (s *ServingLimiterTestSuite) TestAcquire_Unlimited(c *check.C) {
+	l := newServingLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		_, ok := l.acquire()
+		c.Assert(ok, check.Equals, true)
+	}
+	c.Assert(l.stats(), check.Equals, servingStats{Serving: 100})
+}
+
+func (s *ServingLimiterTestSuite) TestUploadHandler_Rejected(c *check.C) {
+	cfg := &config.Config{}
+	cfg.RV.MaxServingStreams = 1
+	ps := &peerServer{cfg: cfg, streams: newServingLimiter(1, 0)}
+	release, _ := ps.streams.acquire()
+	defer release()
+
+	rr := httptest.NewRecorder()
+	ps.uploadHandler(rr, httptest.NewRequest(http.MethodGet, "/peer/file/task", nil))
+	c.Assert(rr.Code, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(rr.Header().Get("Retry-After"), check.Equals, strconv.Itoa(config.ServingRetryAfter))
+
+	rr = httptest.NewRecorder()
+	ps.statsHandler(rr, httptest.NewRequest(http.MethodGet, config.LocalHTTPStats, nil))
+	c.Assert(rr.Code, check.Equals, http.StatusOK)
+	var stats servingStats
+	c.Assert(json.NewDecoder(rr.Body).Decode(&stats), check.IsNil)
+	c.Assert(stats, check.Equals, servingStats{Serving: 1, MaxServing: 1, Rejected: 1})
+}
@@ -21,6 +21,7 @@ package uploader
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
@@ -62,11 +63,17 @@ func StartPeerServerProcess(cfg *config.Config) (port int, err error) {
 	}
 
 	cmd := exec.Command(os.Args[0], "server",
-		"--ip", cfg.RV.LocalIP,
+		"--ip", cfg.RV.PeerIP,
 		"--meta", cfg.RV.MetaPath,
 		"--data", cfg.RV.SystemDataDir,
 		"--expiretime", cfg.RV.DataExpireTime.String(),
-		"--alivetime", cfg.RV.ServerAliveTime.String())
+		"--alivetime", cfg.RV.ServerAliveTime.String(),
+		"--maxstreams", strconv.Itoa(cfg.RV.MaxServingStreams),
+		"--streamqueuetimeout", cfg.RV.ServingQueueTimeout.String())
+	cmd.Args = append(cmd.Args, supernodeTLSArgs(cfg)...)
+	if cfg.RV.ServeHTTP2 {
+		cmd.Args = append(cmd.Args, "--servehttp2")
+	}
 
 	var stdout io.ReadCloser
 	if stdout, err = cmd.StdoutPipe(); err != nil {
@@ -118,7 +125,7 @@ func checkPeerServerExist(cfg *config.Config, port int) int {
 	}
 
 	// check the peer server whether is available
-	result, err := checkServer(cfg.RV.LocalIP, port, cfg.RV.TargetDir, taskFileName, 0)
+	result, err := checkServer(cfg.RV.PeerIP, port, cfg.RV.TargetDir, taskFileName, 0)
 	cfg.ServerLogger.Infof("local http result:%s err:%v, port:%d path:%s",
 		result, err, port, config.LocalHTTPPathCheck)
 
@@ -218,7 +225,11 @@ func updateServicePortInMeta(cfg *config.Config, port int) {
 func serverGC(cfg *config.Config, interval time.Duration) {
 	cfg.ServerLogger.Info("start server gc, expireTime:", cfg.RV.DataExpireTime)
 
-	supernode := api.NewSupernodeAPI()
+	supernode, err := api.NewSupernodeAPIFromConfig(cfg)
+	if err != nil {
+		cfg.ServerLogger.Warnf("create supernode api error:%v, request the supernodes by http", err)
+		supernode = api.NewSupernodeAPI()
+	}
 	var walkFn filepath.WalkFunc = func(path string, info os.FileInfo, err error) error {
 		if path == cfg.RV.SystemDataDir || info == nil || err != nil {
 			return nil
@@ -257,13 +268,25 @@ func deleteExpiredFile(api api.SupernodeAPI, path string, info os.FileInfo,
 			syncTaskMap.Delete(taskName)
 			return true
 		}
-	} else {
+	} else if !resumable(path, expireTime) {
 		os.Remove(path)
 		return true
 	}
 	return false
 }
 
+// resumable returns whether the file of an unknown task is the sidecar file
+// or the service file of a download to be resumed, which is kept until the
+// sidecar expires.
+func resumable(path string, expireTime time.Duration) bool {
+	sidecar := path
+	if !helper.IsResumeFile(path) {
+		sidecar = helper.GetResumeFile(path)
+	}
+	info, err := os.Stat(sidecar)
+	return err == nil && time.Now().Sub(info.ModTime()) <= expireTime
+}
+
 func monitorAlive(cfg *config.Config, interval time.Duration) {
 	cfg.ServerLogger.Info("monitor peer server whether is alive, aliveTime:",
 		cfg.RV.ServerAliveTime)
@@ -299,6 +322,7 @@ func newPeerServer(cfg *config.Config, port int) *peerServer {
 		finished: make(chan struct{}),
 		host:     cfg.RV.LocalIP,
 		port:     port,
+		streams:  newServingLimiter(cfg.RV.MaxServingStreams, cfg.RV.ServingQueueTimeout),
 	}
 
 	// init router
@@ -308,10 +332,17 @@ func newPeerServer(cfg *config.Config, port int) *peerServer {
 	r.HandleFunc(config.LocalHTTPPathCheck+"{taskFileName:.*}", s.checkHandler).Methods("GET")
 	r.HandleFunc(config.LocalHTTPPathClient+"finish", s.oneFinishHandler).Methods("GET")
 	r.HandleFunc(config.LocalHTTPPing, s.pingHandler).Methods("GET")
+	r.HandleFunc(config.LocalHTTPStats, s.statsHandler).Methods("GET")
 
+	var handler http.Handler = r
+	if cfg.RV.ServeHTTP2 {
+		// the peers fetching pieces by HTTP/2 without TLS are served along
+		// with the HTTP/1 ones.
+		handler = util.NewH2CHandler(r)
+	}
 	s.Server = &http.Server{
 		Addr:    net.JoinHostPort(s.host, strconv.Itoa(port)),
-		Handler: r,
+		Handler: handler,
 	}
 
 	return s
@@ -322,6 +353,9 @@ type peerServer struct {
 	cfg      *config.Config
 	finished chan struct{}
 
+	// streams limits the concurrent uploads.
+	streams *servingLimiter
+
 	// server related fields
 	host string
 	port int
@@ -347,6 +381,15 @@ type uploadParam struct {
 // uploadHandler use to upload a task file when other peers download from it.
 func (ps *peerServer) uploadHandler(w http.ResponseWriter, r *http.Request) {
 	aliveQueue.Put(true)
+	release, ok := ps.streams.acquire()
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(config.ServingRetryAfter))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "too many serving streams, max:%d", ps.cfg.RV.MaxServingStreams)
+		return
+	}
+	defer release()
+
 	// Step1: parse param
 	taskFileName := mux.Vars(r)["taskFileName"]
 	rangeStr := r.Header.Get("range")
@@ -366,12 +409,25 @@ func (ps *peerServer) uploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer f.Close()
 
+	// the compressed service file is decompressed on the fly
+	var content io.ReadSeeker = f
+	if info, err := f.Stat(); err == nil && util.IsCompressedFile(f, info.Size()) {
+		cf, err := util.NewCompressedFile(f, info.Size())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err.Error())
+			ps.cfg.ServerLogger.Errorf("failed to open compressed TaskFile %s, %v", taskFileName, err)
+			return
+		}
+		content = io.NewSectionReader(cf, 0, cf.Size())
+	}
+
 	// Step3: write header
 	w.Header().Set("Content-Length", strconv.FormatInt(params.pieceLen, 10))
 	sendSuccess(w)
 
 	// Step4: tans task file
-	if err := transFile(f, w, params.start, params.readLen); err != nil {
+	if err := transFile(content, w, params.start, params.readLen); err != nil {
 		ps.cfg.ServerLogger.Errorf("send range:%s error: %v", rangeStr, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "read task file failed: %v", err)
@@ -424,6 +480,12 @@ func (ps *peerServer) oneFinishHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "success")
 }
 
+// statsHandler returns the serving concurrency in json format.
+func (ps *peerServer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	sendSuccess(w)
+	json.NewEncoder(w).Encode(ps.streams.stats())
+}
+
 func (ps *peerServer) pingHandler(w http.ResponseWriter, r *http.Request) {
 	sendSuccess(w)
 	fmt.Fprintf(w, "success")
@@ -81,7 +81,7 @@ func parseRange(rangeStr string) (*uploadParam, error) {
 }
 
 // transFile send the file to the remote.
-func transFile(f *os.File, w http.ResponseWriter, start, readLen int64) error {
+func transFile(f io.ReadSeeker, w http.ResponseWriter, start, readLen int64) error {
 	var total int64
 	f.Seek(start, 0)
 
@@ -122,10 +122,28 @@ func transFile(f *os.File, w http.ResponseWriter, start, readLen int64) error {
 
 // LaunchPeerServer helper
 
+// supernodeTLSArgs returns the arguments passing the tls of the supernodes
+// to the peer server process, which reports the expired files to them.
+func supernodeTLSArgs(cfg *config.Config) (args []string) {
+	for _, kv := range [][2]string{
+		{"--supernodecacert", cfg.SupernodeCACert},
+		{"--supernodecert", cfg.SupernodeCert},
+		{"--supernodekey", cfg.SupernodeKey},
+	} {
+		if !util.IsEmptyStr(kv[1]) {
+			args = append(args, kv[0], kv[1])
+		}
+	}
+	if cfg.SupernodeInsecureSkipVerify {
+		args = append(args, "--supernodeinsecure")
+	}
+	return args
+}
+
 // FinishTask report a finished task to peer server.
 func FinishTask(ip string, port int, taskFileName, cid, taskID, node string) error {
-	url := fmt.Sprintf("http://%s:%d%sfinish?taskFileName=%s&cid=%s&taskId=%s&node=%s",
-		ip, port, config.LocalHTTPPathClient,
+	url := fmt.Sprintf("http://%s%sfinish?taskFileName=%s&cid=%s&taskId=%s&node=%s",
+		util.JoinHostPort(ip, port), config.LocalHTTPPathClient,
 		taskFileName, taskID, cid, node)
 	code, _, err := util.Get(url, util.DefaultTimeout)
 	if code == http.StatusOK {
@@ -137,7 +155,7 @@ func FinishTask(ip string, port int, taskFileName, cid, taskID, node string) err
 // checkServer check if the server is available。
 func checkServer(ip string, port int, dataDir string, taskFileName string,
 	timeout time.Duration) (string, error) {
-	url := fmt.Sprintf("http://%s:%d%s%s", ip, port, config.LocalHTTPPathCheck, taskFileName)
+	url := fmt.Sprintf("http://%s%s%s", util.JoinHostPort(ip, port), config.LocalHTTPPathCheck, taskFileName)
 	if timeout <= 0 {
 		timeout = util.DefaultTimeout
 	}
@@ -171,7 +189,7 @@ func checkServer(ip string, port int, dataDir string, taskFileName string,
 }
 
 func pingServer(ip string, port int) bool {
-	url := fmt.Sprintf("http://%s:%d/%s", ip, port, config.LocalHTTPPing)
+	url := fmt.Sprintf("http://%s/%s", util.JoinHostPort(ip, port), config.LocalHTTPPing)
 	code, _, _ := fasthttp.GetTimeout(nil, url, util.DefaultTimeout)
 	return code == http.StatusOK
 }
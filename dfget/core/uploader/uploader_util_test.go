@@ -17,7 +17,9 @@
 package uploader
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
@@ -29,10 +31,12 @@ import (
 	"testing"
 
 	"github.com/dragonflyoss/Dragonfly/dfget/config"
+	"github.com/dragonflyoss/Dragonfly/dfget/util"
 	"github.com/dragonflyoss/Dragonfly/version"
 
 	"github.com/go-check/check"
 	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
 )
 
 var (
@@ -133,6 +137,19 @@ func (s *UploadUtilTestSuite) TestTransFile(c *check.C) {
 	c.Check(err, check.IsNil)
 	c.Check(rr.Body.String(), check.Equals, tempFileCOntent[:5])
 
+	// the compressed file is decompressed on the fly
+	compressed := path.Join(s.dataDir, "compressed")
+	c.Assert(util.CompressFile(f.Name(), compressed, 4), check.IsNil)
+	cf, err := os.Open(compressed)
+	c.Assert(err, check.IsNil)
+	defer cf.Close()
+	info, _ := cf.Stat()
+	r, err := util.NewCompressedFile(cf, info.Size())
+	c.Assert(err, check.IsNil)
+	rr = httptest.NewRecorder()
+	err = transFile(io.NewSectionReader(r, 0, r.Size()), rr, 1, 5)
+	c.Check(err, check.IsNil)
+	c.Check(rr.Body.String(), check.Equals, tempFileCOntent[1:6])
 }
 
 func (s *UploadUtilTestSuite) TestCheckPort(c *check.C) {
@@ -220,6 +237,37 @@ func (s *UploadUtilTestSuite) TestGetPort(c *check.C) {
 }
 
 // createTestFile create a temp file and write a string.
+func (s *UploadUtilTestSuite) TestNewPeerServer_ServeHTTP2(c *check.C) {
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	for _, serve := range []bool{false, true} {
+		comment := check.Commentf("serveHTTP2:%t", serve)
+		cfg := &config.Config{}
+		cfg.RV.ServeHTTP2 = serve
+		ps := newPeerServer(cfg, 0)
+		srv := httptest.NewServer(ps.Handler)
+
+		// the HTTP/1 clients are always served
+		code, _, err := util.Get(srv.URL+config.LocalHTTPPing, util.DefaultTimeout)
+		c.Check(err, check.IsNil, comment)
+		c.Check(code, check.Equals, http.StatusOK, comment)
+
+		resp, err := client.Get(srv.URL + config.LocalHTTPPing)
+		if serve {
+			c.Check(err, check.IsNil, comment)
+			c.Check(resp.ProtoMajor, check.Equals, 2, comment)
+			resp.Body.Close()
+		} else {
+			c.Check(err, check.NotNil, comment)
+		}
+		srv.Close()
+	}
+}
+
 func createTestFile(path string) error {
 	f, err := os.Create(path)
 	if err != nil {
@@ -229,3 +277,44 @@ func createTestFile(path string) error {
 	f.WriteString(tempFileCOntent)
 	return nil
 }
+
+func benchmarkTransFile(b *testing.B, compress bool) {
+	dir, _ := ioutil.TempDir("/tmp", "dfget-BenchmarkTransFile-")
+	defer os.RemoveAll(dir)
+
+	// a compressible file of 16MB
+	const pieceSize = 4 * 1024 * 1024
+	content := make([]byte, 4*pieceSize)
+	for i := range content {
+		content[i] = byte(i / 1024 % 4)
+	}
+	name := path.Join(dir, "file")
+	ioutil.WriteFile(name, content, 0644)
+	if compress {
+		util.CompressFile(name, name+".z", config.CompressBlockSize)
+		name += ".z"
+	}
+	f, _ := os.Open(name)
+	defer f.Close()
+	var r io.ReadSeeker = f
+	if compress {
+		info, _ := f.Stat()
+		cf, _ := util.NewCompressedFile(f, info.Size())
+		r = io.NewSectionReader(cf, 0, cf.Size())
+	}
+
+	b.SetBytes(pieceSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := int64(i%4) * pieceSize
+		transFile(r, httptest.NewRecorder(), start, pieceSize)
+	}
+}
+
+func BenchmarkTransFile_Plain(b *testing.B) {
+	benchmarkTransFile(b, false)
+}
+
+func BenchmarkTransFile_Compressed(b *testing.B) {
+	benchmarkTransFile(b, true)
+}
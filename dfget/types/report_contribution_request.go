@@ -0,0 +1,37 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+// ReportContributionRequest is sent to the supernode when dfget finishes
+// downloading from peers to report how many bytes each peer served.
+type ReportContributionRequest struct {
+	TaskID string `json:"taskId"`
+	Cid    string `json:"cid"`
+
+	// Peers are the peers contributed most sorted by the bytes descending,
+	// the others are summed up by OtherPeers and OtherBytes to keep the
+	// request compact.
+	Peers      []*PeerContribution `json:"peers"`
+	OtherPeers int                 `json:"otherPeers,omitempty"`
+	OtherBytes int64               `json:"otherBytes,omitempty"`
+}
+
+// PeerContribution is the bytes served by the peer identified by its cid.
+type PeerContribution struct {
+	Cid   string `json:"cid"`
+	Bytes int64  `json:"bytes"`
+}
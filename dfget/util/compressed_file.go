@@ -0,0 +1,253 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The compressed file is in the zstd seekable format, so that it can be
+// decompressed by the zstd tools as well: the blocks are compressed as the
+// independent zstd frames, which are followed by a skippable frame holding
+// the seek table, so that any range can be read by decompressing the frames
+// covering it only. All the integers are little endian.
+//
+//	frames:     the zstd frame of each block
+//	seek table: skippableMagic(4) frameSize(4)
+//	            the compressedSize(4) and decompressedSize(4) of each frame
+//	            frames(4) descriptor(1) seekableMagic(4)
+//
+// The descriptor is 0 since the frames carry their own checksums.
+const (
+	skippableMagic         = 0x184D2A5E
+	seekableMagic          = 0x8F92EAB1
+	skippableHeaderSize    = 8
+	seekTableFooterSize    = 9
+	seekTableEntrySize     = 8
+	maxCompressedBlockSize = 1 << 31
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// CompressFile compresses the src into dst block by block by zstd, every
+// block contains blockSize bytes of the src except the last one.
+func CompressFile(src string, dst string, blockSize int) (err error) {
+	if blockSize <= 0 || blockSize >= maxCompressedBlockSize {
+		return fmt.Errorf("invalid block size:%d", blockSize)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := out.Close(); err == nil {
+			err = e
+		}
+	}()
+
+	w := bufio.NewWriter(out)
+	var (
+		table []byte
+		buf   = make([]byte, blockSize)
+		frame []byte
+	)
+	for {
+		n, e := io.ReadFull(in, buf)
+		if n > 0 {
+			frame = zstdEncoder.EncodeAll(buf[:n], frame[:0])
+			if _, err = w.Write(frame); err != nil {
+				return err
+			}
+			table = appendUint32(table, uint32(len(frame)))
+			table = appendUint32(table, uint32(n))
+		}
+		if e == io.EOF || e == io.ErrUnexpectedEOF {
+			break
+		}
+		if e != nil {
+			return e
+		}
+	}
+
+	frames := len(table) / seekTableEntrySize
+	skippable := appendUint32(nil, skippableMagic)
+	skippable = appendUint32(skippable, uint32(len(table)+seekTableFooterSize))
+	skippable = append(skippable, table...)
+	skippable = appendUint32(skippable, uint32(frames))
+	skippable = append(skippable, 0)
+	skippable = appendUint32(skippable, seekableMagic)
+	if _, err = w.Write(skippable); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// IsCompressedFile returns whether the f of the size is written by
+// CompressFile.
+func IsCompressedFile(f io.ReaderAt, size int64) bool {
+	_, err := readSeekTable(f, size)
+	return err == nil
+}
+
+// readSeekTable reads the entries of the seek table at the end of the f.
+func readSeekTable(f io.ReaderAt, size int64) ([]byte, error) {
+	if size < skippableHeaderSize+seekTableFooterSize {
+		return nil, fmt.Errorf("not a compressed file")
+	}
+	footer := make([]byte, seekTableFooterSize)
+	if _, err := f.ReadAt(footer, size-seekTableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic {
+		return nil, fmt.Errorf("not a compressed file")
+	}
+	if footer[4] != 0 {
+		return nil, fmt.Errorf("unsupported seek table descriptor:%d", footer[4])
+	}
+	tableSize := int64(binary.LittleEndian.Uint32(footer)) * seekTableEntrySize
+	start := size - seekTableFooterSize - tableSize - skippableHeaderSize
+	if start < 0 {
+		return nil, fmt.Errorf("invalid seek table size:%d", tableSize)
+	}
+	table := make([]byte, skippableHeaderSize+tableSize)
+	if _, err := f.ReadAt(table, start); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(table) != skippableMagic ||
+		int64(binary.LittleEndian.Uint32(table[4:])) != tableSize+seekTableFooterSize {
+		return nil, fmt.Errorf("invalid seek table")
+	}
+	return table[skippableHeaderSize:], nil
+}
+
+// CompressedFile reads the uncompressed content of a file written by
+// CompressFile. It's safe for concurrent use.
+type CompressedFile struct {
+	f    io.ReaderAt
+	size int64
+	// offsets and rawOffsets are the offsets of the frames in the file and
+	// of their contents in the uncompressed content, both end with the ends
+	// of the last frame.
+	offsets    []int64
+	rawOffsets []int64
+
+	mu        sync.Mutex
+	lastIndex int
+	lastBlock []byte
+}
+
+// NewCompressedFile creates a CompressedFile reading from f of the size.
+func NewCompressedFile(f io.ReaderAt, size int64) (*CompressedFile, error) {
+	table, err := readSeekTable(f, size)
+	if err != nil {
+		return nil, err
+	}
+	frames := len(table) / seekTableEntrySize
+	cf := &CompressedFile{
+		f:          f,
+		offsets:    make([]int64, frames+1),
+		rawOffsets: make([]int64, frames+1),
+		lastIndex:  -1,
+	}
+	for i := 0; i < frames; i++ {
+		entry := table[i*seekTableEntrySize:]
+		cf.offsets[i+1] = cf.offsets[i] + int64(binary.LittleEndian.Uint32(entry))
+		cf.rawOffsets[i+1] = cf.rawOffsets[i] + int64(binary.LittleEndian.Uint32(entry[4:]))
+	}
+	cf.size = cf.rawOffsets[frames]
+	if cf.offsets[frames]+int64(len(table))+skippableHeaderSize+seekTableFooterSize != size {
+		return nil, fmt.Errorf("invalid seek table, frames end at:%d", cf.offsets[frames])
+	}
+	return cf, nil
+}
+
+// Size returns the size of the uncompressed content.
+func (cf *CompressedFile) Size() int64 {
+	return cf.size
+}
+
+// ReadAt implements io.ReaderAt on the uncompressed content.
+func (cf *CompressedFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset:%d", off)
+	}
+	for n < len(p) {
+		if off >= cf.size {
+			return n, io.EOF
+		}
+		// the frame whose content covers the off
+		idx := sort.Search(len(cf.rawOffsets)-1, func(i int) bool {
+			return cf.rawOffsets[i+1] > off
+		})
+		block, e := cf.block(idx)
+		if e != nil {
+			return n, e
+		}
+		copied := copy(p[n:], block[off-cf.rawOffsets[idx]:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// block returns the uncompressed content of the frame idx, the last one is
+// cached for the sequential reads.
+func (cf *CompressedFile) block(idx int) ([]byte, error) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if idx == cf.lastIndex {
+		return cf.lastBlock, nil
+	}
+	start, end := cf.offsets[idx], cf.offsets[idx+1]
+	frame := make([]byte, end-start)
+	if _, err := cf.f.ReadAt(frame, start); err != nil {
+		return nil, err
+	}
+	block, err := zstdDecoder.DecodeAll(frame, nil)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(block)) != cf.rawOffsets[idx+1]-cf.rawOffsets[idx] {
+		return nil, fmt.Errorf("frame %d decompressed to %d bytes, expected %d",
+			idx, len(block), cf.rawOffsets[idx+1]-cf.rawOffsets[idx])
+	}
+	cf.lastIndex, cf.lastBlock = idx, block
+	return block, nil
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/go-check/check"
+)
+
+func (s *FileUtilTestSuite) TestCompressFile(c *check.C) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	content = append(content, "tail"...)
+	src := path.Join(s.tmpDir, "TestCompressFile")
+	dst := src + ".z"
+	c.Assert(ioutil.WriteFile(src, content, 0644), check.IsNil)
+	c.Assert(CompressFile(src, dst, 0), check.NotNil)
+	c.Assert(CompressFile(src, dst, 1000), check.IsNil)
+
+	f, err := os.Open(dst)
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	info, _ := f.Stat()
+	c.Assert(info.Size() < int64(len(content)), check.Equals, true)
+	c.Assert(IsCompressedFile(f, info.Size()), check.Equals, true)
+
+	cf, err := NewCompressedFile(f, info.Size())
+	c.Assert(err, check.IsNil)
+	c.Assert(cf.Size(), check.Equals, int64(len(content)))
+
+	var cases = []struct {
+		off int64
+		n   int
+	}{
+		{off: 0, n: 10},
+		{off: 995, n: 10},
+		{off: 2500, n: 5000},
+		{off: int64(len(content)) - 4, n: 4},
+	}
+	for _, v := range cases {
+		p := make([]byte, v.n)
+		n, err := cf.ReadAt(p, v.off)
+		c.Assert(err, check.IsNil)
+		c.Assert(n, check.Equals, v.n)
+		c.Assert(p, check.DeepEquals, content[v.off:v.off+int64(v.n)])
+	}
+
+	// test: read beyond the end
+	p := make([]byte, 10)
+	n, err := cf.ReadAt(p, int64(len(content))-4)
+	c.Assert(err, check.Equals, io.EOF)
+	c.Assert(string(p[:n]), check.Equals, "tail")
+
+	all, err := ioutil.ReadAll(io.NewSectionReader(cf, 0, cf.Size()))
+	c.Assert(err, check.IsNil)
+	c.Assert(all, check.DeepEquals, content)
+
+	// test: the plain file isn't compressed
+	plain, _ := os.Open(src)
+	defer plain.Close()
+	c.Assert(IsCompressedFile(plain, int64(len(content))), check.Equals, false)
+	_, err = NewCompressedFile(plain, int64(len(content)))
+	c.Assert(err, check.NotNil)
+}
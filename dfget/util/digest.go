@@ -0,0 +1,78 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// The algorithms of the digests.
+const (
+	DigestMd5    = "md5"
+	DigestSha256 = "sha256"
+)
+
+// ParseDigest splits the digest in the form of '<algorithm>:<hex>' into its
+// algorithm and hex, the digest without the algorithm is a md5 as Md5Sum
+// returns.
+func ParseDigest(digest string) (algorithm string, encoded string) {
+	if kv := strings.SplitN(digest, ":", 2); len(kv) == 2 {
+		return kv[0], kv[1]
+	}
+	return DigestMd5, digest
+}
+
+// FormatDigest formats the hex digest of the algorithm as ParseDigest
+// parses, the md5 is formatted without the algorithm to be compatible with
+// Md5Sum.
+func FormatDigest(algorithm string, encoded string) string {
+	if algorithm == DigestMd5 {
+		return encoded
+	}
+	return algorithm + ":" + encoded
+}
+
+// NewDigest returns a hash computing the digests of the algorithm, it
+// returns nil if the algorithm isn't supported.
+func NewDigest(algorithm string) hash.Hash {
+	switch algorithm {
+	case DigestMd5:
+		return md5.New()
+	case DigestSha256:
+		return sha256.New()
+	}
+	return nil
+}
+
+// CheckDigest checks whether the digest is well-formed and its algorithm
+// is supported.
+func CheckDigest(digest string) error {
+	algorithm, encoded := ParseDigest(digest)
+	h := NewDigest(algorithm)
+	if h == nil {
+		return fmt.Errorf("unsupported digest algorithm:%s", algorithm)
+	}
+	if b, err := hex.DecodeString(encoded); err != nil || len(b) != h.Size() {
+		return fmt.Errorf("invalid %s digest:%s", algorithm, encoded)
+	}
+	return nil
+}
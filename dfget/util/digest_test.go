@@ -0,0 +1,56 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"strings"
+
+	"github.com/go-check/check"
+)
+
+func init() {
+	check.Suite(&DigestTestSuite{})
+}
+
+type DigestTestSuite struct{}
+
+func (s *DigestTestSuite) TestParseDigest(c *check.C) {
+	var cases = []struct {
+		digest    string
+		algorithm string
+		encoded   string
+	}{
+		{digest: "abc", algorithm: DigestMd5, encoded: "abc"},
+		{digest: "sha256:abc", algorithm: DigestSha256, encoded: "abc"},
+		{digest: "md5:abc", algorithm: DigestMd5, encoded: "abc"},
+	}
+	for _, v := range cases {
+		algorithm, encoded := ParseDigest(v.digest)
+		c.Assert(algorithm, check.Equals, v.algorithm)
+		c.Assert(encoded, check.Equals, v.encoded)
+	}
+	c.Assert(FormatDigest(DigestMd5, "abc"), check.Equals, "abc")
+	c.Assert(FormatDigest(DigestSha256, "abc"), check.Equals, "sha256:abc")
+}
+
+func (s *DigestTestSuite) TestCheckDigest(c *check.C) {
+	c.Assert(CheckDigest("sha256:"+strings.Repeat("a", 64)), check.IsNil)
+	c.Assert(CheckDigest(strings.Repeat("a", 32)), check.IsNil)
+	c.Assert(CheckDigest("sha256:"+strings.Repeat("a", 32)), check.NotNil)
+	c.Assert(CheckDigest("sha256:"+strings.Repeat("x", 64)), check.NotNil)
+	c.Assert(CheckDigest("sha1:"+strings.Repeat("a", 40)), check.NotNil)
+}
@@ -18,11 +18,11 @@ package util
 
 import (
 	"bufio"
-	"crypto/md5"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"syscall"
 )
 
 // BufferSize define the buffer size when reading and writing file
@@ -140,13 +140,15 @@ func MoveFile(src string, dst string) error {
 }
 
 // MoveFileAfterCheckMd5 will check whether the file's md5 is equals to the param md5
-// before move the file src to dst.
+// before move the file src to dst. The md5 can be a digest of the other
+// algorithms in the form of ParseDigest.
 func MoveFileAfterCheckMd5(src string, dst string, md5 string) error {
 	if !IsRegularFile(src) {
 		return fmt.Errorf("move file with md5 check:%s error, is not a "+
 			"regular file", src)
 	}
-	m := Md5Sum(src)
+	algorithm, _ := ParseDigest(md5)
+	m := DigestSum(src, algorithm)
 	if m != md5 {
 		return fmt.Errorf("move file with md5 check:%s error, md5 of srouce "+
 			"file doesn't match against the given md5 value", src)
@@ -154,6 +156,16 @@ func MoveFileAfterCheckMd5(src string, dst string, md5 string) error {
 	return MoveFile(src, dst)
 }
 
+// Fsync commits the file or the directory of name to the stable storage.
+func Fsync(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
 // PathExist reports whether the path is exist.
 // Any error get from os.Stat, it will return false.
 func PathExist(name string) bool {
@@ -182,7 +194,14 @@ func IsRegularFile(name string) bool {
 
 // Md5Sum generate md5 for a given file
 func Md5Sum(name string) string {
-	if !IsRegularFile(name) {
+	return DigestSum(name, DigestMd5)
+}
+
+// DigestSum generates the digest of the algorithm for a given file, which
+// is formatted by FormatDigest.
+func DigestSum(name string, algorithm string) string {
+	h := NewDigest(algorithm)
+	if h == nil || !IsRegularFile(name) {
 		return ""
 	}
 	f, err := os.Open(name)
@@ -191,12 +210,70 @@ func Md5Sum(name string) string {
 	}
 	defer f.Close()
 	r := bufio.NewReaderSize(f, BufferSize)
-	h := md5.New()
 
 	_, err = io.Copy(h, r)
 	if err != nil {
 		return ""
 	}
 
-	return fmt.Sprintf("%x", h.Sum(nil))
+	return FormatDigest(algorithm, fmt.Sprintf("%x", h.Sum(nil)))
+}
+
+// FreeInodes returns the number of the free inodes and the total inodes of
+// the filesystem the path is on. The total is 0 if the filesystem doesn't
+// have a fixed number of inodes.
+func FreeInodes(path string) (free uint64, total uint64, err error) {
+	var fs syscall.Statfs_t
+	if err = syscall.Statfs(path, &fs); err != nil {
+		return 0, 0, err
+	}
+	return uint64(fs.Ffree), uint64(fs.Files), nil
+}
+
+// FreeBytes returns the number of the bytes available to the unprivileged
+// users in the filesystem the path is on.
+func FreeBytes(path string) (uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, err
+	}
+	return uint64(fs.Bavail) * uint64(fs.Bsize), nil
+}
+
+// SameDevice reports whether the paths are on the same device, which means
+// a file of one can be hard linked or renamed into the other.
+func SameDevice(path1 string, path2 string) (bool, error) {
+	var st1, st2 syscall.Stat_t
+	if err := syscall.Stat(path1, &st1); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat(path2, &st2); err != nil {
+		return false, err
+	}
+	return st1.Dev == st2.Dev, nil
+}
+
+// IsReadOnlyMount reports whether the filesystem the path is on is mounted
+// read-only.
+func IsReadOnlyMount(path string) bool {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return false
+	}
+	// ST_RDONLY on linux and MNT_RDONLY on darwin
+	return fs.Flags&0x1 != 0
+}
+
+// IsReadOnlyError reports whether the err is caused by writing a read-only
+// filesystem.
+func IsReadOnlyError(err error) bool {
+	switch e := err.(type) {
+	case *os.LinkError:
+		err = e.Err
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == syscall.EROFS
 }
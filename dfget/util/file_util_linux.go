@@ -0,0 +1,71 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Preallocate reserves the blocks of the first size bytes of the file f by
+// fallocate and extends it to size, so that the content written at random
+// offsets later isn't fragmented. The file is extended sparsely by truncate
+// on the filesystems which don't support fallocate.
+func Preallocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return f.Truncate(size)
+	}
+	return err
+}
+
+// ficlone is the ioctl request FICLONE of linux cloning a file.
+const ficlone = 0x40049409
+
+// Reflink clones the file src to dst by the ioctl FICLONE, the clone shares
+// the data blocks with the src until either of them is modified. It fails
+// on the filesystems which don't support it, such as ext4, and dst isn't
+// left then.
+func Reflink(src string, dst string) error {
+	if !IsRegularFile(src) {
+		return fmt.Errorf("reflink file:%s error, is not a regular file", src)
+	}
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if PathExist(dst) {
+		return fmt.Errorf("reflink file:%s error, dst file already exists", dst)
+	}
+	d, err := OpenFile(dst, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0755)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.Fd(), ficlone, s.Fd())
+	d.Close()
+	if errno != 0 {
+		os.Remove(dst)
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"fmt"
+	"os"
+)
+
+// Preallocate extends the file f to size sparsely by truncate, the blocks
+// aren't reserved on the platforms without fallocate.
+func Preallocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	return f.Truncate(size)
+}
+
+// Reflink fails on the platforms without the ioctl FICLONE, and dst isn't
+// left then.
+func Reflink(src string, dst string) error {
+	return fmt.Errorf("reflink file:%s error, not supported on this platform", src)
+}
@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"syscall"
 
 	"github.com/go-check/check"
 )
@@ -216,3 +217,44 @@ func (s *FileUtilTestSuite) TestMd5sum(c *check.C) {
 	pathStrMd5 = Md5Sum(pathStr)
 	c.Assert(pathStrMd5, check.Equals, "")
 }
+
+func (s *FileUtilTestSuite) TestFreeInodes(c *check.C) {
+	free, total, err := FreeInodes(s.tmpDir)
+	c.Assert(err, check.IsNil)
+	c.Assert(free <= total, check.Equals, true)
+
+	_, _, err = FreeInodes(path.Join(s.tmpDir, "notExist"))
+	c.Assert(err, check.NotNil)
+}
+
+func (s *FileUtilTestSuite) TestIsReadOnly(c *check.C) {
+	c.Assert(IsReadOnlyMount(s.tmpDir), check.Equals, false)
+
+	c.Assert(IsReadOnlyError(&os.LinkError{Op: "rename", Err: syscall.EROFS}), check.Equals, true)
+	c.Assert(IsReadOnlyError(&os.PathError{Op: "open", Err: syscall.EROFS}), check.Equals, true)
+	c.Assert(IsReadOnlyError(syscall.EROFS), check.Equals, true)
+	c.Assert(IsReadOnlyError(&os.LinkError{Op: "rename", Err: syscall.EACCES}), check.Equals, false)
+	c.Assert(IsReadOnlyError(nil), check.Equals, false)
+}
+
+func (s *FileUtilTestSuite) TestFsync(c *check.C) {
+	pathStr := path.Join(s.tmpDir, "TestFsync")
+	c.Assert(Fsync(pathStr), check.NotNil)
+
+	ioutil.WriteFile(pathStr, []byte("hello"), 0644)
+	c.Assert(Fsync(pathStr), check.IsNil)
+	c.Assert(Fsync(s.tmpDir), check.IsNil)
+}
+
+func (s *FileUtilTestSuite) TestPreallocate(c *check.C) {
+	pathStr := path.Join(s.tmpDir, "TestPreallocate")
+	f, err := OpenFile(pathStr, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+
+	c.Assert(Preallocate(f, 0), check.IsNil)
+	c.Assert(Preallocate(f, 100), check.IsNil)
+	info, err := f.Stat()
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Size(), check.Equals, int64(100))
+}
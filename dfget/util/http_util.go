@@ -18,14 +18,18 @@ package util
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"reflect"
 	"strings"
 	"time"
 
 	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
 )
 
 /* http content types */
@@ -55,6 +59,22 @@ type SimpleHTTPClient interface {
 // defaultHTTPClient
 
 type defaultHTTPClient struct {
+	// client sends the requests instead of the default client of fasthttp
+	// if it's not nil.
+	client *fasthttp.Client
+}
+
+// NewHTTPSClient creates a SimpleHTTPClient whose https requests are secured
+// by the tlsConfig.
+func NewHTTPSClient(tlsConfig *tls.Config) SimpleHTTPClient {
+	return NewHTTPClient(tlsConfig, "")
+}
+
+// NewHTTPClient creates a SimpleHTTPClient whose requests carry the
+// userAgent, the https requests are secured by the tlsConfig if it's not
+// nil. The default User-Agent of fasthttp is sent if the userAgent is empty.
+func NewHTTPClient(tlsConfig *tls.Config, userAgent string) SimpleHTTPClient {
+	return &defaultHTTPClient{client: &fasthttp.Client{TLSConfig: tlsConfig, Name: userAgent}}
 }
 
 // PostJSON send a POST request whose content-type is 'application/json;charset=utf-8'.
@@ -82,9 +102,14 @@ func (c *defaultHTTPClient) PostJSON(url string, body interface{}, timeout time.
 	resp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseResponse(resp)
 
-	if timeout > 0 {
+	switch {
+	case c.client != nil && timeout > 0:
+		err = c.client.DoTimeout(req, resp, timeout)
+	case c.client != nil:
+		err = c.client.Do(req, resp)
+	case timeout > 0:
 		err = fasthttp.DoTimeout(req, resp, timeout)
-	} else {
+	default:
 		err = fasthttp.Do(req, resp)
 	}
 	return resp.StatusCode(), resp.Body(), err
@@ -94,7 +119,12 @@ func (c *defaultHTTPClient) PostJSON(url string, body interface{}, timeout time.
 // When timeout <= 0, it will block until receiving response from server.
 func (c *defaultHTTPClient) Get(url string, timeout time.Duration) (
 	code int, body []byte, e error) {
-	if timeout > 0 {
+	switch {
+	case c.client != nil && timeout > 0:
+		return c.client.GetTimeout(nil, url, timeout)
+	case c.client != nil:
+		return c.client.Get(nil, url)
+	case timeout > 0:
 		return fasthttp.GetTimeout(nil, url, timeout)
 	}
 	return fasthttp.Get(nil, url)
@@ -119,6 +149,32 @@ func HTTPStatusOk(code int) bool {
 	return fasthttp.StatusOK == code
 }
 
+// ConvertHeaders converts the headers in the form of 'key: value' into a
+// map, the values of the same key are joined by commas and the ones without
+// a value are ignored. It returns nil if there's no header.
+func ConvertHeaders(headers []string) map[string]string {
+	if len(headers) == 0 {
+		return nil
+	}
+	hm := make(map[string]string)
+	for _, header := range headers {
+		kv := strings.SplitN(header, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if v == "" {
+			continue
+		}
+		if _, in := hm[k]; in {
+			hm[k] = hm[k] + "," + v
+		} else {
+			hm[k] = v
+		}
+	}
+	return hm
+}
+
 // ParseQuery only parses the fields with tag 'request' of the query to parameters.
 // query must be a pointer to a struct.
 func ParseQuery(query interface{}) string {
@@ -149,19 +205,79 @@ func ParseQuery(query interface{}) string {
 // param timeout: its unit is milliseconds, reset to 500 ms if <= 0
 // returns localIP
 func CheckConnect(ip string, port int, timeout int) (localIP string, e error) {
+	return CheckConnectFrom("", ip, port, timeout)
+}
+
+// CheckConnectFrom checks the network connectivity between the given local ip
+// and remote. It's the same as CheckConnect if the param from is empty.
+func CheckConnectFrom(from string, ip string, port int, timeout int) (localIP string, e error) {
 	t := time.Duration(timeout) * time.Millisecond
 	if timeout <= 0 {
 		t = DefaultTimeout
 	}
 
 	var conn net.Conn
-	addr := fmt.Sprintf("%s:%d", ip, port)
-	if conn, e = net.DialTimeout("tcp", addr, t); e == nil {
-		localIP = conn.LocalAddr().String()
+	if conn, e = NewDialer(from, t).Dial("tcp", JoinHostPort(ip, port)); e == nil {
+		localIP, _ = SplitHostPort(conn.LocalAddr().String(), 0)
 		conn.Close()
-		if idx := strings.LastIndexByte(localIP, ':'); idx >= 0 {
-			localIP = localIP[:idx]
-		}
 	}
 	return
 }
+
+// ----------------------------------------------------------------------------
+// h2cHandler
+
+// NewH2CHandler returns the handler which serves the clients sending HTTP/2
+// without TLS by prior knowledge along with the HTTP/1 ones, all the
+// requests are handled by the handler.
+func NewH2CHandler(handler http.Handler) http.Handler {
+	return &h2cHandler{
+		handler: handler,
+		server:  &http2.Server{},
+	}
+}
+
+type h2cHandler struct {
+	handler http.Handler
+	server  *http2.Server
+}
+
+func (h *h2cHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the http server parses the request line of the HTTP/2 client preface
+	// as the request "PRI * HTTP/2.0".
+	if r.Method != "PRI" || r.RequestURI != "*" || r.ProtoMajor != 2 {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "HTTP/2 without TLS is not supported", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	rest := http2.ClientPreface[strings.Index(http2.ClientPreface, "\r\n\r\n")+4:]
+	buf := make([]byte, len(rest))
+	if _, err := io.ReadFull(rw, buf); err != nil || string(buf) != rest {
+		conn.Close()
+		return
+	}
+	// the http2 server reads the whole preface from the connection.
+	h.server.ServeConn(&prefacedConn{
+		Conn:   conn,
+		reader: io.MultiReader(strings.NewReader(http2.ClientPreface), rw),
+	}, &http2.ServeConnOpts{Handler: h.handler})
+}
+
+// prefacedConn is the hijacked connection whose reads start from the HTTP/2
+// client preface consumed by the http server.
+type prefacedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *prefacedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -94,6 +94,30 @@ func (s *HTTPUtilTestSuite) TestHTTPStatusOk(c *check.C) {
 	}
 }
 
+func (s *HTTPUtilTestSuite) TestConvertHeaders(c *check.C) {
+	cases := []struct {
+		h []string
+		e map[string]string
+	}{
+		{
+			h: []string{"a:1", "a:2", "b:", "b", "c:3"},
+			e: map[string]string{"a": "1,2", "c": "3"},
+		},
+		{
+			h: []string{"Authorization: Bearer a:b", "X-Empty:", "invalid"},
+			e: map[string]string{"Authorization": "Bearer a:b"},
+		},
+		{
+			h: []string{},
+			e: nil,
+		},
+	}
+	for _, v := range cases {
+		headers := ConvertHeaders(v.h)
+		c.Assert(headers, check.DeepEquals, v.e)
+	}
+}
+
 func (s *HTTPUtilTestSuite) TestParseQuery(c *check.C) {
 	type req struct {
 		A int    `request:"a"`
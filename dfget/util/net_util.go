@@ -0,0 +1,104 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResolveLocalIP returns the ip of the given local network interface.
+// The param nameOrIP could be an ip address or the name of a network
+// interface, and an error is returned if it doesn't belong to the local host.
+func ResolveLocalIP(nameOrIP string) (string, error) {
+	if ip := net.ParseIP(nameOrIP); ip != nil {
+		if !IsLocalIP(ip) {
+			return "", fmt.Errorf("ip:%s does not belong to any local interface", nameOrIP)
+		}
+		return ip.String(), nil
+	}
+
+	iface, err := net.InterfaceByName(nameOrIP)
+	if err != nil {
+		return "", fmt.Errorf("get interface:%s error: %v", nameOrIP, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("get addresses of interface:%s error: %v", nameOrIP, err)
+	}
+	// prefer ipv4 address
+	var ip6 net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			if ipNet.IP.To4() != nil {
+				return ipNet.IP.String(), nil
+			}
+			if ip6 == nil && !ipNet.IP.IsLinkLocalUnicast() {
+				ip6 = ipNet.IP
+			}
+		}
+	}
+	if ip6 != nil {
+		return ip6.String(), nil
+	}
+	return "", fmt.Errorf("interface:%s has no available ip address", nameOrIP)
+}
+
+// IsLocalIP reports whether the ip belongs to a local network interface.
+func IsLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewDialer creates a net.Dialer whose connections are bound to the
+// local ip. It doesn't bind the connections if localIP is empty.
+func NewDialer(localIP string, timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout}
+	if ip := net.ParseIP(localIP); ip != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return dialer
+}
+
+// JoinHostPort combines the host and the port into the address "host:port",
+// the ipv6 host is enclosed in the square brackets unless it's already.
+func JoinHostPort(host string, port int) string {
+	return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+}
+
+// SplitHostPort splits the address in the form of "host", "host:port",
+// "[ipv6]", "[ipv6]:port" or a bare ipv6 literal into the host without the
+// square brackets and the port, which is defaultPort if it's absent.
+func SplitHostPort(addr string, defaultPort int) (string, int) {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			return host, p
+		}
+	}
+	return strings.Trim(addr, "[]"), defaultPort
+}
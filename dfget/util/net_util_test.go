@@ -0,0 +1,86 @@
+/*
+ * Copyright The Dragonfly Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"net"
+
+	"github.com/go-check/check"
+)
+
+type NetUtilTestSuite struct{}
+
+func init() {
+	check.Suite(&NetUtilTestSuite{})
+}
+
+func (s *NetUtilTestSuite) TestResolveLocalIP(c *check.C) {
+	var cases = []struct {
+		nameOrIP string
+		expected string
+	}{
+		{nameOrIP: "127.0.0.1", expected: "127.0.0.1"},
+		{nameOrIP: "lo", expected: "127.0.0.1"},
+		{nameOrIP: "203.0.113.1", expected: ""},
+		{nameOrIP: "not-exist-interface", expected: ""},
+	}
+
+	for _, v := range cases {
+		ip, err := ResolveLocalIP(v.nameOrIP)
+		if v.expected == "" {
+			c.Assert(err, check.NotNil, check.Commentf("%v", v))
+		} else {
+			c.Assert(err, check.IsNil, check.Commentf("%v", v))
+			c.Assert(ip, check.Equals, v.expected)
+		}
+	}
+}
+
+func (s *NetUtilTestSuite) TestNewDialer(c *check.C) {
+	dialer := NewDialer("", 0)
+	c.Assert(dialer.LocalAddr, check.IsNil)
+
+	dialer = NewDialer("127.0.0.1", 0)
+	c.Assert(dialer.LocalAddr, check.DeepEquals, &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+}
+
+func (s *NetUtilTestSuite) TestJoinHostPort(c *check.C) {
+	c.Assert(JoinHostPort("127.0.0.1", 8002), check.Equals, "127.0.0.1:8002")
+	c.Assert(JoinHostPort("::1", 8002), check.Equals, "[::1]:8002")
+	c.Assert(JoinHostPort("[fd00::2]", 8002), check.Equals, "[fd00::2]:8002")
+}
+
+func (s *NetUtilTestSuite) TestSplitHostPort(c *check.C) {
+	var cases = []struct {
+		addr string
+		host string
+		port int
+	}{
+		{addr: "127.0.0.1", host: "127.0.0.1", port: 8002},
+		{addr: "127.0.0.1:8001", host: "127.0.0.1", port: 8001},
+		{addr: "::1", host: "::1", port: 8002},
+		{addr: "[::1]", host: "::1", port: 8002},
+		{addr: "[fd00::2]:8001", host: "fd00::2", port: 8001},
+		{addr: "localhost:8001", host: "localhost", port: 8001},
+	}
+
+	for _, v := range cases {
+		host, port := SplitHostPort(v.addr, 8002)
+		c.Assert(host, check.Equals, v.host, check.Commentf("%v", v))
+		c.Assert(port, check.Equals, v.port, check.Commentf("%v", v))
+	}
+}
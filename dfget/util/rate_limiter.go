@@ -17,6 +17,7 @@
 package util
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -60,6 +61,27 @@ func (rl *RateLimiter) AcquireNonBlocking(token int32) int32 {
 	return rl.acquire(token, false)
 }
 
+// AcquireContext acquires tokens as AcquireBlocking, but it returns -1 and
+// the error of the ctx once the ctx is done before the bucket has enough
+// required number of tokens.
+func (rl *RateLimiter) AcquireContext(ctx context.Context, token int32) (int32, error) {
+	for {
+		if n := rl.acquire(token, false); n >= 0 {
+			return n, nil
+		}
+		rl.mu.Lock()
+		window := time.Duration(rl.window) * time.Millisecond
+		rl.mu.Unlock()
+		timer := time.NewTimer(window)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return -1, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
 // SetRate sets rate of RateLimiter.
 func (rl *RateLimiter) SetRate(rate int32) {
 	if rl.rate != rate {
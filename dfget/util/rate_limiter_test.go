@@ -17,6 +17,7 @@
 package util
 
 import (
+	"context"
 	"time"
 
 	"github.com/go-check/check"
@@ -104,3 +105,19 @@ func (suite *DFGetUtilSuite) TestRateLimiter_AcquireNonBlocking(c *check.C) {
 	rl.blocking(1000)
 	c.Assert(rl.AcquireNonBlocking(1000), check.Equals, int32(1000))
 }
+
+func (suite *DFGetUtilSuite) TestRateLimiter_AcquireContext(c *check.C) {
+	rl := NewRateLimiter(10, 1)
+	n, err := rl.AcquireContext(context.Background(), 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, int32(1))
+
+	// the token is generated after 100ms, which isn't waited for
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	n, err = rl.AcquireContext(ctx, 1)
+	c.Assert(err, check.Equals, context.DeadlineExceeded)
+	c.Assert(n, check.Equals, int32(-1))
+	c.Assert(time.Since(start) < 80*time.Millisecond, check.Equals, true)
+}
@@ -21,6 +21,9 @@ export GO_SOURCE_DIRECTORIES=( \
     "version" \
 )
 
+# the client is built in the GOPATH mode with the vendor directory.
+export GO111MODULE=off
+
 GOOS=$(go env GOOS)
 GOARCH=$(go env GOARCH)
 export GOOS